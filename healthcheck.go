@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/mkideal/cli"
+	"net"
+	"strings"
+	"time"
+)
+
+type healthCheckConfig struct {
+	Help    bool   `cli:"!h,help" usage:"Show this screen."`
+	Server  string `cli:"s,server" usage:"DNS server to query, as host[:port] (default: 127.0.0.1:53)" dft:"127.0.0.1:53"`
+	Name    string `cli:"n,name" usage:"Name to query (default: example.com)" dft:"example.com"`
+	Type    string `cli:"type" usage:"Type of the query (default: A)" dft:"A"`
+	Timeout int    `cli:"timeout" usage:"Seconds to wait for the response (default: 5)" dft:"5"`
+}
+
+func (argv *healthCheckConfig) AutoHelp() bool {
+	return argv.Help
+}
+
+// runHealthCheck implements the healthcheck subcommand, for container health
+// checks without dig or drill: it sends a query to a DNS server, the proxy
+// itself by default, and returns 0 if it's answered with NOERROR or
+// NXDOMAIN, 1 otherwise.
+func runHealthCheck(args []string) int {
+	cfg := healthCheckConfig{}
+	return cli.RunWithArgs(&cfg, args, func(ctx *cli.Context) error {
+		if cfg.Help {
+			return nil
+		}
+		qtype, ok := dns.StringToType[strings.ToUpper(cfg.Type)]
+		if !ok {
+			return fmt.Errorf("unknown query type %q", cfg.Type)
+		}
+		server := cfg.Server
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(cfg.Name), qtype)
+		client := &dns.Client{Timeout: time.Duration(cfg.Timeout) * time.Second}
+		resp, _, err := client.Exchange(msg, server)
+		if err != nil {
+			return fmt.Errorf("querying %s: %w", server, err)
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			return fmt.Errorf("%s answered %s for %s", server, dns.RcodeToString[resp.Rcode], cfg.Name)
+		}
+		return nil
+	}, "Query a DNS server and exit with 0 if it answers, for container health checks")
+}
@@ -1,462 +1,565 @@
 package main
 
 import (
-	"bufio"
-	"encoding/base64"
-	"fmt"
+	"context"
+	"crypto/tls"
+	"dns-server/proxy"
+	"encoding/json"
+	"errors"
 	"github.com/miekg/dns"
 	"github.com/mkideal/cli"
-	"io"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 	"log"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
-type HostInfo struct {
-	IP    net.IP
-	CName string
-}
-
-type Host interface {
-	IsIP() bool
-	IsCName() bool
-}
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
 
-func (h HostInfo) IsIP() bool {
-	return h.IP != nil
-}
-
-func (h HostInfo) IsCName() bool {
-	return h.CName != ""
-}
+// selfTestTimeout bounds the canary query sent to the upstream at startup.
+const selfTestTimeout = 3 * time.Second
 
-type cacheEntry struct {
-	rrs  []dns.RR
-	time time.Time
+type config struct {
+	Help               bool     `cli:"!h,help" usage:"Show this screen."`
+	UpstreamUrls       []string `cli:"u,upstream" usage:"Upstream URL to forward queries to (for instance https://cloudflare-dns.com/dns-query or dns://1.1.1.1, can be repeated to spread queries over several)"`
+	UpstreamStrategy   string   `cli:"upstream-strategy" usage:"How to choose among several upstreams: round-robin, or adaptive to prefer the fastest (default: round-robin)" dft:"round-robin"`
+	Recursive          bool     `cli:"recursive" usage:"Resolve queries from the root servers instead of forwarding them to an upstream"`
+	BindTo             string   `cli:"b,bind" usage:"Address to bind to (default: 0.0.0.0:53)" dft:"0.0.0.0:53"`
+	UnixSocket         string   `cli:"unix-socket" usage:"Also serve DNS on a Unix stream socket at this path"`
+	UnixgramSocket     string   `cli:"unixgram-socket" usage:"Also serve DNS on a Unix datagram socket at this path"`
+	DohListen          string   `cli:"doh-listen" usage:"Also serve DNS over HTTPS on this address, at /dns-query (plain HTTP without --doh-cert, for use behind a TLS-terminating proxy)"`
+	DohCert            string   `cli:"doh-cert" usage:"TLS certificate file for the DoH and DoT servers, reloaded when it changes"`
+	DohKey             string   `cli:"doh-key" usage:"TLS key file for the DoH and DoT servers, reloaded when it changes"`
+	DohHTTP2           bool     `cli:"doh-http2" usage:"Also serve DoH over HTTP/2 (cleartext HTTP/2 without --doh-cert)"`
+	AcmeHost           string   `cli:"acme-host" usage:"Get and renew the DoH and DoT servers' certificate for this hostname from Let's Encrypt, unless --doh-cert is given"`
+	AcmeCache          string   `cli:"acme-cache" usage:"Directory to keep ACME account keys and certificates in, required with --acme-host"`
+	DotListen          string   `cli:"dot-listen" usage:"Also serve DNS over TLS on this address, e.g. 0.0.0.0:853, with the certificate from --doh-cert or --acme-host"`
+	DotIdleTimeout     int      `cli:"dot-idle-timeout" usage:"Seconds DoT connections can stay idle before they're closed (default: 30)" dft:"30"`
+	UdpSize            int      `cli:"udp-size" usage:"Largest UDP response to send, longer ones are truncated (default: 1232)" dft:"1232"`
+	HostsTTL           int      `cli:"t,ttl" usage:"TTL for hosts file entries (default: 10)" dft:"10"`
+	TTLFromUpstream    bool     `cli:"ttl-from-upstream" usage:"Answer local CNAMEs pointing upstream with the upstream's TTLs, rather than the --ttl (default: true)" dft:"true"`
+	HostsFiles         []string `cli:"H,hosts" usage:"Path to hosts file"`
+	SystemHosts        bool     `cli:"use-system-hosts" usage:"Also load the operating system's hosts file (/etc/hosts on Unix)"`
+	SkipLoopback       bool     `cli:"system-hosts-skip-loopback" usage:"Leave out loopback entries such as 127.0.0.1 localhost from the system hosts file"`
+	MinTTL             int      `cli:"min-ttl" usage:"Raise TTLs in responses below this value to it"`
+	TTLJitter          int      `cli:"local-ttl-jitter" usage:"Randomly raise or lower the TTLs of local and cached answers by up to this percentage, to spread out cache expiry"`
+	MaxTTL             int      `cli:"max-ttl" usage:"Lower TTLs in responses above this value to it"`
+	ZoneFiles          []string `cli:"zone" usage:"Path to an RFC 1035 zone file to serve records from (can be repeated)"`
+	Database           string   `cli:"db" usage:"SQLite database to load local records from, with a records table of name, type (A, AAAA or CNAME), value and ttl columns, reloaded when it changes"`
+	DbPollInterval     int      `cli:"db-poll-interval" usage:"Seconds between checks of the --db database for changes (default: 5)" dft:"5"`
+	Transfers          []string `cli:"transfer" usage:"Zone to pull from its primary with AXFR/IXFR and serve, refreshed as its SOA says, as zone=primary[:port] (can be repeated)"`
+	ZoneApexes         []string `cli:"zone-apex" usage:"Zone to be authoritative for, with its nameservers, e.g. corp.internal=ns1.corp.internal (can be repeated)"`
+	Delegations        []string `cli:"delegate" usage:"Subzone to answer with referrals to its nameservers, given by name or address, e.g. sub.corp.internal=10.0.0.53 (can be repeated)"`
+	UpstreamTimeout    int      `cli:"T,timeout" usage:"Timeout for upstream requests (default: 5)" dft:"5"`
+	QueryDeadline      int      `cli:"query-deadline" usage:"Milliseconds a client query can take in total, across upstream retries and fallbacks, before SERVFAIL (default: 0, no limit)"`
+	No0x20             bool     `cli:"no-0x20" usage:"Don't randomize the case of query names sent to plain DNS upstreams"`
+	SanitizeQueries    bool     `cli:"sanitize-queries" usage:"Strip EDNS options and extra records from queries sent to plain DNS upstreams"`
+	Pad                bool     `cli:"pad" usage:"Pad queries sent over DoH and DoQ to a multiple of 128 bytes to hide their length"`
+	DohMethod          string   `cli:"doh-method" usage:"HTTP method for DoH requests, GET or POST (default: GET)" dft:"GET"`
+	DohUserAgent       string   `cli:"doh-user-agent" usage:"User-Agent for DoH requests, empty to send none (default: shitty-dns-proxy/<version>)"`
+	DohURITemplate     string   `cli:"doh-uri-template" usage:"RFC 8484 URI template to build DoH request URLs from, such as https://dns.example/query{?dns}, for servers not taking ?dns= queries at the upstream URL"`
+	DohMaxRetries      int      `cli:"doh-max-retries" usage:"How many times to retry DoH requests failing with a network or gateway error (default: 2)" dft:"2"`
+	ForwardClientIP    bool     `cli:"forward-client-ip" usage:"Send client IPs to the upstream in X-Forwarded-For headers and EDNS client subnet options"`
+	MaxConcurrency     int      `cli:"max-upstream-concurrency" usage:"Maximum number of queries sent to the upstream at once, as many more wait and others get SERVFAIL (default: 0, no limit)"`
+	FailureThreshold   int      `cli:"upstream-failure-threshold" usage:"Log a warning when this percentage of the recent upstream queries fail with an error or SERVFAIL (default: 0, never)"`
+	StrictUpstream     bool     `cli:"strict-upstream" usage:"Exit if the upstream doesn't answer the canary query sent at startup"`
+	CanaryName         string   `cli:"canary-name" usage:"Name queried at startup to check that the upstream works (default: example.com)" dft:"example.com"`
+	CacheSize          int      `cli:"cache-size" usage:"Number of upstream responses to cache (default: 0, no caching)"`
+	EcsCache           bool     `cli:"ecs-cache" usage:"Cache responses to queries with an EDNS client subnet (with --forward-client-ip) separately for each subnet they apply to"`
+	CacheFile          string   `cli:"cache-file" usage:"Save the cache to this file on shutdown and load it back on start, so restarts keep it warm"`
+	PrefetchSiblings   bool     `cli:"prefetch-siblings" usage:"Prefetch AAAA records when A records are queried and vice versa, for names that get queried for both"`
+	Verbose            bool     `cli:"V,verbose" usage:"Verbose output"`
+	Check              bool     `cli:"check" usage:"Check the hosts and zone files for errors and conflicts, then exit"`
+	Dump               bool     `cli:"dump" usage:"Print the effective configuration, the loaded records by file and the synthesized PTR records as JSON, then exit"`
+	RequireAD          bool     `cli:"require-ad" usage:"Return SERVFAIL for DNSSEC queries if the upstream response is not authenticated"`
+	AdminAddr          string   `cli:"admin-addr" usage:"Address to serve the admin HTTP API on (disabled by default)"`
+	StatsAddr          string   `cli:"stats-addr" usage:"Address to serve stats on, as JSON on /stats and for Prometheus on /metrics (disabled by default)"`
+	PprofAddr          string   `cli:"pprof-addr" usage:"Address to serve pprof profiles on, e.g. 127.0.0.1:6060 (disabled by default)"`
+	OtelEndpoint       string   `cli:"otel-endpoint" usage:"OTLP/HTTP collector to export OpenTelemetry traces of query handling to, e.g. http://localhost:4318 (default: none)"`
+	AdminToken         string   `cli:"admin-token" usage:"Bearer token required by the admin HTTP API"`
+	GrpcAddr           string   `cli:"grpc-addr" usage:"Address to serve the gRPC management API on, authenticated with --admin-token (disabled by default)"`
+	AllowUpdate        []string `cli:"allow-update" usage:"Subnet allowed to send DNS UPDATE messages (can be repeated)"`
+	UpdateZones        []string `cli:"update-zone" usage:"Zone that can be changed with DNS UPDATE messages (can be repeated)"`
+	LocalOnlyTypes     bool     `cli:"local-only-types" usage:"Answer NODATA instead of forwarding queries for local names with types that aren't served locally"`
+	LocalRRRotate      bool     `cli:"local-rr-rotate" usage:"Rotate the order of local A/AAAA answers on every response (round-robin)"`
+	HttpsAlpn          []string `cli:"https-alpn" usage:"Synthesize HTTPS/SVCB records for a local name, e.g. host.lan=h2,h3 (can be repeated)"`
+	TypePolicies       []string `cli:"type-policy" usage:"Override how queries of a type for a name are answered, e.g. host.lan:AAAA=nodata (local, forward or nodata, can be repeated)"`
+	NoAAAA             bool     `cli:"no-aaaa" usage:"Answer all AAAA queries with NODATA, local or not, to disable IPv6 on networks where it's broken"`
+	PreferFamily       string   `cli:"prefer-family" usage:"Bias clients toward this address family, v4 or v6, for local names with addresses of both, by giving answers for the other one shorter TTLs"`
+	PreferFamilyNoData int      `cli:"prefer-family-nodata" usage:"Percentage of queries for the non-preferred address family to answer with NODATA instead, to migrate traffic gradually"`
+	MaxAnswers         int      `cli:"max-answers" usage:"Truncate UDP responses to this many answer records, setting TC so that clients retry over TCP, to limit amplification (0 for no limit)"`
+	SortSubnets        []string `cli:"sort-subnet" usage:"Subnet whose addresses are moved first in answers to clients within it, e.g. 10.1.0.0/16 (can be repeated)"`
+	TunnelThreshold    int      `cli:"tunneling-threshold" usage:"Log queries whose subdomains look like DNS tunneling, with long high-entropy labels, scoring above this (150 is a good start, default: 0, off)"`
+	BlockTunneling     bool     `cli:"block-tunneling" usage:"Refuse queries that look like DNS tunneling (with a threshold of 150 unless --tunneling-threshold is set)"`
+	StripTypes         []string `cli:"strip-types" usage:"Record types to remove from forwarded responses, e.g. HTTPS,SVCB, for clients that mishandle them (can be repeated)"`
+	FlattenCNAME       bool     `cli:"flatten-cname" usage:"Replace CNAME chains in forwarded A/AAAA answers with the addresses they lead to, owned by the queried name"`
+	MinimalResponses   bool     `cli:"minimal-responses" usage:"Remove the authority and additional sections from forwarded responses, except for EDNS and the SOA records of negative answers"`
+	Schedules          []string `cli:"schedule" usage:"Only resolve names at some times of day, answering NXDOMAIN otherwise, e.g. games.example=16:00-20:00 (* for all names, can be repeated)"`
+	ScheduleTZ         string   `cli:"schedule-tz" usage:"Time zone of --schedule times, e.g. Europe/Rome (default: local time)"`
+	MdnsInterface      string   `cli:"mdns-interface" usage:"Resolve .local names without local records with multicast DNS on this interface"`
+	SinglePtr          bool     `cli:"single-ptr" usage:"Answer PTR queries for addresses with several names with only the first name"`
+	NoAutoPtr          bool     `cli:"no-auto-ptr" usage:"Don't derive PTR records from local A and AAAA records, PTR queries are then answered from zone files, --ptr-subnet or the upstream"`
+	PtrSubnets         []string `cli:"ptr-subnet" usage:"Synthesize PTR records for a subnet, e.g. 10.0.0.0/24={ip}.internal (can be repeated)"`
+	CatchAllIPs        []string `cli:"catch-all-ip" usage:"Answer A/AAAA queries for names without any other answer with this address instead of forwarding them (can be repeated)"`
+	NoRecursion        string   `cli:"norecursion-response" usage:"How to answer queries with the RD bit unset that can't be answered locally: refused, empty (NOERROR without records), nxdomain or forward (default: refused)" dft:"refused"`
+	User               string   `cli:"user" usage:"User to run as once the DNS sockets are bound, by name or ID"`
+	Group              string   `cli:"group" usage:"Group to run as once the DNS sockets are bound, by name or ID (default: the user's primary group)"`
+	RebindProtect      bool     `cli:"rebind-protect" usage:"Remove private, loopback and link-local addresses from forwarded answers, against DNS rebinding"`
+	RebindRanges       []string `cli:"rebind-range" usage:"Address range to remove from forwarded answers with --rebind-protect, instead of the default ones (can be repeated)"`
+	RebindAllow        []string `cli:"rebind-allow" usage:"Domain whose names may resolve to private addresses with --rebind-protect (can be repeated)"`
 }
 
-type dnsProxy struct {
-	httpUrl         url.URL
-	records         map[string][]HostInfo
-	ptrRecords      map[string]string
-	cnameCache      map[uint16]map[string]cacheEntry
-	localTTL        int
-	verbose         bool
-	upstreamTimeout time.Duration
+func (argv *config) AutoHelp() bool {
+	return argv.Help
 }
 
-func parseHostsScanner(scanner *bufio.Scanner) (map[string][]HostInfo, error) {
-	records := make(map[string][]HostInfo)
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
-
-		commentIndex := strings.Index(line, "#")
-		if commentIndex != -1 {
-			line = line[:commentIndex]
-		}
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		os.Exit(runHealthCheck(os.Args[1:]))
+	}
 
-		fields := strings.Fields(line)
-		if len(fields) < 2 {
-			continue
+	cfg := config{}
+	ret := cli.Run(&cfg, func(ctx *cli.Context) error {
+		// Only use the default User-Agent if none was given, an explicit empty one is allowed.
+		if !ctx.IsSet("--doh-user-agent") {
+			cfg.DohUserAgent = "shitty-dns-proxy/" + version
 		}
+		return nil
+	}, "Davide's shitty DNS proxy")
+	if ret != 0 || cfg.Help {
+		return
+	}
 
-		destField := fields[0]
-		hostInfo := HostInfo{}
+	var upstreamURL string
+	var moreUpstreamURLs []string
+	if len(cfg.UpstreamUrls) > 0 {
+		upstreamURL, moreUpstreamURLs = cfg.UpstreamUrls[0], cfg.UpstreamUrls[1:]
+	}
 
-		if strings.HasPrefix(destField, "@") {
-			hostInfo.CName = destField[1:] + "."
-		} else {
-			ip := net.ParseIP(destField)
-			if ip == nil {
-				continue
-			}
-			hostInfo.IP = ip
-		}
+	opts := proxy.Options{
+		UpstreamURL:      upstreamURL,
+		UpstreamURLs:     moreUpstreamURLs,
+		UpstreamStrategy: cfg.UpstreamStrategy,
+		Recursive:        cfg.Recursive,
+		UpstreamOptions: proxy.UpstreamOptions{
+			Timeout:         time.Duration(cfg.UpstreamTimeout) * time.Second,
+			DohMethod:       cfg.DohMethod,
+			DohMaxRetries:   cfg.DohMaxRetries,
+			DohUserAgent:    cfg.DohUserAgent,
+			DohURITemplate:  cfg.DohURITemplate,
+			ForwardClientIP: cfg.ForwardClientIP,
+			Disable0x20:     cfg.No0x20,
+			SanitizeQueries: cfg.SanitizeQueries,
+			Pad:             cfg.Pad,
+		},
+		HostsFiles:               cfg.HostsFiles,
+		UseSystemHosts:           cfg.SystemHosts,
+		SkipSystemLoopback:       cfg.SkipLoopback,
+		ZoneFiles:                cfg.ZoneFiles,
+		Database:                 cfg.Database,
+		DatabasePollInterval:     time.Duration(cfg.DbPollInterval) * time.Second,
+		Transfers:                cfg.Transfers,
+		ZoneApexes:               cfg.ZoneApexes,
+		Delegations:              cfg.Delegations,
+		LocalTTL:                 cfg.HostsTTL,
+		LocalCNAMETTL:            !cfg.TTLFromUpstream,
+		MinTTL:                   cfg.MinTTL,
+		MaxTTL:                   cfg.MaxTTL,
+		TTLJitter:                cfg.TTLJitter,
+		UdpSize:                  cfg.UdpSize,
+		QueryDeadline:            time.Duration(cfg.QueryDeadline) * time.Millisecond,
+		MaxUpstreamConcurrency:   cfg.MaxConcurrency,
+		UpstreamFailureThreshold: cfg.FailureThreshold,
+		CacheSize:                cfg.CacheSize,
+		EcsCache:                 cfg.EcsCache,
+		CacheFile:                cfg.CacheFile,
+		PrefetchSiblings:         cfg.PrefetchSiblings,
+		Verbose:                  cfg.Verbose,
+		RequireAD:                cfg.RequireAD,
+		AllowUpdate:              cfg.AllowUpdate,
+		UpdateZones:              cfg.UpdateZones,
+		LocalOnlyTypes:           cfg.LocalOnlyTypes,
+		LocalRRRotate:            cfg.LocalRRRotate,
+		HttpsAlpn:                cfg.HttpsAlpn,
+		TypePolicies:             cfg.TypePolicies,
+		NoAAAA:                   cfg.NoAAAA,
+		PreferFamily:             cfg.PreferFamily,
+		PreferFamilyNoData:       cfg.PreferFamilyNoData,
+		MaxAnswers:               cfg.MaxAnswers,
+		SortSubnets:              cfg.SortSubnets,
+		TunnelingThreshold:       cfg.TunnelThreshold,
+		BlockTunneling:           cfg.BlockTunneling,
+		StripTypes:               cfg.StripTypes,
+		FlattenCNAME:             cfg.FlattenCNAME,
+		MinimalResponses:         cfg.MinimalResponses,
+		Schedules:                cfg.Schedules,
+		ScheduleTimeZone:         cfg.ScheduleTZ,
+		MdnsInterface:            cfg.MdnsInterface,
+		SinglePtr:                cfg.SinglePtr,
+		NoAutoPtr:                cfg.NoAutoPtr,
+		PtrSubnets:               cfg.PtrSubnets,
+		CatchAllIPs:              cfg.CatchAllIPs,
+		NoRecursionResponse:      cfg.NoRecursion,
+		RebindProtect:            cfg.RebindProtect,
+		RebindRanges:             cfg.RebindRanges,
+		RebindExceptions:         cfg.RebindAllow,
+	}
 
-		for _, host := range fields[1:] {
-			dnsName := fmt.Sprintf("%s.", host)
-			if _, ok := records[dnsName]; !ok {
-				records[dnsName] = make([]HostInfo, 0)
-			}
-			records[dnsName] = append(records[dnsName], hostInfo)
+	if cfg.Check {
+		if !proxy.CheckConfig(opts) {
+			os.Exit(1)
 		}
+		return
 	}
 
-	return records, nil
-}
-
-func parseHostsFile(path string) (map[string][]HostInfo, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
+	if cfg.AdminAddr != "" && cfg.AdminToken == "" {
+		log.Fatal("--admin-addr requires --admin-token")
 	}
-	defer f.Close()
-
-	scanner := bufio.NewScanner(f)
-	return parseHostsScanner(scanner)
-}
-
-func (p *dnsProxy) queryCName(cname string, recordType uint16, onBehalfOf net.Addr) ([]dns.RR, error) {
-	cache, ok := p.cnameCache[recordType]
-	if !ok {
-		return nil, fmt.Errorf("unsupported record type %d", recordType)
+	if cfg.GrpcAddr != "" && cfg.AdminToken == "" {
+		log.Fatal("--grpc-addr requires --admin-token")
 	}
-	cached, ok := cache[cname]
-	if ok && time.Since(cached.time) < time.Duration(p.localTTL)*time.Second {
-		return cached.rrs, nil
+	if (cfg.DohCert == "") != (cfg.DohKey == "") {
+		log.Fatal("--doh-cert and --doh-key must be given together")
+	}
+	if cfg.DohCert != "" && cfg.DohListen == "" && cfg.DotListen == "" {
+		log.Fatal("--doh-cert requires --doh-listen or --dot-listen")
+	}
+	if cfg.AcmeHost != "" && cfg.DohListen == "" {
+		// ACME challenges are answered on the DoH listener.
+		log.Fatal("--acme-host requires --doh-listen")
+	}
+	if cfg.DotListen != "" && cfg.DohCert == "" && cfg.AcmeHost == "" {
+		log.Fatal("--dot-listen requires --doh-cert and --doh-key, or --acme-host")
+	}
+	if cfg.AcmeHost != "" && cfg.AcmeCache == "" {
+		log.Fatal("--acme-host requires --acme-cache, so that certificates aren't requested again on every start")
 	}
 
-	// Request the domain's A and AAAA records from the upstream server.
-	req := new(dns.Msg)
-	req.SetQuestion(cname, recordType)
-	req.RecursionDesired = true
-
-	resp, err := p.respondToRequest(req, onBehalfOf)
+	p, err := proxy.New(opts)
 	if err != nil {
-		return nil, err
+		log.Fatal(err)
 	}
 
-	rrs := resp.Answer
-
-	p.cnameCache[recordType][cname] = cacheEntry{rrs, time.Now()}
-	return rrs, nil
-}
+	if cfg.Dump {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(p.Dump()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-func (p *dnsProxy) addLocalResponses(m *dns.Msg, onBehalfOf net.Addr) bool {
-	foundEntries := false
-	for _, q := range m.Question {
-		switch q.Qtype {
-		case dns.TypeA:
-			fallthrough
-		case dns.TypeAAAA:
-			queryType := dns.TypeToString[q.Qtype]
+	// Catch typos in the upstream URL and unreachable resolvers now rather than on the first query.
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	err = p.CheckUpstream(ctx, cfg.CanaryName)
+	cancel()
+	if err != nil && cfg.StrictUpstream {
+		log.Fatalf("Upstream self-test failed: %s\n", err.Error())
+	} else if err != nil {
+		log.Printf("Warning: upstream self-test failed: %s\n", err.Error())
+	} else {
+		log.Printf("Upstream self-test passed\n")
+	}
 
-			if p.verbose {
-				log.Printf("%s query for %s\n", queryType, q.Name)
-			}
+	if cfg.AdminAddr != "" {
+		go func() {
+			log.Printf("Serving admin API on %s\n", cfg.AdminAddr)
+			err := http.ListenAndServe(cfg.AdminAddr, p.AdminHandler(cfg.AdminToken))
+			log.Fatalf("Failed to run admin API: %s\n", err.Error())
+		}()
+	}
 
-			records := p.records[q.Name]
-			for _, record := range records {
-				var ipStr string
+	if cfg.GrpcAddr != "" {
+		l, err := net.Listen("tcp", cfg.GrpcAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Printf("Serving gRPC management API on %s\n", cfg.GrpcAddr)
+			err := p.GRPCServer(cfg.AdminToken).Serve(l)
+			log.Fatalf("Failed to run gRPC management API: %s\n", err.Error())
+		}()
+	}
 
-				if record.IsIP() {
-					ip := record.IP
-					if q.Qtype == dns.TypeAAAA {
-						if ip.To4() != nil {
-							// Skip IPv4 addresses for AAAA queries, but prevent from asking upstream.
-							foundEntries = true
-							continue
-						} else {
-							ipStr = ip.String()
-						}
-					} else {
-						if ip.To4() == nil {
-							foundEntries = true
-							continue
-						}
-						ipStr = ip.To4().String()
-					}
+	if cfg.StatsAddr != "" {
+		go func() {
+			log.Printf("Serving stats on %s\n", cfg.StatsAddr)
+			err := http.ListenAndServe(cfg.StatsAddr, p.StatsHandler())
+			log.Fatalf("Failed to run stats server: %s\n", err.Error())
+		}()
+	}
 
-					rr, err := dns.NewRR(fmt.Sprintf("%s %d %s %s", q.Name, p.localTTL, queryType, ipStr))
-					if err != nil {
-						log.Printf("Failed to create RR: %s\n", err.Error())
-						continue
-					}
-					m.Answer = append(m.Answer, rr)
-					foundEntries = true
+	if cfg.PprofAddr != "" {
+		go func() {
+			log.Printf("Serving pprof on %s\n", cfg.PprofAddr)
+			err := http.ListenAndServe(cfg.PprofAddr, pprofHandler())
+			log.Fatalf("Failed to run pprof server: %s\n", err.Error())
+		}()
+	}
 
-				} else {
-					if p.verbose {
-						log.Printf(" -> querying CNAME %s\n", record.CName)
-					}
-					rrs, err := p.queryCName(record.CName, q.Qtype, onBehalfOf)
-					if err != nil {
-						log.Printf("Failed to query %s: %s\n", record.CName, err.Error())
-						continue
-					}
-					m.Answer = append(m.Answer, rrs...)
+	var tracerProvider *sdktrace.TracerProvider
+	if cfg.OtelEndpoint != "" {
+		tracerProvider, err = setupTracing(cfg.OtelEndpoint)
+		if err != nil {
+			log.Fatalf("Failed to set up tracing: %s\n", err.Error())
+		}
+		log.Printf("Exporting traces to %s\n", cfg.OtelEndpoint)
+	}
 
-					// Fixup the cname of the records.
-					for _, rr := range m.Answer {
-						rr.Header().Name = q.Name
-					}
+	dns.Handle(".", p)
 
-					foundEntries = true
-					continue
-				}
-			}
-			break
-		case dns.TypePTR:
-			if p.verbose {
-				log.Printf("PTR query for %s\n", q.Name)
-			}
-			ptr, ok := p.ptrRecords[q.Name]
-			if !ok {
-				continue
-			}
-			rr, err := dns.NewRR(fmt.Sprintf("%s %d PTR %s", q.Name, p.localTTL, ptr))
-			if err != nil {
-				log.Printf("Failed to create RR: %s\n", err.Error())
-				continue
-			}
-			m.Answer = append(m.Answer, rr)
-			foundEntries = true
-		default:
-			if p.verbose {
-				log.Printf("Unsupported query type %s for %s\n", dns.TypeToString[q.Qtype], q.Name)
-			}
+	// The DoH and DoT servers share their TLS configuration, so that
+	// certificates from ACME are only requested once.
+	var tlsConfig *tls.Config
+	if cfg.DohListen != "" || cfg.DotListen != "" {
+		tlsConfig, err = serverTLSConfig(cfg)
+		if err != nil {
+			log.Fatalf("Failed to set up TLS: %s\n", err.Error())
 		}
 	}
-	if p.verbose {
-		if foundEntries {
-			log.Printf(" -> locally handled (%d records)\n", len(m.Answer))
-		} else {
-			log.Printf(" -> forwarding to upstream\n")
+	var dohServer *http.Server
+	var dohListener net.Listener
+	if cfg.DohListen != "" {
+		dohServer = newDohServer(p, tlsConfig, cfg.DohHTTP2)
+		dohListener, err = net.Listen("tcp", cfg.DohListen)
+		if err != nil {
+			log.Fatal(err)
 		}
 	}
-	return foundEntries
-}
-
-func exchangeHTTPSClient(
-	url url.URL,
-	client *http.Client,
-	forwardedFor net.IP,
-	req *dns.Msg,
-) (resp *dns.Msg, err error) {
-	buf, err := req.Pack()
-	if err != nil {
-		return nil, fmt.Errorf("packing message: %w", err)
+	var dotServer *dns.Server
+	if cfg.DotListen != "" {
+		dotServer, err = listenDot(cfg.DotListen, tlsConfig, time.Duration(cfg.DotIdleTimeout)*time.Second)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	// It appears, that GET requests are more memory-efficient with Golang
-	// implementation of HTTP/2.
-	method := http.MethodGet
-
-	u := url
-	u.RawQuery = fmt.Sprintf("dns=%s", base64.RawURLEncoding.EncodeToString(buf))
-
-	httpReq, err := http.NewRequest(method, u.String(), nil)
-	if err != nil {
-		return nil, fmt.Errorf("creating http request to %s: %w", url.String(), err)
+	var socketPaths []string
+	for _, socket := range []struct{ path, network string }{
+		{cfg.UnixSocket, "unix"},
+		{cfg.UnixgramSocket, "unixgram"},
+	} {
+		if socket.path == "" {
+			continue
+		}
+		server, err := listenUnix(socket.path, socket.network)
+		if err != nil {
+			log.Fatal(err)
+		}
+		socketPaths = append(socketPaths, socket.path)
+		go func() {
+			log.Printf("Serving DNS on %s (%s)\n", socket.path, socket.network)
+			err := server.ActivateAndServe()
+			log.Fatalf("Failed to run %s server: %s\n", socket.network, err.Error())
+		}()
 	}
-
-	httpReq.Header.Set("Accept", "application/dns-message")
-	httpReq.Header.Set("User-Agent", "")
-	httpReq.Header.Set("X-Forwarded-Proto", "https") // not really but lol
-	httpReq.Header.Set("X-Forwarded-For", forwardedFor.String())
-	httpReq.Header.Set("X-Real-IP", forwardedFor.String())
-
-	httpResp, err := client.Do(httpReq)
-	if err != nil {
-		return nil, fmt.Errorf("requesting %s: %w", u.String(), err)
+	if len(socketPaths) > 0 || cfg.CacheFile != "" || tracerProvider != nil || dohServer != nil || dotServer != nil {
+		// Finish answering the DoH and DoT queries in flight on shutdown,
+		// remove the socket files, so that they don't linger, save the cache
+		// to be loaded back on the next start, and export the last traces.
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			<-signals
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if dohServer != nil {
+				dohServer.Shutdown(ctx)
+			}
+			if dotServer != nil {
+				dotServer.ShutdownContext(ctx)
+			}
+			cancel()
+			for _, path := range socketPaths {
+				os.Remove(path)
+			}
+			if tracerProvider != nil {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				tracerProvider.Shutdown(ctx)
+				cancel()
+			}
+			if err := p.SaveCache(); err != nil {
+				log.Fatalf("Failed to save the cache: %s\n", err.Error())
+			}
+			os.Exit(0)
+		}()
 	}
-	defer httpResp.Body.Close()
 
-	body, err := io.ReadAll(httpResp.Body)
+	servers, err := systemdServers()
 	if err != nil {
-		return nil, fmt.Errorf("reading %s: %w", u.String(), err)
-	}
-
-	if httpResp.StatusCode != http.StatusOK {
-		return nil,
-			fmt.Errorf(
-				"expected status %d, got %d from %s",
-				http.StatusOK,
-				httpResp.StatusCode,
-				u.String(),
-			)
+		log.Fatal(err)
 	}
-
-	resp = &dns.Msg{}
-	err = resp.Unpack(body)
-	if err != nil {
-		return nil, fmt.Errorf(
-			"unpacking response from %s: body is %s: %w",
-			u.String(),
-			body,
-			err,
-		)
+	if servers == nil {
+		servers, err = listen(cfg.BindTo)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-
-	if resp.Id != req.Id {
-		err = dns.ErrId
+	// Everything that needs privileges, like binding port 53, must be done by now.
+	if cfg.User != "" || cfg.Group != "" {
+		if err := dropPrivileges(cfg.User, cfg.Group); err != nil {
+			log.Fatalf("Failed to drop privileges: %s\n", err.Error())
+		}
+		log.Printf("Running as uid %d, gid %d\n", os.Getuid(), os.Getgid())
 	}
 
-	return resp, err
-}
-
-func getForwardedFor(addr net.Addr) net.IP {
-	switch addr := addr.(type) {
-	case *net.UDPAddr:
-		return addr.IP
-	case *net.TCPAddr:
-		return addr.IP
-	default:
-		log.Fatalf("Unsupported remote address type: %T", addr)
-	}
-	return nil
-}
-
-func (p *dnsProxy) respondToRequest(r *dns.Msg, onBehalfOf net.Addr) (resp *dns.Msg, err error) {
-	m := new(dns.Msg)
-	m.SetReply(r)
-	m.Compress = false
-	m.RecursionAvailable = true
-
-	switch r.Opcode {
-	case dns.OpcodeQuery:
-		if !p.addLocalResponses(m, onBehalfOf) {
-			if r.RecursionDesired {
-				httpClient := &http.Client{
-					Timeout: p.upstreamTimeout,
-				}
-
-				forwardedFor := getForwardedFor(onBehalfOf)
-				return exchangeHTTPSClient(p.httpUrl, httpClient, forwardedFor, r)
+	if dohServer != nil {
+		go func() {
+			var err error
+			if dohServer.TLSConfig != nil {
+				log.Printf("Serving DoH on https://%s%s\n", dohListener.Addr(), proxy.DohPath)
+				err = dohServer.ServeTLS(dohListener, "", "")
 			} else {
-				m.SetRcode(r, dns.RcodeNameError)
+				log.Printf("Serving DoH on http://%s%s\n", dohListener.Addr(), proxy.DohPath)
+				err = dohServer.Serve(dohListener)
 			}
-		} else {
-			m.SetRcode(r, dns.RcodeSuccess)
-		}
+			if !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("Failed to run DoH server: %s\n", err.Error())
+			}
+		}()
 	}
-
-	return m, nil
+	if dotServer != nil {
+		go func() {
+			log.Printf("Serving DoT on %s\n", dotServer.Listener.Addr())
+			if err := dotServer.ActivateAndServe(); err != nil {
+				log.Fatalf("Failed to run DoT server: %s\n", err.Error())
+			}
+		}()
+	}
+	for _, server := range servers {
+		go func() {
+			log.Printf("Serving DNS on %s\n", serverAddr(server))
+			err := server.ActivateAndServe()
+			log.Fatalf("Failed to run server on %s: %s\n", serverAddr(server), err.Error())
+		}()
+	}
+	select {}
 }
 
-func (p *dnsProxy) handleDnsRequest(w dns.ResponseWriter, r *dns.Msg) {
-	resp, err := p.respondToRequest(r, w.RemoteAddr())
-
+// listen creates DNS servers bound to addr over UDP, and over TCP for clients
+// retrying truncated responses.
+func listen(addr string) ([]*dns.Server, error) {
+	pc, err := net.ListenPacket("udp", addr)
 	if err != nil {
-		log.Printf("Failed to query %s: %s\n", r.Question[0].Name, err.Error())
-		resp = new(dns.Msg)
-		resp.SetReply(r)
-		resp.Compress = false
-		resp.RecursionAvailable = true
-		resp.SetRcode(r, dns.RcodeServerFailure)
+		return nil, err
 	}
-
-	err = w.WriteMsg(resp)
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Printf("Failed to write response: %s\n", err.Error())
+		pc.Close()
+		return nil, err
 	}
+	return []*dns.Server{{PacketConn: pc}, {Listener: l}}, nil
 }
 
-// from net.dnsclient
-func reverseaddr(ip net.IP) (arpa string) {
-	const hexDigit = "0123456789abcdef"
-
-	if ip == nil {
-		return ""
-	}
-	if ip.To4() != nil {
-		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", ip[15], ip[14], ip[13], ip[12])
-	}
-	// Must be IPv6
-	buf := make([]byte, 0, len(ip)*4+len("ip6.arpa."))
-	//Add it, in reverse, to the buffer
-	for i := len(ip) - 1; i >= 0; i-- {
-		v := ip[i]
-		buf = append(buf, hexDigit[v&0xF],
-			'.',
-			hexDigit[v>>4],
-			'.')
-	}
-	//Append "ip6.arpa." and return (buf already has the final .)
-	buf = append(buf, "ip6.arpa."...)
-	return string(buf)
-}
-
-type config struct {
-	Help            bool     `cli:"!h,help" usage:"Show this screen."`
-	UpstreamUrl     string   `cli:"u,upstream" usage:"Upstream URL to forward queries to (for instance https://cloudflare-dns.com/dns-query)"`
-	BindTo          string   `cli:"b,bind" usage:"Address to bind to (default: 0.0.0.0:53)" dft:"0.0.0.0:53"`
-	HostsTTL        int      `cli:"t,ttl" usage:"TTL for hosts file entries (default: 10)" dft:"10"`
-	HostsFiles      []string `cli:"H,hosts" usage:"Path to hosts file"`
-	UpstreamTimeout int      `cli:"T,timeout" usage:"Timeout for upstream requests (default: 5)" dft:"5"`
-	Verbose         bool     `cli:"V,verbose" usage:"Verbose output"`
-}
-
-func (argv *config) AutoHelp() bool {
-	return argv.Help
+// serverTLSConfig returns the TLS configuration for the DoH and DoT servers:
+// with the certificate in --doh-cert if given, or one from Let's Encrypt for
+// --acme-host, or nil to serve DoH over plain HTTP.
+func serverTLSConfig(cfg config) (*tls.Config, error) {
+	if cfg.DohCert != "" {
+		if cfg.AcmeHost != "" {
+			log.Printf("Using the certificate in %s rather than getting one for %s with ACME\n", cfg.DohCert, cfg.AcmeHost)
+		}
+		certs, err := proxy.NewCertReloader(cfg.DohCert, cfg.DohKey)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		}, nil
+	}
+	if cfg.AcmeHost != "" {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.AcmeHost),
+			Cache:      autocert.DirCache(cfg.AcmeCache),
+		}
+		// The certificate is validated with TLS-ALPN-01 challenges, answered
+		// on the DoH listener itself, so that no HTTP server is needed on port 80.
+		return &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: manager.GetCertificate,
+			NextProtos:     []string{acme.ALPNProto},
+		}, nil
+	}
+	return nil, nil
 }
 
-func main() {
-	cfg := config{}
-	ret := cli.Run(&cfg, func(ctx *cli.Context) error {
-		return nil
-	}, "Davide's shitty DNS proxy")
-	if ret != 0 || cfg.Help {
-		return
+// newDohServer creates an HTTP server for DoH queries to p, serving HTTPS with
+// tlsConfig, or plain HTTP if it's nil, and HTTP/2 as well as HTTP/1.1 if
+// http2 is set.
+func newDohServer(p *proxy.Proxy, tlsConfig *tls.Config, http2 bool) *http.Server {
+	server := &http.Server{
+		Handler:           p.DohHandler(),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		Protocols:         new(http.Protocols),
+	}
+	server.Protocols.SetHTTP1(true)
+	if tlsConfig == nil {
+		server.Protocols.SetUnencryptedHTTP2(http2)
+	} else {
+		server.Protocols.SetHTTP2(http2)
 	}
+	return server
+}
 
-	u, err := url.Parse(cfg.UpstreamUrl)
+// listenDot creates a DNS over TLS server bound to addr, closing connections
+// idle for longer than idleTimeout.
+func listenDot(addr string, tlsConfig *tls.Config, idleTimeout time.Duration) (*dns.Server, error) {
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = append(tlsConfig.NextProtos, "dot")
+	return &dns.Server{
+		Listener:    tls.NewListener(l, tlsConfig),
+		Net:         "tcp-tls",
+		TLSConfig:   tlsConfig,
+		IdleTimeout: func() time.Duration { return idleTimeout },
+		// TLS handshakes are expensive, so let clients send as many
+		// queries as they like over each connection.
+		MaxTCPQueries: -1,
+	}, nil
+}
 
-	proxy := &dnsProxy{
-		httpUrl:         *u,
-		records:         make(map[string][]HostInfo),
-		ptrRecords:      make(map[string]string),
-		cnameCache:      make(map[uint16]map[string]cacheEntry),
-		localTTL:        cfg.HostsTTL,
-		verbose:         cfg.Verbose,
-		upstreamTimeout: time.Duration(cfg.UpstreamTimeout) * time.Second,
+// serverAddr describes the socket a server listens on, e.g. 0.0.0.0:53/udp.
+func serverAddr(server *dns.Server) string {
+	var addr net.Addr
+	if server.PacketConn != nil {
+		addr = server.PacketConn.LocalAddr()
+	} else {
+		addr = server.Listener.Addr()
 	}
+	return addr.String() + "/" + addr.Network()
+}
 
-	proxy.cnameCache[dns.TypeA] = make(map[string]cacheEntry)
-	proxy.cnameCache[dns.TypeAAAA] = make(map[string]cacheEntry)
-
-	count := 0
-	for _, hostsFile := range cfg.HostsFiles {
-		records, err := parseHostsFile(hostsFile)
-		if err != nil {
-			log.Fatal(err)
-		}
-		for k, v := range records {
-			proxy.records[k] = v
-			count += len(v)
+// listenUnix creates a DNS server for a Unix socket of the given network
+// ("unix" or "unixgram") at path, replacing any socket left there.
+func listenUnix(path, network string) (*dns.Server, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
 		}
 	}
-
-	for name, ips := range proxy.records {
-		for _, ip := range ips {
-			if ip.IsCName() {
-				continue
-			}
-
-			reversed := reverseaddr(ip.IP)
-			if _, ok := proxy.ptrRecords[reversed]; !ok {
-				proxy.ptrRecords[reversed] = name
-			}
+	if network == "unixgram" {
+		pc, err := net.ListenPacket(network, path)
+		if err != nil {
+			return nil, err
 		}
+		return &dns.Server{PacketConn: pc}, nil
 	}
-
-	if len(cfg.HostsFiles) > 0 {
-		log.Printf("Loaded %d records from %d hosts files", count, len(cfg.HostsFiles))
-	}
-
-	dns.HandleFunc(".", proxy.handleDnsRequest)
-
-	// start server
-	server := &dns.Server{Addr: cfg.BindTo, Net: "udp"}
-	log.Printf("Serving DNS on %s/udp\n", cfg.BindTo)
-
-	err = server.ListenAndServe()
-	if err != nil {
-		log.Fatalf("Failed to run server: %s\n ", err.Error())
-	}
-	err = server.Shutdown()
+	l, err := net.Listen(network, path)
 	if err != nil {
-		log.Fatalf("Failed to shutdown server: %s\n ", err.Error())
+		return nil, err
 	}
+	return &dns.Server{Listener: l}, nil
 }
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func dropPrivileges(username, groupname string) error {
+	return fmt.Errorf("--user and --group are not supported on %s", runtime.GOOS)
+}
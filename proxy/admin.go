@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// adminRecord is the JSON representation of a local record in the admin API.
+type adminRecord struct {
+	Name  string `json:"name"`
+	IP    string `json:"ip,omitempty"`
+	CName string `json:"cname,omitempty"`
+	// NXDOMAIN or REFUSED, for names blocked with that rcode.
+	Block string `json:"block,omitempty"`
+	// For explicit PTR records, the name the reverse name points to.
+	Ptr string `json:"ptr,omitempty"`
+}
+
+func newAdminRecord(name string, host HostInfo) adminRecord {
+	record := adminRecord{Name: name, CName: host.CName, Ptr: host.Ptr}
+	if host.IsIP() {
+		record.IP = host.IP.String()
+	}
+	if host.IsBlock() {
+		record.Block = dns.RcodeToString[host.Block]
+	}
+	return record
+}
+
+func (r adminRecord) hostInfo() (HostInfo, error) {
+	set := 0
+	for _, field := range []string{r.IP, r.CName, r.Block, r.Ptr} {
+		if field != "" {
+			set++
+		}
+	}
+	switch {
+	case set > 1:
+		return HostInfo{}, fmt.Errorf("only one of ip, cname, block and ptr can be set")
+	case r.IP != "":
+		ip := net.ParseIP(r.IP)
+		if ip == nil {
+			return HostInfo{}, fmt.Errorf("invalid ip %q", r.IP)
+		}
+		return HostInfo{IP: ip}, nil
+	case r.CName != "":
+		cname, err := cnameTarget(r.CName)
+		if err != nil {
+			return HostInfo{}, fmt.Errorf("invalid cname %q: %w", r.CName, err)
+		}
+		return HostInfo{CName: cname}, nil
+	case r.Block != "":
+		rcode, ok := blockRcodes[strings.ToUpper(r.Block)]
+		if !ok {
+			return HostInfo{}, fmt.Errorf("invalid block %q, expected NXDOMAIN or REFUSED", r.Block)
+		}
+		return HostInfo{Block: rcode}, nil
+	case r.Ptr != "":
+		ptr, err := canonicalHostName(r.Ptr)
+		if err != nil {
+			return HostInfo{}, fmt.Errorf("invalid ptr %q: %w", r.Ptr, err)
+		}
+		return HostInfo{Ptr: ptr}, nil
+	default:
+		return HostInfo{}, fmt.Errorf("one of ip, cname, block and ptr must be set")
+	}
+}
+
+// AdminHandler serves the admin HTTP API, which allows listing, adding and
+// removing local records at runtime, and dumping the configuration. Every request must carry token as a bearer token.
+func (p *Proxy) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/records", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			p.adminListRecords(w)
+		case http.MethodPost:
+			p.adminAddRecord(w, r)
+		case http.MethodPut:
+			p.adminSetRecords(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/dump", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(p.Dump()); err != nil {
+			log.Printf("Failed to write admin response: %s\n", err.Error())
+		}
+	})
+	mux.HandleFunc("/records/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/records/")
+		if name == "" {
+			http.Error(w, "missing record name", http.StatusBadRequest)
+			return
+		}
+		name, err := canonicalHostName(name)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid record name: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+		if !p.removeRecords(name) {
+			http.Error(w, "no such record", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (p *Proxy) adminListRecords(w http.ResponseWriter) {
+	p.recordsMu.RLock()
+	records := make([]adminRecord, 0, len(p.records))
+	for name, hosts := range p.records {
+		for _, host := range hosts {
+			records = append(records, newAdminRecord(name, host))
+		}
+	}
+	p.recordsMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(records); err != nil {
+		log.Printf("Failed to write admin response: %s\n", err.Error())
+	}
+}
+
+func (p *Proxy) adminAddRecord(w http.ResponseWriter, r *http.Request) {
+	var record adminRecord
+	if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+		http.Error(w, fmt.Sprintf("invalid record: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if record.Name == "" {
+		http.Error(w, "invalid record: missing name", http.StatusBadRequest)
+		return
+	}
+	name, err := canonicalHostName(record.Name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid record name: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	hostInfo, err := record.hostInfo()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid record: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	added, err := p.addRecord(name, hostInfo)
+	switch {
+	case err != nil:
+		http.Error(w, fmt.Sprintf("invalid record: %s", err.Error()), http.StatusConflict)
+	case !added:
+		// The record is already there.
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (p *Proxy) adminSetRecords(w http.ResponseWriter, r *http.Request) {
+	var adminRecords []adminRecord
+	if err := json.NewDecoder(r.Body).Decode(&adminRecords); err != nil {
+		http.Error(w, fmt.Sprintf("invalid records: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	records := make(map[string][]HostInfo)
+	for _, record := range adminRecords {
+		name, err := canonicalHostName(record.Name)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid record name %q", record.Name), http.StatusBadRequest)
+			return
+		}
+		hostInfo, err := record.hostInfo()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid record for %s: %s", record.Name, err.Error()), http.StatusBadRequest)
+			return
+		}
+		records[name] = append(records[name], hostInfo)
+	}
+
+	if err := p.SetRecords(records); err != nil {
+		http.Error(w, fmt.Sprintf("invalid records: %s", err.Error()), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetRecords replaces the local entries from hosts files, zone files and
+// earlier changes with records, keyed by name, and reindexes them, PTR
+// records included. Entries from the record database and zone transfers
+// stay, until they're next reloaded, as do zone records of other types. If records would form CNAME loops,
+// nothing is changed and an error is returned. Queries being answered
+// concurrently see either the old or the new records.
+func (p *Proxy) SetRecords(records map[string][]HostInfo) error {
+	canonical := make(map[string][]HostInfo, len(records))
+	for name, hosts := range records {
+		mergeRecords(canonical, map[string][]HostInfo{dns.CanonicalName(name): hosts})
+	}
+
+	p.recordsMu.Lock()
+	defer p.recordsMu.Unlock()
+	databaseRecords := addNewRecords(canonical, p.databaseRecords)
+	transferRecords := make([]map[string][]HostInfo, len(p.transfers))
+	for i, t := range p.transfers {
+		transferRecords[i] = addNewRecords(canonical, t.records)
+	}
+	if loops := findCNameLoops(canonical); len(loops) > 0 {
+		return fmt.Errorf("CNAME loop: %s", strings.Join(loops, ", "))
+	}
+
+	p.records = canonical
+	p.databaseRecords = databaseRecords
+	for i, t := range p.transfers {
+		t.records = transferRecords[i]
+	}
+	p.indexRecords()
+	return nil
+}
+
+// addRecord adds a local record for name and reindexes it, returning
+// whether it was added: records already there aren't added twice. CNAMEs
+// that would form a loop aren't added either, and an error is returned.
+func (p *Proxy) addRecord(name string, hostInfo HostInfo) (bool, error) {
+	p.recordsMu.Lock()
+	defer p.recordsMu.Unlock()
+
+	name = dns.CanonicalName(name)
+	if p.hasRecord(name, hostInfo) {
+		return false, nil
+	}
+	old := p.records[name]
+	if hostInfo.IsCName() {
+		chain := cnameChain(func(n string) []HostInfo {
+			if n == name {
+				return append(slices.Clone(old), hostInfo)
+			}
+			return p.records[n]
+		}, name)
+		if loops := findCNameLoops(chain); len(loops) > 0 {
+			return false, fmt.Errorf("CNAME loop: %s", strings.Join(loops, ", "))
+		}
+	}
+	p.records[name] = append(p.records[name], hostInfo)
+	p.reindexHosts(map[string][]HostInfo{name: old})
+	return true, nil
+}
+
+// removeRecords removes all local records for name, returning whether there were any.
+func (p *Proxy) removeRecords(name string) bool {
+	p.recordsMu.Lock()
+	defer p.recordsMu.Unlock()
+
+	name = dns.CanonicalName(name)
+	old, ok := p.records[name]
+	if !ok {
+		return false
+	}
+	delete(p.records, name)
+	p.reindexHosts(map[string][]HostInfo{name: old})
+	return true
+}
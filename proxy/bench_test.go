@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"testing"
+)
+
+// benchmarkHosts returns a hosts file with n entries, one in ten of them a CNAME.
+func benchmarkHosts(n int) string {
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		if i%10 == 9 {
+			fmt.Fprintf(&sb, "@host%d.lan alias%d.lan\n", i-1, i)
+		} else {
+			fmt.Fprintf(&sb, "10.%d.%d.%d host%d.lan\n", i>>16&0xff, i>>8&0xff, i&0xff, i)
+		}
+	}
+	return sb.String()
+}
+
+// benchmarkProxy returns a proxy with 10000 local records and an upstream
+// answering every query with an A record.
+func benchmarkProxy(b *testing.B) *Proxy {
+	records, _, err := parseHostsScanner(bufio.NewScanner(strings.NewReader(benchmarkHosts(10000))))
+	if err != nil {
+		b.Fatal(err)
+	}
+	return &Proxy{
+		records:    records,
+		cnameCache: map[uint16]map[string]cacheEntry{dns.TypeA: {}, dns.TypeAAAA: {}},
+		localTTL:   10,
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			return replyA(req), nil
+		}),
+	}
+}
+
+func benchmarkRespond(b *testing.B, proxy *Proxy, name string, qtype uint16) {
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	if resp, err := proxy.respondToRequest(context.Background(), req, addr); err != nil || len(resp.Answer) == 0 {
+		b.Fatal("Expected an answer, got", resp, err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := proxy.respondToRequest(context.Background(), req, addr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRespondLocal(b *testing.B) {
+	benchmarkRespond(b, benchmarkProxy(b), "host1234.lan.", dns.TypeA)
+}
+
+func BenchmarkRespondLocalPtr(b *testing.B) {
+	benchmarkRespond(b, benchmarkProxy(b), "210.4.0.10.in-addr.arpa.", dns.TypePTR)
+}
+
+func BenchmarkRespondCached(b *testing.B) {
+	proxy := benchmarkProxy(b)
+	proxy.cache = newResponseCache(1000, &proxy.cacheStats)
+	benchmarkRespond(b, proxy, "example.com.", dns.TypeA)
+}
+
+func BenchmarkParseHosts(b *testing.B) {
+	hosts := benchmarkHosts(10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := parseHostsScanner(bufio.NewScanner(strings.NewReader(hosts))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkIndexRecordsShared indexes a hosts file where every name has the
+// same address, like blocklists pointing names to a sinkhole.
+func BenchmarkIndexRecordsShared(b *testing.B) {
+	var sb strings.Builder
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&sb, "127.0.0.1 ads%d.example.com\n", i)
+	}
+	records, _, err := parseHostsScanner(bufio.NewScanner(strings.NewReader(sb.String())))
+	if err != nil {
+		b.Fatal(err)
+	}
+	proxy := &Proxy{records: records}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		proxy.indexRecords()
+	}
+}
+
+// BenchmarkAddRecord adds and removes a record among 10000 local records and
+// a blocklist of 100000 names.
+func BenchmarkAddRecord(b *testing.B) {
+	proxy := benchmarkProxy(b)
+	for i := 0; i < 100000; i++ {
+		proxy.records[fmt.Sprintf("ads%d.example.com.", i)] = []HostInfo{{IP: net.IPv4zero}}
+	}
+	proxy.indexRecords()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		proxy.addRecord("new.lan.", HostInfo{IP: net.ParseIP("10.0.0.1")})
+		proxy.removeRecords("new.lan.")
+	}
+}
@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"container/list"
+	"github.com/miekg/dns"
+	"net"
+	"sync"
+	"time"
+)
+
+type responseCacheKey struct {
+	name          string
+	qtype, qclass uint16
+	// DNSSEC responses carry extra records, so they're cached separately.
+	do bool
+	// Responses to CD queries may be bogus, and mustn't be served to clients
+	// relying on the upstream's validation.
+	cd bool
+	// With ECS caching, the client subnet the response applies to, e.g. 10.0.0.0/24.
+	subnet string
+}
+
+type cachedResponse struct {
+	key     responseCacheKey
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// responseCache is an LRU cache of upstream responses, kept for as long as
+// their TTL allows.
+type responseCache struct {
+	size  int
+	stats *cacheStats
+	// Whether to cache responses to EDNS client subnet queries, by the
+	// subnet their scope covers.
+	ecs bool
+
+	mu      sync.Mutex
+	entries map[responseCacheKey]*list.Element
+	lru     *list.List
+}
+
+func newResponseCache(size int, stats *cacheStats) *responseCache {
+	return &responseCache{
+		size:    size,
+		stats:   stats,
+		entries: make(map[responseCacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// clientSubnet returns the EDNS client subnet option of msg, or nil if it has none.
+func clientSubnet(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+				return ecs
+			}
+		}
+	}
+	return nil
+}
+
+// cacheKey returns the cache key for req, with its client subnet cut to
+// prefix bits if it has one, and whether its response can be cached.
+func (c *responseCache) cacheKey(req *dns.Msg, prefix uint8) (responseCacheKey, bool) {
+	if len(req.Question) != 1 {
+		return responseCacheKey{}, false
+	}
+	q := req.Question[0]
+	key := responseCacheKey{name: dns.CanonicalName(q.Name), qtype: q.Qtype, qclass: q.Qclass, do: dnssecOk(req), cd: req.CheckingDisabled}
+	if ecs := clientSubnet(req); ecs != nil {
+		// Responses to client subnet queries may be specific to the client.
+		if !c.ecs {
+			return responseCacheKey{}, false
+		}
+		bits := 128
+		if ecs.Family == 1 {
+			bits = 32
+		}
+		prefix = min(prefix, ecs.SourceNetmask, uint8(bits))
+		subnet := net.IPNet{IP: ecs.Address.Mask(net.CIDRMask(int(prefix), bits)), Mask: net.CIDRMask(int(prefix), bits)}
+		key.subnet = subnet.String()
+	}
+	return key, true
+}
+
+// lookupKeys returns the keys a cached response to req can be stored under,
+// the most specific first. With ECS caching, that's one for each scope the
+// response could have had, up to the query's source prefix.
+func (c *responseCache) lookupKeys(req *dns.Msg) []responseCacheKey {
+	ecs := clientSubnet(req)
+	if ecs == nil || !c.ecs {
+		if key, ok := c.cacheKey(req, 0); ok {
+			return []responseCacheKey{key}
+		}
+		return nil
+	}
+	keys := make([]responseCacheKey, 0, int(ecs.SourceNetmask)+1)
+	for prefix := int(ecs.SourceNetmask); prefix >= 0; prefix-- {
+		key, _ := c.cacheKey(req, uint8(prefix))
+		if len(keys) == 0 || keys[len(keys)-1] != key {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// lookup returns the cache entry for req and its element, if there's one.
+// The caller must hold mu.
+func (c *responseCache) lookup(req *dns.Msg) (*list.Element, bool) {
+	for _, key := range c.lookupKeys(req) {
+		if element, ok := c.entries[key]; ok {
+			return element, true
+		}
+	}
+	return nil, false
+}
+
+// get returns a cached response to req, with its TTLs decreased by the time
+// it spent in the cache, or nil if there's none.
+func (c *responseCache) get(req *dns.Msg) *dns.Msg {
+	c.mu.Lock()
+	element, ok := c.lookup(req)
+	var entry *cachedResponse
+	if ok {
+		entry = element.Value.(*cachedResponse)
+		if time.Now().Before(entry.expires) {
+			c.lru.MoveToFront(element)
+		} else {
+			c.remove(element)
+			c.stats.evictions.Add(1)
+			entry = nil
+		}
+	}
+	c.mu.Unlock()
+
+	if entry == nil {
+		c.stats.misses.Add(1)
+		return nil
+	}
+	c.stats.hits.Add(1)
+
+	resp := entry.msg.Copy()
+	resp.Id = req.Id
+	resp.Question = req.Question
+	elapsed := uint32(time.Since(entry.stored).Seconds())
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT {
+				hdr.Ttl -= min(hdr.Ttl, elapsed)
+			}
+		}
+	}
+	return resp
+}
+
+// has returns whether there's a fresh cached response to req.
+func (c *responseCache) has(req *dns.Msg) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.lookup(req)
+	return ok && time.Now().Before(element.Value.(*cachedResponse).expires)
+}
+
+// put caches resp as the response to req, if it's cacheable.
+func (c *responseCache) put(req, resp *dns.Msg) {
+	// Answers to client subnet queries apply to the scope the upstream
+	// returns, or to everyone if it didn't return one (RFC 7871 section 7.3.1).
+	var scope uint8
+	if ecs := clientSubnet(resp); ecs != nil {
+		scope = ecs.SourceScope
+	}
+	key, ok := c.cacheKey(req, scope)
+	if !ok || resp.Truncated || (resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		return
+	}
+	ttl, ok := cacheTTL(resp)
+	if !ok || ttl == 0 {
+		return
+	}
+	now := time.Now()
+	entry := &cachedResponse{key, resp.Copy(), now, now.Add(time.Duration(ttl) * time.Second)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+		c.stats.evictions.Add(1)
+	}
+}
+
+// cacheTTL returns how long resp can be cached for: the lowest TTL of its
+// records, or for negative responses the SOA minimum (RFC 2308).
+func cacheTTL(resp *dns.Msg) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			rrTTL := hdr.Ttl
+			if soa, ok := rr.(*dns.SOA); ok && len(resp.Answer) == 0 {
+				rrTTL = min(rrTTL, soa.Minttl)
+			}
+			if !found || rrTTL < ttl {
+				ttl = rrTTL
+				found = true
+			}
+		}
+	}
+	return ttl, found
+}
+
+// remove removes an element from the cache. The caller must hold mu.
+func (c *responseCache) remove(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.entries, element.Value.(*cachedResponse).key)
+}
+
+// clear removes every entry from the cache.
+func (c *responseCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[responseCacheKey]*list.Element)
+	c.lru.Init()
+}
+
+func (c *responseCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
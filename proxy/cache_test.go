@@ -0,0 +1,356 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/miekg/dns"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResponseCache(t *testing.T) {
+	var stats cacheStats
+	cache := newResponseCache(2, &stats)
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		return req
+	}
+
+	req := query("example.com.", dns.TypeA)
+	cache.put(req, replyA(req))
+	resp := cache.get(query("EXAMPLE.com.", dns.TypeA))
+	if resp == nil || len(resp.Answer) != 1 || resp.Question[0].Name != "EXAMPLE.com." {
+		t.Error("Expected a cached response with the query's question, got", resp)
+	}
+	if cache.get(query("example.com.", dns.TypeAAAA)) != nil {
+		t.Error("Expected no cached response for another type")
+	}
+
+	// Negative responses are cached for the SOA minimum.
+	nx := query("missing.example.com.", dns.TypeA)
+	negative := new(dns.Msg)
+	negative.SetRcode(nx, dns.RcodeNameError)
+	soa, _ := dns.NewRR("example.com. 3600 SOA ns.example.com. hostmaster.example.com. 1 3600 600 86400 0")
+	negative.Ns = append(negative.Ns, soa)
+	cache.put(nx, negative)
+	if cache.get(nx) != nil {
+		t.Error("Expected a negative response with a 0 SOA minimum not to be cached")
+	}
+
+	// The least recently used entry is evicted when the cache is full.
+	for _, name := range []string{"a.example.", "b.example."} {
+		req := query(name, dns.TypeA)
+		cache.put(req, replyA(req))
+	}
+	if cache.get(query("example.com.", dns.TypeA)) != nil || cache.len() != 2 {
+		t.Error("Expected the oldest entry to be evicted")
+	}
+	if stats.hits.Load() != 1 || stats.evictions.Load() != 1 {
+		t.Error("Incorrect cache stats:", stats.hits.Load(), stats.evictions.Load())
+	}
+}
+
+func TestPrefetchSiblings(t *testing.T) {
+	var mu sync.Mutex
+	queried := make(map[uint16]int)
+	proxy := &Proxy{
+		records:          make(map[string][]HostInfo),
+		localTTL:         10,
+		prefetchSiblings: true,
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			mu.Lock()
+			queried[req.Question[0].Qtype]++
+			mu.Unlock()
+			m := new(dns.Msg)
+			m.SetReply(req)
+			rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN " + dns.TypeToString[req.Question[0].Qtype] + " ::1")
+			if req.Question[0].Qtype == dns.TypeA {
+				rr, _ = dns.NewRR(req.Question[0].Name + " 60 IN A 1.2.3.4")
+			}
+			m.Answer = append(m.Answer, rr)
+			return m, nil
+		}),
+	}
+	proxy.cache = newResponseCache(100, &proxy.cacheStats)
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+
+	query := func(name string, qtype uint16) {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		if _, err := proxy.respondToRequest(context.Background(), msg, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := func(qtype uint16) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return queried[qtype]
+	}
+
+	// Names only ever queried for one type don't get their sibling prefetched.
+	query("v4only.example.", dns.TypeA)
+	query("v4only.example.", dns.TypeA)
+	time.Sleep(50 * time.Millisecond)
+	if count(dns.TypeAAAA) != 0 {
+		t.Error("Expected no AAAA prefetch for a name only queried for A")
+	}
+
+	// Once a name is known to get both, the sibling is prefetched.
+	query("dual.example.", dns.TypeA)
+	query("dual.example.", dns.TypeAAAA)
+	proxy.cache = newResponseCache(100, &proxy.cacheStats)
+	query("dual.example.", dns.TypeA)
+	time.Sleep(50 * time.Millisecond)
+	before := count(dns.TypeAAAA)
+	query("dual.example.", dns.TypeAAAA)
+	if count(dns.TypeAAAA) != before || before != 2 {
+		t.Error("Expected the AAAA query to be answered from the prefetched cache entry, got AAAA queries:", count(dns.TypeAAAA))
+	}
+}
+
+func TestPrefetchRequiresAD(t *testing.T) {
+	proxy := &Proxy{
+		records:          make(map[string][]HostInfo),
+		localTTL:         10,
+		prefetchSiblings: true,
+		requireAD:        true,
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			// Only the A answers are authenticated.
+			if req.Question[0].Qtype == dns.TypeA {
+				rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 1.2.3.4")
+				m.Answer = append(m.Answer, rr)
+				m.AuthenticatedData = true
+			} else {
+				rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN AAAA ::1")
+				m.Answer = append(m.Answer, rr)
+			}
+			return m, nil
+		}),
+	}
+	proxy.cache = newResponseCache(100, &proxy.cacheStats)
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	query := func(qtype uint16) (*dns.Msg, error) {
+		msg := new(dns.Msg)
+		msg.SetQuestion("dual.example.", qtype)
+		msg.SetEdns0(dns.DefaultMsgSize, true)
+		return proxy.respondToRequest(context.Background(), msg, addr)
+	}
+
+	query(dns.TypeA)
+	query(dns.TypeAAAA)
+	proxy.cache = newResponseCache(100, &proxy.cacheStats)
+	if _, err := query(dns.TypeA); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if resp, err := query(dns.TypeAAAA); !errors.Is(err, errNotAuthenticated) {
+		t.Error("Expected the prefetched unauthenticated answer not to be served, got", resp, err)
+	}
+}
+
+func TestEcsCache(t *testing.T) {
+	var stats cacheStats
+	cache := newResponseCache(10, &stats)
+	withSubnet := func(msg *dns.Msg, subnet string, scope uint8) *dns.Msg {
+		_, ipNet, _ := net.ParseCIDR(subnet)
+		ones, _ := ipNet.Mask.Size()
+		msg.SetEdns0(4096, false)
+		msg.IsEdns0().Option = append(msg.IsEdns0().Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: uint8(ones),
+			SourceScope:   scope,
+			Address:       ipNet.IP,
+		})
+		return msg
+	}
+	query := func(name, subnet string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		return withSubnet(req, subnet, 0)
+	}
+	answer := func(req *dns.Msg, subnet string, scope uint8, addr string) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 A " + addr)
+		resp.Answer = append(resp.Answer, rr)
+		return withSubnet(resp, subnet, scope)
+	}
+	cachedAddr := func(req *dns.Msg) string {
+		resp := cache.get(req)
+		if resp == nil {
+			return ""
+		}
+		return resp.Answer[0].(*dns.A).A.String()
+	}
+
+	req := query("geo.example.", "10.0.1.0/24")
+	cache.put(req, answer(req, "10.0.1.0/24", 24, "1.1.1.1"))
+	if cachedAddr(req) != "" {
+		t.Error("Expected client subnet responses not to be cached without ECS caching")
+	}
+
+	cache.ecs = true
+	cache.put(req, answer(req, "10.0.1.0/24", 24, "1.1.1.1"))
+	other := query("geo.example.", "10.0.2.0/24")
+	cache.put(other, answer(other, "10.0.2.0/24", 24, "2.2.2.2"))
+	if got := cachedAddr(query("geo.example.", "10.0.1.0/24")); got != "1.1.1.1" {
+		t.Error("Expected the first subnet's answer, got", got)
+	}
+	if got := cachedAddr(query("geo.example.", "10.0.2.0/24")); got != "2.2.2.2" {
+		t.Error("Expected the second subnet's answer, got", got)
+	}
+	if got := cachedAddr(query("geo.example.", "10.0.3.0/24")); got != "" {
+		t.Error("Expected no answer for a third subnet, got", got)
+	}
+
+	// A broader scope covers all the subnets within it.
+	req = query("wide.example.", "10.1.1.0/24")
+	cache.put(req, answer(req, "10.1.1.0/24", 16, "3.3.3.3"))
+	if got := cachedAddr(query("wide.example.", "10.1.200.0/24")); got != "3.3.3.3" {
+		t.Error("Expected the answer for the /16 scope, got", got)
+	}
+	if got := cachedAddr(query("wide.example.", "10.2.1.0/24")); got != "" {
+		t.Error("Expected no answer outside the /16 scope, got", got)
+	}
+
+	// Without an ECS option in the response, the answer applies to everyone.
+	req = query("global.example.", "10.0.1.0/24")
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	rr, _ := dns.NewRR("global.example. 60 A 4.4.4.4")
+	resp.Answer = append(resp.Answer, rr)
+	cache.put(req, resp)
+	if got := cachedAddr(query("global.example.", "192.168.0.0/24")); got != "4.4.4.4" {
+		t.Error("Expected an unscoped answer to be shared, got", got)
+	}
+}
+
+func TestCheckingDisabled(t *testing.T) {
+	queries := 0
+	proxy := &Proxy{
+		records:   make(map[string][]HostInfo),
+		localTTL:  10,
+		requireAD: true,
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			queries++
+			if !dnssecOk(req) {
+				t.Error("Expected the DO bit to be forwarded")
+			}
+			// A validating upstream that doesn't echo the CD bit.
+			m := replyA(req)
+			m.AuthenticatedData = !req.CheckingDisabled
+			m.CheckingDisabled = false
+			return m, nil
+		}),
+	}
+	proxy.cache = newResponseCache(100, &proxy.cacheStats)
+
+	query := func(cd bool) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		msg.SetEdns0(4096, true)
+		msg.CheckingDisabled = cd
+		resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// CD queries aren't held to --require-ad, and get the CD bit back.
+	if resp := query(true); !resp.CheckingDisabled || resp.AuthenticatedData {
+		t.Error("Expected an unauthenticated response with the CD bit, got", resp)
+	}
+	// The unvalidated answer isn't served from the cache to a validating client.
+	if resp := query(false); resp.CheckingDisabled || !resp.AuthenticatedData || queries != 2 {
+		t.Error("Expected an authenticated response from the upstream, got", resp)
+	}
+	if resp := query(true); !resp.CheckingDisabled || queries != 2 {
+		t.Error("Expected a cached response with the CD bit, got", resp)
+	}
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	var stats cacheStats
+	cache := newResponseCache(10, &stats)
+	for _, name := range []string{"a.example.", "b.example.", "expired.example."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		cache.put(req, replyA(req))
+	}
+	cd := new(dns.Msg)
+	cd.SetQuestion("cd.example.", dns.TypeA)
+	cd.CheckingDisabled = true
+	cache.put(cd, replyA(cd))
+	// Pretend the entries were cached 10 seconds ago, and one has expired since.
+	for _, element := range cache.entries {
+		entry := element.Value.(*cachedResponse)
+		entry.stored = entry.stored.Add(-10 * time.Second)
+		if entry.key.name == "expired.example." {
+			entry.expires = time.Now().Add(-time.Second)
+		}
+	}
+
+	var snapshot bytes.Buffer
+	if err := cache.save(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	restored := newResponseCache(10, &stats)
+	loaded, err := restored.load(bytes.NewReader(snapshot.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded != 3 || restored.len() != 3 {
+		t.Error("Expected the 3 unexpired entries to be loaded, got", loaded)
+	}
+	if restored.get(cd) == nil {
+		t.Error("Expected the CD entry to be restored")
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.", dns.TypeA)
+	resp := restored.get(req)
+	if resp == nil || len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl > 50 {
+		t.Error("Expected the restored entry with its TTL decreased by its time in the cache, got", resp)
+	}
+	// The least recently used order is kept, cd.example. and a.example. having just been used.
+	if restored.lru.Back().Value.(*cachedResponse).key.name != "b.example." {
+		t.Error("Expected b.example. to be the least recently used entry")
+	}
+
+	if _, err := restored.load(bytes.NewReader([]byte("not a snapshot"))); err == nil {
+		t.Error("Expected an error loading something that isn't a snapshot")
+	}
+	// A snapshot of another version loads as an empty cache.
+	other := bytes.Clone(snapshot.Bytes())
+	other[len(cacheFileMagic)] = cacheFileVersion - 1
+	if loaded, err := newResponseCache(10, &stats).load(bytes.NewReader(other)); err != nil || loaded != 0 {
+		t.Error("Expected nothing loaded from another version's snapshot, got", loaded, err)
+	}
+	truncated := snapshot.Bytes()[:snapshot.Len()-5]
+	if _, err := newResponseCache(10, &stats).load(bytes.NewReader(truncated)); err == nil {
+		t.Error("Expected an error loading a truncated snapshot")
+	}
+
+	// A snapshot that can't be loaded doesn't stop the proxy from starting.
+	path := filepath.Join(t.TempDir(), "cache")
+	if err := os.WriteFile(path, truncated, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := New(Options{UpstreamURL: "dns://1.1.1.1", CacheSize: 10, CacheFile: path})
+	if err != nil {
+		t.Fatal("Expected the proxy to start with a truncated snapshot, got", err)
+	}
+	if proxy.cache.len() != 0 {
+		t.Error("Expected an empty cache, got", proxy.cache.len(), "entries")
+	}
+}
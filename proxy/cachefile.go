@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cacheFileMagic starts cache snapshots, followed by cacheFileVersion, which
+// must be bumped whenever the format changes. Snapshots of other versions
+// are ignored, leaving the cache empty: version 1 didn't key entries on the
+// CD bit, so its entries could serve unvalidated answers to other clients.
+const (
+	cacheFileMagic   = "SDPCACHE"
+	cacheFileVersion = 2
+)
+
+// Cache snapshots are the magic and version, followed by the entries, least
+// recently used first, each made of:
+//
+//	name, subnet   uint16 length followed by the bytes
+//	qtype, qclass  uint16
+//	flags          uint8, 1 if do is set, plus 2 if cd is set
+//	stored,expires int64 Unix time in nanoseconds
+//	msg            uint16 length followed by the packed message
+//
+// All integers are big endian.
+
+// save writes a snapshot of the cache's entries to w.
+func (c *responseCache) save(w io.Writer) error {
+	c.mu.Lock()
+	entries := make([]*cachedResponse, 0, c.lru.Len())
+	for element := c.lru.Back(); element != nil; element = element.Prev() {
+		entries = append(entries, element.Value.(*cachedResponse))
+	}
+	c.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(cacheFileMagic)
+	bw.WriteByte(cacheFileVersion)
+	for _, entry := range entries {
+		packed, err := entry.msg.Pack()
+		if err != nil {
+			return fmt.Errorf("packing cached response for %s: %w", entry.key.name, err)
+		}
+		writeString(bw, entry.key.name)
+		writeString(bw, entry.key.subnet)
+		binary.Write(bw, binary.BigEndian, entry.key.qtype)
+		binary.Write(bw, binary.BigEndian, entry.key.qclass)
+		var flags uint8
+		if entry.key.do {
+			flags |= 1
+		}
+		if entry.key.cd {
+			flags |= 2
+		}
+		bw.WriteByte(flags)
+		binary.Write(bw, binary.BigEndian, entry.stored.UnixNano())
+		binary.Write(bw, binary.BigEndian, entry.expires.UnixNano())
+		writeString(bw, string(packed))
+	}
+	return bw.Flush()
+}
+
+func writeString(w *bufio.Writer, s string) {
+	binary.Write(w, binary.BigEndian, uint16(len(s)))
+	w.WriteString(s)
+}
+
+// load adds the entries of a snapshot written by save to the cache,
+// skipping the expired ones, and returns how many were added. Snapshots of
+// another version add nothing.
+func (c *responseCache) load(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(cacheFileMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:len(cacheFileMagic)]) != cacheFileMagic {
+		return 0, errors.New("not a cache snapshot")
+	}
+	if version := header[len(cacheFileMagic)]; version != cacheFileVersion {
+		log.Printf("Ignoring cache snapshot of version %d, expected %d\n", version, cacheFileVersion)
+		return 0, nil
+	}
+
+	now := time.Now()
+	loaded := 0
+	for {
+		var key responseCacheKey
+		var err error
+		if key.name, err = readString(br); err == io.EOF {
+			return loaded, nil
+		} else if err != nil {
+			return loaded, err
+		}
+		var flags uint8
+		var stored, expires int64
+		var packed string
+		key.subnet, err = readString(br)
+		for _, field := range []any{&key.qtype, &key.qclass, &flags, &stored, &expires} {
+			if err == nil {
+				err = binary.Read(br, binary.BigEndian, field)
+			}
+		}
+		if err == nil {
+			packed, err = readString(br)
+		}
+		if err != nil {
+			return loaded, fmt.Errorf("truncated cache snapshot: %w", err)
+		}
+		key.do = flags&1 != 0
+		key.cd = flags&2 != 0
+
+		entry := &cachedResponse{key: key, stored: time.Unix(0, stored), expires: time.Unix(0, expires)}
+		if !now.Before(entry.expires) {
+			continue
+		}
+		entry.msg = new(dns.Msg)
+		if err := entry.msg.Unpack([]byte(packed)); err != nil {
+			return loaded, fmt.Errorf("unpacking cached response for %s: %w", key.name, err)
+		}
+
+		c.mu.Lock()
+		if element, ok := c.entries[key]; ok {
+			c.remove(element)
+		}
+		c.entries[key] = c.lru.PushFront(entry)
+		for c.lru.Len() > c.size {
+			c.remove(c.lru.Back())
+		}
+		c.mu.Unlock()
+		loaded++
+	}
+}
+
+func readString(r *bufio.Reader) (string, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// loadCacheFile fills the cache from the snapshot at path. A snapshot that
+// can't be read only costs a cold cache, so the error is logged and the
+// cache left empty rather than failing to start. A missing file isn't even
+// logged, since there's none before the first shutdown.
+func (p *Proxy) loadCacheFile(path string) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	} else if err != nil {
+		log.Printf("Not loading the cache from %s: %s\n", path, err)
+		return
+	}
+	defer f.Close()
+
+	loaded, err := p.cache.load(f)
+	if err != nil {
+		log.Printf("Not loading the cache from %s, starting empty: %s\n", path, err)
+		p.cache.clear()
+		return
+	}
+	log.Printf("Loaded %d cached responses from %s\n", loaded, path)
+}
+
+// SaveCache writes the response cache to the file set with
+// Options.CacheFile, to be loaded back on the next start. It does nothing
+// if there's no cache file.
+func (p *Proxy) SaveCache() error {
+	if p.cacheFile == "" || p.cache == nil {
+		return nil
+	}
+	// Write to a temporary file first, so that a crash halfway through
+	// doesn't leave a truncated snapshot behind.
+	f, err := os.CreateTemp(filepath.Dir(p.cacheFile), filepath.Base(p.cacheFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := p.cache.save(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p.cacheFile)
+}
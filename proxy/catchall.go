@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"github.com/miekg/dns"
+	"log"
+)
+
+// addCatchAllResponses answers the questions in m with the catch-all
+// addresses, for names without any other answer: A and AAAA queries get the
+// catch-all addresses of their family, all other types get NODATA. It returns
+// whether catch-all addresses are configured.
+func (p *Proxy) addCatchAllResponses(m *dns.Msg) bool {
+	if len(p.catchAllIPs) == 0 {
+		return false
+	}
+	for _, q := range m.Question {
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: uint32(p.localTTL)}
+		for _, ip := range p.catchAllIPs {
+			ip4 := ip.To4()
+			switch {
+			case q.Qtype == dns.TypeA && ip4 != nil:
+				m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip4})
+			case q.Qtype == dns.TypeAAAA && ip4 == nil:
+				m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+	}
+	p.jitterTTLs(m.Answer)
+	if len(m.Answer) == 0 {
+		m.Ns = append(m.Ns, p.syntheticSOA(m.Question[0].Name))
+	}
+	if p.verbose {
+		log.Printf(" -> answered with the catch-all addresses (%d records)\n", len(m.Answer))
+	}
+	return true
+}
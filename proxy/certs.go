@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloader serves a TLS certificate from a pair of PEM files, loading it
+// again whenever either of them changes, so that renewed certificates are
+// picked up without a restart.
+type CertReloader struct {
+	certFile, keyFile string
+
+	mu                  sync.Mutex
+	cert                *tls.Certificate
+	certMtime, keyMtime time.Time
+}
+
+// NewCertReloader loads the certificate in certFile and its key in keyFile.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config. If the
+// files changed but can't be loaded, for instance because they're halfway
+// through being replaced, the previous certificate is kept.
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.reload(); err != nil {
+		log.Printf("Failed to reload the certificate, keeping the old one: %s\n", err.Error())
+	}
+	return c.cert, nil
+}
+
+// reload loads the certificate again if the files changed since it was last
+// loaded. c.mu must be held, unless c isn't shared yet.
+func (c *CertReloader) reload() error {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return fmt.Errorf("reading certificate: %w", err)
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return fmt.Errorf("reading certificate key: %w", err)
+	}
+	if c.cert != nil && certInfo.ModTime().Equal(c.certMtime) && keyInfo.ModTime().Equal(c.keyMtime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading certificate %s: %w", c.certFile, err)
+	}
+	if c.cert != nil {
+		log.Printf("Reloaded certificate %s\n", c.certFile)
+	}
+	c.cert = &cert
+	c.certMtime = certInfo.ModTime()
+	c.keyMtime = keyInfo.ModTime()
+	return nil
+}
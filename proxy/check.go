@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// findConflicts returns the names that are both a CNAME and something else,
+// which resolvers can't make sense of, and the addresses belonging to more
+// than one name without explicit PTR entries, which get several PTR records.
+func findConflicts(records map[string][]HostInfo) (conflicts []string, duplicatePtrs []string) {
+	explicitPtrs := explicitPtrRecords(records)
+	names := make(map[string][]string)
+	for name, hosts := range records {
+		cnames, blocks := 0, 0
+		for _, host := range hosts {
+			if host.IsCName() {
+				cnames++
+			} else if host.IsBlock() {
+				blocks++
+			} else if host.IsPtr() || len(explicitPtrs[reverseaddr(host.IP)]) > 0 {
+				continue
+			} else {
+				ip := host.IP.String()
+				names[ip] = append(names[ip], name)
+			}
+		}
+		if cnames > 0 && len(hosts) > 1 {
+			conflicts = append(conflicts, fmt.Sprintf("%s is a CNAME but has other records too", name))
+		}
+		if blocks > 0 && len(hosts) > blocks {
+			conflicts = append(conflicts, fmt.Sprintf("%s is blocked but has other records too", name))
+		}
+	}
+	for ip, ipNames := range names {
+		if len(ipNames) > 1 {
+			sort.Strings(ipNames)
+			duplicatePtrs = append(duplicatePtrs, fmt.Sprintf("%s belongs to several names (%s), which all get a PTR record unless only one is kept", ip, strings.Join(ipNames, ", ")))
+		}
+	}
+	sort.Strings(conflicts)
+	sort.Strings(duplicatePtrs)
+	return conflicts, duplicatePtrs
+}
+
+// cnameChain returns the entries of names, as returned by lookup, and of the
+// names their CNAMEs lead to, so that only those are checked for loops after
+// a change.
+func cnameChain(lookup func(name string) []HostInfo, names ...string) map[string][]HostInfo {
+	chain := make(map[string][]HostInfo)
+	var visit func(name string)
+	visit = func(name string) {
+		if _, ok := chain[name]; ok {
+			return
+		}
+		chain[name] = lookup(name)
+		for _, host := range chain[name] {
+			if host.IsCName() {
+				visit(dns.CanonicalName(host.CName))
+			}
+		}
+	}
+	for _, name := range names {
+		visit(name)
+	}
+	return chain
+}
+
+// findCNameLoops returns the CNAME chains among records that lead back to a
+// name already in the chain, such as @b a / @a b, which can never resolve.
+func findCNameLoops(records map[string][]HostInfo) []string {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+	var loops []string
+	var path []string
+
+	var visit func(name string)
+	visit = func(name string) {
+		switch state[name] {
+		case visiting:
+			start := slices.Index(path, name)
+			loops = append(loops, strings.Join(append(slices.Clone(path[start:]), name), " -> "))
+			return
+		case done:
+			return
+		}
+		state[name] = visiting
+		path = append(path, name)
+		for _, host := range records[name] {
+			if host.IsCName() {
+				visit(dns.CanonicalName(host.CName))
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = done
+	}
+
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		visit(name)
+	}
+	return loops
+}
+
+// CheckConfig parses the hosts and zone files in opts without starting a
+// proxy, logging any problem found, and returns whether there were no errors.
+func CheckConfig(opts Options) bool {
+	ok := true
+	records := make(map[string][]HostInfo)
+
+	for _, hostsFile := range opts.HostsFiles {
+		fileRecords, warnings, err := parseHostsFile(hostsFile)
+		for _, warning := range warnings {
+			log.Printf("Warning: %s\n", warning)
+		}
+		if err != nil {
+			log.Printf("Error: %s: %s\n", hostsFile, err.Error())
+			ok = false
+			continue
+		}
+		mergeRecords(records, fileRecords)
+	}
+	if opts.UseSystemHosts {
+		systemRecords, warnings, err := parseSystemHosts(systemHostsPath(), opts.SkipSystemLoopback)
+		for _, warning := range warnings {
+			log.Printf("Warning: %s\n", warning)
+		}
+		if err != nil {
+			log.Printf("Error: %s\n", err.Error())
+			ok = false
+		} else {
+			mergeRecords(records, systemRecords)
+		}
+	}
+	for _, zoneFile := range opts.ZoneFiles {
+		zoneRecords, _, err := parseZoneFile(zoneFile)
+		if err != nil {
+			log.Printf("Error: %s\n", err.Error())
+			ok = false
+			continue
+		}
+		mergeRecords(records, zoneRecords)
+	}
+
+	conflicts, duplicatePtrs := findConflicts(records)
+	for _, conflict := range conflicts {
+		log.Printf("Error: %s\n", conflict)
+		ok = false
+	}
+	for _, loop := range findCNameLoops(records) {
+		log.Printf("Error: CNAME loop: %s\n", loop)
+		ok = false
+	}
+	if !opts.NoAutoPtr {
+		for _, duplicate := range duplicatePtrs {
+			log.Printf("Warning: %s\n", duplicate)
+		}
+	}
+
+	if ok {
+		log.Printf("Configuration OK, %d names defined\n", len(records))
+	}
+	return ok
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestHostsWarnings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.hosts")
+	content := "10.0.0.1 host1\n@badcname\n\n# comment\n999.999.999.999 host2\n@ host3\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	records, warnings, err := parseHostsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Error("Expected only the valid entry to be loaded, got", records)
+	}
+	lines := []int{2, 5, 6}
+	if len(warnings) != len(lines) {
+		t.Fatal("Expected warnings for lines", lines, "got", warnings)
+	}
+	for i, line := range lines {
+		if warnings[i].file != path || warnings[i].line != line {
+			t.Errorf("Expected a warning for line %d, got %s", line, warnings[i])
+		}
+	}
+}
+
+func TestFindConflicts(t *testing.T) {
+	records := map[string][]HostInfo{
+		"host1.": {{IP: net.ParseIP("10.0.0.1")}},
+		"host2.": {{IP: net.ParseIP("10.0.0.1")}},
+		"alias.": {{CName: "host1."}, {IP: net.ParseIP("10.0.0.2")}},
+		"ok.":    {{CName: "host1."}},
+	}
+	conflicts, duplicatePtrs := findConflicts(records)
+	if len(conflicts) != 1 {
+		t.Error("Expected a conflict for alias., got", conflicts)
+	}
+	if len(duplicatePtrs) != 1 {
+		t.Error("Expected a duplicate PTR for 10.0.0.1, got", duplicatePtrs)
+	}
+
+	// Addresses with explicit PTR entries only get those.
+	records["1.0.0.10.in-addr.arpa."] = []HostInfo{{Ptr: "host1."}}
+	if conflicts, duplicatePtrs := findConflicts(records); len(conflicts) != 1 || len(duplicatePtrs) != 0 {
+		t.Error("Expected no duplicate PTR for 10.0.0.1 with an explicit PTR entry, got", conflicts, duplicatePtrs)
+	}
+}
+
+func TestFindCNameLoops(t *testing.T) {
+	records := map[string][]HostInfo{
+		"a.":     {{CName: "b."}},
+		"b.":     {{CName: "A."}},
+		"self.":  {{CName: "self."}},
+		"alias.": {{CName: "host."}},
+		"host.":  {{IP: net.ParseIP("10.0.0.1")}},
+		"ext.":   {{CName: "example.com."}},
+	}
+	loops := findCNameLoops(records)
+	expected := []string{"a. -> b. -> a.", "self. -> self."}
+	if !slices.Equal(loops, expected) {
+		t.Error("Expected loops", expected, "got", loops)
+	}
+
+	delete(records, "a.")
+	delete(records, "self.")
+	if loops := findCNameLoops(records); len(loops) != 0 {
+		t.Error("Expected no loops, got", loops)
+	}
+}
+
+func TestParseSystemHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	content := "127.0.0.1 localhost\n::1 localhost ip6-localhost\n127.0.1.1 myhost\n192.168.1.10 nas nas.lan\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	records, _, err := parseSystemHosts(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"localhost.", "ip6-localhost.", "myhost.", "nas.", "nas.lan."} {
+		if len(records[name]) == 0 {
+			t.Error("Expected records for", name)
+		}
+	}
+
+	records, _, err = parseSystemHosts(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || len(records["nas."]) != 1 || len(records["nas.lan."]) != 1 {
+		t.Error("Expected only the non-loopback entries, got", records)
+	}
+}
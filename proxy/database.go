@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultDatabasePollInterval is how often the record database is checked for changes by default.
+const defaultDatabasePollInterval = 5 * time.Second
+
+// recordDatabase is a SQLite database local records are loaded from, with a
+// records table of name, type, value and ttl columns, such as
+// ('nas.lan', 'A', '10.0.0.2', 60). Types are A, AAAA and CNAME, and ttl
+// can be NULL or 0 for the default local TTL.
+type recordDatabase struct {
+	path string
+	db   *sql.DB
+	// A connection of its own, as PRAGMA data_version only tells about
+	// changes made through other connections since the last check on it.
+	conn *sql.Conn
+	// mu serializes reloads, from polling and from the gRPC API.
+	mu      sync.Mutex
+	version int64
+}
+
+// openRecordDatabase opens the SQLite database at path, read-only.
+func openRecordDatabase(ctx context.Context, path string) (*recordDatabase, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro&_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("opening record database %s: %w", path, err)
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening record database %s: %w", path, err)
+	}
+	return &recordDatabase{path: path, db: db, conn: conn}, nil
+}
+
+// changed returns whether the database was written to since the last call.
+// The first call always returns true.
+func (d *recordDatabase) changed(ctx context.Context) (bool, error) {
+	var version int64
+	if err := d.conn.QueryRowContext(ctx, "PRAGMA data_version").Scan(&version); err != nil {
+		return false, fmt.Errorf("checking record database %s for changes: %w", d.path, err)
+	}
+	changed := version != d.version
+	d.version = version
+	return changed, nil
+}
+
+// load reads all records from the database. Rows that can't be parsed are
+// skipped, and returned as warnings, with their row ID as line number.
+func (d *recordDatabase) load(ctx context.Context) (map[string][]HostInfo, []hostsWarning, error) {
+	rows, err := d.conn.QueryContext(ctx, "SELECT rowid, name, type, value, ttl FROM records")
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading records from %s: %w", d.path, err)
+	}
+	defer rows.Close()
+
+	records := make(map[string][]HostInfo)
+	var warnings []hostsWarning
+	for rows.Next() {
+		var rowid int
+		var name, rtype, value string
+		var ttl sql.NullInt64
+		if err := rows.Scan(&rowid, &name, &rtype, &value, &ttl); err != nil {
+			return nil, nil, fmt.Errorf("reading records from %s: %w", d.path, err)
+		}
+		warn := func(format string, args ...any) {
+			warnings = append(warnings, hostsWarning{d.path, rowid, fmt.Sprintf(format, args...)})
+		}
+
+		hostInfo := HostInfo{}
+		switch strings.ToUpper(rtype) {
+		case "A", "AAAA":
+			ip := net.ParseIP(value)
+			if ip == nil || (ip.To4() != nil) != strings.EqualFold(rtype, "A") {
+				warn("invalid %s address %q", strings.ToUpper(rtype), value)
+				continue
+			}
+			hostInfo.IP = ip
+		case "CNAME":
+			cname, err := cnameTarget(value)
+			if err != nil {
+				warn("invalid CNAME target %q: %s", value, err.Error())
+				continue
+			}
+			hostInfo.CName = cname
+		default:
+			warn("unsupported record type %q, expected A, AAAA or CNAME", rtype)
+			continue
+		}
+		if ttl.Valid {
+			if ttl.Int64 < 0 || ttl.Int64 > int64(^uint32(0)) {
+				warn("invalid TTL %d", ttl.Int64)
+				continue
+			}
+			hostInfo.TTL = uint32(ttl.Int64)
+		}
+
+		dnsName, err := canonicalHostName(name)
+		if err != nil {
+			warn("invalid host name %q: %s", name, err.Error())
+			continue
+		}
+		records[dnsName] = append(records[dnsName], hostInfo)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("reading records from %s: %w", d.path, err)
+	}
+	return records, warnings, nil
+}
+
+// loadInto loads the records in the database into dst, returning them and
+// the ones that were added, as opposed to being there already.
+func (d *recordDatabase) loadInto(ctx context.Context, dst map[string][]HostInfo) (records, added map[string][]HostInfo, err error) {
+	records, warnings, err := d.load(ctx)
+	for _, warning := range warnings {
+		log.Printf("Ignoring database record at %s\n", warning)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return records, addNewRecords(dst, records), nil
+}
+
+// watchDatabase checks the record database for changes every interval,
+// replacing the records loaded from it when there are any. It never returns.
+func (p *Proxy) watchDatabase(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := p.reloadDatabase(context.Background(), false); err != nil {
+			log.Printf("Failed to reload records: %s\n", err.Error())
+		}
+	}
+}
+
+// reloadDatabase replaces the records loaded from the record database with
+// its current ones, if it changed or force is set. Records from other
+// sources stay, even if the database had the same ones.
+func (p *Proxy) reloadDatabase(ctx context.Context, force bool) error {
+	p.database.mu.Lock()
+	defer p.database.mu.Unlock()
+	changed, err := p.database.changed(ctx)
+	if err != nil || (!changed && !force) {
+		return err
+	}
+
+	p.recordsMu.Lock()
+	defer p.recordsMu.Unlock()
+	records := withoutRecords(p.records, p.databaseRecords)
+	_, added, err := p.database.loadInto(ctx, records)
+	if err != nil {
+		// Try again on the next check, the database may just be busy.
+		p.database.version = 0
+		return err
+	}
+	if loops := findCNameLoops(records); len(loops) > 0 {
+		for _, loop := range loops {
+			log.Printf("CNAME loop: %s\n", loop)
+		}
+		return fmt.Errorf("CNAME loops in the records from %s, keeping the previous ones", p.database.path)
+	}
+
+	old := entriesOf(p.records, p.databaseRecords, added)
+	p.records = records
+	p.reindexHosts(old)
+	p.databaseRecords = added
+	log.Printf("Reloaded records from %s\n", p.database.path)
+	return nil
+}
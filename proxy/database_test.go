@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"database/sql"
+	"github.com/miekg/dns"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordDatabase(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "records.db")
+	hostsPath := filepath.Join(dir, "hosts")
+	if err := os.WriteFile(hostsPath, []byte("10.0.0.1 shared.lan\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another writer, like the external tools updating the database.
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	exec := func(query string, args ...any) {
+		t.Helper()
+		if _, err := db.Exec(query, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exec("CREATE TABLE records (name TEXT, type TEXT, value TEXT, ttl INTEGER)")
+	exec(`INSERT INTO records VALUES
+		('NAS.lan', 'A', '10.0.0.2', 60),
+		('nas.lan', 'aaaa', 'fd00::2', NULL),
+		('www.lan', 'CNAME', 'nas.lan', 0),
+		('shared.lan', 'A', '10.0.0.1', 30),
+		('bad.lan', 'A', 'fd00::3', 0),
+		('bad.lan', 'MX', 'mail.lan', 0)`)
+
+	proxy, err := New(Options{
+		Upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			return replyA(req), nil
+		}),
+		HostsFiles: []string{hostsPath},
+		Database:   dbPath,
+		// Reloads are triggered by hand below.
+		DatabasePollInterval: time.Hour,
+		LocalTTL:             10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := func(name string, qtype uint16) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := query("nas.lan.", dns.TypeA); len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.0.0.2" || resp.Answer[0].Header().Ttl != 60 {
+		t.Error("Expected the A record from the database with its TTL, got", resp)
+	}
+	if resp := query("nas.lan.", dns.TypeAAAA); len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != 10 {
+		t.Error("Expected the AAAA record from the database with the default TTL, got", resp)
+	}
+	if resp := query("www.lan.", dns.TypeA); len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.0.0.2" {
+		t.Error("Expected the CNAME from the database to be followed, got", resp)
+	}
+	if records := proxy.lookupRecords("bad.lan."); len(records) != 0 {
+		t.Error("Expected invalid rows to be skipped, got", records)
+	}
+	if proxy.databaseRecords["shared.lan."] != nil {
+		t.Error("Expected records already in the hosts file not to count as added from the database")
+	}
+
+	if err := proxy.reloadDatabase(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if resp := query("nas.lan.", dns.TypeA); len(resp.Answer) != 1 {
+		t.Error("Expected the records to stay the same without changes, got", resp)
+	}
+
+	exec("DELETE FROM records WHERE name IN ('shared.lan', 'www.lan')")
+	exec("UPDATE records SET value = '10.0.0.4' WHERE type = 'A' AND name = 'NAS.lan'")
+	if err := proxy.reloadDatabase(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if resp := query("nas.lan.", dns.TypeA); len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.0.0.4" {
+		t.Error("Expected the changed record after reloading, got", resp)
+	}
+	if ptrs := proxy.lookupLocal(dns.Question{Name: "4.0.0.10.in-addr.arpa.", Qtype: dns.TypePTR}); len(ptrs) != 1 || ptrs[0].(*dns.PTR).Ptr != "nas.lan." {
+		t.Error("Expected the PTR records to follow the changes, got", ptrs)
+	}
+	if records := proxy.lookupRecords("www.lan."); len(records) != 0 {
+		t.Error("Expected the removed CNAME to be gone, got", records)
+	}
+	if resp := query("shared.lan.", dns.TypeA); len(resp.Answer) != 1 {
+		t.Error("Expected the hosts file record to stay when removed from the database, got", resp)
+	}
+
+	exec("INSERT INTO records VALUES ('loop1.lan', 'CNAME', 'loop2.lan', 0), ('loop2.lan', 'CNAME', 'loop1.lan', 0)")
+	if err := proxy.reloadDatabase(context.Background(), false); err == nil {
+		t.Error("Expected an error for CNAME loops")
+	}
+	if resp := query("nas.lan.", dns.TypeA); len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.0.0.4" {
+		t.Error("Expected the previous records to be kept after a failed reload, got", resp)
+	}
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// subzoneDelegation is a zone below local names whose queries are answered
+// with a referral to its nameservers, as its parent zone would.
+type subzoneDelegation struct {
+	zone        string
+	nameservers []string
+	// Addresses of the nameservers given by address, by their synthesized name.
+	glue map[string]net.IP
+}
+
+// parseDelegation parses a delegation in the form zone=ns[,ns...], where
+// each ns is a nameserver's name, or its address. Nameservers given by
+// address are named ns1.<zone>, ns2.<zone> and so on, with glue records.
+func parseDelegation(s string) (subzoneDelegation, error) {
+	zone, nameservers, _ := strings.Cut(s, "=")
+	if zone == "" || nameservers == "" {
+		return subzoneDelegation{}, fmt.Errorf("invalid delegation %q, expected zone=ns[,ns...]", s)
+	}
+	d := subzoneDelegation{zone: dns.CanonicalName(zone), glue: make(map[string]net.IP)}
+	for _, ns := range strings.Split(nameservers, ",") {
+		if ip := net.ParseIP(ns); ip != nil {
+			name := "ns" + strconv.Itoa(len(d.glue)+1) + "." + d.zone
+			d.glue[name] = ip
+			d.nameservers = append(d.nameservers, name)
+		} else if _, ok := dns.IsDomainName(ns); ok && ns != "" {
+			d.nameservers = append(d.nameservers, dns.CanonicalName(ns))
+		} else {
+			return subzoneDelegation{}, fmt.Errorf("invalid nameserver %q for delegation %q", ns, s)
+		}
+	}
+	return d, nil
+}
+
+// delegation returns the most specific delegated zone containing name.
+func (p *Proxy) delegation(name string) (subzoneDelegation, bool) {
+	var found subzoneDelegation
+	ok := false
+	for _, d := range p.delegations {
+		if dns.IsSubDomain(d.zone, name) && (!ok || dns.CountLabel(d.zone) > dns.CountLabel(found.zone)) {
+			found = d
+			ok = true
+		}
+	}
+	return found, ok
+}
+
+// addReferral adds a referral to the nameservers of the delegated zone
+// containing q's name to m, returning whether there's one. Glue is added
+// for the nameservers given by address, and for those with local addresses.
+func (p *Proxy) addReferral(m *dns.Msg, q dns.Question) bool {
+	d, ok := p.delegation(q.Name)
+	// DS records are served by the parent side of the cut.
+	if !ok || (q.Qtype == dns.TypeDS && dns.CanonicalName(q.Name) == d.zone) {
+		return false
+	}
+	if p.verbose {
+		log.Printf("%s query for %s referred to the nameservers of %s\n", dns.TypeToString[q.Qtype], q.Name, d.zone)
+	}
+	ttl := uint32(p.localTTL)
+	for _, ns := range d.nameservers {
+		m.Ns = append(m.Ns, &dns.NS{
+			Hdr: dns.RR_Header{Name: d.zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl},
+			Ns:  ns,
+		})
+		ips := []net.IP{d.glue[ns]}
+		if d.glue[ns] == nil {
+			ips = ips[:0]
+			for _, host := range p.lookupRecords(ns) {
+				if host.IsIP() {
+					ips = append(ips, host.IP)
+				}
+			}
+		}
+		for _, ip := range ips {
+			if ip4 := ip.To4(); ip4 != nil {
+				m.Extra = append(m.Extra, &dns.A{
+					Hdr: dns.RR_Header{Name: ns, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+					A:   ip4,
+				})
+			} else {
+				m.Extra = append(m.Extra, &dns.AAAA{
+					Hdr:  dns.RR_Header{Name: ns, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl},
+					AAAA: ip,
+				})
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"math"
+	mathrand "math/rand/v2"
+	"net"
+	"sync/atomic"
+)
+
+// Strategies for choosing which of several upstreams a query is sent to.
+const (
+	// StrategyRoundRobin sends queries to each upstream in turn.
+	StrategyRoundRobin = "round-robin"
+	// StrategyAdaptive sends queries to the upstream with the lowest
+	// latency, probing the others every now and then.
+	StrategyAdaptive = "adaptive"
+)
+
+// adaptiveProbeRate is the share of queries the adaptive strategy sends to an
+// upstream other than the fastest, so that their latency estimates stay fresh
+// and one that got faster is noticed.
+const adaptiveProbeRate = 0.05
+
+// multiUpstream spreads queries over several upstreams.
+type multiUpstream struct {
+	upstreams []*instrumentedUpstream
+	adaptive  bool
+	next      atomic.Uint64
+}
+
+func newMultiUpstream(upstreams []*instrumentedUpstream, strategy string) (*multiUpstream, error) {
+	switch strategy {
+	case "", StrategyRoundRobin, StrategyAdaptive:
+	default:
+		return nil, fmt.Errorf("unknown upstream strategy %q, expected %s or %s", strategy, StrategyRoundRobin, StrategyAdaptive)
+	}
+	return &multiUpstream{upstreams: upstreams, adaptive: strategy == StrategyAdaptive}, nil
+}
+
+func (m *multiUpstream) Exchange(ctx context.Context, req *dns.Msg, forwardedFor net.IP) (*dns.Msg, error) {
+	return m.pick().Exchange(ctx, req, forwardedFor)
+}
+
+// pick returns the upstream to send the next query to.
+func (m *multiUpstream) pick() *instrumentedUpstream {
+	if !m.adaptive {
+		return m.upstreams[(m.next.Add(1)-1)%uint64(len(m.upstreams))]
+	}
+	best := m.fastest()
+	if mathrand.Float64() < adaptiveProbeRate {
+		other := mathrand.IntN(len(m.upstreams) - 1)
+		if other >= best {
+			other++
+		}
+		return m.upstreams[other]
+	}
+	return m.upstreams[best]
+}
+
+// fastest returns the index of the upstream with the lowest selection score.
+func (m *multiUpstream) fastest() int {
+	best, bestScore := 0, math.Inf(1)
+	for i, u := range m.upstreams {
+		if score := u.stats.selectionScore(); score < bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
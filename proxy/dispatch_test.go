@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+// testUpstreams returns n instrumented stub upstreams, counting the queries each one gets.
+func testUpstreams(n int) ([]*instrumentedUpstream, []int) {
+	counts := make([]int, n)
+	upstreams := make([]*instrumentedUpstream, n)
+	for i := range upstreams {
+		upstreams[i] = &instrumentedUpstream{
+			Upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+				counts[i]++
+				return replyA(req), nil
+			}),
+			stats: newUpstreamStats("dns://upstream"),
+		}
+	}
+	return upstreams, counts
+}
+
+func TestMultiUpstreamRoundRobin(t *testing.T) {
+	upstreams, counts := testUpstreams(3)
+	multi, err := newMultiUpstream(upstreams, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 6 {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		if _, err := multi.Exchange(context.Background(), req, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, count := range counts {
+		if count != 2 {
+			t.Errorf("Expected 2 queries to upstream %d, got %d", i, count)
+		}
+	}
+
+	if _, err := newMultiUpstream(upstreams, "fastest"); err == nil {
+		t.Error("Expected an error for an unknown strategy")
+	}
+}
+
+func TestMultiUpstreamAdaptive(t *testing.T) {
+	upstreams, _ := testUpstreams(2)
+	multi, err := newMultiUpstream(upstreams, StrategyAdaptive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fast, slow := upstreams[0], upstreams[1]
+
+	fast.stats.observe(10*time.Millisecond, nil)
+	if multi.upstreams[multi.fastest()] != slow {
+		t.Error("Expected the upstream without an estimate to be tried first")
+	}
+	slow.stats.observe(100*time.Millisecond, nil)
+
+	picks := map[*instrumentedUpstream]int{}
+	for range 1000 {
+		picks[multi.pick()]++
+	}
+	if picks[fast] < 900 {
+		t.Error("Expected the fastest upstream to get most queries, got", picks[fast])
+	}
+	if picks[slow] == 0 {
+		t.Error("Expected the slower upstream to be probed")
+	}
+
+	// An upstream failing fast must not look fast.
+	for range failureWindow {
+		fast.stats.observeResult(nil, errors.New("failed"))
+	}
+	picks = map[*instrumentedUpstream]int{}
+	for range 1000 {
+		picks[multi.pick()]++
+	}
+	if picks[slow] < 900 {
+		t.Error("Expected the working upstream to get most queries, got", picks[slow])
+	}
+}
@@ -0,0 +1,2153 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHostsFile(t *testing.T) {
+	hostsFile := `
+# comment
+123.123.123.123 host1 host2 # comment
+            # comment
+1.1.1.1	host3#comment
+2606:4700:4700::1001 one.one.one.one
+
+123.45.67.89         host4
+@one.one.one.one somehost
+`
+	scanner := bufio.NewScanner(strings.NewReader(hostsFile))
+	records, _, err := parseHostsScanner(scanner)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(records) != 6 {
+		t.Error("Expected 6 records, got", len(records))
+	}
+	if len(records["host1."]) != 1 {
+		t.Error("Expected 1 record for host1, got", len(records["host1."]))
+	}
+	if records["host1."][0].IP.String() != "123.123.123.123" {
+		t.Error("Incorrect IP for host1: ", records["host1."][0])
+	}
+	if records["host2."][0].IP.String() != "123.123.123.123" {
+		t.Error("Incorrect IP for host2: ", records["host2."][0])
+	}
+	if records["host3."][0].IP.String() != "1.1.1.1" {
+		t.Error("Incorrect IP for host3: ", records["host3."][0])
+	}
+	if records["one.one.one.one."][0].IP.String() != "2606:4700:4700::1001" {
+		t.Error("Incorrect IP for one.one.one.one: ", records["one.one.one.one."][0])
+	}
+	if records["host4."][0].IP.String() != "123.45.67.89" {
+		t.Error("Incorrect IP for host4: ", records["host4."][0])
+	}
+	if records["somehost."][0].CName != "one.one.one.one." {
+		t.Error("Incorrect CName for somehost: ", records["somehost."][0])
+	}
+}
+
+func TestReverseAddress(t *testing.T) {
+	if reverseaddr(net.ParseIP("123.123.123.123")) != "123.123.123.123.in-addr.arpa." {
+		t.Error("Incorrect reverse address for 123.123.123.123")
+	}
+	if reverseaddr(net.ParseIP("2606:4700:4700::1001")) != "1.0.0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.7.4.0.0.7.4.6.0.6.2.ip6.arpa." {
+		t.Error("Incorrect reverse address for 2606:4700:4700::1001")
+	}
+	if arpa := reverseaddr(net.IP{10, 0, 0, 1}); arpa != "1.0.0.10.in-addr.arpa." {
+		t.Error("Incorrect reverse address for 4-byte 10.0.0.1:", arpa)
+	}
+	if arpa := reverseaddr(net.ParseIP("::ffff:10.0.0.1")); arpa != "1.0.0.10.in-addr.arpa." {
+		t.Error("Incorrect reverse address for ::ffff:10.0.0.1:", arpa)
+	}
+	if arpa := reverseaddr(net.IP{1, 2, 3}); arpa != "" {
+		t.Error("Expected no reverse address for an invalid IP, got", arpa)
+	}
+	mapped := "1.0.0.0.0.0.a.0.f.f.f.f.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa."
+	if ip := parseReverseAddr(mapped); ip != nil {
+		t.Error("Expected the ip6.arpa name of an IPv4-mapped address to be rejected, got", ip)
+	}
+}
+
+func TestLocalQuery(t *testing.T) {
+	hostsFile := `
+123.45.67.89 	   	 host1
+2606:4700:4700::1001 one.one.one.one
+@host1			     hostv4
+@one.one.one.one     hostv6
+`
+	scanner := bufio.NewScanner(strings.NewReader(hostsFile))
+	records, _, err := parseHostsScanner(scanner)
+	if err != nil {
+		t.Error(err)
+	}
+
+	proxy := Proxy{
+		records:         records,
+		cnameCache:      make(map[uint16]map[string]cacheEntry),
+		localTTL:        1,
+		verbose:         true,
+		upstreamTimeout: 1,
+	}
+	proxy.cnameCache[dns.TypeA] = make(map[string]cacheEntry)
+	proxy.cnameCache[dns.TypeAAAA] = make(map[string]cacheEntry)
+
+	// Test A record
+	msg := new(dns.Msg)
+	msg.SetQuestion("host1.", dns.TypeA)
+	resp, err := proxy.respondToRequest(context.Background(), msg, &net.TCPAddr{
+		IP:   net.ParseIP("123.123.123.123"),
+		Port: 1234,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Error("Expected 1 answer, got", len(resp.Answer))
+	}
+	if resp.Answer[0].Header().Name != "host1." {
+		t.Error("Incorrect answer name: ", resp.Answer[0].Header().Name)
+	}
+	if resp.Answer[0].Header().Rrtype != dns.TypeA {
+		t.Error("Incorrect answer type: ", resp.Answer[0].Header().Rrtype)
+	}
+	if resp.Answer[0].(*dns.A).A.String() != "123.45.67.89" {
+		t.Error("Incorrect answer IP: ", resp.Answer[0].(*dns.A).A.String())
+	}
+
+	// Test AAAA record
+	msg = new(dns.Msg)
+	msg.SetQuestion("one.one.one.one.", dns.TypeAAAA)
+	resp, err = proxy.respondToRequest(context.Background(), msg, &net.TCPAddr{
+		IP:   net.ParseIP("123.123.123.123"),
+		Port: 1234,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Error("Expected 1 answer, got", len(resp.Answer))
+	}
+	if resp.Answer[0].Header().Name != "one.one.one.one." {
+		t.Error("Incorrect answer name: ", resp.Answer[0].Header().Name)
+	}
+	if resp.Answer[0].Header().Rrtype != dns.TypeAAAA {
+		t.Error("Incorrect answer type: ", resp.Answer[0].Header().Rrtype)
+	}
+	if resp.Answer[0].(*dns.AAAA).AAAA.String() != "2606:4700:4700::1001" {
+		t.Error("Incorrect answer IP: ", resp.Answer[0].(*dns.AAAA).AAAA.String())
+	}
+
+	// Test CNAME records
+	msg = new(dns.Msg)
+	msg.SetQuestion("hostv4.", dns.TypeA)
+	resp, err = proxy.respondToRequest(context.Background(), msg, &net.TCPAddr{
+		IP:   net.ParseIP("123.123.123.123"),
+		Port: 1234,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Error("Expected 1 answer, got", len(resp.Answer))
+	}
+	if resp.Answer[0].Header().Name != "hostv4." {
+		t.Error("Incorrect answer name: ", resp.Answer[0].Header().Name)
+	}
+	if resp.Answer[0].Header().Rrtype != dns.TypeA {
+		t.Error("Incorrect answer type: ", resp.Answer[0].Header().Rrtype)
+	}
+	if resp.Answer[0].(*dns.A).A.String() != "123.45.67.89" {
+		t.Error("Incorrect answer IP: ", resp.Answer[0].(*dns.A).A.String())
+	}
+
+	msg = new(dns.Msg)
+	msg.SetQuestion("hostv6.", dns.TypeAAAA)
+	resp, err = proxy.respondToRequest(context.Background(), msg, &net.TCPAddr{
+		IP:   net.ParseIP("123.123.123.123"),
+		Port: 1234,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Error("Expected 1 answer, got", len(resp.Answer))
+	}
+	if resp.Answer[0].Header().Name != "hostv6." {
+		t.Error("Incorrect answer name: ", resp.Answer[0].Header().Name)
+	}
+	if resp.Answer[0].Header().Rrtype != dns.TypeAAAA {
+		t.Error("Incorrect answer type: ", resp.Answer[0].Header().Rrtype)
+	}
+	if resp.Answer[0].(*dns.AAAA).AAAA.String() != "2606:4700:4700::1001" {
+		t.Error("Incorrect answer IP: ", resp.Answer[0].(*dns.AAAA).AAAA.String())
+	}
+}
+
+type stubUpstream func(req *dns.Msg, forwardedFor net.IP) (*dns.Msg, error)
+
+func (s stubUpstream) Exchange(_ context.Context, req *dns.Msg, forwardedFor net.IP) (*dns.Msg, error) {
+	return s(req, forwardedFor)
+}
+
+func TestDnssecPassthrough(t *testing.T) {
+	authenticated := false
+	proxy := Proxy{
+		records:   make(map[string][]HostInfo),
+		requireAD: true,
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			if !dnssecOk(req) {
+				t.Error("Expected the DO bit to be forwarded")
+			}
+			m := new(dns.Msg)
+			m.SetReply(req)
+			m.AuthenticatedData = authenticated
+			a, _ := dns.NewRR("example.com. 60 A 1.2.3.4")
+			sig, _ := dns.NewRR("example.com. 60 RRSIG A 13 2 60 20300101000000 20200101000000 12345 example.com. AAAA")
+			m.Answer = append(m.Answer, a, sig)
+			return m, nil
+		}),
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.SetEdns0(4096, true)
+	addr := &net.UDPAddr{IP: net.ParseIP("123.123.123.123"), Port: 1234}
+
+	if _, err := proxy.respondToRequest(context.Background(), msg, addr); err == nil {
+		t.Error("Expected an error for an unauthenticated response")
+	}
+
+	authenticated = true
+	resp, err := proxy.respondToRequest(context.Background(), msg, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.AuthenticatedData {
+		t.Error("Expected the AD bit to be preserved")
+	}
+	if len(resp.Answer) != 2 || resp.Answer[1].Header().Rrtype != dns.TypeRRSIG {
+		t.Error("Expected the RRSIG to be passed through, got", resp.Answer)
+	}
+}
+
+func TestHostsInclude(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"main.hosts":           "1.1.1.1 host1\n$INCLUDE sub/child.hosts\n",
+		"sub/child.hosts":      "2.2.2.2 host2\n$INCLUDE grandchild.hosts # relative to sub/\n",
+		"sub/grandchild.hosts": "3.3.3.3 host3\n",
+		"cycle-a.hosts":        "$INCLUDE cycle-b.hosts\n",
+		"cycle-b.hosts":        "$INCLUDE cycle-a.hosts\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, _, err := parseHostsFile(filepath.Join(dir, "main.hosts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, ip := range map[string]string{"host1.": "1.1.1.1", "host2.": "2.2.2.2", "host3.": "3.3.3.3"} {
+		if len(records[host]) != 1 || records[host][0].IP.String() != ip {
+			t.Errorf("Incorrect records for %s: %v", host, records[host])
+		}
+	}
+
+	if _, _, err := parseHostsFile(filepath.Join(dir, "cycle-a.hosts")); err == nil {
+		t.Error("Expected an error for an include cycle")
+	}
+}
+
+func TestPtrSubnets(t *testing.T) {
+	proxy := Proxy{
+		records: map[string][]HostInfo{"5.0.0.10.in-addr.arpa.": {{Ptr: "explicit.lan."}}},
+	}
+	for _, mapping := range []string{"10.0.0.0/24={ip}.internal", "fd00::/64=host-{ip}.v6.internal."} {
+		s, err := parsePtrSubnet(mapping)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy.ptrSubnets = append(proxy.ptrSubnets, s)
+	}
+	if _, err := parsePtrSubnet("10.0.0.0/24=internal"); err == nil {
+		t.Error("Expected an error for a template without {ip}")
+	}
+
+	for name, expected := range map[string]string{
+		"5.0.0.10.in-addr.arpa.":            "explicit.lan.",
+		"42.0.0.10.in-addr.arpa.":           "10-0-0-42.internal.",
+		reverseaddr(net.ParseIP("fd00::1")): "host-fd00--1.v6.internal.",
+	} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypePTR)
+		resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].(*dns.PTR).Ptr != expected {
+			t.Errorf("Expected PTR %s for %s, got %v", expected, name, resp.Answer)
+		}
+	}
+
+	if ptr, ok := proxy.synthesizePtr("1.0.0.11.in-addr.arpa."); ok {
+		t.Error("Expected no PTR outside the configured subnets, got", ptr)
+	}
+}
+
+func TestLocalOnlyTypes(t *testing.T) {
+	forwarded := false
+	proxy := Proxy{
+		records:  map[string][]HostInfo{"host1.": {{IP: net.ParseIP("10.0.0.1")}}},
+		localTTL: 10,
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			forwarded = true
+			m := new(dns.Msg)
+			m.SetReply(req)
+			return m, nil
+		}),
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("host1.", dns.TypeHTTPS)
+	if _, err := proxy.respondToRequest(context.Background(), msg, addr); err != nil {
+		t.Fatal(err)
+	}
+	if !forwarded {
+		t.Error("Expected the query to be forwarded by default")
+	}
+
+	forwarded = false
+	proxy.localOnlyTypes = true
+	resp, err := proxy.respondToRequest(context.Background(), msg, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forwarded {
+		t.Error("Expected the query not to be forwarded")
+	}
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Error("Expected a NODATA response with a SOA record, got", resp)
+	}
+
+	msg.SetQuestion("unknown.", dns.TypeHTTPS)
+	if _, err := proxy.respondToRequest(context.Background(), msg, addr); err != nil {
+		t.Fatal(err)
+	}
+	if !forwarded {
+		t.Error("Expected queries for non-local names to be forwarded")
+	}
+}
+
+func TestLocalServiceBinding(t *testing.T) {
+	proxy := Proxy{
+		records: map[string][]HostInfo{"host1.": {
+			{IP: net.ParseIP("10.0.0.1")},
+			{IP: net.ParseIP("fd00::1")},
+		}},
+		localTTL:  10,
+		httpsAlpn: map[string][]string{"host1.": {"h2", "h3"}},
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("host1.", dns.TypeHTTPS)
+	resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatal("Expected 1 answer, got", len(resp.Answer))
+	}
+	https, ok := resp.Answer[0].(*dns.HTTPS)
+	if !ok {
+		t.Fatal("Expected an HTTPS record, got", resp.Answer[0])
+	}
+	expected := `host1.	10	IN	HTTPS	1 . alpn="h2,h3" ipv4hint="10.0.0.1" ipv6hint="fd00::1"`
+	if https.String() != expected {
+		t.Error("Incorrect HTTPS record: ", https.String())
+	}
+
+	// The synthesized record must survive packing and parsing.
+	buf, err := resp.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed := new(dns.Msg)
+	if err := parsed.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Answer[0].String() != expected {
+		t.Error("HTTPS record changed after a round-trip: ", parsed.Answer[0].String())
+	}
+}
+
+func TestMergeRecords(t *testing.T) {
+	first, _, err := parseHostsScanner(bufio.NewScanner(strings.NewReader("10.0.0.1 host1 host2\n10.0.0.1 host1\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := parseHostsScanner(bufio.NewScanner(strings.NewReader("10.0.0.1 host1\n10.0.0.2 host1\n@host2 host3\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := make(map[string][]HostInfo)
+	count := mergeRecords(records, first) + mergeRecords(records, second)
+	if count != 4 {
+		t.Error("Expected 4 unique records, got", count)
+	}
+	if len(records["host1."]) != 2 {
+		t.Fatal("Expected 2 records for host1, got", records["host1."])
+	}
+	if records["host1."][0].IP.String() != "10.0.0.1" || records["host1."][1].IP.String() != "10.0.0.2" {
+		t.Error("Incorrect records for host1: ", records["host1."])
+	}
+	if len(records["host2."]) != 1 || len(records["host3."]) != 1 {
+		t.Error("Incorrect records for host2 and host3: ", records["host2."], records["host3."])
+	}
+}
+
+func TestLocalRRRotate(t *testing.T) {
+	proxy := Proxy{
+		records: map[string][]HostInfo{"host1.": {
+			{IP: net.ParseIP("10.0.0.1")},
+			{IP: net.ParseIP("10.0.0.2")},
+			{IP: net.ParseIP("10.0.0.3")},
+		}},
+		localTTL: 10,
+	}
+	firstAnswers := func() []string {
+		var firsts []string
+		for i := 0; i < 3; i++ {
+			msg := new(dns.Msg)
+			msg.SetQuestion("host1.", dns.TypeA)
+			resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Answer) != 3 {
+				t.Fatal("Expected 3 answers, got", len(resp.Answer))
+			}
+			firsts = append(firsts, resp.Answer[0].(*dns.A).A.String())
+		}
+		return firsts
+	}
+
+	for _, first := range firstAnswers() {
+		if first != "10.0.0.1" {
+			t.Error("Expected stable order by default, got", first, "first")
+		}
+	}
+
+	proxy.rotateLocal = true
+	seen := make(map[string]bool)
+	for _, first := range firstAnswers() {
+		seen[first] = true
+	}
+	if len(seen) != 3 {
+		t.Error("Expected every address to come first once, got", seen)
+	}
+}
+
+func TestLocalWeights(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader("10.0.0.1 host weight=8\n10.0.0.2 host weight=2\n10.0.0.3 bad weight=0\n@host alias weight=2\n"))
+	records, warnings, err := parseHostsScanner(scanner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 2 {
+		t.Error("Expected warnings for the zero weight and the weighted CNAME, got", warnings)
+	}
+	if hosts := records["host."]; len(hosts) != 2 || hosts[0].Weight != 8 || hosts[1].Weight != 2 {
+		t.Fatal("Expected two weighted addresses for host., got", hosts)
+	}
+
+	proxy := Proxy{
+		records:     records,
+		localTTL:    10,
+		rotateLocal: true,
+	}
+	firsts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		msg := new(dns.Msg)
+		msg.SetQuestion("host.", dns.TypeA)
+		resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 2 {
+			t.Fatal("Expected 2 answers, got", len(resp.Answer))
+		}
+		firsts[resp.Answer[0].(*dns.A).A.String()]++
+	}
+	// 800 expected, allow for randomness.
+	if n := firsts["10.0.0.1"]; n < 700 || n > 900 {
+		t.Error("Expected 10.0.0.1 first about 80% of the time, got", firsts)
+	}
+}
+
+func TestClientSubnetStripped(t *testing.T) {
+	var sawSubnet bool
+	proxy := Proxy{
+		records: make(map[string][]HostInfo),
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			sawSubnet = false
+			for _, o := range req.IsEdns0().Option {
+				if o.Option() == dns.EDNS0SUBNET {
+					sawSubnet = true
+				}
+			}
+			m := new(dns.Msg)
+			m.SetReply(req)
+			return m, nil
+		}),
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.SetEdns0(4096, false)
+	msg.IsEdns0().Option = append(msg.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       net.ParseIP("10.0.0.0").To4(),
+	})
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+
+	if _, err := proxy.respondToRequest(context.Background(), msg, addr); err != nil {
+		t.Fatal(err)
+	}
+	if sawSubnet {
+		t.Error("Expected the client subnet option to be stripped by default")
+	}
+	if len(msg.IsEdns0().Option) != 1 {
+		t.Error("The client's message was modified")
+	}
+
+	proxy.forwardClientIP = true
+	if _, err := proxy.respondToRequest(context.Background(), msg, addr); err != nil {
+		t.Fatal(err)
+	}
+	if !sawSubnet {
+		t.Error("Expected the client subnet option to be forwarded")
+	}
+}
+
+func TestClientSubnetEcho(t *testing.T) {
+	records, _, err := parseHostsScanner(bufio.NewScanner(strings.NewReader("10.0.0.1 host.lan\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := Proxy{
+		records:  records,
+		localTTL: 10,
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			m := replyA(req)
+			// Answer with a scope whether the query had a subnet or not.
+			m.SetEdns0(4096, false)
+			m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        1,
+				SourceNetmask: 24,
+				SourceScope:   16,
+				Address:       net.ParseIP("192.0.2.0").To4(),
+			})
+			return m, nil
+		}),
+	}
+	query := func(name string, withSubnet bool) *dns.EDNS0_SUBNET {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		msg.SetEdns0(4096, false)
+		if withSubnet {
+			msg.IsEdns0().Option = append(msg.IsEdns0().Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        1,
+				SourceNetmask: 24,
+				Address:       net.ParseIP("10.0.0.0").To4(),
+			})
+		}
+		resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return clientSubnet(resp)
+	}
+
+	if ecs := query("host.lan.", true); ecs == nil || ecs.SourceScope != 0 || ecs.SourceNetmask != 24 || !ecs.Address.Equal(net.ParseIP("10.0.0.0")) {
+		t.Error("Expected the client subnet to be echoed with scope 0 for local answers, got", ecs)
+	}
+	if ecs := query("example.com.", true); ecs == nil || ecs.SourceScope != 0 {
+		t.Error("Expected scope 0 when the client subnet isn't forwarded, got", ecs)
+	}
+	proxy.forwardClientIP = true
+	if ecs := query("example.com.", true); ecs == nil || ecs.SourceScope != 16 || !ecs.Address.Equal(net.ParseIP("10.0.0.0")) {
+		t.Error("Expected the client subnet to be echoed with the upstream's scope, got", ecs)
+	}
+	if ecs := query("example.com.", false); ecs != nil {
+		t.Error("Expected no client subnet in responses to queries without one, got", ecs)
+	}
+}
+
+func TestResponseQuestionMismatch(t *testing.T) {
+	var answerName string
+	proxy := Proxy{
+		records: make(map[string][]HostInfo),
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			m.Question[0].Name = answerName
+			return m, nil
+		}),
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+
+	answerName = "evil.com."
+	if _, err := proxy.respondToRequest(context.Background(), msg, addr); err == nil {
+		t.Error("Expected an error for a response to a different question")
+	}
+
+	answerName = "ExAmPlE.CoM."
+	if _, err := proxy.respondToRequest(context.Background(), msg, addr); err != nil {
+		t.Error("Expected question names to be compared case-insensitively, got", err)
+	}
+}
+
+func TestLocalAuthoritative(t *testing.T) {
+	proxy := Proxy{
+		records: map[string][]HostInfo{
+			"host1.":       {{IP: net.ParseIP("10.0.0.1")}},
+			"alias.":       {{CName: "example.com."}},
+			"host.corp.":   {{IP: net.ParseIP("10.0.0.2")}},
+			"other.local.": {{IP: net.ParseIP("10.0.0.3")}},
+		},
+		cnameCache: map[uint16]map[string]cacheEntry{dns.TypeA: {}},
+		localTTL:   10,
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			return replyA(req), nil
+		}),
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+
+	query := func(name string) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		resp, err := proxy.respondToRequest(context.Background(), msg, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := query("host1."); !resp.Authoritative {
+		t.Error("Expected local answers to be authoritative, got", resp)
+	}
+	if resp := query("alias."); len(resp.Answer) == 0 || resp.Authoritative {
+		t.Error("Expected answers resolved through the upstream not to be authoritative, got", resp)
+	}
+	if resp := query("example.com."); resp.Authoritative {
+		t.Error("Expected forwarded answers not to be authoritative, got", resp)
+	}
+
+	proxy.authZones = []authZone{{apex: "corp.", nameservers: []string{"ns.corp."}}}
+	if resp := query("host.corp."); !resp.Authoritative {
+		t.Error("Expected local answers in a zone to be authoritative, got", resp)
+	}
+	if resp := query("other.local."); resp.Authoritative {
+		t.Error("Expected local answers outside configured zones not to be authoritative, got", resp)
+	}
+}
+
+func TestHostsIDN(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader("10.0.0.1 café.local\n@bücher.example alias.local\n10.0.0.2 -bücher.local\n"))
+	records, warnings, err := parseHostsScanner(scanner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 {
+		t.Error("Expected a warning for the invalid IDN, got", warnings)
+	}
+	if records["alias.local."][0].CName != "xn--bcher-kva.example." {
+		t.Error("Expected the CNAME target in A-label form, got", records["alias.local."])
+	}
+
+	proxy := Proxy{records: records, localTTL: 10}
+	msg := new(dns.Msg)
+	msg.SetQuestion("xn--caf-dma.local.", dns.TypeA)
+	resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Error("Expected the Unicode host to answer A-label queries, got", resp.Answer)
+	}
+}
+
+func TestLocalQueryCaseInsensitive(t *testing.T) {
+	records, _, err := parseHostsScanner(bufio.NewScanner(strings.NewReader("10.0.0.1 Host1.LAN\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := Proxy{records: records, localTTL: 10}
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+
+	for _, name := range []string{"host1.lan.", "HOST1.lan.", "hOsT1.LaN."} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		resp, err := proxy.respondToRequest(context.Background(), msg, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].Header().Name != name {
+			t.Errorf("Expected an answer for %s with the name's case preserved, got %v", name, resp.Answer)
+		}
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("1.0.0.10.IN-ADDR.ARPA.", dns.TypePTR)
+	resp, err := proxy.respondToRequest(context.Background(), msg, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.PTR).Ptr != "host1.lan." {
+		t.Error("Expected a PTR answer for a mixed case reverse name, got", resp.Answer)
+	}
+}
+
+func TestMultiplePtr(t *testing.T) {
+	records, _, err := parseHostsScanner(bufio.NewScanner(strings.NewReader("10.0.0.1 web.lan db.lan\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := Proxy{records: records, localTTL: 10}
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("1.0.0.10.in-addr.arpa.", dns.TypePTR)
+	resp, err := proxy.respondToRequest(context.Background(), msg, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 2 || resp.Answer[0].(*dns.PTR).Ptr != "db.lan." || resp.Answer[1].(*dns.PTR).Ptr != "web.lan." {
+		t.Error("Expected a PTR answer for each name, got", resp.Answer)
+	}
+
+	proxy.singlePtr = true
+	resp, err = proxy.respondToRequest(context.Background(), msg, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.PTR).Ptr != "db.lan." {
+		t.Error("Expected a single PTR answer with --single-ptr, got", resp.Answer)
+	}
+}
+
+func TestExplicitPtr(t *testing.T) {
+	hosts := "10.0.0.1 web.lan\nPTR 10.0.0.1 server.example.com\nPTR 2.0.0.10.in-addr.arpa. b.example.com a.example.com\n" +
+		"10.0.0.3 db.lan\nPTR bogus.lan host.lan\nPTR 10.0.0.4\n"
+	records, warnings, err := parseHostsScanner(bufio.NewScanner(strings.NewReader(hosts)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 2 {
+		t.Error("Expected warnings for the invalid PTR entries, got", warnings)
+	}
+	proxy := Proxy{
+		records: records,
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			m := new(dns.Msg)
+			m.SetRcode(req, dns.RcodeNameError)
+			return m, nil
+		}),
+		localTTL: 10,
+	}
+	proxy.indexRecords()
+	query := func(name string, qtype uint16) []dns.RR {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Answer
+	}
+	ptrs := func(answer []dns.RR) []string {
+		var names []string
+		for _, rr := range answer {
+			names = append(names, rr.(*dns.PTR).Ptr)
+		}
+		return names
+	}
+
+	// Explicit PTR entries replace the derived ones for their address.
+	if names := ptrs(query("1.0.0.10.in-addr.arpa.", dns.TypePTR)); len(names) != 1 || names[0] != "server.example.com." {
+		t.Error("Expected only the explicit PTR record, got", names)
+	}
+	if names := ptrs(query("2.0.0.10.in-addr.arpa.", dns.TypePTR)); len(names) != 2 || names[0] != "a.example.com." || names[1] != "b.example.com." {
+		t.Error("Expected the PTR records given by reverse name, got", names)
+	}
+	if names := ptrs(query("3.0.0.10.in-addr.arpa.", dns.TypePTR)); len(names) != 1 || names[0] != "db.lan." {
+		t.Error("Expected the derived PTR record for an address without explicit ones, got", names)
+	}
+	if answer := query("1.0.0.10.in-addr.arpa.", dns.TypeA); len(answer) != 0 {
+		t.Error("Expected no addresses for a reverse name, got", answer)
+	}
+
+	proxy.noAutoPtr = true
+	proxy.indexRecords()
+	if names := ptrs(query("1.0.0.10.in-addr.arpa.", dns.TypePTR)); len(names) != 1 {
+		t.Error("Expected explicit PTR records to be kept with --no-auto-ptr, got", names)
+	}
+	if names := ptrs(query("3.0.0.10.in-addr.arpa.", dns.TypePTR)); len(names) != 0 {
+		t.Error("Expected no derived PTR records with --no-auto-ptr, got", names)
+	}
+}
+
+func TestNoAutoPtr(t *testing.T) {
+	dir := t.TempDir()
+	hostsPath := filepath.Join(dir, "hosts")
+	if err := os.WriteFile(hostsPath, []byte("10.0.0.1 host.lan\n10.0.0.2 other.lan\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	zonePath := filepath.Join(dir, "lan.zone")
+	if err := os.WriteFile(zonePath, []byte("2.0.0.10.in-addr.arpa. 60 IN PTR explicit.lan.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	forwarded := 0
+	proxy, err := New(Options{
+		Upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			forwarded++
+			m := new(dns.Msg)
+			m.SetRcode(req, dns.RcodeNameError)
+			return m, nil
+		}),
+		HostsFiles: []string{hostsPath},
+		ZoneFiles:  []string{zonePath},
+		LocalTTL:   10,
+		NoAutoPtr:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.addRecord("added.lan.", HostInfo{IP: net.ParseIP("10.0.0.3")})
+	query := func(name string) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypePTR)
+		resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	for _, name := range []string{"1.0.0.10.in-addr.arpa.", "3.0.0.10.in-addr.arpa."} {
+		if resp := query(name); resp.Rcode != dns.RcodeNameError || len(resp.Answer) != 0 {
+			t.Errorf("Expected the PTR query for %s to be forwarded, got %v", name, resp)
+		}
+	}
+	if forwarded != 2 {
+		t.Error("Expected 2 forwarded PTR queries, got", forwarded)
+	}
+	if resp := query("2.0.0.10.in-addr.arpa."); len(resp.Answer) != 1 || resp.Answer[0].(*dns.PTR).Ptr != "explicit.lan." {
+		t.Error("Expected the PTR record from the zone file, got", resp.Answer)
+	}
+}
+
+func TestCatchAll(t *testing.T) {
+	records, _, err := parseHostsScanner(bufio.NewScanner(strings.NewReader("10.0.0.1 host.lan\nNXDOMAIN blocked.example\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone, err := parseAuthZone("lan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := Proxy{
+		records:     records,
+		localTTL:    10,
+		authZones:   []authZone{zone},
+		catchAllIPs: []net.IP{net.ParseIP("192.168.1.1")},
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			t.Error("Unexpected upstream query for", req.Question[0].Name)
+			return replyA(req), nil
+		}),
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	query := func(name string, qtype uint16) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		resp, err := proxy.respondToRequest(context.Background(), msg, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := query("example.com.", dns.TypeA); len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "192.168.1.1" {
+		t.Error("Expected the catch-all address for an unknown name, got", resp.Answer)
+	}
+	if resp := query("example.com.", dns.TypeAAAA); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || len(resp.Ns) != 1 {
+		t.Error("Expected NODATA for AAAA without an IPv6 catch-all address, got", resp)
+	}
+	if resp := query("example.com.", dns.TypeMX); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		t.Error("Expected NODATA for other types, got", resp)
+	}
+	if resp := query("host.lan.", dns.TypeA); len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Error("Expected the local record for a local name, got", resp.Answer)
+	}
+	if resp := query("missing.lan.", dns.TypeA); resp.Rcode != dns.RcodeNameError {
+		t.Error("Expected NXDOMAIN for a missing name in an authoritative zone, got", dns.RcodeToString[resp.Rcode])
+	}
+	if resp := query("blocked.example.", dns.TypeA); resp.Rcode != dns.RcodeNameError {
+		t.Error("Expected blocked names to stay blocked, got", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestNoRecursion(t *testing.T) {
+	records, _, err := parseHostsScanner(bufio.NewScanner(strings.NewReader("10.0.0.1 host.lan\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwarded := 0
+	proxy := Proxy{
+		records:  records,
+		localTTL: 10,
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			forwarded++
+			return replyA(req), nil
+		}),
+	}
+	query := func(name string) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		msg.RecursionDesired = false
+		resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := query("host.lan."); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Error("Expected local names to be answered without recursion, got", resp)
+	}
+	if resp := query("unknown.example."); resp.Rcode != dns.RcodeRefused || len(resp.Answer) != 0 {
+		t.Error("Expected REFUSED for an unknown name by default, got", dns.RcodeToString[resp.Rcode])
+	}
+	for name, expected := range map[string]int{"empty": dns.RcodeSuccess, "nxdomain": dns.RcodeNameError} {
+		proxy.norecursion = norecursionResponses[name]
+		if resp := query("unknown.example."); resp.Rcode != expected || len(resp.Answer) != 0 {
+			t.Errorf("Expected %s with %s, got %s", dns.RcodeToString[expected], name, dns.RcodeToString[resp.Rcode])
+		}
+	}
+	if forwarded != 0 {
+		t.Error("Expected no queries to be forwarded, got", forwarded)
+	}
+	proxy.norecursion = norecursionForward
+	if resp := query("unknown.example."); len(resp.Answer) != 1 || forwarded != 1 {
+		t.Error("Expected the query to be forwarded, got", resp)
+	}
+}
+
+func TestLocalTruncation(t *testing.T) {
+	records := make(map[string][]HostInfo)
+	for i := 0; i < 50; i++ {
+		records["many."] = append(records["many."], HostInfo{IP: net.IPv4(10, 0, 0, byte(i))})
+	}
+	proxy := &Proxy{records: records, localTTL: 10, udpSize: 1232}
+	addr := startStubServer(t, proxy.ServeDNS)
+	startTcpStubServer(t, addr, proxy.ServeDNS)
+
+	tests := []struct {
+		net       string
+		edns      uint16
+		truncated bool
+		maxSize   int
+	}{
+		{"udp", 0, true, 512},
+		{"udp", 4096, false, 1232},
+		{"udp", 700, true, 700},
+		{"tcp", 0, false, dns.MaxMsgSize},
+	}
+	for _, test := range tests {
+		msg := new(dns.Msg)
+		msg.SetQuestion("many.", dns.TypeA)
+		if test.edns != 0 {
+			msg.SetEdns0(test.edns, false)
+		}
+		client := &dns.Client{Net: test.net, UDPSize: dns.MaxMsgSize}
+		resp, _, err := client.Exchange(msg, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Measure the response as it was sent, which may have been compressed.
+		resp.Compress = true
+		if resp.Truncated != test.truncated || resp.Len() > test.maxSize {
+			t.Errorf("Expected truncated=%t and at most %d bytes over %s with EDNS size %d, got truncated=%t and %d bytes",
+				test.truncated, test.maxSize, test.net, test.edns, resp.Truncated, resp.Len())
+		}
+		if !test.truncated && len(resp.Answer) != 50 {
+			t.Error("Expected all answers, got", len(resp.Answer))
+		}
+	}
+}
+
+func TestClampTTLs(t *testing.T) {
+	proxy := Proxy{
+		records:  map[string][]HostInfo{"host1.": {{IP: net.ParseIP("10.0.0.1")}}},
+		localTTL: 10,
+		minTTL:   30,
+		maxTTL:   3600,
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			rr, _ := dns.NewRR(req.Question[0].Name + " 86400 A 1.2.3.4")
+			m.Answer = append(m.Answer, rr)
+			m.SetEdns0(4096, true)
+			return m, nil
+		}),
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+
+	for name, ttl := range map[string]uint32{"host1.": 30, "example.com.": 3600} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		resp, err := proxy.respondToRequest(context.Background(), msg, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != ttl {
+			t.Errorf("Expected TTL %d for %s, got %v", ttl, name, resp.Answer)
+		}
+		if opt := resp.IsEdns0(); opt != nil && !opt.Do() {
+			t.Error("The OPT record's flags were changed:", opt)
+		}
+	}
+}
+
+func TestLocalCNameChain(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader("10.0.0.5 service\n@service alias\n@alias alias2\n@b a\n@a b\n@self self\n"))
+	records, _, err := parseHostsScanner(scanner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := Proxy{
+		records:    records,
+		cnameCache: map[uint16]map[string]cacheEntry{dns.TypeA: {}, dns.TypeAAAA: {}},
+		localTTL:   10,
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			t.Error("Unexpected upstream query for", req.Question[0].Name)
+			return replyA(req), nil
+		}),
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("alias2.", dns.TypeA)
+	resp, err := proxy.respondToRequest(context.Background(), msg, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.0.0.5" || resp.Answer[0].Header().Name != "alias2." {
+		t.Error("Expected the local CNAME chain to be resolved locally, got", resp.Answer)
+	}
+	if !resp.Authoritative {
+		t.Error("Expected a locally resolved CNAME chain to be authoritative")
+	}
+
+	for _, name := range []string{"a.", "b.", "self."} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		resp, err := proxy.respondToRequest(context.Background(), msg, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 0 {
+			t.Errorf("Expected no answers for the CNAME loop at %s, got %v", name, resp.Answer)
+		}
+	}
+}
+
+func TestLocalCNAMETTL(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader("@example.com alias\n"))
+	records, _, err := parseHostsScanner(scanner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := Proxy{
+		records:    records,
+		cnameCache: map[uint16]map[string]cacheEntry{dns.TypeA: {}, dns.TypeAAAA: {}},
+		localTTL:   10,
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			return replyA(req), nil
+		}),
+	}
+	query := func() dns.RR {
+		msg := new(dns.Msg)
+		msg.SetQuestion("alias.", dns.TypeA)
+		resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].Header().Name != "alias." {
+			t.Fatal("Expected the CNAME target's address under the local name, got", resp.Answer)
+		}
+		return resp.Answer[0]
+	}
+
+	if rr := query(); rr.Header().Ttl != 60 {
+		t.Error("Expected the upstream TTL, got", rr)
+	}
+	proxy.localCNAMETTL = true
+	if rr := query(); rr.Header().Ttl != 10 {
+		t.Error("Expected the local TTL, got", rr)
+	}
+}
+
+func TestNew(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.hosts")
+	if err := os.WriteFile(path, []byte("10.0.0.1 host1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := New(Options{
+		Upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			return replyA(req), nil
+		}),
+		HostsFiles: []string{path},
+		LocalTTL:   10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]string{"host1.": "10.0.0.1", "example.com.": "1.2.3.4"} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != expected {
+			t.Errorf("Expected %s for %s, got %v", expected, name, resp.Answer)
+		}
+	}
+
+	if _, err := New(Options{UpstreamURL: "dns://1.1.1.1", PrefetchSiblings: true}); err == nil {
+		t.Error("Expected an error prefetching siblings without a cache")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	proxy := Proxy{
+		records:    map[string][]HostInfo{"host1.": {{IP: net.ParseIP("10.0.0.1")}}},
+		cnameCache: map[uint16]map[string]cacheEntry{dns.TypeA: {}, dns.TypeAAAA: {}},
+		localTTL:   10,
+		upstream: stubUpstream(func(req *dns.Msg, forwardedFor net.IP) (*dns.Msg, error) {
+			if !forwardedFor.Equal(net.ParseIP("10.0.0.2")) {
+				t.Error("Expected the client IP to be forwarded, got", forwardedFor)
+			}
+			return replyA(req), nil
+		}),
+	}
+	client := net.ParseIP("10.0.0.2")
+
+	resp, err := proxy.Resolve(context.Background(), dns.Question{Name: "host1.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Error("Expected the local record, got", resp.Answer)
+	}
+
+	resp, err = proxy.Resolve(context.Background(), dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+		t.Error("Expected the upstream answer, got", resp.Answer)
+	}
+}
+
+// otherAddr is a net.Addr of a type getForwardedFor doesn't know about.
+type otherAddr struct{}
+
+func (otherAddr) Network() string { return "other" }
+func (otherAddr) String() string  { return "other" }
+
+func TestUnknownAddrType(t *testing.T) {
+	proxy := Proxy{
+		records: make(map[string][]HostInfo),
+		upstream: stubUpstream(func(req *dns.Msg, forwardedFor net.IP) (*dns.Msg, error) {
+			if forwardedFor != nil {
+				t.Error("Expected no client IP to be forwarded, got", forwardedFor)
+			}
+			return replyA(req), nil
+		}),
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	resp, err := proxy.respondToRequest(context.Background(), msg, otherAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Error("Expected the upstream answer, got", resp.Answer)
+	}
+}
+
+func TestResolveCancel(t *testing.T) {
+	// A server that never answers.
+	addr := startStubServer(t, func(w dns.ResponseWriter, r *dns.Msg) {})
+	u, err := url.Parse("dns://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := NewUpstream(*u, UpstreamOptions{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := Proxy{
+		upstream: upstream,
+		records:  make(map[string][]HostInfo),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := proxy.Resolve(ctx, dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, nil); err == nil {
+		t.Error("Expected an error when the context is done")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Expected the query to stop when the context is done, took", elapsed)
+	}
+}
+
+func TestEmptyQuestion(t *testing.T) {
+	proxy := Proxy{
+		records: make(map[string][]HostInfo),
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			t.Error("Unexpected upstream query for a message without questions")
+			return nil, fmt.Errorf("unexpected query")
+		}),
+	}
+	msg := new(dns.Msg)
+	msg.Id = dns.Id()
+	msg.RecursionDesired = true
+	resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeFormatError {
+		t.Error("Expected FORMERR, got", dns.RcodeToString[resp.Rcode])
+	}
+	if resp.Id != msg.Id {
+		t.Error("Expected the reply to have the query's ID, got", resp.Id)
+	}
+}
+
+func TestUnsupportedOpcode(t *testing.T) {
+	proxy := Proxy{
+		records: make(map[string][]HostInfo),
+	}
+	for _, opcode := range []int{dns.OpcodeNotify, dns.OpcodeStatus, dns.OpcodeIQuery} {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeSOA)
+		msg.Opcode = opcode
+		resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Rcode != dns.RcodeNotImplemented {
+			t.Errorf("Expected NOTIMP for opcode %s, got %s", dns.OpcodeToString[opcode], dns.RcodeToString[resp.Rcode])
+		}
+	}
+}
+
+func TestHostsBlock(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader("NXDOMAIN ads.example.com\nREFUSED tracker.example.com\n"))
+	records, warnings, err := parseHostsScanner(scanner)
+	if err != nil || len(warnings) != 0 {
+		t.Fatal("Expected the block entries to parse, got", err, warnings)
+	}
+	// A local alias of a blocked name is blocked too.
+	records["alias.example.com."] = []HostInfo{{CName: "ads.example.com."}}
+	proxy := Proxy{
+		records:  records,
+		localTTL: 10,
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			t.Error("Unexpected upstream query for", req.Question[0].Name)
+			return replyA(req), nil
+		}),
+	}
+	proxy.indexRecords()
+	if len(proxy.local.rrs) != 0 {
+		t.Error("Expected no records indexed for blocked names, got", proxy.local.rrs)
+	}
+
+	for name, rcode := range map[string]int{"ads.example.com.": dns.RcodeNameError, "Tracker.Example.com.": dns.RcodeRefused, "alias.example.com.": dns.RcodeNameError} {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeTXT} {
+			msg := new(dns.Msg)
+			msg.SetQuestion(name, qtype)
+			resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Rcode != rcode || len(resp.Answer) != 0 {
+				t.Errorf("Expected %s for %s %s, got %s with %v", dns.RcodeToString[rcode], dns.TypeToString[qtype], name, dns.RcodeToString[resp.Rcode], resp.Answer)
+			}
+		}
+	}
+}
+
+func TestQueryDeadline(t *testing.T) {
+	// A server that never answers.
+	addr := startStubServer(t, func(w dns.ResponseWriter, r *dns.Msg) {})
+	u, err := url.Parse("dns://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := NewUpstream(*u, UpstreamOptions{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := Proxy{
+		upstream:      upstream,
+		records:       make(map[string][]HostInfo),
+		queryDeadline: 100 * time.Millisecond,
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	start := time.Now()
+	if _, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}); err == nil {
+		t.Error("Expected an error once the query deadline is exceeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Expected the query to stop at the deadline, took", elapsed)
+	}
+}
+
+func TestExtendedErrors(t *testing.T) {
+	records, _, err := parseHostsScanner(bufio.NewScanner(strings.NewReader("NXDOMAIN ads.example.com\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &Proxy{
+		records:  records,
+		localTTL: 10,
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			if req.Question[0].Name == "slow.example.com." {
+				return nil, context.DeadlineExceeded
+			}
+			return nil, errors.New("connection refused")
+		}),
+	}
+	addr := startStubServer(t, proxy.ServeDNS)
+
+	query := func(name string, edns bool) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		if edns {
+			msg.SetEdns0(1232, false)
+		}
+		resp, err := dns.Exchange(msg, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	extendedError := func(resp *dns.Msg) *dns.EDNS0_EDE {
+		if opt := resp.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if ede, ok := o.(*dns.EDNS0_EDE); ok {
+					return ede
+				}
+			}
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name  string
+		rcode int
+		code  uint16
+	}{
+		{"ads.example.com.", dns.RcodeNameError, dns.ExtendedErrorCodeBlocked},
+		{"down.example.com.", dns.RcodeServerFailure, dns.ExtendedErrorCodeNetworkError},
+		{"slow.example.com.", dns.RcodeServerFailure, dns.ExtendedErrorCodeNoReachableAuthority},
+	}
+	for _, test := range tests {
+		resp := query(test.name, true)
+		if ede := extendedError(resp); resp.Rcode != test.rcode || ede == nil || ede.InfoCode != test.code {
+			t.Errorf("Expected %s with extended error %d for %s, got %s with %v", dns.RcodeToString[test.rcode], test.code, test.name, dns.RcodeToString[resp.Rcode], ede)
+		}
+		if resp := query(test.name, false); resp.IsEdns0() != nil {
+			t.Error("Expected no OPT record for a query without EDNS, got", resp.IsEdns0())
+		}
+	}
+}
+
+func TestNormalizeAnswer(t *testing.T) {
+	proxy := Proxy{
+		records: make(map[string][]HostInfo),
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			for _, record := range []string{
+				"example.com. 60 CNAME WWW.Example.NET.",
+				"EXAMPLE.com. 60 CNAME WWW.Example.NET.",
+				"WWW.Example.NET. 60 A 1.2.3.4",
+				"www.example.net. 30 A 1.2.3.4",
+				"www.example.net. 60 A 1.2.3.5",
+			} {
+				rr, err := dns.NewRR(record)
+				if err != nil {
+					return nil, err
+				}
+				m.Answer = append(m.Answer, rr)
+			}
+			return m, nil
+		}),
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("Example.COM.", dns.TypeA)
+	resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"Example.COM.", "www.example.net.", "www.example.net."}
+	if len(resp.Answer) != len(expected) {
+		t.Fatal("Expected the duplicates to be removed, got", resp.Answer)
+	}
+	for i, name := range expected {
+		if resp.Answer[i].Header().Name != name {
+			t.Errorf("Expected owner name %s, got %s", name, resp.Answer[i].Header().Name)
+		}
+	}
+	if target := resp.Answer[0].(*dns.CNAME).Target; target != "WWW.Example.NET." {
+		t.Error("Expected record data to be left alone, got", target)
+	}
+}
+
+func TestTTLJitter(t *testing.T) {
+	proxy := Proxy{
+		records:   map[string][]HostInfo{"host1.": {{IP: net.ParseIP("10.0.0.1")}}},
+		localTTL:  100,
+		ttlJitter: 20,
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			return replyA(req), nil
+		}),
+	}
+	proxy.cache = newResponseCache(10, &proxy.cacheStats)
+
+	for name, ttl := range map[string]uint32{"host1.": 100, "example.com.": 60} {
+		seen := make(map[uint32]bool)
+		for i := 0; i < 50; i++ {
+			msg := new(dns.Msg)
+			msg.SetQuestion(name, dns.TypeA)
+			resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := resp.Answer[0].Header().Ttl
+			if got < ttl*8/10 || got > ttl*12/10 {
+				t.Errorf("Expected the TTL for %s within 20%% of %d, got %d", name, ttl, got)
+			}
+			seen[got] = true
+		}
+		if len(seen) < 2 {
+			t.Error("Expected the TTL for", name, "to vary, got", seen)
+		}
+	}
+}
+
+func TestServeUnixSocket(t *testing.T) {
+	proxy := &Proxy{
+		records:  map[string][]HostInfo{"host1.": {{IP: net.ParseIP("10.0.0.1")}}},
+		localTTL: 10,
+	}
+	dir := t.TempDir()
+
+	for _, network := range []string{"unix", "unixgram"} {
+		path := filepath.Join(dir, network+".sock")
+		server := &dns.Server{Handler: proxy}
+		var err error
+		if network == "unixgram" {
+			server.PacketConn, err = net.ListenPacket(network, path)
+		} else {
+			server.Listener, err = net.Listen(network, path)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+		go server.ActivateAndServe()
+		<-started
+		t.Cleanup(func() { server.Shutdown() })
+
+		// Datagram clients need an address of their own for the reply.
+		var conn net.Conn
+		if network == "unixgram" {
+			conn, err = net.DialUnix(network, &net.UnixAddr{Name: filepath.Join(dir, "client.sock"), Net: network}, &net.UnixAddr{Name: path, Net: network})
+		} else {
+			conn, err = net.Dial(network, path)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+
+		dnsConn := &dns.Conn{Conn: conn}
+		msg := new(dns.Msg)
+		msg.SetQuestion("host1.", dns.TypeA)
+		if err := dnsConn.WriteMsg(msg); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := dnsConn.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+			t.Errorf("Expected the local record over %s, got %v", network, resp.Answer)
+		}
+	}
+}
+
+func TestRebindProtect(t *testing.T) {
+	answers := map[string][]string{
+		"public.example.":   {"93.184.216.34", "10.0.0.1"},
+		"lan.example.":      {"192.168.1.1", "127.0.0.1", "169.254.0.1"},
+		"v6.example.":       {"2001:db8::1", "fd00::1", "fe80::1", "::1", "::ffff:10.0.0.1"},
+		"nas.corp.example.": {"10.0.0.2"},
+	}
+	proxy, err := New(Options{
+		Upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			for _, addr := range answers[req.Question[0].Name] {
+				rr, _ := dns.NewRR(fmt.Sprintf("%s 60 %s %s", req.Question[0].Name, dns.TypeToString[req.Question[0].Qtype], addr))
+				m.Answer = append(m.Answer, rr)
+			}
+			return m, nil
+		}),
+		LocalTTL:         10,
+		RebindProtect:    true,
+		RebindExceptions: []string{"corp.example"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		qtype    uint16
+		expected []string
+	}{
+		{"public.example.", dns.TypeA, []string{"93.184.216.34"}},
+		{"lan.example.", dns.TypeA, nil},
+		{"v6.example.", dns.TypeAAAA, []string{"2001:db8::1"}},
+		{"nas.corp.example.", dns.TypeA, []string{"10.0.0.2"}},
+	} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(test.name, test.qtype)
+		resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, rr := range resp.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				got = append(got, rr.A.String())
+			case *dns.AAAA:
+				got = append(got, rr.AAAA.String())
+			}
+		}
+		if resp.Rcode != dns.RcodeSuccess || !slices.Equal(got, test.expected) {
+			t.Errorf("Expected %v for %s, got %s %v", test.expected, test.name, dns.RcodeToString[resp.Rcode], got)
+		}
+	}
+}
+
+func TestTypePolicies(t *testing.T) {
+	records, _, err := parseHostsScanner(bufio.NewScanner(strings.NewReader("10.0.0.1 host.lan\nfd00::1 host.lan\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := Proxy{
+		records:      records,
+		localTTL:     10,
+		typePolicies: make(map[string]map[uint16]typePolicy),
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			rr, _ := dns.NewRR(req.Question[0].Name + " 60 " + dns.TypeToString[req.Question[0].Qtype] + " 2001:db8::1")
+			m.Answer = append(m.Answer, rr)
+			return m, nil
+		}),
+	}
+	for _, s := range []string{"host.lan:AAAA=forward", "Other.lan:aaaa=nodata", "host.lan:MX=local"} {
+		name, qtype, policy, err := parseTypePolicy(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proxy.typePolicies[name] == nil {
+			proxy.typePolicies[name] = make(map[uint16]typePolicy)
+		}
+		proxy.typePolicies[name][qtype] = policy
+	}
+	for _, s := range []string{"host.lan=nodata", "host.lan:BOGUS=nodata", "host.lan:A=drop"} {
+		if _, _, _, err := parseTypePolicy(s); err == nil {
+			t.Error("Expected an error parsing", s)
+		}
+	}
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	if resp := query("host.lan.", dns.TypeA); len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Error("Expected the local A record without a policy, got", resp.Answer)
+	}
+	if resp := query("host.lan.", dns.TypeAAAA); len(resp.Answer) != 1 || resp.Answer[0].(*dns.AAAA).AAAA.String() != "2001:db8::1" {
+		t.Error("Expected AAAA to be forwarded, got", resp.Answer)
+	}
+	if resp := query("other.lan.", dns.TypeAAAA); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || len(resp.Ns) != 1 {
+		t.Error("Expected NODATA for a nodata policy, got", resp)
+	}
+	if resp := query("host.lan.", dns.TypeMX); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || len(resp.Ns) != 1 {
+		t.Error("Expected NODATA for a local policy without local records, got", resp)
+	}
+}
+
+func TestNoAAAA(t *testing.T) {
+	records, _, err := parseHostsScanner(bufio.NewScanner(strings.NewReader("10.0.0.1 host.lan\nfd00::1 host.lan\nfd00::2 kept.lan\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwarded := 0
+	proxy := Proxy{
+		records:      records,
+		localTTL:     10,
+		noAAAA:       true,
+		typePolicies: map[string]map[uint16]typePolicy{"kept.lan.": {dns.TypeAAAA: policyLocal}},
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			forwarded++
+			return replyA(req), nil
+		}),
+	}
+	query := func(name string, qtype uint16) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	for _, name := range []string{"host.lan.", "example.com."} {
+		resp := query(name, dns.TypeAAAA)
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeSOA {
+			t.Error("Expected NODATA with a SOA for AAAA queries for", name, "got", resp)
+		}
+	}
+	if forwarded != 0 {
+		t.Error("Expected AAAA queries not to be forwarded, got", forwarded)
+	}
+	if resp := query("host.lan.", dns.TypeA); len(resp.Answer) != 1 {
+		t.Error("Expected A queries to be answered as usual, got", resp.Answer)
+	}
+	if resp := query("kept.lan.", dns.TypeAAAA); len(resp.Answer) != 1 || resp.Answer[0].(*dns.AAAA).AAAA.String() != "fd00::2" {
+		t.Error("Expected a name's own AAAA policy to win, got", resp.Answer)
+	}
+}
+
+func TestPreferFamily(t *testing.T) {
+	records, _, err := parseHostsScanner(bufio.NewScanner(strings.NewReader("10.0.0.1 host.lan\nfd00::1 host.lan\nfd00::2 v6only.lan\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := Proxy{
+		records:      records,
+		localTTL:     10,
+		preferFamily: familyV4,
+	}
+	query := func(name string, qtype uint16) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := query("host.lan.", dns.TypeA); len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != 10 {
+		t.Error("Expected the preferred family to keep its TTL, got", resp.Answer)
+	}
+	if resp := query("host.lan.", dns.TypeAAAA); len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != 5 {
+		t.Error("Expected the other family to get half the TTL, got", resp.Answer)
+	}
+	if resp := query("v6only.lan.", dns.TypeAAAA); len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != 10 {
+		t.Error("Expected names without addresses of both families to be left alone, got", resp.Answer)
+	}
+
+	proxy.preferFamilyNoData = 100
+	if resp := query("host.lan.", dns.TypeAAAA); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || len(resp.Ns) != 1 {
+		t.Error("Expected NODATA for the other family, got", resp)
+	}
+	if resp := query("host.lan.", dns.TypeA); len(resp.Answer) != 1 {
+		t.Error("Expected the preferred family to be answered, got", resp.Answer)
+	}
+}
+
+func TestMaxAnswers(t *testing.T) {
+	var hosts strings.Builder
+	for i := 1; i <= 20; i++ {
+		fmt.Fprintf(&hosts, "10.0.0.%d many.lan\n10.0.1.1 name%d.lan\n", i, i)
+	}
+	records, _, err := parseHostsScanner(bufio.NewScanner(strings.NewReader(hosts.String())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := Proxy{
+		records:    records,
+		localTTL:   10,
+		maxAnswers: 5,
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			for i := range 10 {
+				m.Answer = append(m.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.IPv4(1, 2, 3, byte(i)),
+				})
+			}
+			return m, nil
+		}),
+	}
+	query := func(name string, qtype uint16, client net.Addr) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		resp, err := proxy.respondToRequest(context.Background(), msg, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	udp := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+
+	for _, q := range []dns.Question{
+		{Name: "many.lan.", Qtype: dns.TypeA},
+		{Name: "1.1.0.10.in-addr.arpa.", Qtype: dns.TypePTR},
+		{Name: "example.com.", Qtype: dns.TypeA},
+	} {
+		if resp := query(q.Name, q.Qtype, udp); len(resp.Answer) != 5 || !resp.Truncated {
+			t.Error("Expected 5 answers with TC set for", q.Name, "got", len(resp.Answer), resp.Truncated)
+		}
+	}
+	if resp := query("many.lan.", dns.TypeA, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}); len(resp.Answer) != 20 || resp.Truncated {
+		t.Error("Expected all answers over TCP, got", len(resp.Answer), resp.Truncated)
+	}
+	resp, err := proxy.Resolve(context.Background(), dns.Question{Name: "many.lan.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, net.ParseIP("10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 20 || resp.Truncated {
+		t.Error("Expected all answers from Resolve, got", len(resp.Answer), resp.Truncated)
+	}
+	if resp := query("name1.lan.", dns.TypeA, udp); len(resp.Answer) != 1 || resp.Truncated {
+		t.Error("Expected short answers to be left alone, got", resp)
+	}
+}
+
+func TestSortSubnets(t *testing.T) {
+	records, _, err := parseHostsScanner(bufio.NewScanner(strings.NewReader("10.1.0.1 host.lan\n10.2.0.1 host.lan\n10.3.0.1 host.lan\n@host.lan alias.lan\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sortSubnets []*net.IPNet
+	for _, cidr := range []string{"10.1.0.0/16", "10.2.0.0/16"} {
+		_, subnet, _ := net.ParseCIDR(cidr)
+		sortSubnets = append(sortSubnets, subnet)
+	}
+	proxy := Proxy{
+		records:     records,
+		cnameCache:  map[uint16]map[string]cacheEntry{dns.TypeA: {}, dns.TypeAAAA: {}},
+		localTTL:    10,
+		sortSubnets: sortSubnets,
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			for _, ip := range []string{"10.3.0.2", "10.2.0.2", "10.1.0.2"} {
+				m.Answer = append(m.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.ParseIP(ip).To4(),
+				})
+			}
+			return m, nil
+		}),
+	}
+	first := func(name, client string) string {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP(client), Port: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rr := range resp.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				return a.A.String()
+			}
+		}
+		return ""
+	}
+
+	for client, expected := range map[string]string{"10.1.5.5": "10.1.0.1", "10.2.5.5": "10.2.0.1", "192.168.1.1": "10.1.0.1", "10.3.5.5": "10.1.0.1"} {
+		if ip := first("host.lan.", client); ip != expected {
+			t.Errorf("Expected %s first for a client at %s, got %s", expected, client, ip)
+		}
+	}
+	if ip := first("alias.lan.", "10.2.5.5"); ip != "10.2.0.1" {
+		t.Error("Expected the client's subnet first behind a CNAME, got", ip)
+	}
+	for client, expected := range map[string]string{"10.1.5.5": "10.1.0.2", "10.2.5.5": "10.2.0.2", "192.168.1.1": "10.3.0.2"} {
+		if ip := first("example.com.", client); ip != expected {
+			t.Errorf("Expected %s first in a forwarded answer for a client at %s, got %s", expected, client, ip)
+		}
+	}
+}
+
+func TestTunneling(t *testing.T) {
+	for _, name := range []string{"www.example.com.", "ec2-54-123-45-67.eu-west-1.compute.amazonaws.com.", "f.e.d.c.b.a.9.8.7.6.5.4.3.2.1.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."} {
+		if score := tunnelingScore(name); score >= defaultTunnelingThreshold {
+			t.Errorf("Expected %s to score below the threshold, got %f", name, score)
+		}
+	}
+	tunneled := "nrbxg5dfmjwgy3dpeb3w64tmmqqgc3tfmqqgy4dfeb2gs3lfebzxi2lnmv4g.tunnel.example.com."
+	if score := tunnelingScore(tunneled); score <= defaultTunnelingThreshold {
+		t.Error("Expected base32 encoded data to score above the threshold, got", score)
+	}
+
+	forwarded := 0
+	proxy := Proxy{
+		records:            make(map[string][]HostInfo),
+		tunnelingThreshold: defaultTunnelingThreshold,
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			forwarded++
+			return replyA(req), nil
+		}),
+	}
+	query := func(name string) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeTXT)
+		resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := query(tunneled); resp.Rcode != dns.RcodeSuccess || forwarded != 1 {
+		t.Error("Expected flagged queries to be answered without blocking, got", resp.Rcode, forwarded)
+	}
+	proxy.blockTunneling = true
+	if resp := query(tunneled); resp.Rcode != dns.RcodeRefused || forwarded != 1 {
+		t.Error("Expected flagged queries to be refused with blocking, got", resp.Rcode, forwarded)
+	}
+	if resp := query("www.example.com."); resp.Rcode != dns.RcodeSuccess || forwarded != 2 {
+		t.Error("Expected other queries to be answered, got", resp.Rcode, forwarded)
+	}
+	if flagged := proxy.stats().TunnelingFlagged; flagged != 2 {
+		t.Error("Expected 2 flagged queries in the stats, got", flagged)
+	}
+}
+
+func TestFlattenCNAME(t *testing.T) {
+	proxy := Proxy{
+		records:      make(map[string][]HostInfo),
+		localTTL:     10,
+		flattenCNAME: true,
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			name := req.Question[0].Name
+			for _, s := range []string{
+				name + " 300 CNAME b.example.net.",
+				"b.example.net. 30 CNAME C.example.org.",
+				"c.example.org. 120 CNAME d.example.org.",
+				"d.example.org. 600 A 1.2.3.4",
+				"d.example.org. 10 A 1.2.3.5",
+				"d.example.org. 600 AAAA 2001:db8::1",
+			} {
+				rr, _ := dns.NewRR(s)
+				m.Answer = append(m.Answer, rr)
+			}
+			return m, nil
+		}),
+	}
+	query := func(dnssec bool) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion("a.example.com.", dns.TypeA)
+		if dnssec {
+			msg.SetEdns0(dns.DefaultMsgSize, true)
+		}
+		resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := query(false)
+	if len(resp.Answer) != 2 {
+		t.Fatal("Expected the chain to be flattened into 2 A records, got", resp)
+	}
+	for i, want := range []uint32{30, 10} {
+		a, ok := resp.Answer[i].(*dns.A)
+		if !ok || a.Hdr.Name != "a.example.com." || a.Hdr.Ttl != want {
+			t.Errorf("Expected an A record for a.example.com. with TTL %d, got %v", want, resp.Answer[i])
+		}
+	}
+
+	if resp := query(true); len(resp.Answer) != 6 {
+		t.Error("Expected answers to DNSSEC queries to be left alone, got", resp)
+	}
+	proxy.flattenCNAME = false
+	if resp := query(false); len(resp.Answer) != 6 {
+		t.Error("Expected the chain to be kept when disabled, got", resp)
+	}
+}
+
+func TestMinimalResponses(t *testing.T) {
+	proxy := Proxy{
+		records:          make(map[string][]HostInfo),
+		localTTL:         10,
+		minimalResponses: true,
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			name := req.Question[0].Name
+			if name == "missing.example.com." {
+				m.Rcode = dns.RcodeNameError
+				soa, _ := dns.NewRR("example.com. 60 SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 60")
+				m.Ns = append(m.Ns, soa)
+			} else {
+				a, _ := dns.NewRR(name + " 60 A 1.2.3.4")
+				ns, _ := dns.NewRR("example.com. 3600 NS ns1.example.com.")
+				glue, _ := dns.NewRR("ns1.example.com. 3600 A 5.6.7.8")
+				m.Answer = append(m.Answer, a)
+				m.Ns = append(m.Ns, ns)
+				m.Extra = append(m.Extra, glue)
+			}
+			m.SetEdns0(dns.DefaultMsgSize, false)
+			return m, nil
+		}),
+	}
+	query := func(name string) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := query("www.example.com.")
+	if len(resp.Answer) != 1 || len(resp.Ns) != 0 || len(resp.Extra) != 1 || resp.IsEdns0() == nil {
+		t.Error("Expected only the answer and the OPT record to be kept, got", resp)
+	}
+	resp = query("missing.example.com.")
+	if resp.Rcode != dns.RcodeNameError || len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Error("Expected negative answers to keep their SOA record, got", resp)
+	}
+
+	proxy.minimalResponses = false
+	if resp := query("www.example.com."); len(resp.Ns) != 1 || len(resp.Extra) != 2 {
+		t.Error("Expected the authority and additional sections to be kept when disabled, got", resp)
+	}
+}
+
+func TestStripTypes(t *testing.T) {
+	strippedTypes, err := parseStripTypes([]string{"https,SVCB", "TXT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseStripTypes([]string{"HTTPS,BOGUS"}); err == nil {
+		t.Error("Expected an error for an unknown type")
+	}
+	proxy := Proxy{
+		records:       make(map[string][]HostInfo),
+		localTTL:      10,
+		strippedTypes: strippedTypes,
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			name := req.Question[0].Name
+			switch req.Question[0].Qtype {
+			case dns.TypeHTTPS:
+				rr, _ := dns.NewRR(name + " 60 HTTPS 1 . alpn=h2")
+				m.Answer = append(m.Answer, rr)
+			case dns.TypeSVCB:
+				rr, _ := dns.NewRR(name + " 60 SVCB 1 . alpn=h2")
+				m.Answer = append(m.Answer, rr)
+			case dns.TypeTXT:
+				rr, _ := dns.NewRR(name + ` 60 TXT "hello"`)
+				m.Answer = append(m.Answer, rr)
+			case dns.TypeA:
+				a, _ := dns.NewRR(name + " 60 A 1.2.3.4")
+				svcb, _ := dns.NewRR("_dns." + name + " 60 SVCB 1 . alpn=dot")
+				m.Answer = append(m.Answer, a)
+				m.Extra = append(m.Extra, svcb)
+			case dns.TypeMX:
+				rr, _ := dns.NewRR(name + " 60 MX 10 mail." + name)
+				m.Answer = append(m.Answer, rr)
+			}
+			return m, nil
+		}),
+	}
+	query := func(name string, qtype uint16) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	for _, qtype := range []uint16{dns.TypeHTTPS, dns.TypeSVCB, dns.TypeTXT} {
+		resp := query("example.com.", qtype)
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeSOA {
+			t.Errorf("Expected NODATA with a SOA for a stripped %s answer, got %v", dns.TypeToString[qtype], resp)
+		}
+	}
+	if resp := query("example.com.", dns.TypeA); len(resp.Answer) != 1 || len(resp.Extra) != 0 || len(resp.Ns) != 0 {
+		t.Error("Expected the SVCB record to be stripped from the additional section only, got", resp)
+	}
+	if resp := query("example.com.", dns.TypeMX); len(resp.Answer) != 1 || len(resp.Ns) != 0 {
+		t.Error("Expected other types to be kept, got", resp)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	var schedules []nameSchedule
+	for _, spec := range []string{"games.example=16:00-20:00", "*=07:00-22:30", "night.example=22:00-06:00,12:00-13:00"} {
+		schedule, err := parseSchedule(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		schedules = append(schedules, schedule)
+	}
+	for _, spec := range []string{"games.example", "games.example=16:00", "games.example=4pm-8pm", "=16:00-20:00"} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Error("Expected an error parsing", spec)
+		}
+	}
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("No time zone data:", err)
+	}
+	var now time.Time
+	proxy := Proxy{
+		records:          make(map[string][]HostInfo),
+		schedules:        schedules,
+		scheduleLocation: location,
+		now:              func() time.Time { return now },
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			return replyA(req), nil
+		}),
+	}
+
+	tests := []struct {
+		name    string
+		time    string
+		blocked bool
+	}{
+		{"www.games.example.", "17:00", false},
+		{"www.games.example.", "21:00", true},
+		{"other.example.", "21:00", false},
+		{"other.example.", "23:00", true},
+		{"night.example.", "23:00", false},
+		{"night.example.", "05:59", false},
+		{"night.example.", "12:30", false},
+		{"night.example.", "09:00", true},
+	}
+	for _, test := range tests {
+		local, _ := time.ParseInLocation("15:04", test.time, location)
+		// The clock is in UTC, the schedule in New York time.
+		now = local.UTC()
+		msg := new(dns.Msg)
+		msg.SetQuestion(test.name, dns.TypeA)
+		resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blocked := resp.Rcode == dns.RcodeNameError; blocked != test.blocked {
+			t.Errorf("Expected %s at %s to be blocked: %t, got %s", test.name, test.time, test.blocked, dns.RcodeToString[resp.Rcode])
+		}
+	}
+}
+
+func TestCheckUpstream(t *testing.T) {
+	rcode := dns.RcodeSuccess
+	proxy := Proxy{
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			if req.Question[0].Name != "canary.example." || req.Question[0].Qtype != dns.TypeA {
+				t.Error("Unexpected canary query", req.Question[0])
+			}
+			if rcode < 0 {
+				return nil, errors.New("unreachable")
+			}
+			m := new(dns.Msg)
+			m.SetRcode(req, rcode)
+			return m, nil
+		}),
+	}
+	for _, test := range []struct {
+		rcode int
+		ok    bool
+	}{
+		{dns.RcodeSuccess, true},
+		{dns.RcodeNameError, true},
+		{dns.RcodeServerFailure, false},
+		{-1, false},
+	} {
+		rcode = test.rcode
+		if err := proxy.CheckUpstream(context.Background(), "canary.example"); (err == nil) != test.ok {
+			t.Errorf("Expected the check to succeed: %v with rcode %d, got %v", test.ok, test.rcode, err)
+		}
+	}
+}
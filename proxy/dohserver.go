@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+)
+
+// DohPath is where DoH queries are served, as suggested by RFC 8484.
+const DohPath = "/dns-query"
+
+// DohHandler returns an HTTP handler serving DNS over HTTPS queries on
+// DohPath, as GET requests with a base64url encoded dns parameter or POST
+// requests with an application/dns-message body. Queries are answered just
+// like those over plain DNS.
+func (p *Proxy) DohHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(DohPath, func(w http.ResponseWriter, r *http.Request) {
+		var buf []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != "application/dns-message" {
+				http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			buf, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid query: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(buf); err != nil {
+			http.Error(w, fmt.Sprintf("invalid query: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+
+		dw := &dohResponseWriter{w: w, r: r}
+		p.ServeDNS(dw, req)
+		if dw.err != nil {
+			http.Error(w, dw.err.Error(), http.StatusInternalServerError)
+		}
+	})
+	return mux
+}
+
+// dohResponseWriter is a dns.ResponseWriter writing responses to a DoH query.
+// Like a TCP connection, it takes responses of any size.
+type dohResponseWriter struct {
+	w   http.ResponseWriter
+	r   *http.Request
+	err error
+}
+
+func (d *dohResponseWriter) LocalAddr() net.Addr {
+	if addr, ok := d.r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
+
+func (d *dohResponseWriter) RemoteAddr() net.Addr {
+	addrPort, err := netip.ParseAddrPort(d.r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return net.TCPAddrFromAddrPort(addrPort)
+}
+
+func (d *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	buf, err := m.Pack()
+	if err != nil {
+		d.err = err
+		return err
+	}
+	// Let HTTP caches keep the response as long as its shortest TTL, per RFC 8484.
+	ttl := ^uint32(0)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				ttl = min(ttl, rr.Header().Ttl)
+			}
+		}
+	}
+	if ttl != ^uint32(0) {
+		d.w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+	_, err = d.Write(buf)
+	return err
+}
+
+func (d *dohResponseWriter) Write(buf []byte) (int, error) {
+	d.w.Header().Set("Content-Type", "application/dns-message")
+	return d.w.Write(buf)
+}
+
+func (d *dohResponseWriter) Close() error        { return nil }
+func (d *dohResponseWriter) TsigStatus() error   { return nil }
+func (d *dohResponseWriter) TsigTimersOnly(bool) {}
+func (d *dohResponseWriter) Hijack()             {}
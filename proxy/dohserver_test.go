@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/miekg/dns"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDohServer(t *testing.T) {
+	records, _, err := parseHostsScanner(bufio.NewScanner(strings.NewReader("1.2.3.4 host.lan\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &Proxy{
+		records:  records,
+		localTTL: 10,
+	}
+	server := httptest.NewServer(proxy.DohHandler())
+	defer server.Close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("host.lan.", dns.TypeA)
+	buf, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(httpResp *http.Response, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer httpResp.Body.Close()
+		if httpResp.StatusCode != http.StatusOK || httpResp.Header.Get("Content-Type") != "application/dns-message" {
+			t.Fatal("Expected a DNS message, got", httpResp.Status, httpResp.Header.Get("Content-Type"))
+		}
+		if cacheControl := httpResp.Header.Get("Cache-Control"); cacheControl != "max-age=10" {
+			t.Error("Expected the response to be cacheable for its TTL, got", cacheControl)
+		}
+		body, err := io.ReadAll(httpResp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(body); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Id != msg.Id || len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+			t.Error("Expected the local record, got", resp)
+		}
+	}
+	check(http.Get(server.URL + DohPath + "?dns=" + base64.RawURLEncoding.EncodeToString(buf)))
+	check(http.Post(server.URL+DohPath, "application/dns-message", bytes.NewReader(buf)))
+
+	if resp, err := http.Get(server.URL + DohPath + "?dns=garbage"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Error("Expected 400 for an invalid query, got", resp, err)
+	}
+	if resp, err := http.Post(server.URL+DohPath, "text/plain", bytes.NewReader(buf)); err != nil || resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Error("Expected 415 for a query that isn't a DNS message, got", resp, err)
+	}
+}
+
+// writeTestCert writes a self-signed certificate for name and its key to
+// certFile and keyFile.
+func writeTestCert(t *testing.T, name, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if _, err := NewCertReloader(certFile, keyFile); err == nil {
+		t.Error("Expected an error for missing files")
+	}
+
+	writeTestCert(t, "old.example", certFile, keyFile)
+	certs, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commonName := func() string {
+		cert, err := certs.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.Leaf.Subject.CommonName
+	}
+	if name := commonName(); name != "old.example" {
+		t.Error("Expected the loaded certificate, got", name)
+	}
+
+	writeTestCert(t, "new.example", certFile, keyFile)
+	// Make sure the change shows in the modification time, however coarse.
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	if name := commonName(); name != "new.example" {
+		t.Error("Expected the renewed certificate to be loaded, got", name)
+	}
+
+	if err := os.WriteFile(certFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if name := commonName(); name != "new.example" {
+		t.Error("Expected the previous certificate to be kept when the new one is broken, got", name)
+	}
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// dumpSampleSize is how many records of each source are shown in dumps.
+const dumpSampleSize = 5
+
+// recordSource describes a file local records were loaded from.
+type recordSource struct {
+	Path string `json:"path"`
+	// Records in the file, and how many of them weren't already loaded from
+	// an earlier file.
+	Records int `json:"records"`
+	Added   int `json:"added"`
+	// The first few records, by name.
+	Sample []adminRecord `json:"sample"`
+}
+
+// newRecordSource describes the records loaded from path, added of which were new.
+func newRecordSource(path string, records map[string][]HostInfo, added int) recordSource {
+	names := make([]string, 0, len(records))
+	total := 0
+	for name, hosts := range records {
+		names = append(names, name)
+		total += len(hosts)
+	}
+	sort.Strings(names)
+	source := recordSource{Path: path, Records: total, Added: added, Sample: []adminRecord{}}
+	for _, name := range names {
+		for _, host := range records[name] {
+			if len(source.Sample) == dumpSampleSize {
+				return source
+			}
+			source.Sample = append(source.Sample, newAdminRecord(name, host))
+		}
+	}
+	return source
+}
+
+// Dump is the effective configuration of a proxy and what it loaded, for debugging.
+type Dump struct {
+	Config Options `json:"config"`
+	// The type of the upstream, and its URL.
+	Upstream string `json:"upstream"`
+	// The files local records were loaded from, in loading order.
+	Sources []recordSource `json:"sources"`
+	// Names with local records now, including those added at runtime.
+	Names int `json:"names"`
+	// The PTR records served from the local records, by reverse name.
+	PtrRecords map[string][]string `json:"ptr_records"`
+}
+
+// Dump returns the effective configuration of p and a summary of its local
+// records. Passwords in upstream URLs are redacted.
+func (p *Proxy) Dump() Dump {
+	config := p.options
+	config.UpstreamURL = redactURL(config.UpstreamURL)
+	config.UpstreamURLs = nil
+	for _, upstreamURL := range p.options.UpstreamURLs {
+		config.UpstreamURLs = append(config.UpstreamURLs, redactURL(upstreamURL))
+	}
+	config.UpstreamOptions.DohURITemplate = redactURL(config.UpstreamOptions.DohURITemplate)
+
+	var upstream string
+	if multi, ok := p.upstream.(*multiUpstream); ok {
+		upstreams := make([]string, len(multi.upstreams))
+		for i, u := range multi.upstreams {
+			upstreams[i] = fmt.Sprintf("%T %s", u.Upstream, u.stats.url)
+		}
+		strategy := StrategyRoundRobin
+		if multi.adaptive {
+			strategy = StrategyAdaptive
+		}
+		upstream = strategy + ": " + strings.Join(upstreams, ", ")
+	} else {
+		inner := p.upstream
+		if instrumented, ok := inner.(*instrumentedUpstream); ok {
+			inner = instrumented.Upstream
+		}
+		upstream = fmt.Sprintf("%T", inner)
+		if config.UpstreamURL != "" && p.options.Upstream == nil && !p.options.Recursive {
+			upstream += " " + config.UpstreamURL
+		}
+	}
+
+	idx := p.rlockIndex()
+	defer p.recordsMu.RUnlock()
+	ptrRecords := make(map[string][]string)
+	for name, types := range idx.rrs {
+		for _, rr := range types[dns.TypePTR] {
+			ptrRecords[name] = append(ptrRecords[name], rr.(*dns.PTR).Ptr)
+		}
+	}
+	return Dump{
+		Config:     config,
+		Upstream:   upstream,
+		Sources:    p.sources,
+		Names:      len(p.records),
+		PtrRecords: ptrRecords,
+	}
+}
+
+// redactURL replaces the password in rawURL, if any, with xxxxx.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// There's no telling where a password would be.
+		return "[redacted]"
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/miekg/dns"
+	"net"
+)
+
+var (
+	errQueryDeadline    = errors.New("query deadline exceeded")
+	errNotAuthenticated = errors.New("not authenticated")
+)
+
+// setExtendedError adds an extended DNS error (RFC 8914) with code and text
+// to resp, the response to r, telling the client why it got it. Clients that
+// didn't send an OPT record don't get one back, so they get no reason.
+func (p *Proxy) setExtendedError(r, resp *dns.Msg, code uint16, text string) {
+	if r.IsEdns0() == nil {
+		return
+	}
+	opt := resp.IsEdns0()
+	if opt == nil {
+		resp.SetEdns0(uint16(p.maxUdpSize(r)), dnssecOk(r))
+		opt = resp.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: code, ExtraText: text})
+}
+
+// extendedErrorFor returns the extended DNS error code and text for a
+// SERVFAIL caused by err, without the details of err, which may name the
+// upstreams.
+func extendedErrorFor(err error) (uint16, string) {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errNotAuthenticated):
+		return dns.ExtendedErrorCodeDNSSECIndeterminate, "upstream response not authenticated"
+	case errors.Is(err, errQueryDeadline), errors.Is(err, context.DeadlineExceeded):
+		return dns.ExtendedErrorCodeNoReachableAuthority, "upstream timed out"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return dns.ExtendedErrorCodeNoReachableAuthority, "upstream timed out"
+	case errors.Is(err, errTooManyQueries), errors.Is(err, errPoolExhausted):
+		return dns.ExtendedErrorCodeNetworkError, "upstream busy"
+	default:
+		return dns.ExtendedErrorCodeNetworkError, "upstream query failed"
+	}
+}
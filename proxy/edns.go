@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net/url"
+	"strconv"
+)
+
+// defaultUdpEdnsSize is the EDNS buffer size advertised to plain DNS
+// upstreams, small enough to avoid IP fragmentation (DNS flag day 2020).
+const defaultUdpEdnsSize = 1232
+
+// parseEdnsParams sets the EDNS buffer size and DO bit in opts from the
+// udpsize and do query parameters of u, as in dns://1.1.1.1?udpsize=1232&do=1,
+// and removes them from u, so that they aren't sent to DoH servers.
+func parseEdnsParams(u *url.URL, opts *UpstreamOptions) error {
+	query := u.Query()
+	if !query.Has("udpsize") && !query.Has("do") {
+		return nil
+	}
+	if query.Has("udpsize") {
+		size, err := strconv.ParseUint(query.Get("udpsize"), 10, 16)
+		if err != nil || size < dns.MinMsgSize {
+			return fmt.Errorf("invalid EDNS buffer size %q in upstream URL, expected %d to 65535", query.Get("udpsize"), dns.MinMsgSize)
+		}
+		opts.EdnsUDPSize = uint16(size)
+		query.Del("udpsize")
+	}
+	if query.Has("do") {
+		do, err := strconv.ParseBool(query.Get("do"))
+		if err != nil {
+			return fmt.Errorf("invalid DO bit %q in upstream URL, expected 0 or 1", query.Get("do"))
+		}
+		opts.EdnsDO = &do
+		query.Del("do")
+	}
+	u.RawQuery = query.Encode()
+	return nil
+}
+
+// setEdns sets the EDNS buffer size of msg to udpSize, unless it's 0, and its
+// DO bit to do, unless it's nil. An OPT record is only added to carry a DO
+// bit being set, and setEdns returns whether it added one.
+func setEdns(msg *dns.Msg, udpSize uint16, do *bool) bool {
+	opt := msg.IsEdns0()
+	addedOpt := false
+	if opt == nil {
+		if do == nil || !*do {
+			return false
+		}
+		msg.SetEdns0(dns.DefaultMsgSize, true)
+		opt = msg.IsEdns0()
+		addedOpt = true
+	}
+	if udpSize != 0 {
+		opt.SetUDPSize(udpSize)
+	}
+	if do != nil {
+		opt.SetDo(*do)
+	}
+	return addedOpt
+}
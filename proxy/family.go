@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"github.com/miekg/dns"
+	"log"
+	"math/rand/v2"
+)
+
+// addressFamily is the address family clients are biased toward when a
+// local name has addresses of both.
+type addressFamily int
+
+const (
+	// familyAny doesn't bias clients.
+	familyAny addressFamily = iota
+	familyV4
+	familyV6
+)
+
+var addressFamilies = map[string]addressFamily{
+	"v4": familyV4,
+	"v6": familyV6,
+}
+
+// qtype returns the address query type of the family.
+func (f addressFamily) qtype() uint16 {
+	if f == familyV6 {
+		return dns.TypeAAAA
+	}
+	return dns.TypeA
+}
+
+// dualStack returns whether records have both IPv4 and IPv6 addresses.
+func dualStack(records []HostInfo) bool {
+	v4, v6 := false, false
+	for _, record := range records {
+		if !record.IsIP() {
+			continue
+		}
+		if record.IP.To4() != nil {
+			v4 = true
+		} else {
+			v6 = true
+		}
+	}
+	return v4 && v6
+}
+
+// biasFamily biases clients toward the preferred address family, when
+// answering q with rrs for a name with local addresses of both: answers for
+// the other family get half the TTL, so clients come back for the preferred
+// one sooner, or are dropped for NODATA some percentage of the time. It
+// returns the records to answer with, and whether they were dropped.
+func (p *Proxy) biasFamily(q dns.Question, rrs []dns.RR) ([]dns.RR, bool) {
+	if p.preferFamily == familyAny || (q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA) ||
+		q.Qtype == p.preferFamily.qtype() || !dualStack(p.lookupRecords(q.Name)) {
+		return rrs, false
+	}
+	if p.preferFamilyNoData > 0 && rand.IntN(100) < p.preferFamilyNoData {
+		if p.verbose {
+			log.Printf(" -> answered with NODATA to prefer the other address family\n")
+		}
+		return nil, true
+	}
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		hdr.Ttl = max(hdr.Ttl/2, 1)
+	}
+	return rrs, false
+}
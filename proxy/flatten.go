@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"github.com/miekg/dns"
+	"log"
+	"strings"
+)
+
+// flattenCNAMEs replaces a CNAME chain in the answer to an A or AAAA query
+// with the addresses at its end, owned by the queried name, as if it had
+// them itself. Their TTL is the lowest along the chain, since the answer
+// stops being valid as soon as any link in it expires. Answers to DNSSEC
+// queries are left alone, since the rewritten records couldn't be validated,
+// and so are chains that don't end in addresses, like NXDOMAIN ones.
+func (p *Proxy) flattenCNAMEs(r, resp *dns.Msg) {
+	if !p.flattenCNAME || len(r.Question) != 1 || dnssecOk(r) {
+		return
+	}
+	q := r.Question[0]
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return
+	}
+
+	name := q.Name
+	ttl := ^uint32(0)
+	hops := 0
+	for hops <= len(resp.Answer) {
+		i := -1
+		for j, rr := range resp.Answer {
+			if _, ok := rr.(*dns.CNAME); ok && strings.EqualFold(rr.Header().Name, name) {
+				i = j
+				break
+			}
+		}
+		if i == -1 {
+			break
+		}
+		cname := resp.Answer[i].(*dns.CNAME)
+		ttl = min(ttl, cname.Hdr.Ttl)
+		name = cname.Target
+		hops++
+	}
+	if hops == 0 {
+		return
+	}
+
+	var flattened []dns.RR
+	for _, rr := range resp.Answer {
+		hdr := rr.Header()
+		if hdr.Rrtype != q.Qtype || !strings.EqualFold(hdr.Name, name) {
+			continue
+		}
+		rr = dns.Copy(rr)
+		hdr = rr.Header()
+		hdr.Name = q.Name
+		hdr.Ttl = min(hdr.Ttl, ttl)
+		flattened = append(flattened, rr)
+	}
+	if len(flattened) == 0 {
+		return
+	}
+	if p.verbose {
+		log.Printf("Flattened %d CNAMEs in the answer for %s\n", hops, q.Name)
+	}
+	resp.Answer = flattened
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"testing"
+)
+
+func FuzzParseHosts(f *testing.F) {
+	for _, seed := range []string{
+		"10.0.0.1 host.lan alias.lan\n",
+		"fd00::1\thost.lan # comment\n",
+		"@host.lan alias.lan\n",
+		"@\n",
+		"@ alias.lan\n",
+		"10.0.0.1 weighted.lan weight=3\n",
+		"NXDOMAIN ads.example\nREFUSED tracker.example\n",
+		"10.0.0.1 #\n",
+		"#only a comment\n\n   \n",
+		"10.0.0.1 bücher.example\n",
+		"bogus host.lan\n",
+		"0.0.0.0 .00\n",
+		"@a..b alias.lan\n",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Includes would read arbitrary files relative to the working directory.
+		if bytes.Contains(data, []byte("$INCLUDE")) {
+			t.Skip()
+		}
+		records, _, err := parseHostsScanner(bufio.NewScanner(bytes.NewReader(data)))
+		if err != nil {
+			// Only reading can fail, for lines too long for the scanner.
+			return
+		}
+		if records == nil {
+			t.Fatal("Expected a map of records")
+		}
+		for name, hosts := range records {
+			if _, ok := dns.IsDomainName(name); !ok || !strings.HasSuffix(name, ".") || strings.ToLower(name) != name {
+				t.Errorf("Expected valid canonical names, got %q", name)
+			}
+			if len(hosts) == 0 {
+				t.Errorf("Expected records for %q", name)
+			}
+			for _, host := range hosts {
+				kinds := 0
+				for _, is := range []bool{host.IsIP(), host.IsCName(), host.IsBlock()} {
+					if is {
+						kinds++
+					}
+				}
+				if kinds != 1 {
+					t.Errorf("Expected %q to have exactly one of an address, a CNAME or a block, got %+v", name, host)
+				}
+				if host.IsCName() && !strings.HasSuffix(host.CName, ".") {
+					t.Errorf("Expected a fully qualified CNAME target for %q, got %q", name, host.CName)
+				}
+			}
+		}
+		(&Proxy{records: records}).indexRecords()
+	})
+}
+
+// fuzzProxy returns a proxy with a bit of every kind of local data, and an
+// upstream answering every query with an address.
+func fuzzProxy(f *testing.F) *Proxy {
+	records, _, err := parseHostsScanner(bufio.NewScanner(strings.NewReader(
+		"10.0.0.1 host.lan\nfd00::1 host.lan\n@host.lan alias.lan\n@example.com external.lan\nNXDOMAIN blocked.lan\n")))
+	if err != nil {
+		f.Fatal(err)
+	}
+	zone, err := parseAuthZone("lan")
+	if err != nil {
+		f.Fatal(err)
+	}
+	delegation, err := parseDelegation("sub.lan=10.0.0.53")
+	if err != nil {
+		f.Fatal(err)
+	}
+	schedule, err := parseSchedule("scheduled.lan=00:00-00:00")
+	if err != nil {
+		f.Fatal(err)
+	}
+	_, rebindRange, _ := net.ParseCIDR("10.0.0.0/8")
+	return &Proxy{
+		records:       records,
+		zoneRecords:   make(rrIndex),
+		cnameCache:    map[uint16]map[string]cacheEntry{dns.TypeA: {}, dns.TypeAAAA: {}},
+		localTTL:      10,
+		authZones:     []authZone{zone},
+		delegations:   []subzoneDelegation{delegation},
+		typePolicies:  map[string]map[uint16]typePolicy{"host.lan.": {dns.TypeMX: policyLocal}},
+		schedules:     []nameSchedule{schedule},
+		updateZones:   []string{"lan."},
+		rebindRanges:  []*net.IPNet{rebindRange},
+		strippedTypes: map[uint16]bool{dns.TypeHTTPS: true},
+		cache:         newResponseCache(100, &cacheStats{}),
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			if len(req.Question) > 0 {
+				m.Answer = append(m.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.IPv4(1, 2, 3, 4),
+				})
+			}
+			return m, nil
+		}),
+	}
+}
+
+func FuzzRespond(f *testing.F) {
+	proxy := fuzzProxy(f)
+	// The catch-all answers everything without a local answer, taking
+	// different paths.
+	catchAllProxy := fuzzProxy(f)
+	catchAllProxy.catchAllIPs = []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("fd00::2")}
+	for _, name := range []string{"host.lan.", "alias.lan.", "external.lan.", "blocked.lan.", "missing.lan.", "www.sub.lan.", "1.0.0.10.in-addr.arpa.", "example.com.", "scheduled.lan.", "", "."} {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypePTR, dns.TypeMX, dns.TypeHTTPS, dns.TypeSOA, dns.TypeANY} {
+			f.Add(uint8(dns.OpcodeQuery), name, qtype, uint8(1), true, false)
+		}
+	}
+	f.Add(uint8(dns.OpcodeQuery), "host.lan.", dns.TypeA, uint8(0), true, false)
+	f.Add(uint8(dns.OpcodeQuery), "host.lan.", dns.TypeA, uint8(5), true, true)
+	f.Add(uint8(dns.OpcodeQuery), "example.com.", dns.TypeA, uint8(1), false, true)
+	f.Add(uint8(dns.OpcodeUpdate), "lan.", dns.TypeSOA, uint8(1), false, false)
+	f.Add(uint8(dns.OpcodeNotify), "lan.", dns.TypeSOA, uint8(1), false, false)
+	f.Add(uint8(15), "host.lan.", dns.TypeA, uint8(1), true, false)
+
+	f.Fuzz(func(t *testing.T, opcode uint8, name string, qtype uint16, questions uint8, rd, edns bool) {
+		req := new(dns.Msg)
+		req.Id = dns.Id()
+		req.Opcode = int(opcode & 0xf)
+		req.RecursionDesired = rd
+		for i := range int(questions % 8) {
+			// Vary the questions a bit when there are several.
+			req.Question = append(req.Question, dns.Question{Name: name, Qtype: qtype + uint16(i), Qclass: dns.ClassINET})
+		}
+		if edns {
+			req.SetEdns0(1232, true)
+		}
+		// Go through the wire format, as queries from clients do: names
+		// come out escaped, and queries that can't be sent are skipped.
+		packed, err := req.Pack()
+		if err != nil {
+			t.Skip()
+		}
+		req = new(dns.Msg)
+		if err := req.Unpack(packed); err != nil {
+			t.Skip()
+		}
+
+		for _, p := range []*Proxy{proxy, catchAllProxy} {
+			resp, err := p.respondToRequest(context.Background(), req.Copy(), &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+			if err != nil {
+				// Errors become SERVFAIL in ServeDNS.
+				continue
+			}
+			if resp == nil || !resp.Response || resp.Id != req.Id {
+				t.Fatalf("Expected a response to %v, got %v", req, resp)
+			}
+			if _, err := resp.Pack(); err != nil {
+				t.Fatalf("Expected a response that can be packed, got %s for %v", err, resp)
+			}
+		}
+	})
+}
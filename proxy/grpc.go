@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"dns-server/proxy/managementpb"
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// GRPCServer returns a gRPC server for the management API, defined in
+// managementpb/management.proto, which mirrors the admin HTTP API and adds
+// stats, reloads and live query logs. Every call must carry token as a bearer
+// token in its authorization metadata.
+func (p *Proxy) GRPCServer(token string) *grpc.Server {
+	authorize := func(ctx context.Context) error {
+		md, _ := metadata.FromIncomingContext(ctx)
+		auth := md.Get("authorization")
+		if len(auth) != 1 || subtle.ConstantTimeCompare([]byte(auth[0]), []byte("Bearer "+token)) != 1 {
+			return status.Error(codes.Unauthenticated, "unauthorized")
+		}
+		return nil
+	}
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := authorize(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := authorize(stream.Context()); err != nil {
+				return err
+			}
+			return handler(srv, stream)
+		}),
+	)
+	managementpb.RegisterManagementServer(server, &managementServer{p: p})
+	return server
+}
+
+// managementServer implements the gRPC management API for p.
+type managementServer struct {
+	managementpb.UnimplementedManagementServer
+	p *Proxy
+}
+
+func (s *managementServer) ListRecords(context.Context, *managementpb.ListRecordsRequest) (*managementpb.ListRecordsResponse, error) {
+	resp := &managementpb.ListRecordsResponse{}
+	s.p.recordsMu.RLock()
+	defer s.p.recordsMu.RUnlock()
+	for name, hosts := range s.p.records {
+		for _, host := range hosts {
+			record := newAdminRecord(name, host)
+			resp.Records = append(resp.Records, &managementpb.Record{
+				Name:  record.Name,
+				Ip:    record.IP,
+				Cname: record.CName,
+				Block: record.Block,
+				Ptr:   record.Ptr,
+			})
+		}
+	}
+	return resp, nil
+}
+
+func (s *managementServer) AddRecord(_ context.Context, req *managementpb.AddRecordRequest) (*managementpb.AddRecordResponse, error) {
+	record := req.GetRecord()
+	if record.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "invalid record: missing name")
+	}
+	name, err := canonicalHostName(record.GetName())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid record name: %s", err.Error())
+	}
+	hostInfo, err := adminRecord{IP: record.GetIp(), CName: record.GetCname(), Block: record.GetBlock(), Ptr: record.GetPtr()}.hostInfo()
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid record: %s", err.Error())
+	}
+	if _, err := s.p.addRecord(name, hostInfo); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "invalid record: %s", err.Error())
+	}
+	return &managementpb.AddRecordResponse{}, nil
+}
+
+func (s *managementServer) RemoveRecords(_ context.Context, req *managementpb.RemoveRecordsRequest) (*managementpb.RemoveRecordsResponse, error) {
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing record name")
+	}
+	name, err := canonicalHostName(req.GetName())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid record name: %s", err.Error())
+	}
+	if !s.p.removeRecords(name) {
+		return nil, status.Error(codes.NotFound, "no such record")
+	}
+	return &managementpb.RemoveRecordsResponse{}, nil
+}
+
+func (s *managementServer) GetStats(context.Context, *managementpb.GetStatsRequest) (*managementpb.Stats, error) {
+	stats := s.p.stats()
+	resp := &managementpb.Stats{
+		InFlight: stats.InFlight,
+		Rejected: stats.Rejected,
+		Cache: &managementpb.CacheStats{
+			Entries:   int64(stats.Cache.Entries),
+			Hits:      stats.Cache.Hits,
+			Misses:    stats.Cache.Misses,
+			Evictions: stats.Cache.Evictions,
+		},
+		TunnelingFlagged: stats.TunnelingFlagged,
+	}
+	for _, upstream := range stats.Upstreams {
+		resp.Upstreams = append(resp.Upstreams, &managementpb.UpstreamStats{
+			Url:           upstream.URL,
+			Requests:      upstream.Requests,
+			Errors:        upstream.Errors,
+			Servfails:     upstream.Servfails,
+			FailureRate:   upstream.FailureRate,
+			LatencyP50Ms:  upstream.LatencyP50Ms,
+			LatencyP95Ms:  upstream.LatencyP95Ms,
+			LatencyEwmaMs: upstream.LatencyEwmaMs,
+		})
+	}
+	return resp, nil
+}
+
+func (s *managementServer) Reload(ctx context.Context, _ *managementpb.ReloadRequest) (*managementpb.ReloadResponse, error) {
+	if s.p.database == nil {
+		return nil, status.Error(codes.FailedPrecondition, "no record database to reload")
+	}
+	if err := s.p.reloadDatabase(ctx, true); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &managementpb.ReloadResponse{}, nil
+}
+
+func (s *managementServer) StreamQueries(_ *managementpb.StreamQueriesRequest, stream grpc.ServerStreamingServer[managementpb.QueryLogEntry]) error {
+	entries, unsubscribe := s.p.queryLog.subscribe()
+	defer unsubscribe()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case entry := <-entries:
+			client := ""
+			if entry.client != nil {
+				client = entry.client.String()
+			}
+			err := stream.Send(&managementpb.QueryLogEntry{
+				Time:     timestamppb.New(entry.time),
+				Client:   client,
+				Name:     entry.name,
+				Type:     dns.TypeToString[entry.qtype],
+				Rcode:    dns.RcodeToString[entry.rcode],
+				Duration: durationpb.New(entry.duration),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"dns-server/proxy/managementpb"
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGRPCManagement(t *testing.T) {
+	proxy := &Proxy{
+		records:    make(map[string][]HostInfo),
+		cnameCache: make(map[uint16]map[string]cacheEntry),
+		localTTL:   1,
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := proxy.GRPCServer("secret")
+	go server.Serve(l)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := managementpb.NewManagementClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	wrongCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer wrong")
+	if _, err := client.ListRecords(wrongCtx, &managementpb.ListRecordsRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Error("Expected Unauthenticated with a wrong token, got", err)
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+
+	if _, err := client.AddRecord(ctx, &managementpb.AddRecordRequest{Record: &managementpb.Record{Name: "host1", Ip: "1.2.3.4"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.AddRecord(ctx, &managementpb.AddRecordRequest{Record: &managementpb.Record{Name: "host2", Ip: "1.2.3.4", Cname: "host1"}}); status.Code(err) != codes.InvalidArgument {
+		t.Error("Expected InvalidArgument for an invalid record, got", err)
+	}
+	records, err := client.ListRecords(ctx, &managementpb.ListRecordsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records.Records) != 1 || records.Records[0].Name != "host1." || records.Records[0].Ip != "1.2.3.4" {
+		t.Error("Expected the added record to be listed, got", records.Records)
+	}
+
+	stream, err := client.StreamQueries(ctx, &managementpb.StreamQueriesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for !proxy.queryLog.active() {
+		time.Sleep(time.Millisecond)
+	}
+	doh := httptest.NewServer(proxy.DohHandler())
+	defer doh.Close()
+	msg := new(dns.Msg)
+	msg.SetQuestion("host1.", dns.TypeA)
+	buf, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(doh.URL+DohPath, "application/dns-message", bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	entry, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Name != "host1." || entry.Type != "A" || entry.Rcode != "NOERROR" || entry.Client != "127.0.0.1" {
+		t.Error("Expected the query to be streamed, got", entry)
+	}
+
+	if _, err := client.RemoveRecords(ctx, &managementpb.RemoveRecordsRequest{Name: "a..b"}); status.Code(err) != codes.InvalidArgument {
+		t.Error("Expected InvalidArgument when removing an invalid name, got", err)
+	}
+	if _, err := client.RemoveRecords(ctx, &managementpb.RemoveRecordsRequest{Name: "HOST1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.RemoveRecords(ctx, &managementpb.RemoveRecordsRequest{Name: "host1"}); status.Code(err) != codes.NotFound {
+		t.Error("Expected NotFound when removing a missing record, got", err)
+	}
+	if ptrs := proxy.lookupLocal(dns.Question{Name: "4.3.2.1.in-addr.arpa.", Qtype: dns.TypePTR}); len(ptrs) != 0 {
+		t.Error("Expected the PTR record to be removed too, got", ptrs)
+	}
+
+	if _, err := client.AddRecord(ctx, &managementpb.AddRecordRequest{Record: &managementpb.Record{Name: "bücher.lan", Ip: "1.2.3.5"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.RemoveRecords(ctx, &managementpb.RemoveRecordsRequest{Name: "Bücher.lan"}); err != nil {
+		t.Error("Expected an IDN record to be removed by its Unicode name, got", err)
+	}
+	if hosts := proxy.lookupRecords("xn--bcher-kva.lan."); len(hosts) != 0 {
+		t.Error("Expected the IDN record to be removed, got", hosts)
+	}
+
+	if _, err := client.GetStats(ctx, &managementpb.GetStatsRequest{}); err != nil {
+		t.Error("Expected stats, got", err)
+	}
+	if _, err := client.Reload(ctx, &managementpb.ReloadRequest{}); status.Code(err) != codes.FailedPrecondition {
+		t.Error("Expected FailedPrecondition when reloading without a database, got", err)
+	}
+}
@@ -0,0 +1,307 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxIncludeDepth limits how deeply $INCLUDE directives can be nested.
+const maxIncludeDepth = 8
+
+// blockRcodes are the rcodes entries can block names with, by the keyword
+// used in place of an address.
+var blockRcodes = map[string]int{
+	"NXDOMAIN": dns.RcodeNameError,
+	"REFUSED":  dns.RcodeRefused,
+}
+
+// hostsWarning is a problem with a hosts file entry that caused it to be ignored.
+type hostsWarning struct {
+	file   string
+	line   int
+	reason string
+}
+
+func (w hostsWarning) String() string {
+	if w.file == "" {
+		return fmt.Sprintf("line %d: %s", w.line, w.reason)
+	}
+	return fmt.Sprintf("%s:%d: %s", w.file, w.line, w.reason)
+}
+
+type hostsParser struct {
+	records  map[string][]HostInfo
+	warnings []hostsWarning
+	// Files currently being parsed, used to detect include cycles.
+	including map[string]bool
+}
+
+func newHostsParser() *hostsParser {
+	return &hostsParser{
+		records:   make(map[string][]HostInfo),
+		including: make(map[string]bool),
+	}
+}
+
+// parseHostsScanner parses hosts entries from scanner. Entries that can't be
+// parsed are skipped, and returned as warnings.
+func parseHostsScanner(scanner *bufio.Scanner) (map[string][]HostInfo, []hostsWarning, error) {
+	p := newHostsParser()
+	err := p.parse(scanner, "", ".", 0)
+	return p.records, p.warnings, err
+}
+
+// parseHostsFile parses the hosts file at path, like parseHostsScanner.
+func parseHostsFile(path string) (map[string][]HostInfo, []hostsWarning, error) {
+	p := newHostsParser()
+	err := p.parseFile(path, 0)
+	return p.records, p.warnings, err
+}
+
+func (p *hostsParser) parseFile(path string, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("%s: includes nested deeper than %d levels", path, maxIncludeDepth)
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if p.including[absPath] {
+		return fmt.Errorf("%s: include cycle", path)
+	}
+
+	f, err := os.Open(absPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	p.including[absPath] = true
+	defer delete(p.including, absPath)
+
+	scanner := bufio.NewScanner(f)
+	return p.parse(scanner, path, filepath.Dir(absPath), depth)
+}
+
+// parse reads hosts entries from scanner, reading from file. Relative
+// $INCLUDE paths are resolved against dir.
+func (p *hostsParser) parse(scanner *bufio.Scanner, file string, dir string, depth int) error {
+	lineNumber := 0
+	warn := func(format string, args ...any) {
+		p.warnings = append(p.warnings, hostsWarning{file, lineNumber, fmt.Sprintf(format, args...)})
+	}
+
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		commentIndex := strings.Index(line, "#")
+		if commentIndex != -1 {
+			line = line[:commentIndex]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			warn("expected an address followed by host names, got %q", fields[0])
+			continue
+		}
+
+		destField := fields[0]
+
+		if destField == "$INCLUDE" {
+			includePath := strings.Join(fields[1:], " ")
+			if !filepath.IsAbs(includePath) {
+				includePath = filepath.Join(dir, includePath)
+			}
+			if err := p.parseFile(includePath, depth+1); err != nil {
+				return fmt.Errorf("including %s: %w", includePath, err)
+			}
+			continue
+		}
+		if destField == "PTR" {
+			p.parsePtr(fields[1:], warn)
+			continue
+		}
+
+		hostInfo := HostInfo{}
+		hosts, options := splitHostOptions(fields[1:])
+
+		if rcode, ok := blockRcodes[destField]; ok {
+			hostInfo.Block = rcode
+		} else if strings.HasPrefix(destField, "@") {
+			if destField == "@" {
+				warn("missing CNAME target after @")
+				continue
+			}
+			cname, err := cnameTarget(destField[1:])
+			if err != nil {
+				warn("invalid CNAME target %q: %s", destField[1:], err.Error())
+				continue
+			}
+			hostInfo.CName = cname
+		} else {
+			ip := net.ParseIP(destField)
+			if ip == nil {
+				warn("invalid IP address %q", destField)
+				continue
+			}
+			hostInfo.IP = ip
+		}
+
+		if weight, ok := options["weight"]; ok {
+			n, err := strconv.ParseUint(weight, 10, 32)
+			if err != nil || n == 0 {
+				warn("invalid weight %q, expected a positive integer", weight)
+				continue
+			}
+			if !hostInfo.IsIP() {
+				warn("weights only apply to addresses, not CNAMEs")
+				continue
+			}
+			hostInfo.Weight = uint32(n)
+		}
+		if len(hosts) == 0 {
+			warn("expected host names after %q", destField)
+			continue
+		}
+
+		for _, host := range hosts {
+			dnsName, err := canonicalHostName(host)
+			if err != nil {
+				warn("invalid host name %q: %s", host, err.Error())
+				continue
+			}
+			p.records[dnsName] = append(p.records[dnsName], hostInfo)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// parsePtr parses the fields of an explicit PTR entry, an address or reverse
+// name followed by the names it points to, and adds its records under the
+// reverse name.
+func (p *hostsParser) parsePtr(fields []string, warn func(format string, args ...any)) {
+	ip := net.ParseIP(fields[0])
+	if ip == nil {
+		ip = parseReverseAddr(fields[0])
+	}
+	if ip == nil {
+		warn("invalid PTR address or reverse name %q", fields[0])
+		return
+	}
+	if len(fields) < 2 {
+		warn("expected PTR target names after %q", fields[0])
+		return
+	}
+	reversed := reverseaddr(ip)
+	for _, target := range fields[1:] {
+		ptr, err := canonicalHostName(target)
+		if err != nil {
+			warn("invalid PTR target %q: %s", target, err.Error())
+			continue
+		}
+		p.records[reversed] = append(p.records[reversed], HostInfo{Ptr: ptr})
+	}
+}
+
+// systemHostsPath is the path of the operating system's hosts file.
+func systemHostsPath() string {
+	if runtime.GOOS == "windows" {
+		root := os.Getenv("SystemRoot")
+		if root == "" {
+			root = `C:\Windows`
+		}
+		return filepath.Join(root, "System32", "drivers", "etc", "hosts")
+	}
+	return "/etc/hosts"
+}
+
+// parseSystemHosts parses the operating system's hosts file at path, like
+// parseHostsFile. If skipLoopback is set, entries for loopback addresses
+// such as 127.0.0.1 localhost are left out.
+func parseSystemHosts(path string, skipLoopback bool) (map[string][]HostInfo, []hostsWarning, error) {
+	records, warnings, err := parseHostsFile(path)
+	if err != nil || !skipLoopback {
+		return records, warnings, err
+	}
+	for name, hosts := range records {
+		hosts = slices.DeleteFunc(hosts, func(h HostInfo) bool { return h.IsIP() && h.IP.IsLoopback() })
+		if len(hosts) == 0 {
+			delete(records, name)
+		} else {
+			records[name] = hosts
+		}
+	}
+	return records, warnings, nil
+}
+
+// splitHostOptions separates the host names of an entry from its key=value
+// options, such as weight=2.
+func splitHostOptions(fields []string) (hosts []string, options map[string]string) {
+	for _, field := range fields {
+		if key, value, ok := strings.Cut(field, "="); ok {
+			// Most entries have no options, so the map is only made when needed.
+			if options == nil {
+				options = make(map[string]string)
+			}
+			options[key] = value
+		} else {
+			hosts = append(hosts, field)
+		}
+	}
+	return hosts, options
+}
+
+// canonicalHostName converts a host name from an entry to the canonical,
+// fully qualified form records are keyed by.
+func canonicalHostName(host string) (string, error) {
+	asciiHost, err := toASCIIName(host)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := dns.IsDomainName(asciiHost); !ok {
+		return "", fmt.Errorf("not a domain name")
+	}
+	return dns.CanonicalName(asciiHost), nil
+}
+
+// cnameTarget converts the target of a CNAME entry to the fully qualified
+// form answers use, keeping its case.
+func cnameTarget(target string) (string, error) {
+	asciiTarget, err := toASCIIName(target)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := dns.IsDomainName(asciiTarget); !ok {
+		return "", fmt.Errorf("not a domain name")
+	}
+	return dns.Fqdn(asciiTarget), nil
+}
+
+// toASCIIName converts an internationalized domain name to the A-label
+// (punycode) form queries use. ASCII names are returned unchanged.
+func toASCIIName(name string) (string, error) {
+	for _, c := range name {
+		if c >= utf8.RuneSelf {
+			return idna.Lookup.ToASCII(name)
+		}
+	}
+	return name, nil
+}
@@ -0,0 +1,312 @@
+package proxy
+
+import (
+	"github.com/miekg/dns"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// rrIndex holds records by owner name, in canonical form, and type, so that
+// any type of record can be looked up without scanning a name's records.
+type rrIndex map[string]map[uint16][]dns.RR
+
+// add adds rr to the index.
+func (idx rrIndex) add(rr dns.RR) {
+	name := dns.CanonicalName(rr.Header().Name)
+	if idx[name] == nil {
+		idx[name] = make(map[uint16][]dns.RR)
+	}
+	idx[name][rr.Header().Rrtype] = append(idx[name][rr.Header().Rrtype], rr)
+}
+
+// remove removes rr, the same record and not just an equal one, from the
+// index, dropping names left without records.
+func (idx rrIndex) remove(rr dns.RR) {
+	name, rrtype := dns.CanonicalName(rr.Header().Name), rr.Header().Rrtype
+	i := slices.Index(idx[name][rrtype], rr)
+	if i == -1 {
+		return
+	}
+	idx[name][rrtype] = slices.Delete(idx[name][rrtype], i, i+1)
+	if len(idx[name][rrtype]) == 0 {
+		delete(idx[name], rrtype)
+	}
+	if len(idx[name]) == 0 {
+		delete(idx, name)
+	}
+}
+
+// set replaces the records of name, in canonical form, with type rrtype with
+// rrs, dropping names left without records.
+func (idx rrIndex) set(name string, rrtype uint16, rrs []dns.RR) {
+	if len(rrs) > 0 {
+		if idx[name] == nil {
+			idx[name] = make(map[uint16][]dns.RR)
+		}
+		idx[name][rrtype] = rrs
+		return
+	}
+	delete(idx[name], rrtype)
+	if len(idx[name]) == 0 {
+		delete(idx, name)
+	}
+}
+
+// merge adds all records in src to the index, returning how many there were.
+func (idx rrIndex) merge(src rrIndex) int {
+	rrs := src.all()
+	for _, rr := range rrs {
+		idx.add(rr)
+	}
+	return len(rrs)
+}
+
+// all returns all records in the index, in no particular order.
+func (idx rrIndex) all() []dns.RR {
+	var all []dns.RR
+	for _, types := range idx {
+		for _, rrs := range types {
+			all = append(all, rrs...)
+		}
+	}
+	return all
+}
+
+// clone returns a copy of the index that can be changed without affecting it.
+func (idx rrIndex) clone() rrIndex {
+	clone := make(rrIndex, len(idx))
+	for name, types := range idx {
+		clone[name] = make(map[uint16][]dns.RR, len(types))
+		for rrtype, rrs := range types {
+			clone[name][rrtype] = slices.Clone(rrs)
+		}
+	}
+	return clone
+}
+
+// lookup returns the records of name with type qtype, or all of them for ANY.
+func (idx rrIndex) lookup(name string, qtype uint16) []dns.RR {
+	types := idx[dns.CanonicalName(name)]
+	if qtype != dns.TypeANY {
+		return types[qtype]
+	}
+	var rrs []dns.RR
+	for _, rrtype := range slices.Sorted(maps.Keys(types)) {
+		rrs = append(rrs, types[rrtype]...)
+	}
+	return rrs
+}
+
+// localIndex is the local records as they're answered, by name and type:
+// the addresses of the hosts entries and the PTR records for them, along
+// with the records loaded from zones. It's derived from the hosts entries,
+// which also hold what records can't, such as weights and blocks, and
+// updated name by name as they change. Entries for the unspecified address,
+// which blocklists point huge numbers of names to, are left out and
+// answered from the entries themselves.
+type localIndex struct {
+	rrs rrIndex
+	// The CNAME targets of local names, which stand in for records of any type.
+	cnames map[string][]string
+	// The names of each address, by reverse name, to derive PTR records from.
+	addrNames map[string][]string
+	// The names with local names below them, built when first needed and
+	// dropped whenever the records change.
+	ancestors *lazyAncestors
+}
+
+type lazyAncestors struct {
+	once  sync.Once
+	names map[string]bool
+}
+
+// indexRecords builds the index of the hosts entries in p.records and the
+// zone records in p.zoneRecords. The caller must hold recordsMu.
+func (p *Proxy) indexRecords() {
+	p.local = &localIndex{
+		rrs:       make(rrIndex),
+		cnames:    make(map[string][]string),
+		addrNames: make(map[string][]string),
+		ancestors: new(lazyAncestors),
+	}
+	reversed := make(map[string]bool)
+	p.indexZoneRRs(p.zoneRecords.all(), reversed)
+	for name, hosts := range p.records {
+		p.indexHosts(name, hosts, reversed)
+	}
+	p.indexPtrs(reversed)
+}
+
+// reindexHosts updates the index after the hosts entries of the names in
+// old changed from the ones old has for them. The caller must hold
+// recordsMu.
+func (p *Proxy) reindexHosts(old map[string][]HostInfo) {
+	// The index is built from the current entries when first used.
+	if p.local == nil {
+		return
+	}
+	p.local.ancestors = new(lazyAncestors)
+	reversed := make(map[string]bool)
+	for name, hosts := range old {
+		p.unindexHosts(name, hosts, reversed)
+	}
+	for name := range old {
+		p.indexHosts(name, p.records[name], reversed)
+	}
+	p.indexPtrs(reversed)
+}
+
+// reindexZone updates the index after the zone records removed were
+// replaced with added. The caller must hold recordsMu.
+func (p *Proxy) reindexZone(removed, added []dns.RR) {
+	if p.local == nil {
+		return
+	}
+	p.local.ancestors = new(lazyAncestors)
+	reversed := make(map[string]bool)
+	for _, rr := range removed {
+		if rr.Header().Rrtype == dns.TypePTR {
+			reversed[dns.CanonicalName(rr.Header().Name)] = true
+		} else {
+			p.local.rrs.remove(rr)
+		}
+	}
+	p.indexZoneRRs(added, reversed)
+	p.indexPtrs(reversed)
+}
+
+// indexZoneRRs adds the zone records rrs to the index, except PTR records,
+// whose reverse names are added to reversed for indexPtrs.
+func (p *Proxy) indexZoneRRs(rrs []dns.RR, reversed map[string]bool) {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypePTR {
+			reversed[dns.CanonicalName(rr.Header().Name)] = true
+		} else {
+			p.local.rrs.add(rr)
+		}
+	}
+}
+
+// indexHosts adds the hosts entries of name to the index, adding the
+// reverse names whose PTR records they affect to reversed.
+func (p *Proxy) indexHosts(name string, hosts []HostInfo, reversed map[string]bool) {
+	for _, host := range hosts {
+		switch {
+		case host.IsCName():
+			p.local.cnames[name] = append(p.local.cnames[name], host.CName)
+		case host.IsPtr():
+			reversed[name] = true
+		case host.IsIP() && !host.IP.IsUnspecified():
+			p.local.rrs.add(p.addressRR(name, host))
+			arpa := reverseaddr(host.IP)
+			p.local.addrNames[arpa] = append(p.local.addrNames[arpa], name)
+			reversed[arpa] = true
+		}
+	}
+}
+
+// unindexHosts removes the hosts entries of name from the index, like
+// indexHosts adds them.
+func (p *Proxy) unindexHosts(name string, hosts []HostInfo, reversed map[string]bool) {
+	// The name's addresses and CNAMEs all come from its hosts entries, those
+	// of zones included.
+	p.local.rrs.set(name, dns.TypeA, nil)
+	p.local.rrs.set(name, dns.TypeAAAA, nil)
+	delete(p.local.cnames, name)
+	for _, host := range hosts {
+		switch {
+		case host.IsPtr():
+			reversed[name] = true
+		case host.IsIP() && !host.IP.IsUnspecified():
+			arpa := reverseaddr(host.IP)
+			names := p.local.addrNames[arpa]
+			if i := slices.Index(names, name); i != -1 {
+				names = slices.Delete(names, i, i+1)
+			}
+			if len(names) == 0 {
+				delete(p.local.addrNames, arpa)
+			} else {
+				p.local.addrNames[arpa] = names
+			}
+			reversed[arpa] = true
+		}
+	}
+}
+
+// indexPtrs sets the PTR records of each reverse name in reversed: those
+// loaded from zones, then the explicit PTR entries, or if there are none,
+// unless NoAutoPtr is set, those derived from the addresses of hosts
+// entries. Zone records come first, so that --single-ptr prefers them.
+// Addresses belonging to several names get a PTR record for each of them,
+// sorted by name.
+func (p *Proxy) indexPtrs(reversed map[string]bool) {
+	for arpa := range reversed {
+		var names []string
+		for _, host := range p.records[arpa] {
+			if host.IsPtr() {
+				names = append(names, host.Ptr)
+			}
+		}
+		if len(names) == 0 && !p.noAutoPtr {
+			// The names are kept sorted, so that adding one only takes
+			// sorting an almost sorted list.
+			slices.Sort(p.local.addrNames[arpa])
+			names = slices.Clone(p.local.addrNames[arpa])
+		} else {
+			slices.Sort(names)
+		}
+		names = slices.Compact(names)
+
+		rrs := slices.Clone(p.zoneRecords[arpa][dns.TypePTR])
+		for _, name := range names {
+			rrs = append(rrs, &dns.PTR{
+				Hdr: dns.RR_Header{Name: arpa, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: uint32(p.localTTL)},
+				Ptr: name,
+			})
+		}
+		p.local.rrs.set(arpa, dns.TypePTR, rrs)
+	}
+}
+
+// addressRR returns the A or AAAA record of the address entry host for name.
+func (p *Proxy) addressRR(name string, host HostInfo) dns.RR {
+	ttl := uint32(p.localTTL)
+	if host.TTL != 0 {
+		ttl = host.TTL
+	}
+	if ip4 := host.IP.To4(); ip4 != nil {
+		return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: ip4}
+	}
+	return &dns.AAAA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl}, AAAA: host.IP}
+}
+
+// rlockIndex read-locks recordsMu and returns the index of the local
+// records, building it first if they were set without going through New or
+// the methods that change them. The caller must RUnlock recordsMu.
+func (p *Proxy) rlockIndex() *localIndex {
+	p.recordsMu.RLock()
+	if p.local != nil {
+		return p.local
+	}
+	p.recordsMu.RUnlock()
+	p.recordsMu.Lock()
+	if p.local == nil {
+		p.indexRecords()
+	}
+	p.recordsMu.Unlock()
+	p.recordsMu.RLock()
+	return p.local
+}
+
+// lookupLocal returns copies of the local records answering q, with the name
+// as queried, preserving its case.
+func (p *Proxy) lookupLocal(q dns.Question) []dns.RR {
+	idx := p.rlockIndex()
+	defer p.recordsMu.RUnlock()
+	rrs := idx.rrs.lookup(q.Name, q.Qtype)
+	if q.Qtype == dns.TypePTR && p.singlePtr && len(rrs) > 1 {
+		rrs = rrs[:1]
+	}
+	return copyRRs(rrs, q.Name)
+}
@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"github.com/miekg/dns"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRRIndex(t *testing.T) {
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	txt := rr("Host.lan. 300 TXT \"hello\"")
+	hinfo := rr("host.lan. 300 HINFO \"x86_64\" \"Linux\"")
+	idx := make(rrIndex)
+	idx.add(txt)
+	idx.add(hinfo)
+	idx.add(rr("other.lan. 300 TXT \"other\""))
+
+	if rrs := idx.lookup("HOST.lan.", dns.TypeTXT); len(rrs) != 1 || rrs[0] != txt {
+		t.Error("Expected the TXT record whatever the case of the name, got", rrs)
+	}
+	if rrs := idx.lookup("host.lan.", dns.TypeANY); len(rrs) != 2 || rrs[0] != hinfo || rrs[1] != txt {
+		t.Error("Expected all of the name's records ordered by type for ANY, got", rrs)
+	}
+	if rrs := idx.lookup("host.lan.", dns.TypeMX); len(rrs) != 0 {
+		t.Error("Expected no MX records, got", rrs)
+	}
+
+	clone := idx.clone()
+	clone.remove(txt)
+	clone.remove(hinfo)
+	if _, ok := clone["host.lan."]; ok {
+		t.Error("Expected names without records to be removed, got", clone["host.lan."])
+	}
+	if len(idx.lookup("host.lan.", dns.TypeANY)) != 2 {
+		t.Error("Expected removing from a clone to leave the index unchanged")
+	}
+	// Only the record itself is removed, not an equal one.
+	clone.remove(rr("other.lan. 300 TXT \"other\""))
+	if len(clone.lookup("other.lan.", dns.TypeTXT)) != 1 {
+		t.Error("Expected an equal record not to be removed")
+	}
+	if n := clone.merge(idx); n != 3 || len(clone.all()) != 4 {
+		t.Error("Expected 3 records merged into 4, got", n, len(clone.all()))
+	}
+}
+
+func TestLocalIndex(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader(`
+10.0.0.1 host.lan
+fd00::1  host.lan
+@host.lan alias.lan
+@example.com external.lan
+NXDOMAIN blocked.lan
+0.0.0.0 sinkhole.lan
+PTR 10.0.0.9 explicit.lan
+`))
+	records, warnings, err := parseHostsScanner(scanner)
+	if err != nil || len(warnings) != 0 {
+		t.Fatal("Expected the entries to parse, got", err, warnings)
+	}
+	zoneRecords, zoneRRs, err := parseZone(strings.NewReader(`$ORIGIN lan.
+$TTL 300
+host    IN TXT   "hello"
+host    IN LOC   52 22 23.000 N 4 53 32.000 E -2.00m 1m 10000m 10m
+mail    IN A     10.0.0.25
+1.0.0.10.in-addr.arpa. IN PTR zone.lan.
+`), "test.zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mergeRecords(records, zoneRecords)
+	records["pinned.lan."] = []HostInfo{{IP: net.ParseIP("10.0.0.2"), TTL: 30}}
+
+	proxy := &Proxy{
+		records:     records,
+		zoneRecords: zoneRRs,
+		localTTL:    10,
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			m := new(dns.Msg)
+			m.SetRcode(req, dns.RcodeNameError)
+			return m, nil
+		}),
+	}
+	proxy.indexRecords()
+	idx := proxy.local
+
+	if rrs := idx.rrs["host.lan."][dns.TypeA]; len(rrs) != 1 || rrs[0].(*dns.A).A.String() != "10.0.0.1" || rrs[0].Header().Ttl != 10 {
+		t.Error("Expected host's address with the local TTL, got", rrs)
+	}
+	if rrs := idx.rrs["host.lan."][dns.TypeAAAA]; len(rrs) != 1 || rrs[0].(*dns.AAAA).AAAA.String() != "fd00::1" {
+		t.Error("Expected host's IPv6 address, got", rrs)
+	}
+	if rrs := idx.rrs["pinned.lan."][dns.TypeA]; len(rrs) != 1 || rrs[0].Header().Ttl != 30 {
+		t.Error("Expected the entry's own TTL, got", rrs)
+	}
+	if rrs := idx.rrs["mail.lan."][dns.TypeA]; len(rrs) != 1 || rrs[0].Header().Ttl != 300 {
+		t.Error("Expected the zone's address with the zone's TTL, got", rrs)
+	}
+	if cnames := idx.cnames["alias.lan."]; len(cnames) != 1 || cnames[0] != "host.lan." {
+		t.Error("Expected alias to be indexed as a CNAME, got", cnames)
+	}
+	if _, ok := idx.rrs["blocked.lan."]; ok {
+		t.Error("Expected no records for a blocked name, got", idx.rrs["blocked.lan."])
+	}
+	if _, ok := idx.rrs["sinkhole.lan."]; ok {
+		t.Error("Expected no records for a name pointing to the unspecified address, got", idx.rrs["sinkhole.lan."])
+	}
+	if !proxy.hasAddresses("Alias.lan.") || !proxy.hasAddresses("host.lan.") || !proxy.hasAddresses("sinkhole.lan.") || proxy.hasAddresses("blocked.lan.") {
+		t.Error("Expected only names with addresses or CNAMEs to have addresses")
+	}
+	if rrs := idx.rrs["9.0.0.10.in-addr.arpa."][dns.TypePTR]; len(rrs) != 1 || rrs[0].(*dns.PTR).Ptr != "explicit.lan." {
+		t.Error("Expected the explicit PTR record, got", rrs)
+	}
+	// The zone's PTR record comes before the one derived from host.
+	if rrs := idx.rrs["1.0.0.10.in-addr.arpa."][dns.TypePTR]; len(rrs) != 2 || rrs[0].(*dns.PTR).Ptr != "zone.lan." || rrs[1].(*dns.PTR).Ptr != "host.lan." {
+		t.Error("Expected the zone's and the derived PTR records, got", rrs)
+	}
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	tests := []struct {
+		name    string
+		qtype   uint16
+		answers int
+	}{
+		{"Host.lan.", dns.TypeTXT, 1},
+		{"host.lan.", dns.TypeLOC, 1},
+		{"host.lan.", dns.TypeA, 1},
+		{"alias.lan.", dns.TypeAAAA, 1},
+		{"mail.lan.", dns.TypeA, 1},
+		{"sinkhole.lan.", dns.TypeA, 1},
+		{"sinkhole.lan.", dns.TypeAAAA, 0},
+		{"host.lan.", dns.TypeANY, 4},
+		{"9.0.0.10.in-addr.arpa.", dns.TypePTR, 1},
+	}
+	for _, test := range tests {
+		resp := query(test.name, test.qtype)
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != test.answers {
+			t.Errorf("Expected %d answers for %s %s, got %s with %v", test.answers, dns.TypeToString[test.qtype], test.name, dns.RcodeToString[resp.Rcode], resp.Answer)
+		}
+		for _, rr := range resp.Answer {
+			if rr.Header().Name != test.name {
+				t.Errorf("Expected answers named %s as queried, got %s", test.name, rr.Header().Name)
+			}
+		}
+	}
+	if resp := query("blocked.lan.", dns.TypeTXT); resp.Rcode != dns.RcodeNameError {
+		t.Error("Expected blocked names to stay blocked for every type, got", dns.RcodeToString[resp.Rcode])
+	}
+	proxy.singlePtr = true
+	if resp := query("1.0.0.10.in-addr.arpa.", dns.TypePTR); len(resp.Answer) != 1 || resp.Answer[0].(*dns.PTR).Ptr != "zone.lan." {
+		t.Error("Expected only the zone's PTR record with --single-ptr, got", resp.Answer)
+	}
+
+	// Replacing the hosts entries keeps the zone's records.
+	proxy.SetRecords(map[string][]HostInfo{"new.lan": {{IP: net.ParseIP("10.0.0.3")}}})
+	if resp := query("host.lan.", dns.TypeA); len(resp.Answer) != 0 {
+		t.Error("Expected the replaced address to be gone, got", resp.Answer)
+	}
+	if resp := query("host.lan.", dns.TypeTXT); len(resp.Answer) != 1 {
+		t.Error("Expected the zone's TXT record to stay, got", resp.Answer)
+	}
+	if resp := query("new.lan.", dns.TypeA); len(resp.Answer) != 1 {
+		t.Error("Expected the new address, got", resp.Answer)
+	}
+}
+
+func TestLocalIndexUpdates(t *testing.T) {
+	records, _, err := parseHostsScanner(bufio.NewScanner(strings.NewReader(`
+10.0.0.1 host.lan other.lan
+0.0.0.0 ads.example.com
+@host.lan alias.lan
+`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &Proxy{records: records, localTTL: 10}
+	proxy.indexRecords()
+
+	proxy.addRecord("third.lan", HostInfo{IP: net.ParseIP("10.0.0.1")})
+	proxy.addRecord("Alias.lan", HostInfo{CName: "other.lan."})
+	proxy.addRecord("1.0.0.10.in-addr.arpa", HostInfo{Ptr: "explicit.lan."})
+	proxy.addRecord("ads.example.com", HostInfo{IP: net.ParseIP("0.0.0.0")})
+	proxy.removeRecords("other.lan")
+
+	contents := func(idx *localIndex) []string {
+		var all []string
+		for _, rr := range idx.rrs.all() {
+			all = append(all, rr.String())
+		}
+		for name, cnames := range idx.cnames {
+			all = append(all, name+" CNAME "+strings.Join(cnames, " "))
+		}
+		slices.Sort(all)
+		return all
+	}
+	updated := contents(proxy.local)
+	proxy.indexRecords()
+	if rebuilt := contents(proxy.local); !slices.Equal(updated, rebuilt) {
+		t.Errorf("Expected the updated index to be the rebuilt one, got\n%s\ninstead of\n%s", strings.Join(updated, "\n"), strings.Join(rebuilt, "\n"))
+	}
+
+	ptrs := func() []string {
+		var names []string
+		for _, rr := range proxy.lookupLocal(dns.Question{Name: "1.0.0.10.in-addr.arpa.", Qtype: dns.TypePTR}) {
+			names = append(names, rr.(*dns.PTR).Ptr)
+		}
+		return names
+	}
+	if names := ptrs(); !slices.Equal(names, []string{"explicit.lan."}) {
+		t.Error("Expected only the explicit PTR record, got", names)
+	}
+	// The derived PTR records come back once the explicit one is removed.
+	proxy.removeRecords("1.0.0.10.in-addr.arpa")
+	if names := ptrs(); !slices.Equal(names, []string{"host.lan.", "third.lan."}) {
+		t.Error("Expected the derived PTR records of the remaining names, got", names)
+	}
+	if _, ok := proxy.local.addrNames["0.0.0.0.in-addr.arpa."]; ok {
+		t.Error("Expected the unspecified address not to be indexed")
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+var errTooManyQueries = errors.New("too many queries to the upstream in flight")
+
+// upstreamLimiter bounds how many queries are sent to the upstream at once.
+// Queries over the limit wait for a slot, up to as many as the limit itself;
+// queries beyond that fail right away. A limit of 0 doesn't limit anything,
+// but still counts the queries in flight.
+type upstreamLimiter struct {
+	slots chan struct{}
+
+	inFlight atomic.Int64
+	waiting  atomic.Int64
+	rejected atomic.Uint64
+}
+
+func newUpstreamLimiter(limit int) *upstreamLimiter {
+	l := &upstreamLimiter{}
+	if limit > 0 {
+		l.slots = make(chan struct{}, limit)
+	}
+	return l
+}
+
+// acquire waits for a slot to query the upstream, until ctx is done. The
+// slot must be released once the query is done.
+func (l *upstreamLimiter) acquire(ctx context.Context) error {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			if l.waiting.Add(1) > int64(cap(l.slots)) {
+				l.waiting.Add(-1)
+				l.rejected.Add(1)
+				return errTooManyQueries
+			}
+			defer l.waiting.Add(-1)
+			select {
+			case l.slots <- struct{}{}:
+			case <-ctx.Done():
+				l.rejected.Add(1)
+				return ctx.Err()
+			}
+		}
+	}
+	l.inFlight.Add(1)
+	return nil
+}
+
+// tryAcquire takes a slot if one is free, for queries that can be skipped.
+func (l *upstreamLimiter) tryAcquire() bool {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	l.inFlight.Add(1)
+	return true
+}
+
+func (l *upstreamLimiter) release() {
+	l.inFlight.Add(-1)
+	if l.slots != nil {
+		<-l.slots
+	}
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUpstreamConcurrencyLimit(t *testing.T) {
+	release := make(chan struct{})
+	proxy := Proxy{
+		records:         make(map[string][]HostInfo),
+		upstreamLimiter: newUpstreamLimiter(1),
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			<-release
+			return replyA(req), nil
+		}),
+	}
+	query := func() (*dns.Msg, error) {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		return proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+	}
+
+	// One query in flight, one waiting for it.
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := query()
+			errs <- err
+		}()
+	}
+	deadline := time.Now().Add(time.Second)
+	for proxy.upstreamLimiter.inFlight.Load() != 1 || proxy.upstreamLimiter.waiting.Load() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a query in flight and one waiting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := query(); err != errTooManyQueries {
+		t.Error("Expected a query over the limit to fail, got", err)
+	}
+	if stats := proxy.stats(); stats.InFlight != 1 || stats.Rejected != 1 {
+		t.Error("Expected 1 query in flight and 1 rejected, got", stats.InFlight, stats.Rejected)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Error("Expected the queued queries to succeed, got", err)
+		}
+	}
+	if n := proxy.upstreamLimiter.inFlight.Load(); n != 0 {
+		t.Error("Expected no queries in flight, got", n)
+	}
+}
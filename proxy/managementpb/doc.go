@@ -0,0 +1,5 @@
+// Package managementpb holds the protocol buffers contract of the gRPC
+// management API, in management.proto, and the code generated from it.
+package managementpb
+
+//go:generate protoc -I ../.. --go_out=../.. --go_opt=paths=source_relative --go-grpc_out=../.. --go-grpc_opt=paths=source_relative proxy/managementpb/management.proto
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long to wait for mDNS responses.
+	mdnsTimeout = time.Second
+	// Maximum time mDNS answers are cached and served for, whatever their TTL.
+	mdnsMaxTTL = 10
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+type mdnsCacheEntry struct {
+	rrs     []dns.RR
+	expires time.Time
+}
+
+// mdnsResolver answers queries for .local names with one-shot multicast DNS
+// queries (RFC 6762 section 5.1), bridging unicast clients to mDNS.
+type mdnsResolver struct {
+	iface *net.Interface
+	// Address queries are sent to, the mDNS multicast group unless testing.
+	addr    *net.UDPAddr
+	timeout time.Duration
+
+	cacheMu sync.Mutex
+	cache   map[dns.Question]mdnsCacheEntry
+}
+
+func newMdnsResolver(iface *net.Interface) *mdnsResolver {
+	return &mdnsResolver{
+		iface:   iface,
+		addr:    mdnsGroup,
+		timeout: mdnsTimeout,
+		cache:   make(map[dns.Question]mdnsCacheEntry),
+	}
+}
+
+// isMdnsName returns whether name belongs to the mDNS .local domain.
+func isMdnsName(name string) bool {
+	return dns.IsSubDomain("local.", dns.CanonicalName(name))
+}
+
+// resolve returns the answers to q, from the cache or by querying the LAN.
+// A nil result means no host responded.
+func (r *mdnsResolver) resolve(q dns.Question) ([]dns.RR, error) {
+	key := dns.Question{Name: dns.CanonicalName(q.Name), Qtype: q.Qtype, Qclass: q.Qclass}
+
+	r.cacheMu.Lock()
+	cached, ok := r.cache[key]
+	r.cacheMu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return copyRRs(cached.rrs, q.Name), nil
+	}
+
+	rrs, err := r.query(q)
+	if err != nil || len(rrs) == 0 {
+		return nil, err
+	}
+
+	ttl := uint32(mdnsMaxTTL)
+	for _, rr := range rrs {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+	for _, rr := range rrs {
+		rr.Header().Ttl = ttl
+	}
+	r.cacheMu.Lock()
+	r.cache[key] = mdnsCacheEntry{rrs, time.Now().Add(time.Duration(ttl) * time.Second)}
+	r.cacheMu.Unlock()
+
+	return copyRRs(rrs, q.Name), nil
+}
+
+// query sends q to the mDNS group and waits for the first response answering it.
+func (r *mdnsResolver) query(q dns.Question) ([]dns.RR, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, fmt.Errorf("opening mDNS socket: %w", err)
+	}
+	defer conn.Close()
+
+	if r.iface != nil {
+		pc := ipv4.NewPacketConn(conn)
+		if err := pc.SetMulticastInterface(r.iface); err != nil {
+			return nil, fmt.Errorf("using interface %s for mDNS: %w", r.iface.Name, err)
+		}
+		// RFC 6762 section 11: mDNS packets are sent with an IP TTL of 255.
+		if err := pc.SetMulticastTTL(255); err != nil {
+			return nil, fmt.Errorf("setting mDNS multicast TTL: %w", err)
+		}
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(q.Name, q.Qtype)
+	req.RecursionDesired = false
+	// Queries not sent from port 5353 are answered by unicast, directly to us (RFC 6762 section 6.7).
+	req.Id = dns.Id()
+	buf, err := req.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing mDNS query: %w", err)
+	}
+	if _, err := conn.WriteToUDP(buf, r.addr); err != nil {
+		return nil, fmt.Errorf("sending mDNS query: %w", err)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
+		return nil, err
+	}
+	buf = make([]byte, dns.MaxMsgSize)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("reading mDNS response: %w", err)
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(buf[:n]); err != nil || !resp.Response || resp.Id != req.Id {
+			continue
+		}
+		if rrs := mdnsAnswers(resp, q); len(rrs) > 0 {
+			return rrs, nil
+		}
+	}
+}
+
+// mdnsAnswers returns the records in resp answering q, with the mDNS
+// cache-flush bit cleared from their class.
+func mdnsAnswers(resp *dns.Msg, q dns.Question) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range resp.Answer {
+		hdr := rr.Header()
+		if !strings.EqualFold(hdr.Name, q.Name) || (hdr.Rrtype != q.Qtype && hdr.Rrtype != dns.TypeCNAME) {
+			continue
+		}
+		hdr.Class &^= 1 << 15
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+// copyRRs returns copies of rrs owned by name.
+func copyRRs(rrs []dns.RR, name string) []dns.RR {
+	copied := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		copied[i] = dns.Copy(rr)
+		copied[i].Header().Name = name
+	}
+	return copied
+}
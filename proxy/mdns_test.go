@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMdns(t *testing.T) {
+	var queries atomic.Int32
+	addr := startStubServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		if dns.CanonicalName(r.Question[0].Name) != "printer.local." {
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Question = nil
+		rr, _ := dns.NewRR("printer.local. 120 A 192.168.1.20")
+		rr.Header().Class |= 1 << 15
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolver := newMdnsResolver(nil)
+	resolver.addr = udpAddr
+	resolver.timeout = 100 * time.Millisecond
+	proxy := Proxy{
+		records:  make(map[string][]HostInfo),
+		localTTL: 10,
+		mdns:     resolver,
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			t.Error("Unexpected upstream query for", req.Question[0].Name)
+			return nil, nil
+		}),
+	}
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+
+	for i := 0; i < 2; i++ {
+		msg := new(dns.Msg)
+		msg.SetQuestion("Printer.local.", dns.TypeA)
+		resp, err := proxy.respondToRequest(context.Background(), msg, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].Header().Name != "Printer.local." ||
+			resp.Answer[0].Header().Class != dns.ClassINET || resp.Answer[0].Header().Ttl != mdnsMaxTTL {
+			t.Error("Incorrect mDNS answer:", resp.Answer)
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Error("Expected the second answer to be cached, got queries:", n)
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("missing.local.", dns.TypeA)
+	resp, err := proxy.respondToRequest(context.Background(), msg, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeNameError {
+		t.Error("Expected NXDOMAIN when no host responds, got", resp)
+	}
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"github.com/miekg/dns"
+)
+
+// paddingBlockSize is the block size queries are padded to, as recommended by RFC 8467.
+const paddingBlockSize = 128
+
+// padQuery pads msg with an EDNS0 padding option (RFC 7830) so that its
+// packed length is a multiple of paddingBlockSize, adding an OPT record if
+// needed. It returns whether the OPT record was added.
+func padQuery(msg *dns.Msg) bool {
+	opt := msg.IsEdns0()
+	addedOpt := opt == nil
+	if addedOpt {
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		opt = msg.IsEdns0()
+	}
+	removePadding(opt)
+
+	// The padding option itself takes 4 bytes for its code and length.
+	length := msg.Len() + 4
+	padding := (paddingBlockSize - length%paddingBlockSize) % paddingBlockSize
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, padding)})
+	return addedOpt
+}
+
+// unpadResponse removes padding from a response to a query padded with
+// padQuery, and the OPT record if padQuery added it.
+func unpadResponse(resp *dns.Msg, addedOpt bool) {
+	if addedOpt {
+		removeOpt(resp)
+	} else if opt := resp.IsEdns0(); opt != nil {
+		removePadding(opt)
+	}
+}
+
+func removePadding(opt *dns.OPT) {
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0PADDING {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
+
+// removeOpt removes the OPT record from msg.
+func removeOpt(msg *dns.Msg) {
+	extra := msg.Extra[:0]
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+}
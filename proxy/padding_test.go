@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPadQuery(t *testing.T) {
+	for i := 1; i < 200; i += 7 {
+		for _, edns := range []bool{false, true} {
+			msg := new(dns.Msg)
+			msg.SetQuestion(strings.Repeat("a", i%60+1)+"."+strings.Repeat("b", i/4+1)+".example.", dns.TypeA)
+			if edns {
+				msg.SetEdns0(4096, true)
+			}
+			if padQuery(msg) == edns {
+				t.Error("Expected the OPT record to be added only if missing")
+			}
+			buf, err := msg.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(buf)%paddingBlockSize != 0 {
+				t.Errorf("Expected a multiple of %d bytes, got %d for %s", paddingBlockSize, len(buf), msg.Question[0].Name)
+			}
+		}
+	}
+}
+
+func TestHttpUpstreamPadding(t *testing.T) {
+	server := httptest.NewServer(dohHandler(t, func(req *dns.Msg) *dns.Msg {
+		opt := req.IsEdns0()
+		if opt == nil || len(opt.Option) != 1 || opt.Option[0].Option() != dns.EDNS0PADDING {
+			t.Error("Expected a padded query, got", req)
+		}
+		resp := replyA(req)
+		// Servers pad their responses too.
+		resp.SetEdns0(dns.DefaultMsgSize, false)
+		resp.IsEdns0().Option = append(resp.IsEdns0().Option, &dns.EDNS0_PADDING{Padding: make([]byte, 64)})
+		return resp
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := NewUpstream(*u, UpstreamOptions{Timeout: time.Second, DohMethod: http.MethodPost, Pad: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp, err := upstream.Exchange(context.Background(), req, net.ParseIP("10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.IsEdns0() != nil {
+		t.Error("Expected the padding to be stripped from the response, got", resp)
+	}
+	if req.IsEdns0() != nil {
+		t.Error("The request was modified in place:", req)
+	}
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// typePolicy overrides how queries of one type for a name are answered.
+type typePolicy int
+
+const (
+	// policyDefault answers as usual: from local records if the name has
+	// any, otherwise from the upstream.
+	policyDefault typePolicy = iota
+	// policyLocal answers only from local records, with NODATA if there are
+	// none of the type, never forwarding the query.
+	policyLocal
+	// policyForward forwards the query even if the name has local records.
+	policyForward
+	// policyNoData always answers NODATA.
+	policyNoData
+)
+
+var typePolicies = map[string]typePolicy{
+	"local":   policyLocal,
+	"forward": policyForward,
+	"nodata":  policyNoData,
+}
+
+// parseTypePolicy parses a policy in the form name:TYPE=policy, e.g. host.lan:AAAA=nodata.
+func parseTypePolicy(s string) (string, uint16, typePolicy, error) {
+	nameType, policyName, _ := strings.Cut(s, "=")
+	name, typeName, _ := strings.Cut(nameType, ":")
+	qtype, typeOk := dns.StringToType[strings.ToUpper(typeName)]
+	policy, policyOk := typePolicies[strings.ToLower(policyName)]
+	if name == "" || !typeOk || !policyOk {
+		return "", 0, policyDefault, fmt.Errorf("invalid type policy %q, expected name:TYPE=local|forward|nodata", s)
+	}
+	return dns.CanonicalName(name), qtype, policy, nil
+}
+
+// typePolicy returns the policy for queries of q's type for q's name.
+// With --no-aaaa, AAAA queries get NODATA unless the name has its own policy.
+func (p *Proxy) typePolicy(q dns.Question) typePolicy {
+	if policy, ok := p.typePolicies[dns.CanonicalName(q.Name)][q.Qtype]; ok {
+		return policy
+	}
+	if p.noAAAA && q.Qtype == dns.TypeAAAA {
+		return policyNoData
+	}
+	return policyDefault
+}
+
+// forwardedByPolicy returns whether the question in r must be forwarded to
+// the upstream, bypassing local records.
+func (p *Proxy) forwardedByPolicy(r *dns.Msg) bool {
+	return len(r.Question) == 1 && p.typePolicy(r.Question[0]) == policyForward
+}
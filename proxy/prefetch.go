@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"sync"
+)
+
+// maxTrackedNames bounds how many names typeUsage remembers.
+const maxTrackedNames = 10000
+
+// siblingType returns the address type queried along with qtype: AAAA for A, and vice versa.
+func siblingType(qtype uint16) (uint16, bool) {
+	switch qtype {
+	case dns.TypeA:
+		return dns.TypeAAAA, true
+	case dns.TypeAAAA:
+		return dns.TypeA, true
+	default:
+		return 0, false
+	}
+}
+
+// typeUsage remembers which address types names have been queried for, so
+// that siblings are only prefetched for names that get both.
+type typeUsage struct {
+	mu   sync.Mutex
+	seen map[string]map[uint16]bool
+}
+
+// record records a query for name with qtype, and returns whether its
+// sibling type was queried before.
+func (u *typeUsage) record(name string, qtype, sibling uint16) bool {
+	name = dns.CanonicalName(name)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.seen == nil || len(u.seen) >= maxTrackedNames {
+		// Start over rather than growing forever, popular names are learned again quickly.
+		u.seen = make(map[string]map[uint16]bool)
+	}
+	types, ok := u.seen[name]
+	if !ok {
+		types = make(map[uint16]bool)
+		u.seen[name] = types
+	}
+	types[qtype] = true
+	return types[sibling]
+}
+
+// prefetchSibling resolves and caches the sibling type of an A or AAAA query
+// in the background, if the name usually gets queried for both and the
+// sibling isn't cached already.
+func (p *Proxy) prefetchSibling(r *dns.Msg, forwardedFor net.IP) {
+	if len(r.Question) != 1 {
+		return
+	}
+	q := r.Question[0]
+	sibling, ok := siblingType(q.Qtype)
+	if !ok || !p.typeUsage.record(q.Name, q.Qtype, sibling) {
+		return
+	}
+
+	req := r.Copy()
+	req.Question[0].Qtype = sibling
+	if p.cache.has(req) {
+		return
+	}
+	// Prefetches aren't worth waiting for, skip them when the upstream is busy.
+	limiter := p.upstreamLimiter
+	if limiter != nil && !limiter.tryAcquire() {
+		return
+	}
+	go func() {
+		if limiter != nil {
+			defer limiter.release()
+		}
+		// Not tied to the client's query, which may be done before the prefetch.
+		resp, err := p.upstream.Exchange(context.Background(), req, forwardedFor)
+		if err != nil {
+			if p.verbose {
+				log.Printf("Failed to prefetch %s %s: %s\n", dns.TypeToString[sibling], q.Name, err.Error())
+			}
+			return
+		}
+		if err := p.processUpstreamResponse(req, resp); err != nil {
+			if p.verbose {
+				log.Printf("Not caching prefetched %s %s: %s\n", dns.TypeToString[sibling], q.Name, err.Error())
+			}
+			return
+		}
+		p.cache.put(req, resp)
+	}()
+}
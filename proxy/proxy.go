@@ -0,0 +1,1666 @@
+// Package proxy implements a DNS proxy answering queries from local records
+// and forwarding the rest to an upstream resolver.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type HostInfo struct {
+	IP    net.IP
+	CName string
+	// TTL to answer with, 0 means the default local TTL.
+	TTL uint32
+	// Relative weight when picking among the addresses of a name, 0 means unweighted.
+	Weight uint32
+	// Rcode to answer all queries for the name with, such as NXDOMAIN to block it. 0 if not blocked.
+	Block int
+	// Name an explicit PTR record for the reverse name points to.
+	Ptr string
+}
+
+type Host interface {
+	IsIP() bool
+	IsCName() bool
+	IsBlock() bool
+	IsPtr() bool
+}
+
+func (h HostInfo) IsIP() bool {
+	return h.IP != nil
+}
+
+func (h HostInfo) IsCName() bool {
+	return h.CName != ""
+}
+
+func (h HostInfo) IsBlock() bool {
+	return h.Block != 0
+}
+
+func (h HostInfo) IsPtr() bool {
+	return h.Ptr != ""
+}
+
+func sameHostInfo(a, b HostInfo) bool {
+	return a.IP.Equal(b.IP) && a.CName == b.CName && a.Block == b.Block && a.Ptr == b.Ptr
+}
+
+// mergeRecords adds the records in src to dst, skipping duplicates, and
+// returns the number of records added.
+func mergeRecords(dst, src map[string][]HostInfo) int {
+	added := 0
+	for name, hosts := range src {
+	next:
+		for _, host := range hosts {
+			for _, existing := range dst[name] {
+				if sameHostInfo(existing, host) {
+					continue next
+				}
+			}
+			dst[name] = append(dst[name], host)
+			added++
+		}
+	}
+	return added
+}
+
+// addNewRecords adds the records of src that dst doesn't have yet to it,
+// returning them so that they can be taken out again with withoutRecords.
+func addNewRecords(dst, src map[string][]HostInfo) map[string][]HostInfo {
+	added := make(map[string][]HostInfo)
+	for name, hosts := range src {
+		for _, host := range hosts {
+			if !slices.ContainsFunc(dst[name], func(existing HostInfo) bool { return sameHostInfo(existing, host) }) &&
+				!slices.ContainsFunc(added[name], func(existing HostInfo) bool { return sameHostInfo(existing, host) }) {
+				added[name] = append(added[name], host)
+			}
+		}
+	}
+	mergeRecords(dst, added)
+	return added
+}
+
+// withoutRecords returns a copy of records without those in remove.
+func withoutRecords(records, remove map[string][]HostInfo) map[string][]HostInfo {
+	result := make(map[string][]HostInfo, len(records))
+	for name, hosts := range records {
+		result[name] = slices.Clone(hosts)
+	}
+	for name, hosts := range remove {
+		for _, host := range hosts {
+			i := slices.IndexFunc(result[name], func(existing HostInfo) bool { return sameHostInfo(existing, host) })
+			if i != -1 {
+				result[name] = slices.Delete(result[name], i, i+1)
+			}
+		}
+		if len(result[name]) == 0 {
+			delete(result, name)
+		}
+	}
+	return result
+}
+
+// entriesOf returns the entries in records of the names that are keys of any
+// of changed, as reindexHosts takes them.
+func entriesOf(records map[string][]HostInfo, changed ...map[string][]HostInfo) map[string][]HostInfo {
+	entries := make(map[string][]HostInfo)
+	for _, names := range changed {
+		for name := range names {
+			entries[name] = records[name]
+		}
+	}
+	return entries
+}
+
+type cacheEntry struct {
+	rrs  []dns.RR
+	time time.Time
+}
+
+// Proxy answers DNS queries, from local records when it has them and by
+// forwarding them to the upstream otherwise. Create one with New.
+type Proxy struct {
+	upstream Upstream
+	// recordsMu guards records, zoneRecords, local and databaseRecords,
+	// which can be changed at runtime through the admin API, the record
+	// database and zone transfers.
+	recordsMu sync.RWMutex
+	records   map[string][]HostInfo
+	// Records of other types loaded from zone files and transfers.
+	zoneRecords rrIndex
+	// The index of records and zoneRecords queries are answered from, nil
+	// until it's first built.
+	local        *localIndex
+	cnameCacheMu sync.Mutex
+	cnameCache   map[uint16]map[string]cacheEntry
+	cacheStats   cacheStats
+	// Cache of forwarded responses, nil if disabled.
+	cache *responseCache
+	// File the cache is saved to on shutdown and loaded from on start, empty for none.
+	cacheFile string
+	// Whether to prefetch AAAA records when A records are queried and vice versa, and the usage tracking for it.
+	prefetchSiblings bool
+	typeUsage        typeUsage
+	// Stats for each upstream, served with --stats-addr.
+	upstreamStats []*upstreamStats
+	// Limit on the queries sent to the upstream at once, nil for none.
+	upstreamLimiter *upstreamLimiter
+	localTTL        int
+	// Whether upstream answers for local CNAMEs get localTTL instead of their own TTL.
+	localCNAMETTL   bool
+	verbose         bool
+	upstreamTimeout time.Duration
+	// Time a client query can take in total, across retries and fallbacks, 0 for no limit.
+	queryDeadline   time.Duration
+	requireAD       bool
+	forwardClientIP bool
+	// Clients allowed to send DNS UPDATE messages, and the zones they can change.
+	updateACL   []*net.IPNet
+	updateZones []string
+	ptrSubnets  []ptrSubnet
+	// Addresses to answer queries for names without any other answer with, instead of forwarding them.
+	catchAllIPs []net.IP
+	// How queries without the RD bit that can't be answered locally are answered.
+	norecursion norecursionResponse
+	// Ranges forwarded answers can't point to, empty to allow any, and the names they may anyway.
+	rebindRanges     []*net.IPNet
+	rebindExceptions []string
+	// Zones the proxy is authoritative for.
+	authZones []authZone
+	// Subzones whose queries are answered with referrals to their nameservers.
+	delegations []subzoneDelegation
+	// Whether queries for local names with types that aren't served locally get NODATA instead of being forwarded.
+	localOnlyTypes bool
+	// ALPN protocols to advertise in synthesized HTTPS/SVCB records, by name.
+	httpsAlpn map[string][]string
+	// Policies overriding how queries are answered, by name and type.
+	typePolicies map[string]map[uint16]typePolicy
+	// Whether AAAA queries get NODATA, unless a name's policy says otherwise.
+	noAAAA bool
+	// Address family clients are biased toward for dual-stack local names,
+	// and the percentage of queries for the other family answered with NODATA.
+	preferFamily       addressFamily
+	preferFamilyNoData int
+	// Most records in the answer section of UDP responses, 0 for no limit.
+	maxAnswers int
+	// Subnets whose addresses are moved first in answers to clients within them.
+	sortSubnets []*net.IPNet
+	// Score above which queries are flagged as possible DNS tunneling, 0 to
+	// not check them, whether flagged queries are refused, and how many were.
+	tunnelingThreshold int
+	blockTunneling     bool
+	tunnelingFlagged   atomic.Uint64
+	// Record types removed from forwarded responses.
+	strippedTypes map[uint16]bool
+	// Whether CNAME chains in forwarded A and AAAA answers are replaced with the addresses they lead to.
+	flattenCNAME bool
+	// Whether the authority and additional sections are removed from forwarded responses.
+	minimalResponses bool
+	// Names only resolving at some times of day, the time zone the times are
+	// in, local time if nil, and the clock, time.Now if nil.
+	schedules        []nameSchedule
+	scheduleLocation *time.Location
+	now              func() time.Time
+	// Range TTLs in responses are clamped to, 0 for no limit.
+	minTTL uint32
+	maxTTL uint32
+	// Percentage local and cached TTLs are randomly raised or lowered by, 0 to leave them as they are.
+	ttlJitter int
+	// Largest UDP response to send, whatever the client's EDNS buffer size.
+	udpSize int
+	// Resolver for .local names without local records, nil if mDNS is disabled.
+	mdns *mdnsResolver
+	// Whether to answer PTR queries for addresses with several names with only the first name.
+	singlePtr bool
+	// Whether PTR records aren't derived from the local A and AAAA records.
+	noAutoPtr bool
+	// Whether to rotate the order of local A/AAAA answers on every response, and the rotation counter.
+	rotateLocal bool
+	rotation    atomic.Uint32
+	// The options the proxy was created with and the files its local
+	// records were loaded from, for dumps.
+	options Options
+	sources []recordSource
+	// Subscribers following the answered queries, through the gRPC API.
+	queryLog queryLog
+	// The database records are reloaded from when it changes, if any, and
+	// the records it added to records, as opposed to those already there.
+	database        *recordDatabase
+	databaseRecords map[string][]HostInfo
+	// The zone transfers keeping records up to date, whose records are
+	// guarded by recordsMu.
+	transfers []*zoneTransfer
+}
+
+// Options configures a Proxy.
+type Options struct {
+	// Upstream to forward queries to. If nil, one is created from UpstreamURL and UpstreamOptions.
+	Upstream        Upstream `json:"-"`
+	UpstreamURL     string
+	UpstreamOptions UpstreamOptions
+	// More upstreams to spread queries over along with UpstreamURL, and how
+	// to choose among them: StrategyRoundRobin (the default) or StrategyAdaptive.
+	UpstreamURLs     []string
+	UpstreamStrategy string
+	// Resolve queries iteratively from the root servers instead of forwarding them to UpstreamURL.
+	Recursive bool
+
+	// Hosts and RFC 1035 zone files to load local records from.
+	HostsFiles []string
+	// Whether to load the operating system's hosts file too, and whether to leave out its loopback entries.
+	UseSystemHosts     bool
+	SkipSystemLoopback bool
+	ZoneFiles          []string
+	// SQLite database to load local records from, with a records table of
+	// name, type, value and ttl columns, checked for changes every
+	// DatabasePollInterval (5 seconds if 0).
+	Database             string
+	DatabasePollInterval time.Duration
+	// Zones to pull from their primary with AXFR, refreshed with IXFR as
+	// their SOA says, as zone=primary[:port].
+	Transfers []string
+	// Zones to be authoritative for, as apex[=ns,...].
+	ZoneApexes []string
+	// Subzones to answer queries for with referrals to their nameservers, as zone=ns[,ns...].
+	Delegations []string
+	// TTL of local answers, unless their records specify one.
+	LocalTTL int
+	// Answer local CNAMEs resolved upstream with LocalTTL rather than the upstream's TTLs.
+	LocalCNAMETTL bool
+	// Range TTLs in responses are clamped to, 0 for no limit.
+	MinTTL int
+	MaxTTL int
+	// Percentage local and cached TTLs are randomly raised or lowered by, to spread out cache expiry.
+	TTLJitter int
+	// Largest UDP response to send, 0 for no limit other than the client's.
+	UdpSize int
+	// Total time a query can take, across upstream retries and fallbacks, 0 for no limit.
+	QueryDeadline time.Duration
+	// Maximum number of queries sent to the upstream at once, 0 for no limit.
+	MaxUpstreamConcurrency int
+	// Percentage of recent upstream queries failing with an error or SERVFAIL above which a warning is logged, 0 to disable it.
+	UpstreamFailureThreshold int
+	// Number of upstream responses to cache, 0 to disable the cache.
+	CacheSize int
+	// Whether to cache responses to queries with an EDNS client subnet, by the subnet their scope covers.
+	EcsCache bool
+	// File to save the cache to with SaveCache and load it back from when starting, empty for none.
+	CacheFile        string
+	PrefetchSiblings bool
+	Verbose          bool
+	RequireAD        bool
+	// Subnets allowed to send DNS UPDATE messages, and the zones they can change.
+	AllowUpdate    []string
+	UpdateZones    []string
+	LocalOnlyTypes bool
+	LocalRRRotate  bool
+	// Whether to answer PTR queries for addresses with several names with only the first one, by name.
+	SinglePtr bool
+	// Don't derive PTR records from the local A and AAAA records, leaving PTR
+	// queries to zone data, PtrSubnets and the upstream.
+	NoAutoPtr bool
+	// Names to synthesize HTTPS/SVCB records for, as name=alpn[,alpn...].
+	HttpsAlpn []string
+	// Policies overriding how queries of a type for a name are answered, as name:TYPE=local|forward|nodata.
+	TypePolicies []string
+	// Whether to answer all AAAA queries with NODATA, local or not, to disable IPv6 for clients.
+	NoAAAA bool
+	// Address family to bias clients toward for local names with addresses
+	// of both, v4 or v6, and the percentage of queries for the other family
+	// to answer with NODATA rather than only with shorter TTLs.
+	PreferFamily       string
+	PreferFamilyNoData int
+	// Most records in the answer section of UDP responses, beyond which
+	// they're truncated, 0 for no limit.
+	MaxAnswers int
+	// Subnets, in CIDR notation, whose addresses are moved first in answers
+	// to clients within the same subnet.
+	SortSubnets []string
+	// Tunneling score above which queries are logged as possible DNS
+	// tunneling, 0 to not check them, and whether to refuse those queries,
+	// with a default threshold if none is set.
+	TunnelingThreshold int
+	BlockTunneling     bool
+	// Record types to remove from forwarded responses, as lists like HTTPS,SVCB.
+	StripTypes []string
+	// Whether to replace CNAME chains in forwarded A and AAAA answers with
+	// the addresses they lead to, owned by the queried name.
+	FlattenCNAME bool
+	// Whether to remove the authority and additional sections from forwarded
+	// responses, except for OPT records and the SOA records of negative answers.
+	MinimalResponses bool
+	// Names to only resolve at some times of day, blocking them with NXDOMAIN
+	// otherwise, as name=HH:MM-HH:MM[,...] or *=... for all names, and the
+	// time zone the times are in, local time if empty.
+	Schedules        []string
+	ScheduleTimeZone string
+	// Interface to resolve .local names on with mDNS, empty to disable it.
+	MdnsInterface string
+	// Subnets to synthesize PTR records for, as subnet=template.
+	PtrSubnets []string
+	// Addresses to answer all otherwise unanswered A and AAAA queries with, instead of forwarding them.
+	CatchAllIPs []string
+	// How to answer queries without the RD bit that can't be answered locally:
+	// "refused" (the default), "empty" for an empty NOERROR response, "nxdomain" or "forward".
+	NoRecursionResponse string
+	// Whether to remove addresses in RebindRanges from forwarded answers, by
+	// default private, loopback and link-local ones, except for names within RebindExceptions.
+	RebindProtect    bool
+	RebindRanges     []string
+	RebindExceptions []string
+}
+
+// newUpstreamFromURL creates the upstream for rawURL, and returns it with
+// its URL without the password, if any, for the stats.
+func newUpstreamFromURL(rawURL string, opts UpstreamOptions) (Upstream, string, error) {
+	u, err := ParseUpstreamURL(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	upstream, err := NewUpstream(*u, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return upstream, u.Redacted(), nil
+}
+
+// New creates a Proxy, loading its local records from the configured files.
+func New(opts Options) (*Proxy, error) {
+	upstream := opts.Upstream
+	upstreamName := "custom"
+	if upstream == nil && opts.Recursive {
+		recursive, err := newRecursiveUpstream(opts.UpstreamOptions)
+		if err != nil {
+			return nil, err
+		}
+		upstream = recursive
+		upstreamName = "recursive"
+	}
+	if upstream == nil {
+		upstreamURL := opts.UpstreamURL
+		if upstreamURL == "" && opts.UpstreamOptions.DohURITemplate != "" {
+			// The template is enough to tell which server to send queries to.
+			template, err := parseDohTemplate(opts.UpstreamOptions.DohURITemplate)
+			if err != nil {
+				return nil, err
+			}
+			upstreamURL, _ = template.expand("")
+		}
+		var err error
+		upstream, upstreamName, err = newUpstreamFromURL(upstreamURL, opts.UpstreamOptions)
+		if err != nil {
+			return nil, err
+		}
+	} else if len(opts.UpstreamURLs) > 0 {
+		return nil, fmt.Errorf("more upstream URLs can't be given along with a custom or recursive upstream")
+	}
+	if opts.UpstreamFailureThreshold < 0 || opts.UpstreamFailureThreshold > 100 {
+		return nil, fmt.Errorf("the upstream failure threshold must be a percentage between 0 and 100")
+	}
+	instrument := func(upstream Upstream, name string) *instrumentedUpstream {
+		stats := newUpstreamStats(name)
+		stats.failureThreshold = float64(opts.UpstreamFailureThreshold) / 100
+		return &instrumentedUpstream{Upstream: upstream, stats: stats}
+	}
+	upstreams := []*instrumentedUpstream{instrument(upstream, upstreamName)}
+	for _, upstreamURL := range opts.UpstreamURLs {
+		other, name, err := newUpstreamFromURL(upstreamURL, opts.UpstreamOptions)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, instrument(other, name))
+	}
+	allStats := make([]*upstreamStats, 0, len(upstreams))
+	for _, u := range upstreams {
+		allStats = append(allStats, u.stats)
+	}
+	multi, err := newMultiUpstream(upstreams, opts.UpstreamStrategy)
+	if err != nil {
+		return nil, err
+	}
+	upstream = upstreams[0]
+	if len(upstreams) > 1 {
+		upstream = multi
+	}
+
+	if opts.MinTTL < 0 || opts.MaxTTL < 0 || (opts.MaxTTL != 0 && opts.MinTTL > opts.MaxTTL) {
+		return nil, fmt.Errorf("the minimum and maximum TTLs must be positive, with the minimum not above the maximum")
+	}
+
+	if opts.TTLJitter < 0 || opts.TTLJitter > 100 {
+		return nil, fmt.Errorf("the TTL jitter must be a percentage between 0 and 100")
+	}
+
+	proxy := &Proxy{
+		options:         opts,
+		upstream:        upstream,
+		records:         make(map[string][]HostInfo),
+		zoneRecords:     make(rrIndex),
+		cnameCache:      make(map[uint16]map[string]cacheEntry),
+		upstreamStats:   allStats,
+		upstreamLimiter: newUpstreamLimiter(opts.MaxUpstreamConcurrency),
+		localTTL:        opts.LocalTTL,
+		localCNAMETTL:   opts.LocalCNAMETTL,
+		verbose:         opts.Verbose,
+		upstreamTimeout: opts.UpstreamOptions.Timeout,
+		queryDeadline:   opts.QueryDeadline,
+		requireAD:       opts.RequireAD,
+		forwardClientIP: opts.UpstreamOptions.ForwardClientIP,
+		localOnlyTypes:  opts.LocalOnlyTypes,
+		rotateLocal:     opts.LocalRRRotate,
+		singlePtr:       opts.SinglePtr,
+		noAutoPtr:       opts.NoAutoPtr,
+		udpSize:         opts.UdpSize,
+		minTTL:          uint32(opts.MinTTL),
+		maxTTL:          uint32(opts.MaxTTL),
+		ttlJitter:       opts.TTLJitter,
+	}
+
+	proxy.cnameCache[dns.TypeA] = make(map[string]cacheEntry)
+	proxy.cnameCache[dns.TypeAAAA] = make(map[string]cacheEntry)
+
+	for _, subnet := range opts.AllowUpdate {
+		_, ipNet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return nil, err
+		}
+		proxy.updateACL = append(proxy.updateACL, ipNet)
+	}
+	for _, zone := range opts.UpdateZones {
+		proxy.updateZones = append(proxy.updateZones, dns.Fqdn(zone))
+	}
+	if len(proxy.updateACL) > 0 && len(proxy.updateZones) == 0 {
+		return nil, fmt.Errorf("allowing updates requires at least one update zone")
+	}
+
+	proxy.httpsAlpn = make(map[string][]string)
+	for _, mapping := range opts.HttpsAlpn {
+		name, alpn, ok := strings.Cut(mapping, "=")
+		if !ok || alpn == "" {
+			return nil, fmt.Errorf("invalid HTTPS ALPN mapping %q, expected name=alpn[,alpn...]", mapping)
+		}
+		proxy.httpsAlpn[dns.CanonicalName(name)] = strings.Split(alpn, ",")
+	}
+
+	proxy.typePolicies = make(map[string]map[uint16]typePolicy)
+	proxy.noAAAA = opts.NoAAAA
+	if opts.PreferFamily != "" {
+		family, ok := addressFamilies[strings.ToLower(opts.PreferFamily)]
+		if !ok {
+			return nil, fmt.Errorf("invalid preferred address family %q, expected v4 or v6", opts.PreferFamily)
+		}
+		proxy.preferFamily = family
+	}
+	if opts.PreferFamilyNoData < 0 || opts.PreferFamilyNoData > 100 {
+		return nil, fmt.Errorf("the NODATA percentage for the non-preferred address family must be between 0 and 100")
+	}
+	proxy.preferFamilyNoData = opts.PreferFamilyNoData
+	if opts.MaxAnswers < 0 {
+		return nil, fmt.Errorf("the maximum answer count can't be negative")
+	}
+	proxy.maxAnswers = opts.MaxAnswers
+	if opts.TunnelingThreshold < 0 {
+		return nil, fmt.Errorf("the tunneling threshold can't be negative")
+	}
+	proxy.tunnelingThreshold = opts.TunnelingThreshold
+	if proxy.tunnelingThreshold == 0 && opts.BlockTunneling {
+		proxy.tunnelingThreshold = defaultTunnelingThreshold
+	}
+	proxy.blockTunneling = opts.BlockTunneling
+	for _, cidr := range opts.SortSubnets {
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sort subnet: %w", err)
+		}
+		proxy.sortSubnets = append(proxy.sortSubnets, subnet)
+	}
+	strippedTypes, err := parseStripTypes(opts.StripTypes)
+	if err != nil {
+		return nil, err
+	}
+	proxy.strippedTypes = strippedTypes
+	proxy.flattenCNAME = opts.FlattenCNAME
+	proxy.minimalResponses = opts.MinimalResponses
+	for _, spec := range opts.Schedules {
+		schedule, err := parseSchedule(spec)
+		if err != nil {
+			return nil, err
+		}
+		proxy.schedules = append(proxy.schedules, schedule)
+	}
+	if opts.ScheduleTimeZone != "" {
+		proxy.scheduleLocation, err = time.LoadLocation(opts.ScheduleTimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("loading the schedule time zone: %w", err)
+		}
+	}
+	for _, s := range opts.TypePolicies {
+		name, qtype, policy, err := parseTypePolicy(s)
+		if err != nil {
+			return nil, err
+		}
+		if proxy.typePolicies[name] == nil {
+			proxy.typePolicies[name] = make(map[uint16]typePolicy)
+		}
+		proxy.typePolicies[name][qtype] = policy
+	}
+
+	if opts.CacheSize > 0 {
+		proxy.cache = newResponseCache(opts.CacheSize, &proxy.cacheStats)
+		proxy.cache.ecs = opts.EcsCache
+	}
+	if opts.CacheFile != "" {
+		if proxy.cache == nil {
+			return nil, fmt.Errorf("a cache file requires the cache")
+		}
+		proxy.cacheFile = opts.CacheFile
+		proxy.loadCacheFile(opts.CacheFile)
+	}
+	if opts.PrefetchSiblings {
+		if proxy.cache == nil {
+			return nil, fmt.Errorf("prefetching siblings requires the cache")
+		}
+		proxy.prefetchSiblings = true
+	}
+
+	if opts.MdnsInterface != "" {
+		iface, err := net.InterfaceByName(opts.MdnsInterface)
+		if err != nil {
+			return nil, err
+		}
+		proxy.mdns = newMdnsResolver(iface)
+	}
+
+	for _, apex := range opts.ZoneApexes {
+		zone, err := parseAuthZone(apex)
+		if err != nil {
+			return nil, err
+		}
+		proxy.authZones = append(proxy.authZones, zone)
+	}
+	for _, spec := range opts.Delegations {
+		d, err := parseDelegation(spec)
+		if err != nil {
+			return nil, err
+		}
+		proxy.delegations = append(proxy.delegations, d)
+	}
+
+	for _, mapping := range opts.PtrSubnets {
+		ptrSubnet, err := parsePtrSubnet(mapping)
+		if err != nil {
+			return nil, err
+		}
+		proxy.ptrSubnets = append(proxy.ptrSubnets, ptrSubnet)
+	}
+	for _, s := range opts.CatchAllIPs {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid catch-all address %q", s)
+		}
+		proxy.catchAllIPs = append(proxy.catchAllIPs, ip)
+	}
+	if opts.NoRecursionResponse != "" {
+		norecursion, ok := norecursionResponses[strings.ToLower(opts.NoRecursionResponse)]
+		if !ok {
+			return nil, fmt.Errorf("invalid response to non-recursive queries %q, expected refused, empty, nxdomain or forward", opts.NoRecursionResponse)
+		}
+		proxy.norecursion = norecursion
+	}
+	if opts.RebindProtect {
+		ranges := opts.RebindRanges
+		if len(ranges) == 0 {
+			ranges = defaultRebindRanges
+		}
+		for _, cidr := range ranges {
+			_, subnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, err
+			}
+			proxy.rebindRanges = append(proxy.rebindRanges, subnet)
+		}
+		for _, name := range opts.RebindExceptions {
+			proxy.rebindExceptions = append(proxy.rebindExceptions, dns.Fqdn(name))
+		}
+	}
+
+	count := 0
+	for _, hostsFile := range opts.HostsFiles {
+		records, warnings, err := parseHostsFile(hostsFile)
+		for _, warning := range warnings {
+			log.Printf("Ignoring hosts entry at %s\n", warning)
+		}
+		if err != nil {
+			return nil, err
+		}
+		added := mergeRecords(proxy.records, records)
+		proxy.sources = append(proxy.sources, newRecordSource(hostsFile, records, added))
+		count += added
+	}
+
+	if len(opts.HostsFiles) > 0 {
+		log.Printf("Loaded %d unique records from %d hosts files", count, len(opts.HostsFiles))
+	}
+
+	if opts.UseSystemHosts {
+		records, warnings, err := parseSystemHosts(systemHostsPath(), opts.SkipSystemLoopback)
+		for _, warning := range warnings {
+			log.Printf("Ignoring hosts entry at %s\n", warning)
+		}
+		if err != nil {
+			return nil, err
+		}
+		added := mergeRecords(proxy.records, records)
+		proxy.sources = append(proxy.sources, newRecordSource(systemHostsPath(), records, added))
+		log.Printf("Loaded %d records from %s", added, systemHostsPath())
+	}
+
+	for _, zoneFile := range opts.ZoneFiles {
+		records, rrs, err := parseZoneFile(zoneFile)
+		if err != nil {
+			return nil, err
+		}
+		count := mergeRecords(proxy.records, records)
+		proxy.sources = append(proxy.sources, newRecordSource(zoneFile, records, count))
+		count += proxy.zoneRecords.merge(rrs)
+		log.Printf("Loaded %d records from zone %s", count, zoneFile)
+	}
+
+	if opts.Database != "" {
+		database, err := openRecordDatabase(context.Background(), opts.Database)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := database.changed(context.Background()); err != nil {
+			return nil, err
+		}
+		records, added, err := database.loadInto(context.Background(), proxy.records)
+		if err != nil {
+			return nil, err
+		}
+		count := 0
+		for _, hosts := range added {
+			count += len(hosts)
+		}
+		proxy.sources = append(proxy.sources, newRecordSource(opts.Database, records, count))
+		proxy.database = database
+		proxy.databaseRecords = added
+		log.Printf("Loaded %d records from %s", count, opts.Database)
+
+		interval := opts.DatabasePollInterval
+		if interval == 0 {
+			interval = defaultDatabasePollInterval
+		}
+		go proxy.watchDatabase(interval)
+	}
+
+	for _, transfer := range opts.Transfers {
+		t, err := parseTransfer(transfer)
+		if err != nil {
+			return nil, err
+		}
+		if err := proxy.transferZone(t); err != nil {
+			return nil, err
+		}
+		count := 0
+		for _, hosts := range t.records {
+			count += len(hosts)
+		}
+		count += len(t.zoneRRs.all())
+		proxy.sources = append(proxy.sources, newRecordSource(transfer, t.records, count))
+		proxy.transfers = append(proxy.transfers, t)
+		go proxy.watchTransfer(t)
+	}
+
+	if loops := findCNameLoops(proxy.records); len(loops) > 0 {
+		for _, loop := range loops {
+			log.Printf("CNAME loop: %s\n", loop)
+		}
+		return nil, fmt.Errorf("CNAME loops in the local records")
+	}
+
+	proxy.indexRecords()
+
+	return proxy, nil
+}
+
+// Local names are stored in canonical (lowercase) form, since DNS names are
+// case-insensitive. Lookups canonicalize the queried name accordingly.
+func (p *Proxy) lookupRecords(name string) []HostInfo {
+	p.recordsMu.RLock()
+	defer p.recordsMu.RUnlock()
+	return p.records[dns.CanonicalName(name)]
+}
+
+// blockRcode returns the rcode to answer queries for name with if it's
+// blocked by a local entry, or by its schedule at this time of day.
+func (p *Proxy) blockRcode(name string) (int, bool) {
+	if rcode, ok := p.entryBlockRcode(name, 0); ok {
+		return rcode, true
+	}
+	if p.scheduledOut(name) {
+		return dns.RcodeNameError, true
+	}
+	return 0, false
+}
+
+// entryBlockRcode returns the rcode of the local entry blocking name, if
+// any. Local CNAMEs to blocked names are blocked the same way, rather than
+// having their target queried upstream. depth is the length of the CNAME
+// chain followed so far.
+func (p *Proxy) entryBlockRcode(name string, depth int) (int, bool) {
+	var cnames []string
+	for _, record := range p.lookupRecords(name) {
+		if record.IsBlock() {
+			return record.Block, true
+		}
+		if record.IsCName() {
+			cnames = append(cnames, record.CName)
+		}
+	}
+	if depth >= maxCNameDepth {
+		return 0, false
+	}
+	for _, cname := range cnames {
+		if rcode, ok := p.entryBlockRcode(cname, depth+1); ok {
+			return rcode, true
+		}
+	}
+	return 0, false
+}
+
+func (p *Proxy) queryCName(ctx context.Context, cname string, recordType uint16, onBehalfOf net.Addr) ([]dns.RR, error) {
+	p.cnameCacheMu.Lock()
+	cache, ok := p.cnameCache[recordType]
+	if !ok {
+		p.cnameCacheMu.Unlock()
+		return nil, fmt.Errorf("unsupported record type %d", recordType)
+	}
+	cached, ok := cache[cname]
+	p.cnameCacheMu.Unlock()
+	if ok && time.Since(cached.time) < time.Duration(p.localTTL)*time.Second {
+		p.cacheStats.hits.Add(1)
+		return cached.rrs, nil
+	}
+	p.cacheStats.misses.Add(1)
+	if ok {
+		p.cacheStats.evictions.Add(1)
+	}
+
+	// Request the domain's A and AAAA records from the upstream server.
+	req := new(dns.Msg)
+	req.SetQuestion(cname, recordType)
+	req.RecursionDesired = true
+
+	resp, err := p.respondToRequest(ctx, req, onBehalfOf)
+	if err != nil {
+		return nil, err
+	}
+
+	rrs := resp.Answer
+
+	p.cnameCacheMu.Lock()
+	p.cnameCache[recordType][cname] = cacheEntry{rrs, time.Now()}
+	p.cnameCacheMu.Unlock()
+	return rrs, nil
+}
+
+func (p *Proxy) cnameCacheEntries() int {
+	p.cnameCacheMu.Lock()
+	defer p.cnameCacheMu.Unlock()
+	entries := 0
+	for _, cache := range p.cnameCache {
+		entries += len(cache)
+	}
+	return entries
+}
+
+func (p *Proxy) addLocalResponses(ctx context.Context, m *dns.Msg, onBehalfOf net.Addr) bool {
+	ctx, span := startSpan(ctx, "local lookup")
+	defer span.End()
+	foundEntries := false
+	resolvedCName := false
+	referred := false
+	for _, q := range m.Question {
+		if p.addReferral(m, q) {
+			foundEntries = true
+			referred = true
+			continue
+		}
+		policy := p.typePolicy(q)
+		if policy == policyNoData {
+			if p.verbose {
+				log.Printf("%s query for %s answered with NODATA by policy\n", dns.TypeToString[q.Qtype], q.Name)
+			}
+			m.Ns = append(m.Ns, p.syntheticSOA(q.Name))
+			foundEntries = true
+			continue
+		}
+		answerStart, nsStart := len(m.Answer), len(m.Ns)
+		// Addresses are answered below, following CNAMEs and weights.
+		if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+			if rrs := p.lookupLocal(q); len(rrs) > 0 {
+				if p.verbose {
+					log.Printf("%s query for %s answered from local records\n", dns.TypeToString[q.Qtype], q.Name)
+				}
+				m.Answer = append(m.Answer, rrs...)
+				foundEntries = true
+				continue
+			}
+		}
+		if p.addApexRecords(m, q) {
+			foundEntries = true
+			continue
+		}
+		switch q.Qtype {
+		case dns.TypeA:
+			fallthrough
+		case dns.TypeAAAA:
+			queryType := dns.TypeToString[q.Qtype]
+
+			if p.verbose {
+				log.Printf("%s query for %s\n", queryType, q.Name)
+			}
+
+			rrs, found, resolved := p.localAddresses(ctx, q, q.Name, onBehalfOf, make(map[string]bool))
+			if found {
+				var dropped bool
+				if rrs, dropped = p.biasFamily(q, rrs); dropped {
+					m.Ns = append(m.Ns, p.syntheticSOA(q.Name))
+				}
+			}
+			m.Answer = append(m.Answer, rrs...)
+			foundEntries = foundEntries || found
+			resolvedCName = resolvedCName || resolved
+			// Weighted names are already ordered randomly by weight.
+			if p.rotateLocal && !hasWeights(p.lookupRecords(q.Name)) {
+				rotateRRs(m.Answer[answerStart:], int(p.rotation.Add(1)))
+			}
+			break
+		case dns.TypePTR:
+			if p.verbose {
+				log.Printf("PTR query for %s\n", q.Name)
+			}
+			// There are no local PTR records for the address.
+			if ptr, ok := p.synthesizePtr(q.Name); ok {
+				m.Answer = append(m.Answer, &dns.PTR{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: uint32(p.localTTL)},
+					Ptr: ptr,
+				})
+				foundEntries = true
+			}
+		case dns.TypeSVCB, dns.TypeHTTPS:
+			if p.verbose {
+				log.Printf("%s query for %s\n", dns.TypeToString[q.Qtype], q.Name)
+			}
+			if rr := p.serviceBinding(q); rr != nil {
+				m.Answer = append(m.Answer, rr)
+				foundEntries = true
+			} else if p.addLocalNoData(m, q) {
+				foundEntries = true
+			}
+		default:
+			if p.verbose {
+				log.Printf("Unsupported query type %s for %s\n", dns.TypeToString[q.Qtype], q.Name)
+			}
+			if p.addLocalNoData(m, q) {
+				foundEntries = true
+			}
+		}
+		// Keep the query local even if there's nothing to answer it with.
+		if policy == policyLocal && len(m.Answer) == answerStart && len(m.Ns) == nsStart {
+			m.Ns = append(m.Ns, p.syntheticSOA(q.Name))
+			foundEntries = true
+		}
+	}
+	if foundEntries {
+		p.jitterTTLs(m.Answer)
+	}
+	// Answers from local data are authoritative, but not those resolved
+	// through the upstream, nor referrals to the nameservers of subzones.
+	m.Authoritative = foundEntries && !resolvedCName && !referred && p.ownsNames(m.Question)
+	if p.verbose {
+		if foundEntries {
+			log.Printf(" -> locally handled (%d records)\n", len(m.Answer))
+		} else {
+			log.Printf(" -> forwarding to upstream\n")
+		}
+	}
+	if span.IsRecording() {
+		span.SetAttributes(attribute.Bool("dns.local", foundEntries))
+	}
+	return foundEntries
+}
+
+// maxCNameDepth is the longest chain of local CNAMEs followed when answering
+// a query. Loops are rejected when loading records, but dynamic updates can
+// still create them.
+const maxCNameDepth = 16
+
+// localAddresses returns the records answering an A or AAAA question q from
+// the local records of name, following CNAMEs to other local names and
+// resolving those to non-local names through the upstream. It also returns
+// whether name has local records, and whether the upstream was involved.
+// visiting holds the names on the current CNAME chain, to detect loops.
+func (p *Proxy) localAddresses(ctx context.Context, q dns.Question, name string, onBehalfOf net.Addr, visiting map[string]bool) (rrs []dns.RR, found, resolvedCName bool) {
+	canonical := dns.CanonicalName(name)
+	if visiting[canonical] {
+		log.Printf("CNAME loop at %s while resolving %s\n", name, q.Name)
+		return nil, true, false
+	}
+	if len(visiting) >= maxCNameDepth {
+		log.Printf("CNAME chain too long at %s while resolving %s\n", name, q.Name)
+		return nil, true, false
+	}
+	visiting[canonical] = true
+	defer delete(visiting, canonical)
+
+	idx := p.rlockIndex()
+	// Names with addresses of the other family only get NODATA, rather than
+	// being forwarded.
+	found = len(idx.rrs[canonical][dns.TypeA]) > 0 || len(idx.rrs[canonical][dns.TypeAAAA]) > 0
+	addrs := copyRRs(idx.rrs[canonical][q.Qtype], q.Name)
+	cnames := slices.Clone(idx.cnames[canonical])
+	records := p.records[canonical]
+	p.recordsMu.RUnlock()
+
+	for _, record := range records {
+		// Entries for the unspecified address aren't indexed.
+		if record.IsIP() && record.IP.IsUnspecified() {
+			found = true
+			if rr := p.addressRR(q.Name, record); rr.Header().Rrtype == q.Qtype {
+				addrs = append(addrs, rr)
+			}
+		}
+	}
+	if hasWeights(records) {
+		weightedShuffle(addrs, addressWeights(records, addrs))
+	}
+
+	for _, cname := range cnames {
+		if p.hasAddresses(cname) {
+			if p.verbose {
+				log.Printf(" -> following local CNAME %s\n", cname)
+			}
+			targetRRs, _, resolved := p.localAddresses(ctx, q, cname, onBehalfOf, visiting)
+			rrs = append(rrs, targetRRs...)
+			found = true
+			resolvedCName = resolvedCName || resolved
+			continue
+		}
+
+		if p.verbose {
+			log.Printf(" -> querying CNAME %s\n", cname)
+		}
+		targetRRs, err := p.queryCName(ctx, cname, q.Qtype, onBehalfOf)
+		if err != nil {
+			log.Printf("Failed to query %s: %s\n", cname, err.Error())
+			continue
+		}
+		// The records are shared with the CNAME cache, answer with renamed copies.
+		targetRRs = copyRRs(targetRRs, q.Name)
+		if p.localCNAMETTL {
+			for _, rr := range targetRRs {
+				rr.Header().Ttl = uint32(p.localTTL)
+			}
+		}
+		rrs = append(rrs, targetRRs...)
+		found = true
+		resolvedCName = true
+	}
+	return append(addrs, rrs...), found, resolvedCName
+}
+
+// hasAddresses returns whether name has local addresses or CNAMEs.
+func (p *Proxy) hasAddresses(name string) bool {
+	return slices.ContainsFunc(p.lookupRecords(name), func(h HostInfo) bool { return h.IsIP() || h.IsCName() })
+}
+
+// hasWeights returns whether any of records has a weight set.
+func hasWeights(records []HostInfo) bool {
+	return slices.ContainsFunc(records, func(h HostInfo) bool { return h.Weight != 0 })
+}
+
+// addressWeights returns the weights of the address records addrs, from the
+// entries in records they were built from. Addresses without a weight count
+// as 1.
+func addressWeights(records []HostInfo, addrs []dns.RR) []uint32 {
+	weights := make([]uint32, len(addrs))
+	for i, rr := range addrs {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		}
+		weights[i] = 1
+		if j := slices.IndexFunc(records, func(h HostInfo) bool { return h.IP.Equal(ip) }); j != -1 {
+			weights[i] = max(records[j].Weight, 1)
+		}
+	}
+	return weights
+}
+
+// weightedShuffle orders rrs randomly in place, so that each record is
+// likely to come first in proportion to its weight. Clients usually pick
+// the first address, so this spreads them according to the weights.
+func weightedShuffle(rrs []dns.RR, weights []uint32) {
+	var total uint64
+	for _, w := range weights {
+		total += uint64(w)
+	}
+	for i := range rrs {
+		n := rand.Uint64N(total)
+		j := i
+		for n >= uint64(weights[j]) {
+			n -= uint64(weights[j])
+			j++
+		}
+		rrs[i], rrs[j] = rrs[j], rrs[i]
+		weights[i], weights[j] = weights[j], weights[i]
+		total -= uint64(weights[i])
+	}
+}
+
+// rotateRRs rotates rrs left by n positions in place.
+func rotateRRs(rrs []dns.RR, n int) {
+	if len(rrs) < 2 {
+		return
+	}
+	n %= len(rrs)
+	rotated := append(append(make([]dns.RR, 0, len(rrs)), rrs[n:]...), rrs[:n]...)
+	copy(rrs, rotated)
+}
+
+// addLocalNoData adds a NODATA answer to m if q is for a local name and
+// local-only types are enabled or the name is in an authoritative zone,
+// returning whether it did.
+func (p *Proxy) addLocalNoData(m *dns.Msg, q dns.Question) bool {
+	zone, inZone := p.authZone(q.Name)
+	if !(p.localOnlyTypes || inZone) || !p.isLocalName(q.Name) {
+		return false
+	}
+	// Keep queries for local names local: reply NODATA rather than forwarding.
+	if inZone {
+		m.Ns = append(m.Ns, p.zoneSOA(zone))
+	} else {
+		m.Ns = append(m.Ns, p.syntheticSOA(q.Name))
+	}
+	return true
+}
+
+// syntheticSOA returns a SOA record for negative answers about a local name.
+func (p *Proxy) syntheticSOA(name string) dns.RR {
+	mbox := "hostmaster." + name
+	if name == "." {
+		mbox = "hostmaster."
+	} else if _, ok := dns.IsDomainName(mbox); !ok {
+		// The name is too long to be prefixed.
+		mbox = name
+	}
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: uint32(p.localTTL)},
+		Ns:      name,
+		Mbox:    mbox,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  uint32(p.localTTL),
+	}
+}
+
+func getForwardedFor(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.IPAddr:
+		// Queries made with Resolve.
+		return addr.IP
+	case *net.UnixAddr:
+		// Clients on Unix sockets have no IP to forward.
+		return nil
+	default:
+		log.Printf("Unsupported remote address type %T, not forwarding the client IP\n", addr)
+		return nil
+	}
+}
+
+// stripClientSubnet returns r without EDNS client subnet options, copying it if there were any.
+func stripClientSubnet(r *dns.Msg) *dns.Msg {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return r
+	}
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0SUBNET {
+			r = r.Copy()
+			opt = r.IsEdns0()
+			options := make([]dns.EDNS0, 0, len(opt.Option))
+			for _, o := range opt.Option {
+				if o.Option() != dns.EDNS0SUBNET {
+					options = append(options, o)
+				}
+			}
+			opt.Option = options
+			return r
+		}
+	}
+	return r
+}
+
+// echoClientSubnet sets the EDNS client subnet option of resp, a response
+// to r, as RFC 7871 requires: if r has one, it's echoed back, with the scope
+// of the upstream's answer if the option was forwarded, or 0, meaning that
+// the answer applies to all subnets, for local answers and answers to
+// queries whose option was stripped. Otherwise resp must not have one.
+func (p *Proxy) echoClientSubnet(r, resp *dns.Msg) {
+	ecs := clientSubnet(r)
+	var scope uint8
+	if upstream := clientSubnet(resp); upstream != nil && p.forwardClientIP {
+		scope = upstream.SourceScope
+	}
+	opt := resp.IsEdns0()
+	if opt != nil {
+		opt.Option = slices.DeleteFunc(opt.Option, func(o dns.EDNS0) bool { return o.Option() == dns.EDNS0SUBNET })
+	}
+	if ecs == nil {
+		return
+	}
+	if opt == nil {
+		resp.SetEdns0(uint16(p.maxUdpSize(r)), dnssecOk(r))
+		opt = resp.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        ecs.Family,
+		SourceNetmask: ecs.SourceNetmask,
+		SourceScope:   scope,
+		Address:       ecs.Address,
+	})
+}
+
+// normalizeAnswer removes duplicate records from the answer section of resp
+// and makes the case of owner names consistent: lowercase, except for the
+// queried name, which keeps the case it was asked with.
+func normalizeAnswer(req, resp *dns.Msg) {
+	if len(resp.Answer) == 0 {
+		return
+	}
+	answer := resp.Answer[:0]
+next:
+	for _, rr := range resp.Answer {
+		hdr := rr.Header()
+		if len(req.Question) > 0 && strings.EqualFold(hdr.Name, req.Question[0].Name) {
+			hdr.Name = req.Question[0].Name
+		} else {
+			hdr.Name = strings.ToLower(hdr.Name)
+		}
+		for _, kept := range answer {
+			if dns.IsDuplicate(kept, rr) {
+				continue next
+			}
+		}
+		answer = append(answer, rr)
+	}
+	resp.Answer = answer
+}
+
+// questionsMatch returns whether resp answers the question in req. Error
+// responses without a question section are accepted.
+func questionsMatch(req, resp *dns.Msg) bool {
+	if len(resp.Question) == 0 && resp.Rcode != dns.RcodeSuccess {
+		return true
+	}
+	if len(resp.Question) != len(req.Question) {
+		return false
+	}
+	for i, q := range req.Question {
+		rq := resp.Question[i]
+		if rq.Qtype != q.Qtype || rq.Qclass != q.Qclass || !strings.EqualFold(rq.Name, q.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// jitterTTLs randomly raises or lowers the TTLs of the records in sections by
+// up to the jitter percentage, so that clients' caches don't all expire at
+// once. All records move by the same proportion, keeping RRsets consistent.
+// Zero TTLs, which mean the records mustn't be cached, and OPT records are
+// left alone.
+func (p *Proxy) jitterTTLs(sections ...[]dns.RR) {
+	if p.ttlJitter == 0 {
+		return
+	}
+	factor := 1 + float64(p.ttlJitter)/100*(2*rand.Float64()-1)
+	for _, section := range sections {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT || hdr.Ttl == 0 {
+				continue
+			}
+			hdr.Ttl = max(uint32(math.Round(float64(hdr.Ttl)*factor)), 1)
+		}
+	}
+}
+
+// clampTTLs limits the TTLs of the records in m to the configured range.
+func (p *Proxy) clampTTLs(m *dns.Msg) {
+	if p.minTTL == 0 && p.maxTTL == 0 {
+		return
+	}
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			// The TTL of OPT records holds the extended rcode and flags instead.
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if hdr.Ttl < p.minTTL {
+				hdr.Ttl = p.minTTL
+			}
+			if p.maxTTL != 0 && hdr.Ttl > p.maxTTL {
+				hdr.Ttl = p.maxTTL
+			}
+		}
+	}
+}
+
+// dnssecOk returns whether the DO bit is set in the request.
+func dnssecOk(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+func (p *Proxy) respondToRequest(ctx context.Context, r *dns.Msg, onBehalfOf net.Addr) (resp *dns.Msg, err error) {
+	if p.queryDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.queryDeadline)
+		defer cancel()
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Compress = false
+	m.RecursionAvailable = true
+
+	switch r.Opcode {
+	case dns.OpcodeQuery:
+		if len(r.Question) == 0 {
+			// Malformed, or only partially parsed: there's nothing to answer.
+			m.SetRcode(r, dns.RcodeFormatError)
+			return m, nil
+		}
+		if p.flagTunneling(r, onBehalfOf) && p.blockTunneling {
+			m.SetRcode(r, dns.RcodeRefused)
+			p.setExtendedError(r, m, dns.ExtendedErrorCodeBlocked, "possible DNS tunneling")
+			return m, nil
+		}
+		forward := p.forwardedByPolicy(r)
+		if forward && p.verbose {
+			log.Printf("%s query for %s forwarded by policy\n", dns.TypeToString[r.Question[0].Qtype], r.Question[0].Name)
+		}
+		if rcode, ok := p.blockRcode(r.Question[0].Name); ok {
+			if p.verbose {
+				log.Printf("%s query for %s blocked with %s\n", dns.TypeToString[r.Question[0].Qtype], r.Question[0].Name, dns.RcodeToString[rcode])
+			}
+			m.SetRcode(r, rcode)
+			p.setExtendedError(r, m, dns.ExtendedErrorCodeBlocked, "")
+		} else if !forward && p.addLocalResponses(ctx, m, onBehalfOf) {
+			m.SetRcode(r, dns.RcodeSuccess)
+		} else if rcode, ok := p.addZoneNegativeAnswer(m); !forward && ok {
+			m.SetRcode(r, rcode)
+			m.Authoritative = true
+		} else if !forward && p.mdns != nil && len(r.Question) == 1 && isMdnsName(r.Question[0].Name) {
+			if p.verbose {
+				log.Printf(" -> querying mDNS\n")
+			}
+			m.Answer, err = p.mdns.resolve(r.Question[0])
+			if err != nil {
+				return nil, err
+			}
+			if len(m.Answer) == 0 {
+				m.SetRcode(r, dns.RcodeNameError)
+			} else {
+				m.SetRcode(r, dns.RcodeSuccess)
+			}
+		} else if !forward && p.addCatchAllResponses(m) {
+			m.SetRcode(r, dns.RcodeSuccess)
+		} else if r.RecursionDesired || p.norecursion == norecursionForward {
+			resp, err := p.forward(ctx, r, onBehalfOf)
+			if err != nil {
+				return nil, err
+			}
+			p.sortAnswers(resp, onBehalfOf)
+			p.limitAnswers(resp, onBehalfOf)
+			p.echoClientSubnet(r, resp)
+			return resp, nil
+		} else {
+			m.SetRcode(r, p.norecursion.rcode())
+		}
+	case dns.OpcodeUpdate:
+		m.SetRcode(r, p.handleUpdate(r, getForwardedFor(onBehalfOf)))
+	default:
+		// NOTIFY, STATUS and anything else aren't supported (RFC 1035 section 4.1.1).
+		m.SetRcode(r, dns.RcodeNotImplemented)
+	}
+
+	p.clampTTLs(m)
+	p.sortAnswers(m, onBehalfOf)
+	p.limitAnswers(m, onBehalfOf)
+	p.echoClientSubnet(r, m)
+
+	return m, nil
+}
+
+// limitAnswers cuts the answer section of a response to a UDP client down to
+// the maximum number of answers, setting the TC bit so that the client can
+// retry over TCP to get all of them. This makes the proxy less useful for
+// amplification attacks, which rely on UDP's spoofable source addresses.
+func (p *Proxy) limitAnswers(m *dns.Msg, onBehalfOf net.Addr) {
+	if p.maxAnswers <= 0 || len(m.Answer) <= p.maxAnswers {
+		return
+	}
+	if _, ok := onBehalfOf.(*net.UDPAddr); !ok {
+		return
+	}
+	if p.verbose {
+		log.Printf("Truncated the answer for %s from %d to %d records\n", questionName(m), len(m.Answer), p.maxAnswers)
+	}
+	m.Answer = m.Answer[:p.maxAnswers]
+	m.Truncated = true
+}
+
+// norecursionResponse is how queries with the RD bit unset are answered
+// when they can't be answered locally.
+type norecursionResponse int
+
+const (
+	// norecursionRefused refuses them, since the client asked not to recurse.
+	norecursionRefused norecursionResponse = iota
+	// norecursionEmpty answers with an empty NOERROR response.
+	norecursionEmpty
+	// norecursionNXDomain answers NXDOMAIN, as older versions did.
+	norecursionNXDomain
+	// norecursionForward forwards them like any other query.
+	norecursionForward
+)
+
+var norecursionResponses = map[string]norecursionResponse{
+	"refused":  norecursionRefused,
+	"empty":    norecursionEmpty,
+	"nxdomain": norecursionNXDomain,
+	"forward":  norecursionForward,
+}
+
+func (n norecursionResponse) rcode() int {
+	switch n {
+	case norecursionEmpty:
+		return dns.RcodeSuccess
+	case norecursionNXDomain:
+		return dns.RcodeNameError
+	default:
+		return dns.RcodeRefused
+	}
+}
+
+// forward answers r from the upstream, or the response cache.
+func (p *Proxy) forward(ctx context.Context, r *dns.Msg, onBehalfOf net.Addr) (*dns.Msg, error) {
+	forwardedFor := getForwardedFor(onBehalfOf)
+	if !p.forwardClientIP {
+		r = stripClientSubnet(r)
+	}
+	if p.cache != nil {
+		if p.prefetchSiblings {
+			p.prefetchSibling(r, forwardedFor)
+		}
+		_, span := startSpan(ctx, "cache lookup")
+		cached := p.cache.get(r)
+		if span.IsRecording() {
+			span.SetAttributes(attribute.Bool("dns.cache.hit", cached != nil))
+		}
+		span.End()
+		if cached != nil {
+			p.jitterTTLs(cached.Answer, cached.Ns, cached.Extra)
+			p.clampTTLs(cached)
+			cached.CheckingDisabled = r.CheckingDisabled
+			return cached, nil
+		}
+	}
+	resp, err := p.exchange(ctx, r, forwardedFor)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%w: %w", errQueryDeadline, err)
+		}
+		return nil, err
+	}
+	if err := p.processUpstreamResponse(r, resp); err != nil {
+		return nil, err
+	}
+	if p.cache != nil {
+		p.cache.put(r, resp)
+	}
+	p.clampTTLs(resp)
+	return resp, nil
+}
+
+// processUpstreamResponse checks that resp from the upstream answers r and
+// filters it as configured, for client queries and prefetches alike. An
+// error means resp must be neither served nor cached.
+func (p *Proxy) processUpstreamResponse(r, resp *dns.Msg) error {
+	if !questionsMatch(r, resp) {
+		return fmt.Errorf("upstream response question %v doesn't match the query", resp.Question)
+	}
+	// Not every upstream echoes the CD bit, which the client may look at to
+	// tell whether it got the answer it asked for.
+	resp.CheckingDisabled = r.CheckingDisabled
+	normalizeAnswer(r, resp)
+	p.filterRebinding(r, resp)
+	p.stripTypes(resp)
+	p.flattenCNAMEs(r, resp)
+	p.minimizeResponse(resp)
+	// The response is passed through as-is, including RRSIG/NSEC records and the AD bit.
+	// Clients setting CD validate the answers themselves, so they're not held to --require-ad.
+	if p.requireAD && dnssecOk(r) && !r.CheckingDisabled && !resp.AuthenticatedData {
+		return fmt.Errorf("upstream response for %s is %w", r.Question[0].Name, errNotAuthenticated)
+	}
+	return nil
+}
+
+// exchange sends r to the upstream, within the concurrency limit.
+func (p *Proxy) exchange(ctx context.Context, r *dns.Msg, forwardedFor net.IP) (*dns.Msg, error) {
+	if p.upstreamLimiter != nil {
+		if err := p.upstreamLimiter.acquire(ctx); err != nil {
+			return nil, err
+		}
+		defer p.upstreamLimiter.release()
+	}
+	return p.upstream.Exchange(ctx, r, forwardedFor)
+}
+
+// maxUdpSize returns the largest UDP response the client sending r can
+// receive: 512 bytes, or the buffer size it advertises with EDNS, capped to
+// the configured UDP size.
+func (p *Proxy) maxUdpSize(r *dns.Msg) int {
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		size = max(size, int(opt.UDPSize()))
+	}
+	if p.udpSize > 0 {
+		size = min(size, p.udpSize)
+	}
+	return size
+}
+
+// ServeDNS answers a query received by a dns.Server, implementing dns.Handler.
+func (p *Proxy) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	start := time.Now()
+	ctx, span := tracer.Start(context.Background(), "dns.query",
+		trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(questionAttributes(r)...))
+	resp, err := p.respondToRequest(ctx, r, w.RemoteAddr())
+	endSpan(span, resp, err)
+
+	if err != nil {
+		log.Printf("Failed to query %s: %s\n", questionName(r), err.Error())
+		resp = new(dns.Msg)
+		resp.SetReply(r)
+		resp.Compress = false
+		resp.RecursionAvailable = true
+		resp.SetRcode(r, dns.RcodeServerFailure)
+		code, text := extendedErrorFor(err)
+		p.setExtendedError(r, resp, code, text)
+	}
+	if p.queryLog.active() && len(r.Question) > 0 {
+		p.queryLog.publish(queryLogEntry{
+			time:     start,
+			client:   getForwardedFor(w.RemoteAddr()),
+			name:     r.Question[0].Name,
+			qtype:    r.Question[0].Qtype,
+			rcode:    resp.Rcode,
+			duration: time.Since(start),
+		})
+	}
+
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		// Trim responses that don't fit in what the client can receive over
+		// UDP, setting the TC bit so that it retries over TCP.
+		resp.Truncate(p.maxUdpSize(r))
+	} else if resp.Len() > dns.MinMsgSize {
+		// Save bytes on large TCP responses too.
+		resp.Compress = true
+	}
+
+	err = w.WriteMsg(resp)
+	if err != nil {
+		log.Printf("Failed to write response: %s\n", err.Error())
+	}
+}
+
+// questionName returns the name r asks about, for logging.
+func questionName(r *dns.Msg) string {
+	if len(r.Question) == 0 {
+		return "<no question>"
+	}
+	return r.Question[0].Name
+}
+
+// Resolve answers a single question as if a client at client had asked it
+// with recursion desired, without going through a dns.ResponseWriter. client
+// may be nil, in which case no client IP is forwarded upstream. Cancelling ctx
+// cancels the upstream query. Answers aren't cut down to the maximum number
+// for UDP clients, since there's no transport to retry over.
+func (p *Proxy) Resolve(ctx context.Context, q dns.Question, client net.IP) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(q.Name, q.Qtype)
+	req.Question[0].Qclass = q.Qclass
+	return p.respondToRequest(ctx, req, &net.IPAddr{IP: client})
+}
+
+// CheckUpstream sends a canary query for an A record of name straight to the
+// upstream, or to each of them if there are several, bypassing local records
+// and the cache, and returns an error if one fails or isn't answered with
+// NOERROR or NXDOMAIN.
+func (p *Proxy) CheckUpstream(ctx context.Context, name string) error {
+	multi, ok := p.upstream.(*multiUpstream)
+	if !ok {
+		return checkUpstream(ctx, p.upstream, name)
+	}
+	for _, upstream := range multi.upstreams {
+		if err := checkUpstream(ctx, upstream, name); err != nil {
+			return fmt.Errorf("%s: %w", upstream.stats.url, err)
+		}
+	}
+	return nil
+}
+
+func checkUpstream(ctx context.Context, upstream Upstream, name string) error {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	resp, err := upstream.Exchange(ctx, req, nil)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return fmt.Errorf("canary query for %s answered with %s", req.Question[0].Name, dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
+
+// explicitPtrRecords returns the PTR records of the explicit PTR entries in
+// records, which are stored under the reverse names.
+func explicitPtrRecords(records map[string][]HostInfo) map[string][]string {
+	ptrRecords := make(map[string][]string)
+	for name, hosts := range records {
+		for _, host := range hosts {
+			if host.IsPtr() {
+				ptrRecords[name] = append(ptrRecords[name], host.Ptr)
+			}
+		}
+	}
+	sortPtrRecords(ptrRecords)
+	return ptrRecords
+}
+
+// sortPtrRecords sorts the names of each address in ptrRecords, removing
+// duplicates. Names are deduplicated once sorted, rather than while adding
+// them, which would be quadratic in the number of names of an address.
+func sortPtrRecords(ptrRecords map[string][]string) {
+	for reversed, names := range ptrRecords {
+		slices.Sort(names)
+		ptrRecords[reversed] = slices.Compact(names)
+	}
+}
+
+// from net.dnsclient
+// IPv4 addresses may be in their 4 or 16 byte form, and IPv4-mapped IPv6
+// addresses (::ffff:1.2.3.4) get the in-addr.arpa name of their IPv4 address,
+// since net.IP can't tell them apart. Invalid addresses get an empty name.
+func reverseaddr(ip net.IP) (arpa string) {
+	const hexDigit = "0123456789abcdef"
+
+	if ip4 := ip.To4(); ip4 != nil {
+		buf := make([]byte, 0, len("255.255.255.255.in-addr.arpa."))
+		for i := len(ip4) - 1; i >= 0; i-- {
+			buf = strconv.AppendUint(buf, uint64(ip4[i]), 10)
+			buf = append(buf, '.')
+		}
+		return string(append(buf, "in-addr.arpa."...))
+	}
+	ip = ip.To16()
+	if ip == nil {
+		return ""
+	}
+	// Must be IPv6
+	buf := make([]byte, 0, len(ip)*4+len("ip6.arpa."))
+	//Add it, in reverse, to the buffer
+	for i := len(ip) - 1; i >= 0; i-- {
+		v := ip[i]
+		buf = append(buf, hexDigit[v&0xF],
+			'.',
+			hexDigit[v>>4],
+			'.')
+	}
+	//Append "ip6.arpa." and return (buf already has the final .)
+	buf = append(buf, "ip6.arpa."...)
+	return string(buf)
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// queryLogBuffer is how many entries each query log subscriber can fall
+// behind by before entries are dropped for it.
+const queryLogBuffer = 256
+
+// queryLogEntry describes an answered query.
+type queryLogEntry struct {
+	time     time.Time
+	client   net.IP
+	name     string
+	qtype    uint16
+	rcode    int
+	duration time.Duration
+}
+
+// queryLog broadcasts answered queries to the subscribers following them
+// live. The zero value has no subscribers.
+type queryLog struct {
+	mu          sync.Mutex
+	subscribers map[chan queryLogEntry]struct{}
+	// len(subscribers), to skip building entries nobody reads without locking.
+	count atomic.Int32
+}
+
+// subscribe returns a channel receiving the queries answered from now on,
+// and a function to stop receiving them.
+func (l *queryLog) subscribe() (<-chan queryLogEntry, func()) {
+	ch := make(chan queryLogEntry, queryLogBuffer)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.subscribers == nil {
+		l.subscribers = make(map[chan queryLogEntry]struct{})
+	}
+	l.subscribers[ch] = struct{}{}
+	l.count.Add(1)
+	return ch, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if _, ok := l.subscribers[ch]; ok {
+			delete(l.subscribers, ch)
+			l.count.Add(-1)
+		}
+	}
+}
+
+// active returns whether anyone is following the queries.
+func (l *queryLog) active() bool {
+	return l.count.Load() > 0
+}
+
+// publish sends entry to every subscriber, dropping it for those whose
+// buffer is full rather than holding up the query.
+func (l *queryLog) publish(entry queryLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ch := range l.subscribers {
+		select {
+		case ch <- entry:
+		default:
+		}
+	}
+}
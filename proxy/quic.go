@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// QuicUpstream forwards queries to a DNS-over-QUIC server (RFC 9250). A
+// single QUIC connection is kept open and reused, with one stream per query.
+type QuicUpstream struct {
+	addr    string
+	timeout time.Duration
+	tlsConf *tls.Config
+	// Whether to pad queries to hide their length.
+	pad bool
+	// EDNS buffer size and DO bit to set in queries, if not 0 and nil.
+	ednsUDPSize uint16
+	ednsDO      *bool
+
+	connMu sync.Mutex
+	conn   *quic.Conn
+}
+
+func newQuicUpstream(addr string, opts UpstreamOptions) *QuicUpstream {
+	host, _, _ := net.SplitHostPort(addr)
+	return &QuicUpstream{
+		addr:        addr,
+		timeout:     opts.Timeout,
+		pad:         opts.Pad,
+		ednsUDPSize: opts.EdnsUDPSize,
+		ednsDO:      opts.EdnsDO,
+		tlsConf: &tls.Config{
+			ServerName: host,
+			NextProtos: []string{"doq"},
+		},
+	}
+}
+
+// getConn returns the current connection, dialing a new one if there's none or it was closed.
+func (q *QuicUpstream) getConn(ctx context.Context) (*quic.Conn, error) {
+	q.connMu.Lock()
+	defer q.connMu.Unlock()
+
+	if q.conn != nil && q.conn.Context().Err() == nil {
+		return q.conn, nil
+	}
+	conn, err := quic.DialAddr(ctx, q.addr, q.tlsConf, &quic.Config{
+		HandshakeIdleTimeout: q.timeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", q.addr, err)
+	}
+	q.conn = conn
+	return conn, nil
+}
+
+func (q *QuicUpstream) Exchange(ctx context.Context, req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+	if q.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.timeout)
+		defer cancel()
+	}
+
+	conn, err := q.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The message ID must be 0 over DoQ.
+	out := req.Copy()
+	out.Id = 0
+	ednsAddedOpt := setEdns(out, q.ednsUDPSize, q.ednsDO)
+	addedOpt := false
+	if q.pad {
+		addedOpt = padQuery(out)
+	}
+	buf, err := out.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing message: %w", err)
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("opening stream to %s: %w", q.addr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+
+	msg := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(msg, uint16(len(buf)))
+	copy(msg[2:], buf)
+	if _, err := stream.Write(msg); err != nil {
+		return nil, fmt.Errorf("writing to %s: %w", q.addr, err)
+	}
+	// Closing the stream only closes our sending side, signalling the end of the query.
+	if err := stream.Close(); err != nil {
+		return nil, fmt.Errorf("closing stream to %s: %w", q.addr, err)
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return nil, fmt.Errorf("reading from %s: %w", q.addr, err)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(stream, body); err != nil {
+		return nil, fmt.Errorf("reading from %s: %w", q.addr, err)
+	}
+
+	resp := &dns.Msg{}
+	if err := resp.Unpack(body); err != nil {
+		return nil, fmt.Errorf("unpacking response from %s: %w", q.addr, err)
+	}
+	if q.pad {
+		unpadResponse(resp, addedOpt)
+	}
+	if ednsAddedOpt {
+		removeOpt(resp)
+	}
+	resp.Id = req.Id
+	return resp, nil
+}
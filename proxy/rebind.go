@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"github.com/miekg/dns"
+	"log"
+	"net"
+)
+
+// defaultRebindRanges are the address ranges forwarded answers can't point
+// to with rebinding protection enabled, unless others are configured:
+// unspecified, loopback, private (RFC 1918 and RFC 4193) and link-local addresses.
+var defaultRebindRanges = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// rebindExempt returns whether name is allowed to resolve to addresses in the
+// rebinding protection ranges, being one of the exceptions or a subdomain of one.
+func (p *Proxy) rebindExempt(name string) bool {
+	for _, exception := range p.rebindExceptions {
+		if dns.IsSubDomain(exception, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Proxy) inRebindRanges(ip net.IP) bool {
+	for _, subnet := range p.rebindRanges {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterRebinding removes the A and AAAA records pointing to addresses in the
+// rebinding protection ranges from a forwarded response, so that a public
+// name can't be used to reach hosts on the local network. If none of the
+// question's records are left, the response is a NODATA answer. Clients
+// asking with EDNS are told addresses were removed with an extended error.
+func (p *Proxy) filterRebinding(req, resp *dns.Msg) {
+	if len(p.rebindRanges) == 0 || len(resp.Question) != 1 || p.rebindExempt(resp.Question[0].Name) {
+		return
+	}
+	filter := func(rrs []dns.RR) ([]dns.RR, int) {
+		kept := rrs[:0]
+		removed := 0
+		for _, rr := range rrs {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			}
+			if ip != nil && !p.rebindExempt(rr.Header().Name) && p.inRebindRanges(ip) {
+				removed++
+				continue
+			}
+			kept = append(kept, rr)
+		}
+		return kept, removed
+	}
+	var removedAnswers, removedExtra int
+	resp.Answer, removedAnswers = filter(resp.Answer)
+	resp.Extra, removedExtra = filter(resp.Extra)
+	if removedAnswers+removedExtra == 0 {
+		return
+	}
+	p.setExtendedError(req, resp, dns.ExtendedErrorCodeBlocked, "private addresses removed")
+	if p.verbose {
+		log.Printf("Removed %d private addresses from the answer for %s\n", removedAnswers+removedExtra, resp.Question[0].Name)
+	}
+}
@@ -0,0 +1,353 @@
+package proxy
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rootHints lists the root name servers resolution starts from.
+//
+//go:embed named.root
+var rootHints string
+
+const (
+	// maxReferrals is how many delegations are followed resolving a name.
+	maxReferrals = 32
+	// maxResolveDepth is how deeply resolving a name can nest resolving
+	// others, for CNAME targets and nameservers without glue.
+	maxResolveDepth = 8
+	// maxResolveQueries is how many queries resolving a name can send in
+	// total, counting those for CNAME targets and nameservers without
+	// glue, so that chained glueless delegations can't make one query fan
+	// out into thousands (NXNS amplification).
+	maxResolveQueries = 100
+	// maxDelegations is how many delegations are cached, and
+	// maxDelegationTTL the longest they're cached for.
+	maxDelegations   = 10000
+	maxDelegationTTL = 24 * time.Hour
+)
+
+// RecursiveUpstream resolves queries itself, starting from the root servers
+// and following delegations, instead of relying on another resolver.
+type RecursiveUpstream struct {
+	roots     []string
+	port      string
+	client    *dns.Client
+	tcpClient *dns.Client
+
+	// Nameserver addresses learned from referrals, by zone.
+	delegationsMu sync.Mutex
+	delegations   map[string]delegation
+}
+
+var errQueryBudget = errors.New("too many queries")
+
+type delegation struct {
+	servers []string
+	expires time.Time
+}
+
+func newRecursiveUpstream(opts UpstreamOptions) (*RecursiveUpstream, error) {
+	roots, err := parseRootHints(rootHints)
+	if err != nil {
+		return nil, fmt.Errorf("parsing root hints: %w", err)
+	}
+	return &RecursiveUpstream{
+		roots:       roots,
+		port:        "53",
+		client:      &dns.Client{Net: "udp", Timeout: opts.Timeout},
+		tcpClient:   &dns.Client{Net: "tcp", Timeout: opts.Timeout},
+		delegations: make(map[string]delegation),
+	}, nil
+}
+
+// parseRootHints returns the addresses in a root hints file, IPv4 ones first.
+func parseRootHints(hints string) ([]string, error) {
+	var v4, v6 []string
+	zp := dns.NewZoneParser(strings.NewReader(hints), ".", "named.root")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch rr := rr.(type) {
+		case *dns.A:
+			v4 = append(v4, rr.A.String())
+		case *dns.AAAA:
+			v6 = append(v6, rr.AAAA.String())
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if len(v4)+len(v6) == 0 {
+		return nil, errors.New("no root server addresses")
+	}
+	return append(v4, v6...), nil
+}
+
+func (r *RecursiveUpstream) Exchange(ctx context.Context, req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+	if len(req.Question) != 1 {
+		return nil, fmt.Errorf("can't resolve %d questions at once", len(req.Question))
+	}
+	budget := maxResolveQueries
+	result, err := r.resolve(ctx, req.Question[0], 0, &budget)
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(req, result.Rcode)
+	m.RecursionAvailable = true
+	m.Answer = result.Answer
+	m.Ns = result.Ns
+	if opt := req.IsEdns0(); opt != nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+	}
+	return m, nil
+}
+
+// resolve answers q by querying the nameservers of the closest known zone
+// and following their referrals down to the one that has the answer.
+// budget is how many more queries may be sent, and is shared by every
+// resolution started on the way.
+func (r *RecursiveUpstream) resolve(ctx context.Context, q dns.Question, depth int, budget *int) (*dns.Msg, error) {
+	if depth > maxResolveDepth {
+		return nil, fmt.Errorf("resolving %s nests too deeply", q.Name)
+	}
+
+	zone, servers := r.closestDelegation(q.Name)
+	for range maxReferrals {
+		resp, err := r.query(ctx, q, servers, budget)
+		if err != nil {
+			return nil, fmt.Errorf("resolving %s in %s: %w", q.Name, zone, err)
+		}
+		child, nameservers, ttl := referral(resp, zone, q.Name)
+		if len(resp.Answer) > 0 || resp.Rcode == dns.RcodeNameError || child == "" {
+			return r.followCName(ctx, q, zone, resp, depth, budget)
+		}
+
+		servers, err = r.nameserverAddrs(ctx, resp, zone, nameservers, depth, budget)
+		if err != nil {
+			return nil, fmt.Errorf("resolving %s in %s: %w", q.Name, zone, err)
+		}
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("no addresses for the nameservers of %s", child)
+		}
+		r.cacheDelegation(child, servers, ttl)
+		zone = child
+	}
+	return nil, fmt.Errorf("too many referrals resolving %s", q.Name)
+}
+
+// query sends q to each of servers in turn until one answers, taking each
+// query sent from budget.
+func (r *RecursiveUpstream) query(ctx context.Context, q dns.Question, servers []string, budget *int) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(q.Name, q.Qtype)
+	msg.Question[0].Qclass = q.Qclass
+	msg.RecursionDesired = false
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+
+	err := errors.New("no nameservers")
+	for _, server := range servers {
+		if *budget <= 0 {
+			return nil, errQueryBudget
+		}
+		*budget--
+		addr := net.JoinHostPort(server, r.port)
+		resp, _, exchangeErr := r.client.ExchangeContext(ctx, msg, addr)
+		if exchangeErr == nil && resp.Truncated {
+			if *budget <= 0 {
+				return nil, errQueryBudget
+			}
+			*budget--
+			resp, _, exchangeErr = r.tcpClient.ExchangeContext(ctx, msg, addr)
+		}
+		switch {
+		case exchangeErr != nil:
+			err = fmt.Errorf("querying %s: %w", server, exchangeErr)
+		case resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError:
+			err = fmt.Errorf("%s answered %s", server, dns.RcodeToString[resp.Rcode])
+		default:
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// referral returns the zone a response from a nameserver of zone delegates
+// name to, the names of its nameservers and the TTL of the delegation, or
+// an empty zone if the response isn't a referral.
+func referral(resp *dns.Msg, zone, name string) (string, []string, uint32) {
+	child := ""
+	var nameservers []string
+	var ttl uint32
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := dns.CanonicalName(ns.Hdr.Name)
+		// Only accept delegations of a subzone of zone containing name,
+		// otherwise a nameserver could send resolution in circles.
+		if owner == dns.CanonicalName(zone) || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, name) {
+			continue
+		}
+		if child != "" && owner != child {
+			continue
+		}
+		if child == "" || ns.Hdr.Ttl < ttl {
+			ttl = ns.Hdr.Ttl
+		}
+		child = owner
+		nameservers = append(nameservers, dns.CanonicalName(ns.Ns))
+	}
+	return child, nameservers, ttl
+}
+
+// nameserverAddrs returns the addresses of nameservers, from the glue
+// records in a referral from zone if there are any, otherwise by resolving
+// them. It only fails if the query budget runs out.
+func (r *RecursiveUpstream) nameserverAddrs(ctx context.Context, resp *dns.Msg, zone string, nameservers []string, depth int, budget *int) ([]string, error) {
+	var v4, v6 []string
+	for _, rr := range resp.Extra {
+		owner := dns.CanonicalName(rr.Header().Name)
+		// Glue outside the referring zone could be used to hijack other names.
+		if !dns.IsSubDomain(zone, owner) || !containsName(nameservers, owner) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			v4 = append(v4, rr.A.String())
+		case *dns.AAAA:
+			v6 = append(v6, rr.AAAA.String())
+		}
+	}
+	if len(v4)+len(v6) > 0 {
+		return append(v4, v6...), nil
+	}
+
+	for _, ns := range nameservers {
+		result, err := r.resolve(ctx, dns.Question{Name: ns, Qtype: dns.TypeA, Qclass: dns.ClassINET}, depth+1, budget)
+		if errors.Is(err, errQueryBudget) {
+			return nil, err
+		}
+		if err != nil {
+			continue
+		}
+		for _, rr := range result.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				v4 = append(v4, a.A.String())
+			}
+		}
+		if len(v4) > 0 {
+			break
+		}
+	}
+	return v4, nil
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// followCName completes an answer from a nameserver of zone ending in a
+// CNAME to a name it didn't answer for, by resolving the CNAME's target.
+// Records outside zone are dropped, since the nameserver isn't
+// authoritative for them.
+func (r *RecursiveUpstream) followCName(ctx context.Context, q dns.Question, zone string, resp *dns.Msg, depth int, budget *int) (*dns.Msg, error) {
+	answer := resp.Answer[:0]
+	for _, rr := range resp.Answer {
+		if dns.IsSubDomain(zone, rr.Header().Name) {
+			answer = append(answer, rr)
+		}
+	}
+	resp.Answer = answer
+	if q.Qtype == dns.TypeCNAME || resp.Rcode != dns.RcodeSuccess {
+		return resp, nil
+	}
+
+	target := dns.CanonicalName(q.Name)
+	for range len(resp.Answer) {
+		next := ""
+		for _, rr := range resp.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && dns.CanonicalName(cname.Hdr.Name) == target {
+				next = dns.CanonicalName(cname.Target)
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		target = next
+	}
+	if target == dns.CanonicalName(q.Name) {
+		return resp, nil
+	}
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == q.Qtype && dns.CanonicalName(rr.Header().Name) == target {
+			return resp, nil
+		}
+	}
+
+	result, err := r.resolve(ctx, dns.Question{Name: target, Qtype: q.Qtype, Qclass: q.Qclass}, depth+1, budget)
+	if err != nil {
+		return nil, err
+	}
+	resp.Answer = append(resp.Answer, result.Answer...)
+	resp.Ns = result.Ns
+	resp.Rcode = result.Rcode
+	return resp, nil
+}
+
+// closestDelegation returns the closest enclosing zone of name with known
+// nameservers, and their addresses.
+func (r *RecursiveUpstream) closestDelegation(name string) (string, []string) {
+	name = dns.CanonicalName(name)
+	r.delegationsMu.Lock()
+	defer r.delegationsMu.Unlock()
+
+	now := time.Now()
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if d, ok := r.delegations[name[off:]]; ok {
+			if now.Before(d.expires) {
+				return name[off:], d.servers
+			}
+			delete(r.delegations, name[off:])
+		}
+	}
+	return ".", r.roots
+}
+
+func (r *RecursiveUpstream) cacheDelegation(zone string, servers []string, ttl uint32) {
+	if ttl == 0 {
+		return
+	}
+	r.delegationsMu.Lock()
+	defer r.delegationsMu.Unlock()
+
+	now := time.Now()
+	if len(r.delegations) >= maxDelegations {
+		for zone, d := range r.delegations {
+			if !now.Before(d.expires) {
+				delete(r.delegations, zone)
+			}
+		}
+		if len(r.delegations) >= maxDelegations {
+			return
+		}
+	}
+	r.delegations[zone] = delegation{servers: servers, expires: now.Add(min(time.Duration(ttl)*time.Second, maxDelegationTTL))}
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startRecursiveStubs starts a stub nameserver on each of ips, on the same
+// port, returning the port.
+func startRecursiveStubs(t *testing.T, handlers map[string]dns.HandlerFunc, ips ...string) string {
+	port := "0"
+	for _, ip := range ips {
+		pc, err := net.ListenPacket("udp", net.JoinHostPort(ip, port))
+		if err != nil {
+			t.Skip("Can't listen on", ip, err)
+		}
+		_, port, _ = net.SplitHostPort(pc.LocalAddr().String())
+		started := make(chan struct{})
+		server := &dns.Server{PacketConn: pc, Handler: handlers[ip], NotifyStartedFunc: func() { close(started) }}
+		go server.ActivateAndServe()
+		<-started
+		t.Cleanup(func() { server.Shutdown() })
+	}
+	return port
+}
+
+func TestRecursiveUpstream(t *testing.T) {
+	var rootQueries atomic.Int32
+	handlers := map[string]dns.HandlerFunc{
+		// The root delegates example. with glue, and other. without.
+		"127.0.0.1": func(w dns.ResponseWriter, r *dns.Msg) {
+			rootQueries.Add(1)
+			m := new(dns.Msg)
+			m.SetReply(r)
+			if dns.IsSubDomain("example.", r.Question[0].Name) {
+				ns, _ := dns.NewRR("example. 3600 NS ns.example.")
+				glue, _ := dns.NewRR("ns.example. 3600 A 127.0.0.2")
+				// Addresses of names that aren't nameservers of the zone must be ignored.
+				bogus, _ := dns.NewRR("ns.other. 3600 A 6.6.6.6")
+				m.Ns = append(m.Ns, ns)
+				m.Extra = append(m.Extra, glue, bogus)
+			} else if dns.IsSubDomain("other.", r.Question[0].Name) {
+				ns, _ := dns.NewRR("other. 3600 NS ns.other.example.")
+				m.Ns = append(m.Ns, ns)
+			} else {
+				m.Rcode = dns.RcodeNameError
+			}
+			w.WriteMsg(m)
+		},
+		"127.0.0.2": func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Authoritative = true
+			switch dns.CanonicalName(r.Question[0].Name) {
+			case "www.example.":
+				cname, _ := dns.NewRR("www.example. 300 CNAME web.other.")
+				// Not authoritative for other., so this must be ignored.
+				bogus, _ := dns.NewRR("web.other. 300 A 6.6.6.6")
+				m.Answer = append(m.Answer, cname, bogus)
+			case "ns.other.example.":
+				a, _ := dns.NewRR("ns.other.example. 300 A 127.0.0.3")
+				m.Answer = append(m.Answer, a)
+			default:
+				soa, _ := dns.NewRR("example. 300 SOA ns.example. hostmaster.example. 1 3600 600 86400 300")
+				m.Ns = append(m.Ns, soa)
+				m.Rcode = dns.RcodeNameError
+			}
+			w.WriteMsg(m)
+		},
+		"127.0.0.3": func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Authoritative = true
+			a, _ := dns.NewRR(r.Question[0].Name + " 300 A 10.0.0.1")
+			m.Answer = append(m.Answer, a)
+			w.WriteMsg(m)
+		},
+	}
+	port := startRecursiveStubs(t, handlers, "127.0.0.1", "127.0.0.2", "127.0.0.3")
+
+	upstream, err := newRecursiveUpstream(UpstreamOptions{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(upstream.roots) != 26 || upstream.roots[0] != "198.41.0.4" {
+		t.Error("Expected the bundled root hints, IPv4 first, got", upstream.roots)
+	}
+	upstream.roots = []string{"127.0.0.1"}
+	upstream.port = port
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.", dns.TypeA)
+	resp, err := upstream.Exchange(context.Background(), msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Id != msg.Id || resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 2 {
+		t.Fatal("Expected the CNAME and its target's address, got", resp)
+	}
+	if cname, ok := resp.Answer[0].(*dns.CNAME); !ok || cname.Target != "web.other." {
+		t.Error("Expected the CNAME first, got", resp.Answer[0])
+	}
+	if a, ok := resp.Answer[1].(*dns.A); !ok || a.A.String() != "10.0.0.1" {
+		t.Error("Expected the target's address from its own nameserver, got", resp.Answer[1])
+	}
+
+	queries := rootQueries.Load()
+	msg.SetQuestion("missing.example.", dns.TypeA)
+	resp, err = upstream.Exchange(context.Background(), msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeNameError || len(resp.Ns) != 1 {
+		t.Error("Expected NXDOMAIN with the zone's SOA, got", resp)
+	}
+	if rootQueries.Load() != queries {
+		t.Error("Expected the cached delegation of example. to be used instead of querying the root")
+	}
+}
+
+func TestRecursiveUpstreamQueryBudget(t *testing.T) {
+	// Every nameserver of evil. is in evil. without glue, so resolving
+	// them leads to the same referral again, ten times over at each level.
+	var queries atomic.Int32
+	handlers := map[string]dns.HandlerFunc{
+		"127.0.0.1": func(w dns.ResponseWriter, r *dns.Msg) {
+			queries.Add(1)
+			m := new(dns.Msg)
+			m.SetReply(r)
+			for i := range 10 {
+				ns, _ := dns.NewRR(fmt.Sprintf("evil. 3600 NS ns%d.evil.", i))
+				m.Ns = append(m.Ns, ns)
+			}
+			w.WriteMsg(m)
+		},
+	}
+	port := startRecursiveStubs(t, handlers, "127.0.0.1")
+
+	upstream, err := newRecursiveUpstream(UpstreamOptions{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.roots = []string{"127.0.0.1"}
+	upstream.port = port
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.evil.", dns.TypeA)
+	if _, err := upstream.Exchange(context.Background(), msg, nil); !errors.Is(err, errQueryBudget) {
+		t.Error("Expected the query budget to run out, got", err)
+	}
+	if n := queries.Load(); n > maxResolveQueries {
+		t.Error("Expected at most", maxResolveQueries, "queries, got", n)
+	}
+}
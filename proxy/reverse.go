@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ptrSubnet synthesizes PTR records for all addresses in a subnet from a
+// template, where "{ip}" is replaced by the address with its separators
+// turned into dashes (e.g. 10-0-0-1 or fd00--1).
+type ptrSubnet struct {
+	subnet   *net.IPNet
+	template string
+}
+
+// parsePtrSubnet parses a subnet PTR mapping in the form CIDR=template.
+func parsePtrSubnet(s string) (ptrSubnet, error) {
+	cidr, template, ok := strings.Cut(s, "=")
+	if !ok || !strings.Contains(template, "{ip}") {
+		return ptrSubnet{}, fmt.Errorf("invalid PTR subnet mapping %q, expected CIDR=template with {ip} in the template", s)
+	}
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return ptrSubnet{}, err
+	}
+	return ptrSubnet{subnet: subnet, template: strings.TrimSuffix(template, ".") + "."}, nil
+}
+
+func (s ptrSubnet) ptrFor(ip net.IP) (string, bool) {
+	if !s.subnet.Contains(ip) {
+		return "", false
+	}
+	var dashed string
+	if ip4 := ip.To4(); ip4 != nil {
+		dashed = strings.ReplaceAll(ip4.String(), ".", "-")
+	} else {
+		dashed = strings.ReplaceAll(ip.String(), ":", "-")
+	}
+	return strings.ReplaceAll(s.template, "{ip}", dashed), true
+}
+
+// parseReverseAddr is the inverse of reverseaddr: it returns the address an
+// in-addr.arpa or ip6.arpa name refers to, or nil if it isn't a complete one.
+func parseReverseAddr(name string) net.IP {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	if strings.HasSuffix(name, ".in-addr.arpa") {
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) != 4 {
+			return nil
+		}
+		ip := make(net.IP, 4)
+		for i, label := range labels {
+			v, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return nil
+			}
+			ip[3-i] = byte(v)
+		}
+		return ip.To16()
+	}
+
+	if strings.HasSuffix(name, ".ip6.arpa") {
+		labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(labels) != 32 {
+			return nil
+		}
+		ip := make(net.IP, 16)
+		for i, label := range labels {
+			v, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return nil
+			}
+			// Nibbles are in reverse order, least significant first.
+			pos := 31 - i
+			if pos%2 == 0 {
+				ip[pos/2] |= byte(v) << 4
+			} else {
+				ip[pos/2] |= byte(v)
+			}
+		}
+		// IPv4-mapped addresses would be taken for the IPv4 address they map,
+		// which has its own in-addr.arpa name.
+		if ip.To4() != nil {
+			return nil
+		}
+		return ip
+	}
+
+	return nil
+}
+
+// synthesizePtr returns a PTR target for a reverse name from the configured subnet mappings.
+func (p *Proxy) synthesizePtr(name string) (string, bool) {
+	if len(p.ptrSubnets) == 0 {
+		return "", false
+	}
+	ip := parseReverseAddr(name)
+	if ip == nil {
+		return "", false
+	}
+	for _, s := range p.ptrSubnets {
+		if ptr, ok := s.ptrFor(ip); ok {
+			return ptr, true
+		}
+	}
+	return "", false
+}
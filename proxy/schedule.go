@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+	"time"
+)
+
+// timeWindow is a daily time range, in minutes since midnight. Windows
+// ending before they start span midnight, like 22:00-06:00.
+type timeWindow struct {
+	start, end int
+}
+
+func (w timeWindow) contains(minute int) bool {
+	if w.start <= w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+// nameSchedule restricts the names matching a pattern to resolve only
+// within some time windows.
+type nameSchedule struct {
+	// A name, applying to it and its subdomains, or "." for all names.
+	pattern string
+	windows []timeWindow
+}
+
+// parseSchedule parses a schedule in the form pattern=HH:MM-HH:MM[,HH:MM-HH:MM...],
+// where pattern is a name, matching its subdomains too, or * for all names.
+func parseSchedule(s string) (nameSchedule, error) {
+	pattern, windows, _ := strings.Cut(s, "=")
+	if pattern == "" || windows == "" {
+		return nameSchedule{}, fmt.Errorf("invalid schedule %q, expected name=HH:MM-HH:MM[,HH:MM-HH:MM...]", s)
+	}
+	schedule := nameSchedule{pattern: dns.CanonicalName(pattern)}
+	if pattern == "*" {
+		schedule.pattern = "."
+	}
+	for _, window := range strings.Split(windows, ",") {
+		startTime, endTime, _ := strings.Cut(window, "-")
+		start, startErr := time.Parse("15:04", startTime)
+		end, endErr := time.Parse("15:04", endTime)
+		if startErr != nil || endErr != nil {
+			return nameSchedule{}, fmt.Errorf("invalid time window %q in schedule %q, expected HH:MM-HH:MM", window, s)
+		}
+		schedule.windows = append(schedule.windows, timeWindow{
+			start: start.Hour()*60 + start.Minute(),
+			end:   end.Hour()*60 + end.Minute(),
+		})
+	}
+	return schedule, nil
+}
+
+// scheduledOut returns whether name is outside the allowed hours of the
+// most specific schedule matching it.
+func (p *Proxy) scheduledOut(name string) bool {
+	var found *nameSchedule
+	for i, schedule := range p.schedules {
+		if dns.IsSubDomain(schedule.pattern, name) && (found == nil || dns.CountLabel(schedule.pattern) > dns.CountLabel(found.pattern)) {
+			found = &p.schedules[i]
+		}
+	}
+	if found == nil {
+		return false
+	}
+
+	now := time.Now()
+	if p.now != nil {
+		now = p.now()
+	}
+	if p.scheduleLocation != nil {
+		now = now.In(p.scheduleLocation)
+	}
+	minute := now.Hour()*60 + now.Minute()
+	for _, window := range found.windows {
+		if window.contains(minute) {
+			return false
+		}
+	}
+	return true
+}
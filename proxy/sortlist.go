@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"slices"
+)
+
+// sortAnswers moves the addresses in m's answer that share one of the sort
+// subnets with the client at onBehalfOf ahead of the others, since clients
+// usually connect to the first address, and addresses on their own subnet
+// are the quickest to reach. Other records, like CNAMEs, stay where they are,
+// and the order is kept otherwise, so rotation and weights still apply.
+func (p *Proxy) sortAnswers(m *dns.Msg, onBehalfOf net.Addr) {
+	if len(p.sortSubnets) == 0 || len(m.Answer) < 2 {
+		return
+	}
+	client := getForwardedFor(onBehalfOf)
+	if client == nil {
+		return
+	}
+	var subnets []*net.IPNet
+	for _, subnet := range p.sortSubnets {
+		if subnet.Contains(client) {
+			subnets = append(subnets, subnet)
+		}
+	}
+	if len(subnets) == 0 {
+		return
+	}
+
+	var positions []int
+	var addrs []dns.RR
+	for i, rr := range m.Answer {
+		switch rr.(type) {
+		case *dns.A, *dns.AAAA:
+			positions = append(positions, i)
+			addrs = append(addrs, rr)
+		}
+	}
+	near := func(rr dns.RR) bool {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		}
+		return slices.ContainsFunc(subnets, func(subnet *net.IPNet) bool { return subnet.Contains(ip) })
+	}
+	slices.SortStableFunc(addrs, func(a, b dns.RR) int {
+		switch nearA, nearB := near(a), near(b); {
+		case nearA && !nearB:
+			return -1
+		case nearB && !nearA:
+			return 1
+		}
+		return 0
+	})
+	for i, position := range positions {
+		m.Answer[position] = addrs[i]
+	}
+}
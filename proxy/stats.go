@@ -0,0 +1,326 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencySamples is how many of the most recent latencies percentiles are computed over.
+const latencySamples = 1024
+
+// latencyEwmaWeight is the weight of each new latency in the moving average,
+// so that it follows changes in the upstream's latency within a few dozen queries.
+const latencyEwmaWeight = 0.1
+
+// failureWindow is how many of the most recent queries the failure rate is
+// computed over, and failureMinQueries how many it takes before warning about it.
+const (
+	failureWindow     = 100
+	failureMinQueries = 20
+)
+
+// upstreamStats counts the queries sent to an upstream.
+type upstreamStats struct {
+	url       string
+	requests  atomic.Uint64
+	errors    atomic.Uint64
+	servfails atomic.Uint64
+
+	latenciesMu sync.Mutex
+	latencies   []time.Duration
+	next        int
+	// Exponentially weighted moving average of the latencies, an estimate
+	// of the upstream's current latency.
+	latencyEwma time.Duration
+
+	// Whether each of the recent queries failed, with an error or SERVFAIL.
+	failuresMu  sync.Mutex
+	failures    []bool
+	nextFailure int
+	// Failure rate above which a warning is logged, 0 to never warn, and
+	// whether it's currently above it.
+	failureThreshold float64
+	degraded         bool
+}
+
+func newUpstreamStats(url string) *upstreamStats {
+	return &upstreamStats{
+		url:       url,
+		latencies: make([]time.Duration, 0, latencySamples),
+		failures:  make([]bool, 0, failureWindow),
+	}
+}
+
+// observeResult records whether a query failed, and logs a warning when the
+// failure rate over the recent queries crosses the threshold.
+func (s *upstreamStats) observeResult(resp *dns.Msg, err error) {
+	failed := err != nil || resp.Rcode == dns.RcodeServerFailure
+	if err == nil && failed {
+		s.servfails.Add(1)
+	}
+
+	s.failuresMu.Lock()
+	defer s.failuresMu.Unlock()
+	if len(s.failures) < failureWindow {
+		s.failures = append(s.failures, failed)
+	} else {
+		s.failures[s.nextFailure] = failed
+		s.nextFailure = (s.nextFailure + 1) % failureWindow
+	}
+
+	if s.failureThreshold == 0 || len(s.failures) < failureMinQueries {
+		return
+	}
+	rate := s.failureRateLocked()
+	if !s.degraded && rate >= s.failureThreshold {
+		s.degraded = true
+		log.Printf("Warning: %.0f%% of the last %d queries to %s failed\n", rate*100, len(s.failures), s.url)
+	} else if s.degraded && rate < s.failureThreshold {
+		s.degraded = false
+		log.Printf("Failure rate of %s back to %.0f%%\n", s.url, rate*100)
+	}
+}
+
+// failureRate returns the share of the recent queries that failed, with an error or SERVFAIL.
+func (s *upstreamStats) failureRate() float64 {
+	s.failuresMu.Lock()
+	defer s.failuresMu.Unlock()
+	return s.failureRateLocked()
+}
+
+func (s *upstreamStats) failureRateLocked() float64 {
+	if len(s.failures) == 0 {
+		return 0
+	}
+	failed := 0
+	for _, f := range s.failures {
+		if f {
+			failed++
+		}
+	}
+	return float64(failed) / float64(len(s.failures))
+}
+
+func (s *upstreamStats) observe(latency time.Duration, err error) {
+	s.requests.Add(1)
+	if err != nil {
+		s.errors.Add(1)
+	}
+
+	s.latenciesMu.Lock()
+	defer s.latenciesMu.Unlock()
+	if len(s.latencies) == 0 {
+		s.latencyEwma = latency
+	} else {
+		s.latencyEwma += time.Duration(latencyEwmaWeight * float64(latency-s.latencyEwma))
+	}
+	if len(s.latencies) < latencySamples {
+		s.latencies = append(s.latencies, latency)
+	} else {
+		s.latencies[s.next] = latency
+		s.next = (s.next + 1) % latencySamples
+	}
+}
+
+// latencyEstimate returns the moving average of the upstream's latency, 0 if it hasn't been queried yet.
+func (s *upstreamStats) latencyEstimate() time.Duration {
+	s.latenciesMu.Lock()
+	defer s.latenciesMu.Unlock()
+	return s.latencyEwma
+}
+
+// selectionScore returns what the adaptive strategy ranks upstreams by, lowest
+// first: the latency estimate, raised by the recent failure rate so that an
+// upstream failing fast doesn't look fast. Upstreams that haven't been queried
+// yet score 0, so that they're tried first.
+func (s *upstreamStats) selectionScore() float64 {
+	rate := s.failureRate()
+	if rate >= 1 {
+		return math.Inf(1)
+	}
+	return float64(s.latencyEstimate()) / (1 - rate)
+}
+
+// percentiles returns the given percentiles of the recent latencies, 0 if there are none.
+func (s *upstreamStats) percentiles(ps ...float64) []time.Duration {
+	s.latenciesMu.Lock()
+	sorted := slices.Clone(s.latencies)
+	s.latenciesMu.Unlock()
+	slices.Sort(sorted)
+
+	result := make([]time.Duration, len(ps))
+	if len(sorted) == 0 {
+		return result
+	}
+	for i, p := range ps {
+		result[i] = sorted[int(p*float64(len(sorted)-1))]
+	}
+	return result
+}
+
+// instrumentedUpstream records stats about the queries sent to an Upstream.
+type instrumentedUpstream struct {
+	Upstream
+	stats *upstreamStats
+}
+
+func (u *instrumentedUpstream) Exchange(ctx context.Context, req *dns.Msg, forwardedFor net.IP) (*dns.Msg, error) {
+	ctx, span := startSpan(ctx, "upstream exchange", trace.WithSpanKind(trace.SpanKindClient))
+	if span.IsRecording() {
+		span.SetAttributes(append(questionAttributes(req), attribute.String("dns.upstream", u.stats.url))...)
+	}
+	start := time.Now()
+	resp, err := u.Upstream.Exchange(ctx, req, forwardedFor)
+	endSpan(span, resp, err)
+	u.stats.observe(time.Since(start), err)
+	u.stats.observeResult(resp, err)
+	return resp, err
+}
+
+// cacheStats counts how the CNAME and response caches are used.
+type cacheStats struct {
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+type upstreamStatsJSON struct {
+	URL       string `json:"url"`
+	Requests  uint64 `json:"requests"`
+	Errors    uint64 `json:"errors"`
+	Servfails uint64 `json:"servfails"`
+	// Share of the recent queries that failed, with an error or SERVFAIL.
+	FailureRate  float64 `json:"failure_rate"`
+	LatencyP50Ms float64 `json:"latency_p50_ms"`
+	LatencyP95Ms float64 `json:"latency_p95_ms"`
+	// Moving average of the latency, weighted towards recent queries.
+	LatencyEwmaMs float64 `json:"latency_ewma_ms"`
+}
+
+type cacheStatsJSON struct {
+	Entries   int    `json:"entries"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+type statsJSON struct {
+	Upstreams []upstreamStatsJSON `json:"upstreams"`
+	// Queries to the upstream in flight, and those refused over the concurrency limit.
+	InFlight uint64         `json:"in_flight"`
+	Rejected uint64         `json:"rejected"`
+	Cache    cacheStatsJSON `json:"cache"`
+	// Queries flagged as possible DNS tunneling.
+	TunnelingFlagged uint64 `json:"tunneling_flagged"`
+}
+
+func (p *Proxy) stats() statsJSON {
+	stats := statsJSON{Upstreams: make([]upstreamStatsJSON, 0, len(p.upstreamStats))}
+	for _, s := range p.upstreamStats {
+		latencies := s.percentiles(0.5, 0.95)
+		stats.Upstreams = append(stats.Upstreams, upstreamStatsJSON{
+			URL:           s.url,
+			Requests:      s.requests.Load(),
+			Errors:        s.errors.Load(),
+			Servfails:     s.servfails.Load(),
+			FailureRate:   s.failureRate(),
+			LatencyP50Ms:  latencies[0].Seconds() * 1000,
+			LatencyP95Ms:  latencies[1].Seconds() * 1000,
+			LatencyEwmaMs: s.latencyEstimate().Seconds() * 1000,
+		})
+	}
+	if p.upstreamLimiter != nil {
+		stats.InFlight = uint64(p.upstreamLimiter.inFlight.Load())
+		stats.Rejected = p.upstreamLimiter.rejected.Load()
+	}
+	entries := p.cnameCacheEntries()
+	if p.cache != nil {
+		entries += p.cache.len()
+	}
+	stats.Cache = cacheStatsJSON{
+		Entries:   entries,
+		Hits:      p.cacheStats.hits.Load(),
+		Misses:    p.cacheStats.misses.Load(),
+		Evictions: p.cacheStats.evictions.Load(),
+	}
+	stats.TunnelingFlagged = p.tunnelingFlagged.Load()
+	return stats
+}
+
+// StatsHandler serves the stats as JSON on /stats, and in the Prometheus
+// text format on /metrics.
+func (p *Proxy) StatsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(p.stats()); err != nil {
+			log.Printf("Failed to write stats response: %s\n", err.Error())
+		}
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		p.writeMetrics(w)
+	})
+	return mux
+}
+
+func (p *Proxy) writeMetrics(w http.ResponseWriter) {
+	stats := p.stats()
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("dns_proxy_upstream_requests_total", "counter", "Queries sent to the upstream.")
+	for _, s := range stats.Upstreams {
+		fmt.Fprintf(w, "dns_proxy_upstream_requests_total{upstream=%q} %d\n", s.URL, s.Requests)
+	}
+	metric("dns_proxy_upstream_errors_total", "counter", "Queries to the upstream that failed.")
+	for _, s := range stats.Upstreams {
+		fmt.Fprintf(w, "dns_proxy_upstream_errors_total{upstream=%q} %d\n", s.URL, s.Errors)
+	}
+	metric("dns_proxy_upstream_servfails_total", "counter", "Queries to the upstream answered with SERVFAIL.")
+	for _, s := range stats.Upstreams {
+		fmt.Fprintf(w, "dns_proxy_upstream_servfails_total{upstream=%q} %d\n", s.URL, s.Servfails)
+	}
+	metric("dns_proxy_upstream_failure_rate", "gauge", "Share of the recent queries to the upstream that failed with an error or SERVFAIL.")
+	for _, s := range stats.Upstreams {
+		fmt.Fprintf(w, "dns_proxy_upstream_failure_rate{upstream=%q} %g\n", s.URL, s.FailureRate)
+	}
+	metric("dns_proxy_upstream_latency_seconds", "gauge", "Upstream latency percentiles over recent queries.")
+	for _, s := range stats.Upstreams {
+		fmt.Fprintf(w, "dns_proxy_upstream_latency_seconds{upstream=%q,quantile=\"0.5\"} %g\n", s.URL, s.LatencyP50Ms/1000)
+		fmt.Fprintf(w, "dns_proxy_upstream_latency_seconds{upstream=%q,quantile=\"0.95\"} %g\n", s.URL, s.LatencyP95Ms/1000)
+	}
+	metric("dns_proxy_upstream_latency_ewma_seconds", "gauge", "Moving average of the upstream latency, weighted towards recent queries.")
+	for _, s := range stats.Upstreams {
+		fmt.Fprintf(w, "dns_proxy_upstream_latency_ewma_seconds{upstream=%q} %g\n", s.URL, s.LatencyEwmaMs/1000)
+	}
+	metric("dns_proxy_upstream_in_flight", "gauge", "Queries to the upstream waiting for a response.")
+	fmt.Fprintf(w, "dns_proxy_upstream_in_flight %d\n", stats.InFlight)
+	metric("dns_proxy_upstream_rejected_total", "counter", "Queries not sent to the upstream because too many were in flight.")
+	fmt.Fprintf(w, "dns_proxy_upstream_rejected_total %d\n", stats.Rejected)
+
+	metric("dns_proxy_cache_entries", "gauge", "Entries in the CNAME and response caches.")
+	fmt.Fprintf(w, "dns_proxy_cache_entries %d\n", stats.Cache.Entries)
+	metric("dns_proxy_cache_hits_total", "counter", "CNAME and response cache hits.")
+	fmt.Fprintf(w, "dns_proxy_cache_hits_total %d\n", stats.Cache.Hits)
+	metric("dns_proxy_cache_misses_total", "counter", "CNAME and response cache misses.")
+	fmt.Fprintf(w, "dns_proxy_cache_misses_total %d\n", stats.Cache.Misses)
+	metric("dns_proxy_cache_evictions_total", "counter", "Cache entries evicted because they expired or the cache was full.")
+	fmt.Fprintf(w, "dns_proxy_cache_evictions_total %d\n", stats.Cache.Evictions)
+
+	metric("dns_proxy_tunneling_flagged_total", "counter", "Queries flagged as possible DNS tunneling.")
+	fmt.Fprintf(w, "dns_proxy_tunneling_flagged_total %d\n", stats.TunnelingFlagged)
+}
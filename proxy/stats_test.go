@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	stats := newUpstreamStats("dns://upstream")
+	proxy := &Proxy{
+		records:       map[string][]HostInfo{"alias.": {{CName: "example.com."}}},
+		cnameCache:    map[uint16]map[string]cacheEntry{dns.TypeA: {}},
+		localTTL:      10,
+		upstreamStats: []*upstreamStats{stats},
+		upstream: &instrumentedUpstream{
+			Upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+				if req.Question[0].Name == "fail.example." {
+					return nil, errors.New("failed")
+				}
+				return replyA(req), nil
+			}),
+			stats: stats,
+		},
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	for _, name := range []string{"alias.", "alias.", "fail.example."} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		proxy.respondToRequest(context.Background(), msg, addr)
+	}
+
+	server := httptest.NewServer(proxy.StatsHandler())
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got statsJSON
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(got.Upstreams) != 1 || got.Upstreams[0].Requests != 2 || got.Upstreams[0].Errors != 1 {
+		t.Error("Incorrect upstream stats:", got.Upstreams)
+	}
+	if got.Cache != (cacheStatsJSON{Entries: 1, Hits: 1, Misses: 1}) {
+		t.Error("Incorrect cache stats:", got.Cache)
+	}
+
+	resp, err = server.Client().Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, line := range []string{
+		`dns_proxy_upstream_requests_total{upstream="dns://upstream"} 2`,
+		`dns_proxy_upstream_errors_total{upstream="dns://upstream"} 1`,
+		`dns_proxy_cache_hits_total 1`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("Expected %q in metrics, got:\n%s", line, body)
+		}
+	}
+}
+
+func TestLatencyEstimate(t *testing.T) {
+	stats := newUpstreamStats("dns://upstream")
+	if got := stats.latencyEstimate(); got != 0 {
+		t.Error("Expected no estimate before any query, got", got)
+	}
+	stats.observe(100*time.Millisecond, nil)
+	if got := stats.latencyEstimate(); got != 100*time.Millisecond {
+		t.Error("Expected the first latency as the estimate, got", got)
+	}
+	for range 100 {
+		stats.observe(10*time.Millisecond, nil)
+	}
+	if got := stats.latencyEstimate(); got < 10*time.Millisecond || got > 11*time.Millisecond {
+		t.Error("Expected the estimate to follow the recent latencies, got", got)
+	}
+}
+
+func TestFailureRate(t *testing.T) {
+	stats := newUpstreamStats("dns://upstream")
+	stats.failureThreshold = 0.5
+	servfail := new(dns.Msg)
+	servfail.Rcode = dns.RcodeServerFailure
+	ok := new(dns.Msg)
+
+	for range failureMinQueries / 2 {
+		stats.observeResult(servfail, nil)
+		stats.observeResult(nil, errors.New("failed"))
+	}
+	if got := stats.failureRate(); got != 1 {
+		t.Error("Expected all queries to count as failed, got", got)
+	}
+	if got := stats.servfails.Load(); got != failureMinQueries/2 {
+		t.Error("Expected only SERVFAIL answers to be counted as SERVFAILs, got", got)
+	}
+	if !stats.degraded {
+		t.Error("Expected the upstream to be degraded above the threshold")
+	}
+
+	for range failureMinQueries + 1 {
+		stats.observeResult(ok, nil)
+	}
+	if stats.degraded {
+		t.Error("Expected the upstream to recover below the threshold, got a failure rate of", stats.failureRate())
+	}
+
+	for range failureWindow {
+		stats.observeResult(ok, nil)
+	}
+	if got := stats.failureRate(); got != 0 {
+		t.Error("Expected old failures to leave the window, got", got)
+	}
+}
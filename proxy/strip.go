@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"strings"
+)
+
+// parseStripTypes parses lists of record types, such as HTTPS,SVCB.
+func parseStripTypes(lists []string) (map[uint16]bool, error) {
+	types := make(map[uint16]bool)
+	for _, list := range lists {
+		for _, name := range strings.Split(list, ",") {
+			qtype, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(name))]
+			if !ok {
+				return nil, fmt.Errorf("invalid record type %q to strip", name)
+			}
+			types[qtype] = true
+		}
+	}
+	return types, nil
+}
+
+// stripTypes removes the records of the types configured to be stripped
+// from the answer and additional sections of a forwarded response, for
+// clients that mishandle them. If that leaves no answer, the response is
+// a NODATA answer, with a SOA record so that it's cached as one.
+func (p *Proxy) stripTypes(resp *dns.Msg) {
+	if len(p.strippedTypes) == 0 || len(resp.Question) != 1 {
+		return
+	}
+	strip := func(rrs []dns.RR) ([]dns.RR, int) {
+		kept := rrs[:0]
+		for _, rr := range rrs {
+			if !p.strippedTypes[rr.Header().Rrtype] {
+				kept = append(kept, rr)
+			}
+		}
+		return kept, len(rrs) - len(kept)
+	}
+	var removedAnswers, removedExtra int
+	resp.Answer, removedAnswers = strip(resp.Answer)
+	resp.Extra, removedExtra = strip(resp.Extra)
+	if removedAnswers > 0 && len(resp.Answer) == 0 && !hasSOA(resp.Ns) {
+		resp.Ns = append(resp.Ns, p.syntheticSOA(resp.Question[0].Name))
+	}
+	if removedAnswers+removedExtra > 0 && p.verbose {
+		log.Printf("Stripped %d records from the answer for %s\n", removedAnswers+removedExtra, resp.Question[0].Name)
+	}
+}
+
+// minimizeResponse removes the authority and additional sections from a
+// forwarded response, for clients that choke on large responses, keeping
+// only the OPT record. Negative answers keep their authority section, whose
+// SOA record tells clients how long to cache them.
+func (p *Proxy) minimizeResponse(resp *dns.Msg) {
+	if !p.minimalResponses {
+		return
+	}
+	if len(resp.Answer) > 0 {
+		resp.Ns = nil
+	}
+	extra := resp.Extra[:0]
+	for _, rr := range resp.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	resp.Extra = extra
+}
+
+func hasSOA(rrs []dns.RR) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"github.com/miekg/dns"
+	"net"
+)
+
+// serviceBinding synthesizes an HTTPS or SVCB record for a local name with
+// configured ALPN protocols, hinting the name's local addresses. It returns
+// nil if the name has no configured ALPN protocols.
+func (p *Proxy) serviceBinding(q dns.Question) dns.RR {
+	alpn, ok := p.httpsAlpn[dns.CanonicalName(q.Name)]
+	if !ok {
+		return nil
+	}
+
+	var v4, v6 []net.IP
+	for _, record := range p.lookupRecords(q.Name) {
+		if !record.IsIP() {
+			continue
+		}
+		if ip4 := record.IP.To4(); ip4 != nil {
+			v4 = append(v4, ip4)
+		} else {
+			v6 = append(v6, record.IP)
+		}
+	}
+
+	// Keys must be in increasing order.
+	values := []dns.SVCBKeyValue{&dns.SVCBAlpn{Alpn: alpn}}
+	if len(v4) > 0 {
+		values = append(values, &dns.SVCBIPv4Hint{Hint: v4})
+	}
+	if len(v6) > 0 {
+		values = append(values, &dns.SVCBIPv6Hint{Hint: v6})
+	}
+
+	svcb := dns.SVCB{
+		Hdr:      dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: uint32(p.localTTL)},
+		Priority: 1,
+		Target:   ".",
+		Value:    values,
+	}
+	if q.Qtype == dns.TypeHTTPS {
+		return &dns.HTTPS{SVCB: svcb}
+	}
+	return &svcb
+}
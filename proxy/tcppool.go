@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"time"
+)
+
+const (
+	// Maximum number of TCP connections open to an upstream at once.
+	tcpPoolSize = 4
+	// How long idle TCP connections are kept for reuse.
+	tcpIdleTimeout = 30 * time.Second
+	// TCP keepalive period for pooled connections.
+	tcpKeepAlive = 15 * time.Second
+)
+
+var errPoolExhausted = errors.New("all TCP connections to the upstream are busy")
+
+type pooledConn struct {
+	*dns.Conn
+	idleSince time.Time
+}
+
+// tcpPool keeps TCP connections to an upstream open for reuse by queries
+// retried over TCP, capping how many are open at once.
+type tcpPool struct {
+	addr        string
+	timeout     time.Duration
+	idleTimeout time.Duration
+
+	// open holds a token for each open connection, and idle the connections not in use.
+	open chan struct{}
+	idle chan *pooledConn
+}
+
+func newTcpPool(addr string, size int, timeout, idleTimeout time.Duration) *tcpPool {
+	return &tcpPool{
+		addr:        addr,
+		timeout:     timeout,
+		idleTimeout: idleTimeout,
+		open:        make(chan struct{}, size),
+		idle:        make(chan *pooledConn, size),
+	}
+}
+
+// get returns an idle connection, or a new one if there's none and the pool
+// isn't full, waiting up to the timeout, if any, or until ctx is done for one
+// to become available.
+func (p *tcpPool) get(ctx context.Context) (*pooledConn, error) {
+	var expired <-chan time.Time
+	if p.timeout > 0 {
+		timer := time.NewTimer(p.timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		// Prefer idle connections to dialing new ones.
+		select {
+		case conn := <-p.idle:
+			if p.usable(conn) {
+				return conn, nil
+			}
+			continue
+		default:
+		}
+
+		select {
+		case conn := <-p.idle:
+			if p.usable(conn) {
+				return conn, nil
+			}
+		case p.open <- struct{}{}:
+			dialer := net.Dialer{Timeout: p.timeout}
+			conn, err := dialer.DialContext(ctx, "tcp", p.addr)
+			if err != nil {
+				<-p.open
+				return nil, fmt.Errorf("connecting to %s: %w", p.addr, err)
+			}
+			conn.(*net.TCPConn).SetKeepAlivePeriod(tcpKeepAlive)
+			return &pooledConn{Conn: &dns.Conn{Conn: conn}}, nil
+		case <-expired:
+			return nil, errPoolExhausted
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// usable returns whether an idle connection can be reused, closing it if not.
+func (p *tcpPool) usable(conn *pooledConn) bool {
+	if time.Since(conn.idleSince) < p.idleTimeout {
+		return true
+	}
+	p.discard(conn)
+	return false
+}
+
+// put returns a connection to the pool after a successful exchange.
+func (p *tcpPool) put(conn *pooledConn) {
+	if p.idleTimeout <= 0 {
+		p.discard(conn)
+		return
+	}
+	conn.idleSince = time.Now()
+	p.idle <- conn
+}
+
+// discard closes a connection that can't be reused.
+func (p *tcpPool) discard(conn *pooledConn) {
+	conn.Close()
+	<-p.open
+}
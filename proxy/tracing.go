@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of query handling. It uses the global
+// OpenTelemetry tracer provider, so spans are only recorded once one is set
+// with otel.SetTracerProvider.
+var tracer = otel.Tracer("dns-server/proxy")
+
+// startSpan starts a child span of the span in ctx, if that one is being
+// recorded. Otherwise the child wouldn't be either, and creating it would
+// only cost allocations on the hot path, so the parent is returned as is.
+func startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	parent := trace.SpanFromContext(ctx)
+	if !parent.IsRecording() {
+		return ctx, parent
+	}
+	return tracer.Start(ctx, name, opts...)
+}
+
+// questionAttributes returns the span attributes describing the question of r.
+func questionAttributes(r *dns.Msg) []attribute.KeyValue {
+	if len(r.Question) == 0 {
+		return nil
+	}
+	return []attribute.KeyValue{
+		attribute.String("dns.question.name", r.Question[0].Name),
+		attribute.String("dns.question.type", dns.TypeToString[r.Question[0].Qtype]),
+	}
+}
+
+// endSpan records the outcome of a query on span and ends it.
+func endSpan(span trace.Span, resp *dns.Msg, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if resp != nil {
+		span.SetAttributes(attribute.String("dns.response.rcode", dns.RcodeToString[resp.Rcode]))
+	}
+	span.End()
+}
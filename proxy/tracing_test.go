@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"net"
+	"testing"
+)
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(previous)
+
+	stats := newUpstreamStats("dns://stub")
+	proxy := &Proxy{
+		records: make(map[string][]HostInfo),
+		cache:   newResponseCache(10, &cacheStats{}),
+		upstream: &instrumentedUpstream{Upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			return replyA(req), nil
+		}), stats: stats},
+	}
+	addr := startStubServer(t, proxy.ServeDNS)
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	if _, err := dns.Exchange(msg, addr); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	root, ok := spans["dns.query"]
+	if !ok {
+		t.Fatal("Expected a span for the query, got", exporter.GetSpans())
+	}
+	attributes := make(map[attribute.Key]string)
+	for _, kv := range root.Attributes {
+		attributes[kv.Key] = kv.Value.Emit()
+	}
+	if attributes["dns.question.name"] != "example.com." || attributes["dns.question.type"] != "A" || attributes["dns.response.rcode"] != "NOERROR" {
+		t.Error("Incorrect query span attributes:", root.Attributes)
+	}
+	for _, name := range []string{"local lookup", "cache lookup", "upstream exchange"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Error("Expected a span for", name)
+		} else if span.Parent.SpanID() != root.SpanContext.SpanID() {
+			t.Error("Expected the", name, "span to be a child of the query span")
+		}
+	}
+	for _, kv := range spans["upstream exchange"].Attributes {
+		if kv.Key == "dns.upstream" && kv.Value.AsString() != "dns://stub" {
+			t.Error("Incorrect upstream attribute:", kv.Value.AsString())
+		}
+	}
+}
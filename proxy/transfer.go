@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// transferTimeout is how long connecting to a primary and waiting for
+	// each of its messages can take.
+	transferTimeout = 10 * time.Second
+	// minTransferInterval is the shortest time between two refreshes of a
+	// zone, whatever its SOA says.
+	minTransferInterval = 30 * time.Second
+)
+
+// zoneTransfer is a zone pulled from its primary with AXFR and kept up to
+// date with IXFR, as a secondary server would.
+type zoneTransfer struct {
+	zone    string
+	primary string
+	// The zone's SOA and other records as of the last transfer, nil before
+	// the first one or once the zone expired.
+	soa *dns.SOA
+	rrs []dns.RR
+	// When the primary last answered.
+	refreshed time.Time
+	// The records the zone added to the proxy's records and zoneRecords,
+	// guarded by its recordsMu.
+	records map[string][]HostInfo
+	zoneRRs rrIndex
+}
+
+// parseTransfer parses a zone transfer in the form zone=primary[:port].
+func parseTransfer(s string) (*zoneTransfer, error) {
+	zone, primary, _ := strings.Cut(s, "=")
+	if zone == "" || primary == "" {
+		return nil, fmt.Errorf("invalid zone transfer %q, expected zone=primary[:port]", s)
+	}
+	return &zoneTransfer{
+		zone:    dns.CanonicalName(zone),
+		primary: hostWithDefaultPort(url.URL{Host: primary}, "53"),
+	}, nil
+}
+
+// fetch transfers the zone from the primary, incrementally if it has been
+// transferred before. It returns the zone's SOA and other records, or a nil
+// SOA if the zone didn't change.
+func (t *zoneTransfer) fetch() (*dns.SOA, []dns.RR, error) {
+	msg := new(dns.Msg)
+	if t.soa != nil {
+		msg.SetIxfr(t.zone, t.soa.Serial, t.soa.Ns, t.soa.Mbox)
+	} else {
+		msg.SetAxfr(t.zone)
+	}
+	tr := &dns.Transfer{DialTimeout: transferTimeout, ReadTimeout: transferTimeout}
+	envelopes, err := tr.In(msg, t.primary)
+	if err != nil {
+		return nil, nil, fmt.Errorf("transferring %s from %s: %w", t.zone, t.primary, err)
+	}
+	var rrs []dns.RR
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return nil, nil, fmt.Errorf("transferring %s from %s: %w", t.zone, t.primary, envelope.Error)
+		}
+		rrs = append(rrs, envelope.RR...)
+	}
+
+	if len(rrs) == 0 {
+		return nil, nil, fmt.Errorf("empty transfer of %s from %s", t.zone, t.primary)
+	}
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return nil, nil, fmt.Errorf("transfer of %s from %s doesn't start with a SOA record", t.zone, t.primary)
+	}
+	if t.soa != nil && !serialNewer(soa.Serial, t.soa.Serial) {
+		return nil, nil, nil
+	}
+	if last, ok := rrs[len(rrs)-1].(*dns.SOA); len(rrs) < 2 || !ok || last.Serial != soa.Serial {
+		return nil, nil, fmt.Errorf("truncated transfer of %s from %s", t.zone, t.primary)
+	}
+
+	// Incremental transfers follow the new SOA with the one they start
+	// from, full ones with the zone's other records (RFC 1995 section 4).
+	zone := rrs[1 : len(rrs)-1]
+	if old, ok := rrs[1].(*dns.SOA); ok && old.Serial != soa.Serial {
+		if t.soa == nil {
+			return nil, nil, fmt.Errorf("incremental transfer of %s from %s in reply to a full one", t.zone, t.primary)
+		}
+		if old.Serial != t.soa.Serial {
+			return nil, nil, fmt.Errorf("incremental transfer of %s from %s starts at serial %d, not %d", t.zone, t.primary, old.Serial, t.soa.Serial)
+		}
+		zone = applyIxfr(t.rrs, zone)
+	}
+	// Only serve what the primary is authoritative for.
+	zone = slices.DeleteFunc(zone, func(rr dns.RR) bool {
+		return rr.Header().Rrtype == dns.TypeSOA || !dns.IsSubDomain(t.zone, rr.Header().Name)
+	})
+	return soa, zone, nil
+}
+
+// applyIxfr returns a copy of the zone records rrs with the changes of an
+// incremental transfer applied. The changes are sequences of the old SOA
+// followed by the records deleted from it, and the new SOA followed by the
+// records added to it.
+func applyIxfr(rrs []dns.RR, changes []dns.RR) []dns.RR {
+	rrs = slices.Clone(rrs)
+	deleting := false
+	for _, change := range changes {
+		if _, ok := change.(*dns.SOA); ok {
+			deleting = !deleting
+			continue
+		}
+		if deleting {
+			rrs = slices.DeleteFunc(rrs, func(rr dns.RR) bool { return dns.IsDuplicate(rr, change) })
+		} else {
+			rrs = append(rrs, change)
+		}
+	}
+	return rrs
+}
+
+// serialNewer returns whether serial a is newer than b, in serial number
+// arithmetic (RFC 1982).
+func serialNewer(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// transferInterval returns how long to wait for a SOA timer of seconds.
+func transferInterval(seconds uint32) time.Duration {
+	return max(time.Duration(seconds)*time.Second, minTransferInterval)
+}
+
+// watchTransfer keeps the zone of t up to date, refreshing it as its SOA
+// says.
+func (p *Proxy) watchTransfer(t *zoneTransfer) {
+	next := transferInterval(t.soa.Refresh)
+	for {
+		time.Sleep(next)
+		next = p.refreshTransfer(t)
+	}
+}
+
+// refreshTransfer checks the primary of t for changes to the zone, and
+// returns when to check again. If the primary can't be reached for longer
+// than the zone's expire time, the zone stops being served.
+func (p *Proxy) refreshTransfer(t *zoneTransfer) time.Duration {
+	err := p.transferZone(t)
+	if err == nil {
+		return transferInterval(t.soa.Refresh)
+	}
+	log.Printf("Failed to refresh zone %s: %s\n", t.zone, err.Error())
+	if t.soa == nil {
+		return minTransferInterval
+	}
+	if time.Since(t.refreshed) > time.Duration(t.soa.Expire)*time.Second {
+		log.Printf("Zone %s expired, no longer serving it\n", t.zone)
+		retry := t.soa.Retry
+		p.setTransferredZone(t, nil, nil)
+		t.soa, t.rrs = nil, nil
+		return transferInterval(retry)
+	}
+	return transferInterval(t.soa.Retry)
+}
+
+// transferZone transfers the zone of t from its primary and serves its
+// current records, if they changed.
+func (p *Proxy) transferZone(t *zoneTransfer) error {
+	soa, rrs, err := t.fetch()
+	if err != nil {
+		return err
+	}
+	if soa != nil {
+		if err := p.setTransferredZone(t, soa, rrs); err != nil {
+			return err
+		}
+		t.soa, t.rrs = soa, rrs
+		log.Printf("Transferred zone %s at serial %d from %s\n", t.zone, soa.Serial, t.primary)
+	}
+	t.refreshed = time.Now()
+	return nil
+}
+
+// setTransferredZone replaces the records of the zone of t with soa and
+// rrs, or removes them if soa is nil. Records from other sources stay, even
+// if the zone had the same ones.
+func (p *Proxy) setTransferredZone(t *zoneTransfer, soa *dns.SOA, rrs []dns.RR) error {
+	records := make(map[string][]HostInfo)
+	zoneRRs := make(rrIndex)
+	if soa != nil {
+		addZoneRR(records, zoneRRs, soa)
+	}
+	for _, rr := range rrs {
+		addZoneRR(records, zoneRRs, rr)
+	}
+
+	p.recordsMu.Lock()
+	defer p.recordsMu.Unlock()
+	allRecords := withoutRecords(p.records, t.records)
+	added := addNewRecords(allRecords, records)
+	if loops := findCNameLoops(allRecords); len(loops) > 0 {
+		for _, loop := range loops {
+			log.Printf("CNAME loop: %s\n", loop)
+		}
+		return fmt.Errorf("CNAME loops in zone %s, keeping its previous records", t.zone)
+	}
+	allZoneRRs := p.zoneRecords.clone()
+	for _, rr := range t.zoneRRs.all() {
+		allZoneRRs.remove(rr)
+	}
+	allZoneRRs.merge(zoneRRs)
+
+	old := entriesOf(p.records, t.records, added)
+	p.records = allRecords
+	p.zoneRecords = allZoneRRs
+	p.reindexHosts(old)
+	p.reindexZone(t.zoneRRs.all(), zoneRRs.all())
+	t.records = added
+	t.zoneRRs = zoneRRs
+	return nil
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestZoneTransfer(t *testing.T) {
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	soa := func(serial int) dns.RR {
+		return rr(fmt.Sprintf("example.lan. 3600 SOA ns.example.lan. admin.example.lan. %d 3600 600 86400 60", serial))
+	}
+
+	var mu sync.Mutex
+	axfr := []dns.RR{
+		soa(1),
+		rr("example.lan. 3600 NS ns.example.lan."),
+		rr("host.example.lan. 300 A 10.0.0.1"),
+		rr("host.example.lan. 300 TXT \"hello\""),
+		rr("www.example.lan. 300 CNAME host.example.lan."),
+		rr("outside.example.com. 300 A 10.0.0.9"),
+		soa(1),
+	}
+	var ixfr []dns.RR
+	failing := false
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		rrs, fail := axfr, failing
+		if r.Question[0].Qtype == dns.TypeIXFR {
+			rrs = ixfr
+		}
+		mu.Unlock()
+		if fail {
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeServerFailure)
+			w.WriteMsg(m)
+			return
+		}
+		ch := make(chan *dns.Envelope, 1)
+		ch <- &dns.Envelope{RR: rrs}
+		close(ch)
+		new(dns.Transfer).Out(w, r, ch)
+	}
+	addr := startStubServer(t, handler)
+	startTcpStubServer(t, addr, handler)
+
+	records, _, err := parseHostsScanner(bufio.NewScanner(strings.NewReader("10.0.0.5 other.lan\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &Proxy{
+		records:     records,
+		zoneRecords: make(rrIndex),
+		cnameCache:  map[uint16]map[string]cacheEntry{dns.TypeA: {}, dns.TypeAAAA: {}},
+		localTTL:    10,
+	}
+	query := func(name string, qtype uint16) []dns.RR {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Answer
+	}
+
+	transfer, err := parseTransfer("example.lan=" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.transferZone(transfer); err != nil {
+		t.Fatal(err)
+	}
+	if answer := query("www.example.lan.", dns.TypeA); len(answer) != 1 || answer[0].(*dns.A).A.String() != "10.0.0.1" || answer[0].Header().Ttl != 300 {
+		t.Error("Expected the transferred address behind the CNAME, got", answer)
+	}
+	if answer := query("host.example.lan.", dns.TypeTXT); len(answer) != 1 {
+		t.Error("Expected the transferred TXT record, got", answer)
+	}
+	if answer := query("example.lan.", dns.TypeSOA); len(answer) != 1 || answer[0].(*dns.SOA).Serial != 1 {
+		t.Error("Expected the zone's SOA, got", answer)
+	}
+	if len(proxy.lookupRecords("outside.example.com.")) != 0 {
+		t.Error("Expected records outside the zone to be ignored")
+	}
+	if ptrs := proxy.lookupLocal(dns.Question{Name: "1.0.0.10.in-addr.arpa.", Qtype: dns.TypePTR}); len(ptrs) != 1 || ptrs[0].(*dns.PTR).Ptr != "host.example.lan." {
+		t.Error("Expected a PTR record for the transferred address, got", ptrs)
+	}
+
+	// Changes are transferred incrementally.
+	mu.Lock()
+	ixfr = []dns.RR{soa(2), soa(1), rr("host.example.lan. 300 A 10.0.0.1"), soa(2), rr("host.example.lan. 300 A 10.0.0.2"), soa(2)}
+	mu.Unlock()
+	if next := proxy.refreshTransfer(transfer); next != time.Hour {
+		t.Error("Expected the next refresh after the SOA refresh time, got", next)
+	}
+	if answer := query("host.example.lan.", dns.TypeA); len(answer) != 1 || answer[0].(*dns.A).A.String() != "10.0.0.2" {
+		t.Error("Expected the address changed by the incremental transfer, got", answer)
+	}
+	if answer := query("host.example.lan.", dns.TypeTXT); len(answer) != 1 {
+		t.Error("Expected the unchanged TXT record to stay, got", answer)
+	}
+	if answer := query("example.lan.", dns.TypeSOA); len(answer) != 1 || answer[0].(*dns.SOA).Serial != 2 {
+		t.Error("Expected the new SOA, got", answer)
+	}
+
+	// A primary that can't be reached is retried, and the zone dropped once it expires.
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	if next := proxy.refreshTransfer(transfer); next != 10*time.Minute {
+		t.Error("Expected a retry after the SOA retry time, got", next)
+	}
+	if len(proxy.lookupRecords("host.example.lan.")) != 1 {
+		t.Error("Expected the zone to be served until it expires")
+	}
+	transfer.refreshed = time.Now().Add(-48 * time.Hour)
+	proxy.refreshTransfer(transfer)
+	if len(proxy.lookupRecords("host.example.lan.")) != 0 || len(proxy.lookupLocal(dns.Question{Name: "example.lan.", Qtype: dns.TypeSOA})) != 0 {
+		t.Error("Expected the expired zone's records to be removed")
+	}
+	if len(proxy.lookupRecords("other.lan.")) != 1 {
+		t.Error("Expected the records from other sources to stay")
+	}
+
+	// An incremental transfer in reply to a full one is rejected.
+	mu.Lock()
+	axfr, failing = ixfr, false
+	mu.Unlock()
+	fresh, err := parseTransfer("example.lan=" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fresh.fetch(); err == nil {
+		t.Error("Expected an error for an incremental transfer in reply to a full one")
+	}
+}
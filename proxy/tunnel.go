@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"github.com/miekg/dns"
+	"log"
+	"math"
+	"net"
+	"strings"
+)
+
+// defaultTunnelingThreshold is the tunneling score queries are flagged
+// above when blocking is enabled without a threshold. Everyday names score
+// below 100, while a 60 character label of base32 encoded data scores about 280.
+const defaultTunnelingThreshold = 150
+
+// tunnelingScore estimates how much data is encoded in the subdomain part of
+// name, the labels left of the last two, as in DNS tunneling and
+// exfiltration: the sum, over those labels, of the Shannon entropy of their
+// characters, in bits per character, times their length. Long random-looking
+// labels score highest, while many short ones, as in reverse names, don't.
+func tunnelingScore(name string) float64 {
+	labels := dns.SplitDomainName(name)
+	if len(labels) <= 2 {
+		return 0
+	}
+	score := 0.0
+	for _, label := range labels[:len(labels)-2] {
+		label = strings.ToLower(label)
+		var counts [256]int
+		for i := 0; i < len(label); i++ {
+			counts[label[i]]++
+		}
+		length := float64(len(label))
+		for _, count := range counts {
+			if count > 0 {
+				p := float64(count) / length
+				score -= length * p * math.Log2(p)
+			}
+		}
+	}
+	return score
+}
+
+// flagTunneling returns whether any question in r looks like DNS tunneling,
+// logging an alert for it and counting it in the stats.
+func (p *Proxy) flagTunneling(r *dns.Msg, client net.Addr) bool {
+	if p.tunnelingThreshold == 0 {
+		return false
+	}
+	for _, q := range r.Question {
+		if score := tunnelingScore(q.Name); score > float64(p.tunnelingThreshold) {
+			p.tunnelingFlagged.Add(1)
+			log.Printf("Possible DNS tunneling: %s query for %s from %s scored %.0f\n", dns.TypeToString[q.Qtype], q.Name, getForwardedFor(client), score)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"slices"
+	"strings"
+)
+
+// updateAllowed returns whether client may send DNS UPDATE messages.
+func (p *Proxy) updateAllowed(client net.IP) bool {
+	for _, subnet := range p.updateACL {
+		if subnet.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateZone returns the configured zone matching zone, if any.
+func (p *Proxy) updateZone(zone string) (string, bool) {
+	for _, z := range p.updateZones {
+		if dns.CanonicalName(z) == dns.CanonicalName(zone) {
+			return z, true
+		}
+	}
+	return "", false
+}
+
+// hostInfoFromRR converts an A, AAAA or CNAME record to the equivalent local record.
+func hostInfoFromRR(rr dns.RR) (HostInfo, bool) {
+	ttl := rr.Header().Ttl
+	switch rr := rr.(type) {
+	case *dns.A:
+		return HostInfo{IP: rr.A, TTL: ttl}, true
+	case *dns.AAAA:
+		return HostInfo{IP: rr.AAAA, TTL: ttl}, true
+	case *dns.CNAME:
+		return HostInfo{CName: rr.Target, TTL: ttl}, true
+	default:
+		return HostInfo{}, false
+	}
+}
+
+// addUpdateRecord adds hostInfo to hosts as RFC 2136 section 3.4.2.2 does:
+// a record that's already there only gets its TTL replaced, a CNAME replaces
+// the name's CNAME, and CNAMEs aren't added to names with addresses, nor
+// addresses to names with CNAMEs.
+func addUpdateRecord(hosts []HostInfo, hostInfo HostInfo) []HostInfo {
+	for i, h := range hosts {
+		if sameHostInfo(h, hostInfo) {
+			hosts[i].TTL = hostInfo.TTL
+			return hosts
+		}
+		if h.IsCName() && hostInfo.IsCName() {
+			hosts[i] = hostInfo
+			return hosts
+		}
+		if h.IsCName() && hostInfo.IsIP() || h.IsIP() && hostInfo.IsCName() {
+			return hosts
+		}
+	}
+	return append(hosts, hostInfo)
+}
+
+// hostInfoType returns the record type a local record is served as.
+func hostInfoType(h HostInfo) uint16 {
+	switch {
+	case h.IsCName():
+		return dns.TypeCNAME
+	case h.IsBlock():
+		return dns.TypeNone
+	case h.IsPtr():
+		return dns.TypePTR
+	case h.IP.To4() != nil:
+		return dns.TypeA
+	default:
+		return dns.TypeAAAA
+	}
+}
+
+// handleUpdate applies an RFC 2136 UPDATE message to the local records and
+// returns the rcode to reply with.
+func (p *Proxy) handleUpdate(r *dns.Msg, client net.IP) int {
+	if !p.updateAllowed(client) {
+		return dns.RcodeRefused
+	}
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError
+	}
+	zone, ok := p.updateZone(r.Question[0].Name)
+	if !ok {
+		return dns.RcodeNotAuth
+	}
+
+	p.recordsMu.Lock()
+	defer p.recordsMu.Unlock()
+
+	if rcode := p.checkPrerequisites(r.Answer, zone); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+
+	// Validate the whole update section first so it's applied atomically.
+	for _, rr := range r.Ns {
+		hdr := rr.Header()
+		if !dns.IsSubDomain(zone, hdr.Name) {
+			return dns.RcodeNotZone
+		}
+		switch hdr.Class {
+		case dns.ClassINET, dns.ClassNONE:
+			if _, ok := hostInfoFromRR(rr); !ok {
+				return dns.RcodeNotImplemented
+			}
+		case dns.ClassANY:
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	// Apply the updates to copies of the names' records, so that they can be
+	// checked for CNAME loops first.
+	updated := make(map[string][]HostInfo)
+	for _, rr := range r.Ns {
+		hdr := rr.Header()
+		name := dns.CanonicalName(hdr.Name)
+		hosts, ok := updated[name]
+		if !ok {
+			hosts = slices.Clone(p.records[name])
+		}
+		switch hdr.Class {
+		case dns.ClassINET:
+			hostInfo, _ := hostInfoFromRR(rr)
+			hosts = addUpdateRecord(hosts, hostInfo)
+		case dns.ClassANY:
+			if hdr.Rrtype == dns.TypeANY {
+				hosts = nil
+			} else {
+				hosts = slices.DeleteFunc(hosts, func(h HostInfo) bool { return hostInfoType(h) == hdr.Rrtype })
+			}
+		case dns.ClassNONE:
+			hostInfo, _ := hostInfoFromRR(rr)
+			hosts = slices.DeleteFunc(hosts, func(h HostInfo) bool { return sameHostInfo(h, hostInfo) })
+		}
+		updated[name] = hosts
+	}
+
+	var aliases []string
+	for name, hosts := range updated {
+		if slices.ContainsFunc(hosts, HostInfo.IsCName) {
+			aliases = append(aliases, name)
+		}
+	}
+	chain := cnameChain(func(name string) []HostInfo {
+		if hosts, ok := updated[name]; ok {
+			return hosts
+		}
+		return p.records[name]
+	}, aliases...)
+	if loops := findCNameLoops(chain); len(loops) > 0 {
+		log.Printf("Refused an update to %s from %s forming a CNAME loop: %s\n", zone, client, strings.Join(loops, ", "))
+		return dns.RcodeRefused
+	}
+
+	old := entriesOf(p.records, updated)
+	for name, hosts := range updated {
+		if len(hosts) == 0 {
+			delete(p.records, name)
+		} else {
+			p.records[name] = hosts
+		}
+	}
+	p.reindexHosts(old)
+
+	if p.verbose {
+		log.Printf("Applied %d updates to %s from %s\n", len(r.Ns), zone, client)
+	}
+	return dns.RcodeSuccess
+}
+
+// checkPrerequisites evaluates the prerequisite section of an UPDATE message.
+// The caller must hold recordsMu.
+func (p *Proxy) checkPrerequisites(prereqs []dns.RR, zone string) int {
+	for _, rr := range prereqs {
+		hdr := rr.Header()
+		if !dns.IsSubDomain(zone, hdr.Name) {
+			return dns.RcodeNotZone
+		}
+		name := dns.CanonicalName(hdr.Name)
+		records := p.records[name]
+
+		switch hdr.Class {
+		case dns.ClassANY:
+			if hdr.Rrtype == dns.TypeANY {
+				if len(records) == 0 {
+					return dns.RcodeNameError
+				}
+			} else if !p.hasRecordType(name, hdr.Rrtype) {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if hdr.Rrtype == dns.TypeANY {
+				if len(records) > 0 {
+					return dns.RcodeYXDomain
+				}
+			} else if p.hasRecordType(name, hdr.Rrtype) {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			hostInfo, ok := hostInfoFromRR(rr)
+			if !ok || !p.hasRecord(name, hostInfo) {
+				return dns.RcodeNXRrset
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+func (p *Proxy) hasRecord(name string, hostInfo HostInfo) bool {
+	for _, h := range p.records[name] {
+		if sameHostInfo(h, hostInfo) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Proxy) hasRecordType(name string, rrtype uint16) bool {
+	for _, h := range p.records[name] {
+		if hostInfoType(h) == rrtype {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+func TestDnsUpdate(t *testing.T) {
+	_, acl, _ := net.ParseCIDR("10.0.0.0/8")
+	proxy := &Proxy{
+		records:     make(map[string][]HostInfo),
+		updateACL:   []*net.IPNet{acl},
+		updateZones: []string{"lan."},
+	}
+	allowed := &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}
+
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	update := func(addr net.Addr, build func(m *dns.Msg)) int {
+		m := new(dns.Msg)
+		m.SetUpdate("lan.")
+		build(m)
+		resp, err := proxy.respondToRequest(context.Background(), m, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Rcode
+	}
+
+	rcode := update(&net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1234}, func(m *dns.Msg) {
+		m.Insert([]dns.RR{rr("host.lan. 60 A 10.0.0.1")})
+	})
+	if rcode != dns.RcodeRefused {
+		t.Error("Expected REFUSED for a client outside the ACL, got", dns.RcodeToString[rcode])
+	}
+
+	rcode = update(allowed, func(m *dns.Msg) {
+		m.Insert([]dns.RR{rr("host.example.com. 60 A 10.0.0.1")})
+	})
+	if rcode != dns.RcodeNotZone {
+		t.Error("Expected NOTZONE for a name outside the zone, got", dns.RcodeToString[rcode])
+	}
+
+	rcode = update(allowed, func(m *dns.Msg) {
+		m.NameNotUsed([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: "host.lan."}}})
+		m.Insert([]dns.RR{rr("host.lan. 60 A 10.0.0.1"), rr("host.lan. 60 A 10.0.0.2")})
+	})
+	if rcode != dns.RcodeSuccess {
+		t.Error("Expected NOERROR when adding records, got", dns.RcodeToString[rcode])
+	}
+	if len(proxy.records["host.lan."]) != 2 {
+		t.Error("Expected 2 records for host.lan, got", proxy.records["host.lan."])
+	}
+	if ptrs := proxy.lookupLocal(dns.Question{Name: "1.0.0.10.in-addr.arpa.", Qtype: dns.TypePTR}); len(ptrs) != 1 || ptrs[0].(*dns.PTR).Ptr != "host.lan." {
+		t.Error("Expected a PTR record for the added address, got", ptrs)
+	}
+
+	rcode = update(allowed, func(m *dns.Msg) {
+		m.NameNotUsed([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: "host.lan."}}})
+	})
+	if rcode != dns.RcodeYXDomain {
+		t.Error("Expected YXDOMAIN for a failed prerequisite, got", dns.RcodeToString[rcode])
+	}
+
+	rcode = update(allowed, func(m *dns.Msg) {
+		m.Remove([]dns.RR{rr("host.lan. 60 A 10.0.0.1")})
+	})
+	if rcode != dns.RcodeSuccess {
+		t.Error("Expected NOERROR when removing a record, got", dns.RcodeToString[rcode])
+	}
+	if len(proxy.records["host.lan."]) != 1 || !proxy.records["host.lan."][0].IP.Equal(net.ParseIP("10.0.0.2")) {
+		t.Error("Incorrect records after removal: ", proxy.records["host.lan."])
+	}
+
+	rcode = update(allowed, func(m *dns.Msg) {
+		m.RemoveName([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: "host.lan."}}})
+	})
+	if rcode != dns.RcodeSuccess {
+		t.Error("Expected NOERROR when removing a name, got", dns.RcodeToString[rcode])
+	}
+	if _, ok := proxy.records["host.lan."]; ok {
+		t.Error("Expected host.lan to be removed")
+	}
+
+	rcode = update(allowed, func(m *dns.Msg) {
+		m.Insert([]dns.RR{rr("host.lan. 60 A 10.0.0.1"), rr("alias.lan. 60 CNAME host.lan.")})
+		// Conflicting with the records above, so ignored.
+		m.Insert([]dns.RR{rr("host.lan. 60 CNAME other.lan."), rr("alias.lan. 60 A 10.0.0.3")})
+	})
+	if rcode != dns.RcodeSuccess {
+		t.Error("Expected NOERROR when adding conflicting records, got", dns.RcodeToString[rcode])
+	}
+	if hosts := proxy.records["host.lan."]; len(hosts) != 1 || !hosts[0].IsIP() || hosts[0].TTL != 60 {
+		t.Error("Expected only the address of host.lan with its TTL, got", hosts)
+	}
+	if hosts := proxy.records["alias.lan."]; len(hosts) != 1 || !hosts[0].IsCName() {
+		t.Error("Expected only the CNAME of alias.lan, got", hosts)
+	}
+
+	rcode = update(allowed, func(m *dns.Msg) {
+		m.Insert([]dns.RR{rr("loop1.lan. 60 CNAME loop2.lan."), rr("loop2.lan. 60 CNAME alias.lan.")})
+		m.RemoveName([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: "host.lan."}}})
+		m.Insert([]dns.RR{rr("host.lan. 60 CNAME loop1.lan.")})
+	})
+	if rcode != dns.RcodeRefused {
+		t.Error("Expected REFUSED for an update forming a CNAME loop, got", dns.RcodeToString[rcode])
+	}
+	if _, ok := proxy.records["loop1.lan."]; ok || len(proxy.records["host.lan."]) != 1 || !proxy.records["host.lan."][0].IsIP() {
+		t.Error("Expected the update not to be applied, got", proxy.records)
+	}
+
+	rcode = update(allowed, func(m *dns.Msg) {
+		m.Insert([]dns.RR{rr("other.lan. 60 A 10.0.0.4"), rr("alias.lan. 120 CNAME other.lan.")})
+	})
+	if rcode != dns.RcodeSuccess {
+		t.Error("Expected NOERROR when replacing a CNAME, got", dns.RcodeToString[rcode])
+	}
+	if hosts := proxy.records["alias.lan."]; len(hosts) != 1 || hosts[0].CName != "other.lan." || hosts[0].TTL != 120 {
+		t.Error("Expected the CNAME of alias.lan to be replaced, got", hosts)
+	}
+}
@@ -0,0 +1,691 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"io"
+	"log"
+	mathrand "math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upstream is a DNS server queries that can't be answered locally are forwarded to.
+type Upstream interface {
+	Exchange(ctx context.Context, req *dns.Msg, forwardedFor net.IP) (*dns.Msg, error)
+}
+
+// HttpUpstream forwards queries to a DNS-over-HTTPS server.
+type HttpUpstream struct {
+	url url.URL
+	// RFC 8484 URI template request URLs are built from instead of url, if set.
+	template   dohTemplate
+	method     string
+	timeout    time.Duration
+	maxRetries int
+	userAgent  string
+	// Whether to send the client's IP to the server.
+	forwardClientIP bool
+	// Whether to pad queries to hide their length.
+	pad bool
+	// EDNS buffer size and DO bit to set in queries, if not 0 and nil.
+	ednsUDPSize uint16
+	ednsDO      *bool
+	client      *http.Client
+	// fallback, if set, is used when the QUIC connection of client fails,
+	// e.g. when the HTTP/3 handshake doesn't succeed, and then until
+	// fallbackUntil (in Unix nanoseconds) before client is tried again.
+	fallback      *http.Client
+	fallbackUntil atomic.Int64
+}
+
+// http3RetryInterval is how long HTTP/3 upstreams stay on HTTP/2 after
+// their QUIC connection failed.
+const http3RetryInterval = 5 * time.Minute
+
+// UdpUpstream forwards queries to a plain DNS server over UDP.
+type UdpUpstream struct {
+	addr   string
+	client *dns.Client
+	// Truncated responses are retried over TCP, on pooled connections.
+	tcpClient *dns.Client
+	tcpPool   *tcpPool
+	// Whether to randomize the case of query names (DNS 0x20).
+	use0x20 bool
+	// Whether to strip everything but the question and essential flags from queries.
+	sanitize bool
+	// EDNS buffer size to advertise, and DO bit to set in queries unless nil.
+	ednsUDPSize uint16
+	ednsDO      *bool
+
+	// DNS cookies (RFC 7873): our client cookie, and the server cookies
+	// learned from the upstream, keyed by server address.
+	clientCookie  string
+	cookiesMu     sync.Mutex
+	serverCookies map[string]string
+}
+
+// ParseUpstreamURL parses an upstream URL. Unlike url.Parse, it accepts the
+// zone of an IPv6 address unescaped, as in dns://[fe80::1%eth0]:53, which is
+// how addresses are usually written, besides the %25 escaped form.
+func ParseUpstreamURL(rawUrl string) (*url.URL, error) {
+	if scheme, rest, ok := strings.Cut(rawUrl, "://["); ok {
+		if host, rest, ok := strings.Cut(rest, "]"); ok {
+			// The zone follows the literal %25 separator of RFC 6874 in
+			// the escaped form, so anything else after a % is an
+			// unescaped zone, even one starting with 25.
+			if _, zone, escaped := strings.Cut(host, "%25"); !escaped || zone == "" {
+				if address, zone, ok := strings.Cut(host, "%"); ok {
+					rawUrl = scheme + "://[" + address + "%25" + url.PathEscape(zone) + "]" + rest
+				}
+			}
+		}
+	}
+	return url.Parse(rawUrl)
+}
+
+// hostWithDefaultPort returns the host:port of u, using port if u doesn't specify one.
+func hostWithDefaultPort(u url.URL, port string) string {
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+	return u.Host
+}
+
+// UpstreamOptions configures how queries are sent to an upstream.
+type UpstreamOptions struct {
+	Timeout time.Duration
+	// HTTP method for DoH requests, GET (the default) or POST.
+	DohMethod string
+	// How many times failed DoH requests are retried.
+	DohMaxRetries int
+	// User-Agent header for DoH requests, empty to send none.
+	DohUserAgent string
+	// RFC 8484 URI template to build DoH request URLs from, such as
+	// https://dns.example/query{?dns}, instead of adding ?dns= to the upstream URL.
+	DohURITemplate string
+	// Whether to tell DoH servers the client's IP with X-Forwarded-For and X-Real-IP.
+	ForwardClientIP bool
+	// Disable 0x20 case randomization of query names on plain DNS upstreams.
+	Disable0x20 bool
+	// Strip all EDNS options and extra records from queries sent to plain DNS upstreams.
+	SanitizeQueries bool
+	// Pad queries sent over encrypted transports (DoH and DoQ) to hide their length.
+	Pad bool
+	// EDNS buffer size to advertise, 0 for the default: 1232 bytes over
+	// plain DNS, the client's over other transports. Set per upstream with
+	// the udpsize URL parameter.
+	EdnsUDPSize uint16
+	// Whether to set or clear the DO bit in queries, nil to keep the
+	// client's. Set per upstream with the do URL parameter.
+	EdnsDO *bool
+}
+
+// UpstreamFactory creates an Upstream for a URL with a registered scheme.
+type UpstreamFactory func(u url.URL, opts UpstreamOptions) (Upstream, error)
+
+var (
+	upstreamFactoriesMu sync.RWMutex
+	upstreamFactories   = map[string]UpstreamFactory{
+		"https": newHttpsUpstream,
+		"http":  newHttpsUpstream,
+		"h3":    newHttp3Upstream,
+		"dns":   newDnsUpstream,
+		"udp":   newDnsUpstream,
+		"quic": func(u url.URL, opts UpstreamOptions) (Upstream, error) {
+			return newQuicUpstream(hostWithDefaultPort(u, "853"), opts), nil
+		},
+	}
+)
+
+// RegisterUpstream makes NewUpstream create upstreams for URLs with scheme
+// using factory, replacing any factory already registered for it.
+func RegisterUpstream(scheme string, factory UpstreamFactory) {
+	upstreamFactoriesMu.Lock()
+	defer upstreamFactoriesMu.Unlock()
+	upstreamFactories[strings.ToLower(scheme)] = factory
+}
+
+// NewUpstream creates an Upstream for u, using the factory registered for its scheme.
+func NewUpstream(u url.URL, opts UpstreamOptions) (Upstream, error) {
+	// Link-local IPv6 upstreams need the interface to reach them through,
+	// as a zone: [fe80::1%eth0].
+	if host := u.Hostname(); strings.Contains(host, "%") {
+		addr, err := netip.ParseAddr(host)
+		if err != nil || !addr.Is6() || addr.Zone() == "" {
+			return nil, fmt.Errorf("invalid scoped IPv6 address %q", host)
+		}
+	}
+	if err := parseEdnsParams(&u, &opts); err != nil {
+		return nil, err
+	}
+	upstreamFactoriesMu.RLock()
+	factory, ok := upstreamFactories[strings.ToLower(u.Scheme)]
+	upstreamFactoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported upstream scheme %q", u.Scheme)
+	}
+	return factory(u, opts)
+}
+
+func newHttpsUpstream(u url.URL, opts UpstreamOptions) (Upstream, error) {
+	return newHttpUpstream(u, opts, &http.Client{
+		Timeout: opts.Timeout,
+	}, nil)
+}
+
+func newHttp3Upstream(u url.URL, opts UpstreamOptions) (Upstream, error) {
+	u.Scheme = "https"
+	return newHttpUpstream(u, opts, &http.Client{
+		Timeout: opts.Timeout,
+		Transport: &http3.Transport{
+			// Leave time to fall back to HTTP/2 if the handshake doesn't succeed.
+			QUICConfig: &quic.Config{HandshakeIdleTimeout: opts.Timeout / 2},
+		},
+	}, &http.Client{
+		Timeout: opts.Timeout,
+	})
+}
+
+func newDnsUpstream(u url.URL, opts UpstreamOptions) (Upstream, error) {
+	return newUdpUpstream(hostWithDefaultPort(u, "53"), opts)
+}
+
+func newHttpUpstream(u url.URL, opts UpstreamOptions, client, fallback *http.Client) (*HttpUpstream, error) {
+	// It appears, that GET requests are more memory-efficient with Golang
+	// implementation of HTTP/2, so it's the default.
+	method := strings.ToUpper(opts.DohMethod)
+	switch method {
+	case "":
+		method = http.MethodGet
+	case http.MethodGet, http.MethodPost:
+	default:
+		return nil, fmt.Errorf("unsupported DoH method %q", opts.DohMethod)
+	}
+	var template dohTemplate
+	if opts.DohURITemplate != "" {
+		var err error
+		if template, err = parseDohTemplate(opts.DohURITemplate); err != nil {
+			return nil, err
+		}
+	}
+
+	return &HttpUpstream{
+		url:             u,
+		template:        template,
+		method:          method,
+		timeout:         opts.Timeout,
+		maxRetries:      opts.DohMaxRetries,
+		userAgent:       opts.DohUserAgent,
+		forwardClientIP: opts.ForwardClientIP,
+		pad:             opts.Pad,
+		ednsUDPSize:     opts.EdnsUDPSize,
+		ednsDO:          opts.EdnsDO,
+		client:          client,
+		fallback:        fallback,
+	}, nil
+}
+
+func (h *HttpUpstream) Exchange(ctx context.Context, req *dns.Msg, forwardedFor net.IP) (resp *dns.Msg, err error) {
+	out := req
+	addedOpt, ednsAddedOpt := false, false
+	if h.ednsUDPSize != 0 || h.ednsDO != nil {
+		out = req.Copy()
+		ednsAddedOpt = setEdns(out, h.ednsUDPSize, h.ednsDO)
+	}
+	if h.pad {
+		if out == req {
+			out = req.Copy()
+		}
+		addedOpt = padQuery(out)
+	}
+	buf, err := out.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing message: %w", err)
+	}
+
+	u := h.url
+	if h.template != "" {
+		// Per RFC 8484, the dns variable is only defined for GET requests.
+		query := ""
+		if h.method == http.MethodGet {
+			query = base64.RawURLEncoding.EncodeToString(buf)
+		}
+		expanded, err := h.template.expand(query)
+		if err != nil {
+			return nil, err
+		}
+		templateURL, err := url.Parse(expanded)
+		if err != nil {
+			return nil, fmt.Errorf("parsing expanded URI template %s: %w", expanded, err)
+		}
+		u = *templateURL
+	} else if h.method == http.MethodGet {
+		u.RawQuery = fmt.Sprintf("dns=%s", base64.RawURLEncoding.EncodeToString(buf))
+	}
+
+	body, err := h.doWithRetries(ctx, u, buf, forwardedFor)
+	if err != nil {
+		return nil, err
+	}
+
+	resp = &dns.Msg{}
+	err = resp.Unpack(body)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"unpacking response from %s: body is %s: %w",
+			u.String(),
+			body,
+			err,
+		)
+	}
+	if h.pad {
+		unpadResponse(resp, addedOpt)
+	}
+	if ednsAddedOpt {
+		removeOpt(resp)
+	}
+
+	if resp.Id != req.Id {
+		err = dns.ErrId
+	}
+
+	return resp, err
+}
+
+// httpStatusError is returned when a DoH server replies with an unexpected status.
+type httpStatusError struct {
+	url  string
+	code int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("expected status %d, got %d from %s", http.StatusOK, e.code, e.url)
+}
+
+// retryable returns whether a failed DoH request may succeed if retried:
+// network errors and gateway errors are, other HTTP errors aren't.
+func retryable(err error) bool {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.code {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// quicFailed returns whether err comes from the QUIC connection itself,
+// rather than from the server's HTTP/3 response, so that HTTP/2 may work.
+func quicFailed(err error) bool {
+	var (
+		handshakeErr *quic.HandshakeTimeoutError
+		idleErr      *quic.IdleTimeoutError
+		transportErr *quic.TransportError
+		versionErr   *quic.VersionNegotiationError
+		resetErr     *quic.StatelessResetError
+		opErr        *net.OpError
+	)
+	return errors.As(err, &handshakeErr) || errors.As(err, &idleErr) ||
+		errors.As(err, &transportErr) || errors.As(err, &versionErr) ||
+		errors.As(err, &resetErr) || errors.As(err, &opErr)
+}
+
+// doWithRetries sends the query, retrying transient failures with
+// exponential backoff until maxRetries or the upstream timeout is reached.
+func (h *HttpUpstream) doWithRetries(ctx context.Context, u url.URL, msg []byte, forwardedFor net.IP) ([]byte, error) {
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+
+	backoff := 50 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		client := h.client
+		if h.fallback != nil && time.Now().UnixNano() < h.fallbackUntil.Load() {
+			client = h.fallback
+		}
+		body, err := h.do(ctx, client, u, msg, forwardedFor)
+		if err != nil && client != h.fallback && h.fallback != nil && quicFailed(err) {
+			log.Printf("Request to %s failed, falling back to HTTP/2 for %s: %s\n", u.String(), http3RetryInterval, err.Error())
+			h.fallbackUntil.Store(time.Now().Add(http3RetryInterval).UnixNano())
+			body, err = h.do(ctx, h.fallback, u, msg, forwardedFor)
+		}
+		if err == nil || attempt >= h.maxRetries || !retryable(err) {
+			return body, err
+		}
+
+		// Full jitter: sleep for a random duration up to the backoff.
+		sleep := time.Duration(mathrand.Int64N(int64(backoff)))
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(sleep).After(deadline) {
+			return nil, err
+		}
+		log.Printf("Request to %s failed, retrying: %s\n", u.String(), err.Error())
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// do sends the packed query msg to u with client and returns the response body.
+// With GET, msg must already be encoded in u.
+func (h *HttpUpstream) do(ctx context.Context, client *http.Client, u url.URL, msg []byte, forwardedFor net.IP) ([]byte, error) {
+	var reqBody io.Reader
+	if h.method == http.MethodPost {
+		reqBody = bytes.NewReader(msg)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, h.method, u.String(), reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("creating http request to %s: %w", h.url.String(), err)
+	}
+
+	httpReq.Header.Set("Accept", "application/dns-message")
+	if h.method == http.MethodPost {
+		httpReq.Header.Set("Content-Type", "application/dns-message")
+	}
+	httpReq.Header.Set("User-Agent", h.userAgent)
+	if h.forwardClientIP && forwardedFor != nil {
+		httpReq.Header.Set("X-Forwarded-Proto", "https") // not really but lol
+		httpReq.Header.Set("X-Forwarded-For", forwardedFor.String())
+		httpReq.Header.Set("X-Real-IP", forwardedFor.String())
+	}
+
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("requesting %s: %w", u.String(), err)
+	}
+	defer httpResp.Body.Close()
+
+	body, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", u.String(), err)
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, &httpStatusError{url: u.String(), code: httpResp.StatusCode}
+	}
+
+	return body, nil
+}
+
+// randomId returns a cryptographically random DNS message ID.
+func randomId() (uint16, error) {
+	var buf [2]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(buf[:]), nil
+}
+
+func newUdpUpstream(addr string, opts UpstreamOptions) (*UdpUpstream, error) {
+	var cookie [8]byte
+	if _, err := rand.Read(cookie[:]); err != nil {
+		return nil, fmt.Errorf("generating client cookie: %w", err)
+	}
+	udpSize := opts.EdnsUDPSize
+	if udpSize == 0 {
+		udpSize = defaultUdpEdnsSize
+	}
+	return &UdpUpstream{
+		addr: addr,
+		client: &dns.Client{
+			Net:     "udp",
+			Timeout: opts.Timeout,
+		},
+		tcpClient: &dns.Client{
+			Net:     "tcp",
+			Timeout: opts.Timeout,
+		},
+		tcpPool:       newTcpPool(addr, tcpPoolSize, opts.Timeout, tcpIdleTimeout),
+		use0x20:       !opts.Disable0x20,
+		sanitize:      opts.SanitizeQueries,
+		ednsUDPSize:   udpSize,
+		ednsDO:        opts.EdnsDO,
+		clientCookie:  hex.EncodeToString(cookie[:]),
+		serverCookies: make(map[string]string),
+	}, nil
+}
+
+func (u *UdpUpstream) Exchange(ctx context.Context, req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+	resp, err := u.exchange(ctx, req)
+	if err == nil && resp.Rcode == dns.RcodeBadCookie {
+		// The server sent us a fresh cookie along with BADCOOKIE, retry once with it.
+		resp, err = u.exchange(ctx, req)
+	}
+	return resp, err
+}
+
+func (u *UdpUpstream) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	// Don't let the upstream see the client's chosen ID: replace it with a
+	// random one and restore the original on the reply.
+	id, err := randomId()
+	if err != nil {
+		return nil, fmt.Errorf("generating message id: %w", err)
+	}
+	out := req.Copy()
+	out.Id = id
+	sanitizeQuery(out, u.sanitize)
+	if u.use0x20 {
+		for i := range out.Question {
+			if out.Question[i].Name, err = randomizeCase(out.Question[i].Name); err != nil {
+				return nil, fmt.Errorf("randomizing query name: %w", err)
+			}
+		}
+	}
+	addedOpt := u.setCookie(out)
+	// There's always an OPT record for the cookie, so none is added.
+	setEdns(out, u.ednsUDPSize, u.ednsDO)
+
+	resp, _, err := u.client.ExchangeContext(ctx, out, u.addr)
+	if err == nil && resp.Truncated {
+		// The answer doesn't fit in a UDP response, retry over TCP.
+		resp, err = u.exchangeTcp(ctx, out)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("querying %s: %w", u.addr, err)
+	}
+	if resp.Id != out.Id {
+		return nil, dns.ErrId
+	}
+	if u.use0x20 {
+		if err := restoreCase(req, out, resp); err != nil {
+			return nil, fmt.Errorf("response from %s: %w", u.addr, err)
+		}
+	}
+	if err := u.learnCookie(resp, addedOpt); err != nil {
+		return nil, err
+	}
+
+	resp.Id = req.Id
+	return resp, nil
+}
+
+// sanitizeQuery removes what a client may have put in msg that the upstream
+// doesn't need to answer it. Padding is always removed, since it's useless
+// over plain DNS and only helps fingerprinting clients. If strict is set,
+// only the question, the RD, AD, CD and DO bits and the EDNS buffer size are kept.
+func sanitizeQuery(msg *dns.Msg, strict bool) {
+	opt := msg.IsEdns0()
+	if opt != nil {
+		options := opt.Option[:0]
+		for _, o := range opt.Option {
+			if !strict && o.Option() != dns.EDNS0PADDING {
+				options = append(options, o)
+			}
+		}
+		opt.Option = options
+	}
+	if !strict {
+		return
+	}
+
+	msg.Answer = nil
+	msg.Ns = nil
+	msg.Extra = nil
+	msg.Zero = false
+	if opt != nil {
+		msg.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+}
+
+// exchangeTcp sends msg over a pooled TCP connection.
+func (u *UdpUpstream) exchangeTcp(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	for {
+		conn, err := u.tcpPool.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resp, _, err := u.tcpClient.ExchangeWithConnContext(ctx, msg, conn.Conn)
+		if err != nil {
+			u.tcpPool.discard(conn)
+			// The server may have closed a connection that was idle, try another one.
+			if !conn.idleSince.IsZero() {
+				continue
+			}
+			return nil, fmt.Errorf("over TCP: %w", err)
+		}
+		u.tcpPool.put(conn)
+		return resp, nil
+	}
+}
+
+// randomizeCase randomly flips the case of the letters in name.
+func randomizeCase(name string) (string, error) {
+	bits := make([]byte, len(name))
+	if _, err := rand.Read(bits); err != nil {
+		return "", err
+	}
+	buf := []byte(name)
+	for i, c := range buf {
+		if bits[i]&1 == 0 {
+			continue
+		}
+		switch {
+		case 'a' <= c && c <= 'z':
+			buf[i] = c - 'a' + 'A'
+		case 'A' <= c && c <= 'Z':
+			buf[i] = c - 'A' + 'a'
+		}
+	}
+	return string(buf), nil
+}
+
+// restoreCase checks that resp echoes the exact case of the question names
+// sent in out, then puts back the names of the original request req.
+func restoreCase(req, out, resp *dns.Msg) error {
+	if len(resp.Question) == 0 && resp.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+	if len(resp.Question) != len(out.Question) {
+		return fmt.Errorf("question count mismatch")
+	}
+	for i, q := range out.Question {
+		if resp.Question[i].Name != q.Name {
+			return fmt.Errorf("question name %s doesn't match the query's case %s", resp.Question[i].Name, q.Name)
+		}
+		original := req.Question[i].Name
+		resp.Question[i].Name = original
+		for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+			for _, rr := range section {
+				if rr.Header().Name == q.Name {
+					rr.Header().Name = original
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// setCookie replaces any client-provided cookie in msg with ours, adding an
+// OPT record if needed. It returns whether the OPT record was added.
+func (u *UdpUpstream) setCookie(msg *dns.Msg) bool {
+	opt := msg.IsEdns0()
+	addedOpt := opt == nil
+	if addedOpt {
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		opt = msg.IsEdns0()
+	}
+
+	u.cookiesMu.Lock()
+	cookie := u.clientCookie + u.serverCookies[u.addr]
+	u.cookiesMu.Unlock()
+
+	options := []dns.EDNS0{&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie}}
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0COOKIE {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+	return addedOpt
+}
+
+// validServerCookie returns whether cookie, hex encoded, is a server cookie
+// of 8 to 32 bytes as required by RFC 7873.
+func validServerCookie(cookie string) bool {
+	if len(cookie) < 16 || len(cookie) > 64 {
+		return false
+	}
+	_, err := hex.DecodeString(cookie)
+	return err == nil
+}
+
+// learnCookie checks the cookie echoed by the upstream, stores its server
+// cookie and strips our cookie (or our whole OPT record) from resp.
+func (u *UdpUpstream) learnCookie(resp *dns.Msg, addedOpt bool) error {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		// The server doesn't support EDNS, so no cookies either.
+		return nil
+	}
+
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		cookie, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok {
+			options = append(options, o)
+			continue
+		}
+		if len(cookie.Cookie) < len(u.clientCookie) ||
+			!strings.EqualFold(cookie.Cookie[:len(u.clientCookie)], u.clientCookie) {
+			return fmt.Errorf("client cookie mismatch in response from %s", u.addr)
+		}
+		serverCookie := cookie.Cookie[len(u.clientCookie):]
+		if !validServerCookie(serverCookie) {
+			// Don't echo back a cookie the server shouldn't have sent.
+			continue
+		}
+		u.cookiesMu.Lock()
+		u.serverCookies[u.addr] = serverCookie
+		u.cookiesMu.Unlock()
+	}
+	opt.Option = options
+
+	if addedOpt {
+		removeOpt(resp)
+	}
+	return nil
+}
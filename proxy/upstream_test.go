@@ -0,0 +1,1075 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go/http3"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startStubServer starts a UDP DNS server on localhost answering with handler.
+// The handler runs on the server's goroutines, concurrently with the test, so
+// anything it records must be passed back over a channel or synchronized.
+func startStubServer(t testing.TB, handler dns.HandlerFunc) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+// startTcpStubServer starts a TCP DNS server at addr answering with handler,
+// which runs concurrently with the test like that of startStubServer.
+func startTcpStubServer(t testing.TB, addr string, handler dns.HandlerFunc) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{Listener: l, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+}
+
+func TestUdpUpstreamRandomizesId(t *testing.T) {
+	const queries = 8
+	seenIds := make(chan uint16, queries)
+	addr := startStubServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		seenIds <- r.Id
+		m := new(dns.Msg)
+		m.SetReply(r)
+		w.WriteMsg(m)
+	})
+
+	upstream, err := newUdpUpstream(addr, UpstreamOptions{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < queries; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		req.Id = 1234
+		resp, err := upstream.Exchange(context.Background(), req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Id != 1234 {
+			t.Error("Expected original ID to be restored, got", resp.Id)
+		}
+		if req.Id != 1234 {
+			t.Error("Request ID was modified in place:", req.Id)
+		}
+	}
+	// Any single random ID may happen to be the client's, but not all of them.
+	randomized := false
+	for i := 0; i < queries; i++ {
+		if <-seenIds != 1234 {
+			randomized = true
+		}
+	}
+	if !randomized {
+		t.Error("Upstream saw the client's ID")
+	}
+}
+
+func TestUdpUpstreamRejectsIdMismatch(t *testing.T) {
+	// Replies with the wrong ID are dropped over UDP while waiting for the
+	// right one, so only the TCP retry can get one.
+	addr := startStubServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Truncated = true
+		w.WriteMsg(m)
+	})
+	startTcpStubServer(t, addr, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Id = r.Id + 1
+		w.WriteMsg(m)
+	})
+
+	upstream, err := newUdpUpstream(addr, UpstreamOptions{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp, err := upstream.Exchange(context.Background(), req, nil)
+	if !errors.Is(err, dns.ErrId) {
+		t.Error("Expected an ID mismatch error, got", resp, err)
+	}
+}
+
+func TestUdpUpstreamCookies(t *testing.T) {
+	const serverCookie = "0123456789abcdef"
+	cookies := make(chan string, 2)
+	addr := startStubServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		opt := r.IsEdns0()
+		for _, o := range opt.Option {
+			if cookie, ok := o.(*dns.EDNS0_COOKIE); ok {
+				cookies <- cookie.Cookie
+				m.SetEdns0(opt.UDPSize(), false)
+				m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_COOKIE{
+					Code:   dns.EDNS0COOKIE,
+					Cookie: cookie.Cookie[:16] + serverCookie,
+				})
+			}
+		}
+		w.WriteMsg(m)
+	})
+
+	upstream, err := newUdpUpstream(addr, UpstreamOptions{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		resp, err := upstream.Exchange(context.Background(), req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.IsEdns0() != nil {
+			t.Error("Expected the OPT record added by the proxy to be stripped")
+		}
+	}
+
+	if len(cookies) != 2 {
+		t.Fatal("Expected 2 cookies, got", len(cookies))
+	}
+	seenCookies := []string{<-cookies, <-cookies}
+	if len(seenCookies[0]) != 16 {
+		t.Error("Expected only a client cookie on the first query, got", seenCookies[0])
+	}
+	if seenCookies[1] != seenCookies[0]+serverCookie {
+		t.Error("Expected the server cookie on the second query, got", seenCookies[1])
+	}
+}
+
+func TestUdpUpstreamIgnoresInvalidServerCookies(t *testing.T) {
+	for _, serverCookie := range []string{"0123", strings.Repeat("ab", 33)} {
+		cookies := make(chan string, 2)
+		addr := startStubServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			opt := r.IsEdns0()
+			for _, o := range opt.Option {
+				if cookie, ok := o.(*dns.EDNS0_COOKIE); ok {
+					cookies <- cookie.Cookie
+					m.SetEdns0(opt.UDPSize(), false)
+					m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_COOKIE{
+						Code:   dns.EDNS0COOKIE,
+						Cookie: cookie.Cookie[:16] + serverCookie,
+					})
+				}
+			}
+			w.WriteMsg(m)
+		})
+
+		upstream, err := newUdpUpstream(addr, UpstreamOptions{Timeout: time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			if _, err := upstream.Exchange(context.Background(), req, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if len(cookies) != 2 {
+			t.Fatal("Expected 2 cookies, got", len(cookies))
+		}
+		<-cookies
+		if cookie := <-cookies; len(cookie) != 16 {
+			t.Errorf("Expected the %d character server cookie not to be sent back, got %s", len(serverCookie), cookie)
+		}
+	}
+}
+
+func TestUdpUpstreamWithoutCookieSupport(t *testing.T) {
+	addr := startStubServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		w.WriteMsg(m)
+	})
+
+	upstream, err := newUdpUpstream(addr, UpstreamOptions{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, err := upstream.Exchange(context.Background(), req, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUdpUpstream0x20(t *testing.T) {
+	name := "a-long-name-to-make-case-collisions-unlikely.example.com."
+	seenNames := make(chan string, 1)
+	addr := startStubServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		seenNames <- r.Question[0].Name
+		w.WriteMsg(replyA(r))
+	})
+
+	upstream, err := newUdpUpstream(addr, UpstreamOptions{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	resp, err := upstream.Exchange(context.Background(), req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seenName := <-seenNames; seenName == name || !strings.EqualFold(seenName, name) {
+		t.Error("Expected the query name's case to be randomized, got", seenName)
+	}
+	if resp.Question[0].Name != name || resp.Answer[0].Header().Name != name {
+		t.Error("Expected the original name to be restored, got", resp)
+	}
+}
+
+func TestUdpUpstream0x20Mismatch(t *testing.T) {
+	addr := startStubServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		r.Question[0].Name = strings.ToLower(r.Question[0].Name)
+		w.WriteMsg(replyA(r))
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("a-long-name-to-make-case-collisions-unlikely.example.com.", dns.TypeA)
+
+	upstream, err := newUdpUpstream(addr, UpstreamOptions{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := upstream.Exchange(context.Background(), req, nil); err == nil {
+		t.Error("Expected an error for a response not preserving case, got", resp)
+	}
+
+	upstream, err = newUdpUpstream(addr, UpstreamOptions{Timeout: time.Second, Disable0x20: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := upstream.Exchange(context.Background(), req, nil); err != nil {
+		t.Error("Expected no error with 0x20 disabled, got", err)
+	}
+}
+
+func TestUdpUpstreamSanitizesQueries(t *testing.T) {
+	queries := make(chan *dns.Msg, 1)
+	addr := startStubServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries <- r.Copy()
+		m := new(dns.Msg)
+		m.SetReply(r)
+		w.WriteMsg(m)
+	})
+
+	for _, strict := range []bool{false, true} {
+		upstream, err := newUdpUpstream(addr, UpstreamOptions{Timeout: time.Second, SanitizeQueries: strict})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		req.SetEdns0(4096, true)
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 32)}, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+		txt, _ := dns.NewRR("example.com. 60 TXT tracking")
+		req.Extra = append(req.Extra, txt)
+		if _, err := upstream.Exchange(context.Background(), req, nil); err != nil {
+			t.Fatal(err)
+		}
+		seen := <-queries
+
+		var options []uint16
+		for _, o := range seen.IsEdns0().Option {
+			options = append(options, o.Option())
+		}
+		want := []uint16{dns.EDNS0COOKIE, dns.EDNS0NSID}
+		if strict {
+			want = []uint16{dns.EDNS0COOKIE}
+		}
+		if fmt.Sprint(options) != fmt.Sprint(want) {
+			t.Errorf("Expected EDNS options %v with strict=%t, got %v", want, strict, options)
+		}
+		if strict != (len(seen.Extra) == 1) {
+			t.Errorf("Unexpected extra records with strict=%t: %v", strict, seen.Extra)
+		}
+		if !seen.IsEdns0().Do() || seen.IsEdns0().UDPSize() != defaultUdpEdnsSize {
+			t.Error("Expected the DO bit to be kept and the default buffer size, got", seen.IsEdns0())
+		}
+	}
+}
+
+// truncatingHandler answers with a large response over TCP, and a truncated one over UDP.
+func truncatingHandler(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		m.Truncated = true
+		w.WriteMsg(m)
+		return
+	}
+	for i := 0; i < 100; i++ {
+		rr, _ := dns.NewRR(fmt.Sprintf("%s 60 A 10.0.0.%d", r.Question[0].Name, i))
+		m.Answer = append(m.Answer, rr)
+	}
+	w.WriteMsg(m)
+}
+
+func TestUdpUpstreamTcpFallback(t *testing.T) {
+	var mu sync.Mutex
+	tcpClients := make(map[string]bool)
+	addr := startStubServer(t, truncatingHandler)
+	startTcpStubServer(t, addr, func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		tcpClients[w.RemoteAddr().String()] = true
+		mu.Unlock()
+		truncatingHandler(w, r)
+	})
+
+	upstream, err := newUdpUpstream(addr, UpstreamOptions{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		resp, err := upstream.Exchange(context.Background(), req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Truncated || len(resp.Answer) != 100 {
+			t.Error("Expected the full answer over TCP, got", len(resp.Answer), "records")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(tcpClients) != 1 {
+		t.Error("Expected a single reused TCP connection, got", len(tcpClients))
+	}
+}
+
+func TestTcpPoolWait(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	// Without a timeout, waiting for a connection is only bounded by the context.
+	pool := newTcpPool(l.Addr().String(), 1, 0, tcpIdleTimeout)
+	for i := 0; i < 100; i++ {
+		conn, err := pool.get(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool.put(conn)
+	}
+
+	conn, err := pool.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.discard(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := pool.get(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Expected the context's error while the pool is full, got", err)
+	}
+}
+
+func benchmarkUdpUpstreamTcp(b *testing.B, idleTimeout time.Duration) {
+	addr := startStubServer(b, truncatingHandler)
+	startTcpStubServer(b, addr, truncatingHandler)
+
+	upstream, err := newUdpUpstream(addr, UpstreamOptions{Timeout: time.Second, Disable0x20: true})
+	if err != nil {
+		b.Fatal(err)
+	}
+	upstream.tcpPool = newTcpPool(addr, tcpPoolSize, time.Second, idleTimeout)
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			if _, err := upstream.Exchange(context.Background(), req, nil); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func BenchmarkUdpUpstreamTcpPooled(b *testing.B) {
+	benchmarkUdpUpstreamTcp(b, tcpIdleTimeout)
+}
+
+// BenchmarkUdpUpstreamTcpUnpooled opens a new connection for every query, for comparison.
+func BenchmarkUdpUpstreamTcpUnpooled(b *testing.B) {
+	benchmarkUdpUpstreamTcp(b, 0)
+}
+
+// dohHandler returns an HTTP handler answering DoH GET and POST requests with answer.
+func dohHandler(t testing.TB, answer func(req *dns.Msg) *dns.Msg) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf []byte
+		var err error
+		if r.Method == http.MethodPost {
+			if r.Header.Get("Content-Type") != "application/dns-message" || r.URL.RawQuery != "" {
+				t.Error("Invalid POST request: ", r.Header, r.URL)
+			}
+			buf, err = io.ReadAll(r.Body)
+		} else {
+			buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		}
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(buf); err != nil {
+			t.Error(err)
+			return
+		}
+		buf, err = answer(req).Pack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(buf)
+	})
+}
+
+// startH3Server serves handler over HTTP/3 on localhost, returning its address and
+// the pool of root certificates to trust it.
+func startH3Server(t testing.TB, handler http.Handler) (string, *x509.CertPool) {
+	// Borrow httptest's self-signed certificate.
+	ts := httptest.NewUnstartedServer(handler)
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http3.Server{Handler: handler, TLSConfig: http3.ConfigureTLSConfig(ts.TLS.Clone())}
+	go server.Serve(conn)
+	t.Cleanup(func() { server.Close() })
+	return conn.LocalAddr().String(), pool
+}
+
+func TestHttpUpstreamServiceBindingRoundTrip(t *testing.T) {
+	const record = `example.com.	300	IN	HTTPS	1 . alpn="h3,h2" ipv4hint="1.2.3.4" ech="AEX+DQBBpQAgACBvYA==" ipv6hint="2001:db8::1"`
+
+	server := httptest.NewServer(dohHandler(t, func(req *dns.Msg) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Answer = append(m.Answer, rr)
+		return m
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := NewUpstream(*u, UpstreamOptions{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeHTTPS)
+	resp, err := upstream.Exchange(context.Background(), req, net.ParseIP("10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].String() != record {
+		t.Error("HTTPS record changed going through the upstream: ", resp.Answer)
+	}
+}
+
+func replyA(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	rr, _ := dns.NewRR(req.Question[0].Name + " 60 A 1.2.3.4")
+	m.Answer = append(m.Answer, rr)
+	return m
+}
+
+// newH3Upstream returns an h3:// upstream for addr trusting pool, falling back to fallback.
+func newH3Upstream(t testing.TB, addr string, pool *x509.CertPool, fallback *http.Client, method string) *HttpUpstream {
+	upstream, err := NewUpstream(
+		url.URL{Scheme: "h3", Host: addr, Path: "/dns-query"},
+		UpstreamOptions{Timeout: time.Second, DohMethod: method},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := upstream.(*HttpUpstream)
+	h.client.Transport.(*http3.Transport).TLSClientConfig = &tls.Config{RootCAs: pool}
+	h.fallback = fallback
+	return h
+}
+
+func TestHttp3Upstream(t *testing.T) {
+	addr, pool := startH3Server(t, dohHandler(t, replyA))
+	upstream := newH3Upstream(t, addr, pool, nil, "GET")
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp, err := upstream.Exchange(context.Background(), req, net.ParseIP("10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Error("Expected 1 answer, got", resp.Answer)
+	}
+}
+
+func TestHttp3UpstreamFallback(t *testing.T) {
+	// Only serve over TCP, so that the HTTP/3 request fails.
+	ts := httptest.NewTLSServer(dohHandler(t, replyA))
+	defer ts.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+
+	upstream := newH3Upstream(t, ts.Listener.Addr().String(), pool, ts.Client(), "GET")
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp, err := upstream.Exchange(context.Background(), req, net.ParseIP("10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Error("Expected 1 answer, got", resp.Answer)
+	}
+
+	// Later queries go straight to HTTP/2 for a while.
+	upstream.client = &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		t.Error("Unexpected HTTP/3 request after falling back")
+		return nil, errors.New("unexpected request")
+	})}
+	if _, err := upstream.Exchange(context.Background(), req, net.ParseIP("10.0.0.1")); err != nil {
+		t.Error("Expected the query to go over HTTP/2, got", err)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestHttp3UpstreamNoFallbackOnHttpError(t *testing.T) {
+	addr, pool := startH3Server(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	fallback := &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		t.Error("Unexpected fallback to HTTP/2 after an HTTP error")
+		return nil, errors.New("unexpected request")
+	})}
+	upstream := newH3Upstream(t, addr, pool, fallback, "GET")
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	var statusErr *httpStatusError
+	if _, err := upstream.Exchange(context.Background(), req, net.ParseIP("10.0.0.1")); !errors.As(err, &statusErr) {
+		t.Error("Expected the HTTP/3 status error, got", err)
+	}
+}
+
+func TestHttpUpstreamPost(t *testing.T) {
+	var methods []string
+	handler := dohHandler(t, replyA)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewUpstream(*u, UpstreamOptions{Timeout: time.Second, DohMethod: "PUT"}); err == nil {
+		t.Error("Expected an error for an unsupported method")
+	}
+	upstream, err := NewUpstream(*u, UpstreamOptions{Timeout: time.Second, DohMethod: "post"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp, err := upstream.Exchange(context.Background(), req, net.ParseIP("10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Error("Expected 1 answer, got", resp.Answer)
+	}
+	if len(methods) != 1 || methods[0] != http.MethodPost {
+		t.Error("Expected a single POST request, got", methods)
+	}
+}
+
+func TestHttpUpstreamRetries(t *testing.T) {
+	var requests int
+	statuses := []int{}
+	handler := dohHandler(t, replyA)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if len(statuses) > 0 {
+			status := statuses[0]
+			statuses = statuses[1:]
+			w.WriteHeader(status)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := NewUpstream(*u, UpstreamOptions{Timeout: 5 * time.Second, DohMaxRetries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	for _, c := range []struct {
+		statuses []int
+		success  bool
+		requests int
+	}{
+		{[]int{http.StatusServiceUnavailable, http.StatusBadGateway}, true, 3},
+		{[]int{http.StatusGatewayTimeout, http.StatusGatewayTimeout, http.StatusGatewayTimeout}, false, 3},
+		{[]int{http.StatusBadRequest}, false, 1},
+		{[]int{http.StatusInternalServerError}, false, 1},
+	} {
+		requests = 0
+		statuses = c.statuses
+		_, err := upstream.Exchange(context.Background(), req, net.ParseIP("10.0.0.1"))
+		if (err == nil) != c.success {
+			t.Errorf("Statuses %v: expected success %v, got error %v", c.statuses, c.success, err)
+		}
+		if requests != c.requests {
+			t.Errorf("Statuses %v: expected %d requests, got %d", c.statuses, c.requests, requests)
+		}
+	}
+}
+
+func TestHttpUpstreamZeroTimeout(t *testing.T) {
+	var requests int
+	handler := dohHandler(t, replyA)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A zero timeout means no timeout, not an expired one.
+	upstream, err := NewUpstream(*u, UpstreamOptions{DohMaxRetries: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp, err := upstream.Exchange(context.Background(), req, net.ParseIP("10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Error("Expected 1 answer, got", resp.Answer)
+	}
+	if requests != 2 {
+		t.Error("Expected the failed request to be retried, got", requests, "requests")
+	}
+}
+
+func TestHttpUpstreamUserAgent(t *testing.T) {
+	var userAgents []string
+	handler := dohHandler(t, replyA)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents = append(userAgents, r.Header.Get("User-Agent"))
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, userAgent := range []string{"shitty-dns-proxy/test", ""} {
+		upstream, err := NewUpstream(*u, UpstreamOptions{Timeout: time.Second, DohUserAgent: userAgent})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		if _, err := upstream.Exchange(context.Background(), req, net.ParseIP("10.0.0.1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(userAgents) != 2 || userAgents[0] != "shitty-dns-proxy/test" || userAgents[1] != "" {
+		t.Error("Incorrect User-Agent headers: ", userAgents)
+	}
+}
+
+func TestDohTemplate(t *testing.T) {
+	for template, expected := range map[string]string{
+		"https://dns.example/dns-query{?dns}":    "https://dns.example/dns-query?dns=AbC",
+		"https://dns.example/q?ct=1{&dns}":       "https://dns.example/q?ct=1&dns=AbC",
+		"https://dns.example/q{?ct,dns}":         "https://dns.example/q?dns=AbC",
+		"https://dns.example/resolve/{dns}":      "https://dns.example/resolve/AbC",
+		"https://dns.example/resolve{/dns}/json": "https://dns.example/resolve/AbC/json",
+	} {
+		parsed, err := parseDohTemplate(template)
+		if err != nil {
+			t.Errorf("Failed to parse %s: %s", template, err)
+			continue
+		}
+		if expanded, _ := parsed.expand("AbC"); expanded != expected {
+			t.Errorf("Expected %s to expand to %s, got %s", template, expected, expanded)
+		}
+	}
+	// Without a query, as for POST requests, the dns variable is undefined.
+	if expanded, _ := dohTemplate("https://dns.example/dns-query{?dns}").expand(""); expanded != "https://dns.example/dns-query" {
+		t.Error("Expected the dns variable to expand to nothing, got", expanded)
+	}
+	for _, template := range []string{"https://dns.example/dns-query", "https://dns.example/AAAA{?ct}", "https://dns.example/{?dns", "https://dns.example/{}", "https://dns.example/dns}"} {
+		if _, err := parseDohTemplate(template); err == nil {
+			t.Error("Expected an error parsing", template)
+		}
+	}
+
+	var paths []string
+	handler := dohHandler(t, replyA)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		upstream, err := NewUpstream(*u, UpstreamOptions{Timeout: time.Second, DohMethod: method, DohURITemplate: server.URL + "/resolve{?dns}"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		if _, err := upstream.Exchange(context.Background(), req, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(paths) != 2 || paths[0] != "/resolve" || paths[1] != "/resolve" {
+		t.Error("Expected requests to the template's path, got", paths)
+	}
+}
+
+func TestHttpUpstreamForwardClientIP(t *testing.T) {
+	var forwardedFor []string
+	handler := dohHandler(t, replyA)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedFor = append(forwardedFor, r.Header.Get("X-Forwarded-For"))
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, forward := range []bool{false, true} {
+		upstream, err := NewUpstream(*u, UpstreamOptions{Timeout: time.Second, ForwardClientIP: forward})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		if _, err := upstream.Exchange(context.Background(), req, net.ParseIP("10.0.0.1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(forwardedFor) != 2 || forwardedFor[0] != "" || forwardedFor[1] != "10.0.0.1" {
+		t.Error("Incorrect X-Forwarded-For headers: ", forwardedFor)
+	}
+}
+
+// benchmarkHttp3Upstream measures the memory used by DoH requests over
+// HTTP/3, see the comment on the default method in newHttpUpstream.
+func benchmarkHttp3Upstream(b *testing.B, method string) {
+	addr, pool := startH3Server(b, dohHandler(b, replyA))
+	upstream := newH3Upstream(b, addr, pool, nil, method)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := upstream.Exchange(context.Background(), req, net.ParseIP("10.0.0.1")); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkHttp3UpstreamGet(b *testing.B) {
+	benchmarkHttp3Upstream(b, http.MethodGet)
+}
+
+func BenchmarkHttp3UpstreamPost(b *testing.B) {
+	benchmarkHttp3Upstream(b, http.MethodPost)
+}
+
+func TestNewUpstream(t *testing.T) {
+	for rawUrl, expected := range map[string]string{
+		"https://cloudflare-dns.com/dns-query": "*proxy.HttpUpstream https://cloudflare-dns.com/dns-query",
+		"h3://cloudflare-dns.com/dns-query":    "*proxy.HttpUpstream https://cloudflare-dns.com/dns-query",
+		"dns://1.1.1.1":                        "*proxy.UdpUpstream 1.1.1.1:53",
+		"dns://[2606:4700:4700::1111]:5353":    "*proxy.UdpUpstream [2606:4700:4700::1111]:5353",
+		"quic://dns.adguard-dns.com":           "*proxy.QuicUpstream dns.adguard-dns.com:853",
+		"quic://dns.adguard-dns.com:8853":      "*proxy.QuicUpstream dns.adguard-dns.com:8853",
+	} {
+		u, err := url.Parse(rawUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upstream, err := NewUpstream(*u, UpstreamOptions{Timeout: time.Second})
+		if err != nil {
+			t.Errorf("Failed to create upstream for %s: %s", rawUrl, err)
+			continue
+		}
+		var addr string
+		switch upstream := upstream.(type) {
+		case *HttpUpstream:
+			addr = upstream.url.String()
+		case *UdpUpstream:
+			addr = upstream.addr
+		case *QuicUpstream:
+			addr = upstream.addr
+		}
+		if actual := fmt.Sprintf("%T %s", upstream, addr); actual != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, rawUrl, actual)
+		}
+	}
+
+	if _, err := NewUpstream(url.URL{Scheme: "gopher", Host: "example.com"}, UpstreamOptions{Timeout: time.Second}); err == nil {
+		t.Error("Expected an error for an unsupported scheme")
+	}
+}
+
+func TestScopedUpstream(t *testing.T) {
+	for _, rawUrl := range []string{"dns://[fe80::1%eth0]:53", "dns://[fe80::1%25eth0]:53", "dns://[fe80::1%eth0]"} {
+		u, err := ParseUpstreamURL(rawUrl)
+		if err != nil {
+			t.Errorf("Failed to parse %s: %s", rawUrl, err)
+			continue
+		}
+		upstream, err := NewUpstream(*u, UpstreamOptions{Timeout: time.Second})
+		if err != nil {
+			t.Errorf("Failed to create upstream for %s: %s", rawUrl, err)
+		} else if addr := upstream.(*UdpUpstream).addr; addr != "[fe80::1%eth0]:53" {
+			t.Errorf("Expected the zone to be kept for %s, got %s", rawUrl, addr)
+		}
+	}
+	// A zone that is just 25, as Windows numbers them, isn't the escaped form.
+	if u, err := ParseUpstreamURL("dns://[fe80::1%25]:53"); err != nil || u.Hostname() != "fe80::1%25" {
+		t.Error("Expected the unescaped zone 25 to be kept, got", u, err)
+	}
+	for _, rawUrl := range []string{"dns://[1.2.3.4%eth0]", "dns://[fe80::1%]"} {
+		u, err := ParseUpstreamURL(rawUrl)
+		if err != nil {
+			continue
+		}
+		if _, err := NewUpstream(*u, UpstreamOptions{Timeout: time.Second}); err == nil {
+			t.Error("Expected an error for", rawUrl)
+		}
+	}
+
+	// The zone is used to reach the upstream through the loopback interface.
+	loopback, err := net.InterfaceByIndex(1)
+	if err != nil || loopback.Flags&net.FlagLoopback == 0 {
+		t.Skip("No loopback interface to test with")
+	}
+	port := startRecursiveStubs(t, map[string]dns.HandlerFunc{"::1": func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(replyA(r))
+	}}, "::1")
+	u, err := ParseUpstreamURL("dns://[::1%" + loopback.Name + "]:" + port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := NewUpstream(*u, UpstreamOptions{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	if resp, err := upstream.Exchange(context.Background(), msg, nil); err != nil || len(resp.Answer) != 1 {
+		t.Error("Expected an answer through the scoped address, got", resp, err)
+	}
+}
+
+func TestRegisterUpstream(t *testing.T) {
+	RegisterUpstream("stub", func(u url.URL, opts UpstreamOptions) (Upstream, error) {
+		if opts.Timeout != time.Second {
+			t.Error("Expected the options to be passed to the factory, got", opts)
+		}
+		return stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			m := replyA(req)
+			m.Answer[0].(*dns.A).A = net.ParseIP(u.Host)
+			return m, nil
+		}), nil
+	})
+
+	u, err := url.Parse("stub://10.0.0.42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := NewUpstream(*u, UpstreamOptions{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp, err := upstream.Exchange(context.Background(), req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.0.0.42" {
+		t.Error("Expected the answer from the registered upstream, got", resp.Answer)
+	}
+}
+
+func TestUpstreamEdnsParams(t *testing.T) {
+	for rawUrl, expected := range map[string]string{
+		"dns://1.1.1.1":                                  "*proxy.UdpUpstream 1232 <nil>",
+		"dns://1.1.1.1?udpsize=4096":                     "*proxy.UdpUpstream 4096 <nil>",
+		"dns://1.1.1.1?udpsize=1400&do=1":                "*proxy.UdpUpstream 1400 true",
+		"https://dns.example/dns-query?do=false":         "*proxy.HttpUpstream 0 false https://dns.example/dns-query",
+		"https://dns.example/dns-query?id=1&udpsize=512": "*proxy.HttpUpstream 512 <nil> https://dns.example/dns-query?id=1",
+		"quic://dns.example?udpsize=2048":                "*proxy.QuicUpstream 2048 <nil>",
+	} {
+		u, err := url.Parse(rawUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upstream, err := NewUpstream(*u, UpstreamOptions{Timeout: time.Second})
+		if err != nil {
+			t.Errorf("Failed to create upstream for %s: %s", rawUrl, err)
+			continue
+		}
+		format := func(size uint16, do *bool) string {
+			if do == nil {
+				return fmt.Sprintf("%T %d <nil>", upstream, size)
+			}
+			return fmt.Sprintf("%T %d %t", upstream, size, *do)
+		}
+		var actual string
+		switch upstream := upstream.(type) {
+		case *UdpUpstream:
+			actual = format(upstream.ednsUDPSize, upstream.ednsDO)
+		case *HttpUpstream:
+			actual = format(upstream.ednsUDPSize, upstream.ednsDO) + " " + upstream.url.String()
+		case *QuicUpstream:
+			actual = format(upstream.ednsUDPSize, upstream.ednsDO)
+		}
+		if actual != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, rawUrl, actual)
+		}
+	}
+	for _, rawUrl := range []string{"dns://1.1.1.1?udpsize=100", "dns://1.1.1.1?udpsize=70000", "dns://1.1.1.1?udpsize=big", "dns://1.1.1.1?do=maybe"} {
+		u, err := url.Parse(rawUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewUpstream(*u, UpstreamOptions{Timeout: time.Second}); err == nil {
+			t.Error("Expected an error for", rawUrl)
+		}
+	}
+
+	queries := make(chan *dns.Msg, 1)
+	addr := startStubServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries <- r.Copy()
+		m := new(dns.Msg)
+		m.SetReply(r)
+		w.WriteMsg(m)
+	})
+	do := true
+	upstream, err := newUdpUpstream(addr, UpstreamOptions{Timeout: time.Second, EdnsUDPSize: 1400, EdnsDO: &do})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, err := upstream.Exchange(context.Background(), req, nil); err != nil {
+		t.Fatal(err)
+	}
+	if opt := (<-queries).IsEdns0(); opt == nil || opt.UDPSize() != 1400 || !opt.Do() {
+		t.Error("Expected the configured buffer size and DO bit in the query, got", opt)
+	}
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// uriTemplateOperators are the RFC 6570 expression operators, with what an
+// expansion starts with, what separates its variables, and whether they're
+// expanded as name=value pairs.
+var uriTemplateOperators = map[byte]struct {
+	first, sep string
+	named      bool
+}{
+	'+': {"", ",", false},
+	'#': {"#", ",", false},
+	'.': {".", ".", false},
+	'/': {"/", "/", false},
+	';': {";", ";", true},
+	'?': {"?", "&", true},
+	'&': {"&", "&", true},
+}
+
+// dohTemplate is an RFC 8484 URI template, such as
+// https://dns.example/dns-query{?dns}, with the query in the dns variable.
+type dohTemplate string
+
+// parseDohTemplate checks that template is a URI template with a dns
+// variable expanding to a valid URL.
+func parseDohTemplate(template string) (dohTemplate, error) {
+	t := dohTemplate(template)
+	expanded, err := t.expand("AAAA")
+	if err != nil {
+		return "", fmt.Errorf("invalid DoH URI template %q: %w", template, err)
+	}
+	// The dns variable is the only one expanding to anything, so without
+	// it the expansion doesn't depend on the query.
+	if undefined, _ := t.expand(""); undefined == expanded {
+		return "", fmt.Errorf("invalid DoH URI template %q: no dns variable", template)
+	}
+	if _, err := url.Parse(expanded); err != nil {
+		return "", fmt.Errorf("invalid DoH URI template %q: %w", template, err)
+	}
+	return t, nil
+}
+
+// expand expands the template with the dns variable set to query, the
+// base64url encoded query, or undefined if it's empty, as for POST requests.
+// Other variables are undefined, so they expand to nothing.
+func (t dohTemplate) expand(query string) (string, error) {
+	var sb strings.Builder
+	rest := string(t)
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start == -1 {
+			if strings.IndexByte(rest, '}') != -1 {
+				return "", fmt.Errorf("unopened expression")
+			}
+			sb.WriteString(rest)
+			return sb.String(), nil
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end == -1 {
+			return "", fmt.Errorf("unclosed expression")
+		}
+		sb.WriteString(rest[:start])
+		expression := rest[start+1 : start+end]
+		rest = rest[start+end+1:]
+
+		first, sep, named := "", ",", false
+		if expression != "" {
+			if op, ok := uriTemplateOperators[expression[0]]; ok {
+				first, sep, named = op.first, op.sep, op.named
+				expression = expression[1:]
+			}
+		}
+		if expression == "" {
+			return "", fmt.Errorf("empty expression")
+		}
+		// The query is base64url encoded, so it never needs escaping.
+		written := false
+		for _, name := range strings.Split(expression, ",") {
+			if name != "dns" || query == "" {
+				continue
+			}
+			if written {
+				sb.WriteString(sep)
+			} else {
+				sb.WriteString(first)
+				written = true
+			}
+			if named {
+				sb.WriteString(name + "=")
+			}
+			sb.WriteString(query)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"os"
+	"strings"
+)
+
+// parseZone reads an RFC 1035 master file. A, AAAA and CNAME records are
+// returned as local records, so they behave like hosts file entries; all
+// other records are returned as-is, by owner name.
+func parseZone(r io.Reader, file string) (map[string][]HostInfo, rrIndex, error) {
+	records := make(map[string][]HostInfo)
+	rrs := make(rrIndex)
+
+	zp := dns.NewZoneParser(r, "", file)
+	// Zone files are trusted configuration, just like hosts files.
+	zp.SetIncludeAllowed(true)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		addZoneRR(records, rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, nil, err
+	}
+	return records, rrs, nil
+}
+
+// addZoneRR adds rr to records if it's an A, AAAA or CNAME record, and to
+// rrs otherwise.
+func addZoneRR(records map[string][]HostInfo, rrs rrIndex, rr dns.RR) {
+	if hostInfo, ok := hostInfoFromRR(rr); ok {
+		name := dns.CanonicalName(rr.Header().Name)
+		hostInfo.TTL = rr.Header().Ttl
+		records[name] = append(records[name], hostInfo)
+	} else {
+		rrs.add(rr)
+	}
+}
+
+func parseZoneFile(path string) (map[string][]HostInfo, rrIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	records, rrs, err := parseZone(f, path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing zone %s: %w", path, err)
+	}
+	return records, rrs, nil
+}
+
+// isLocalName returns whether there are any local records for name.
+func (p *Proxy) isLocalName(name string) bool {
+	p.recordsMu.RLock()
+	defer p.recordsMu.RUnlock()
+	name = dns.CanonicalName(name)
+	return len(p.records[name]) > 0 || len(p.zoneRecords[name]) > 0
+}
+
+// hasNamesBelow returns whether any local name, zone record or delegation
+// lies below name, which then exists as an empty non-terminal (RFC 8020).
+func (p *Proxy) hasNamesBelow(name string) bool {
+	idx := p.rlockIndex()
+	defer p.recordsMu.RUnlock()
+	ancestors := idx.ancestors
+	ancestors.once.Do(func() { ancestors.names = p.localAncestors() })
+	return ancestors.names[dns.CanonicalName(name)]
+}
+
+// localAncestors returns the names with local names, zone records or
+// delegations below them. The caller must hold recordsMu.
+func (p *Proxy) localAncestors() map[string]bool {
+	ancestors := make(map[string]bool)
+	add := func(name string) {
+		for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+			if ancestors[name[off:]] {
+				// And so are all the names above it.
+				return
+			}
+			ancestors[name[off:]] = true
+		}
+	}
+	for name := range p.records {
+		add(name)
+	}
+	for name := range p.zoneRecords {
+		add(name)
+	}
+	for _, d := range p.delegations {
+		add(d.zone)
+	}
+	return ancestors
+}
+
+// authZone is a zone the proxy is authoritative for.
+type authZone struct {
+	apex        string
+	nameservers []string
+}
+
+// parseAuthZone parses a zone declaration in the form apex[=ns[,ns...]].
+// Without nameservers, ns.<apex> is used.
+func parseAuthZone(s string) (authZone, error) {
+	apex, nameservers, hasNs := strings.Cut(s, "=")
+	if apex == "" || (hasNs && nameservers == "") {
+		return authZone{}, fmt.Errorf("invalid zone %q, expected apex[=ns[,ns...]]", s)
+	}
+	zone := authZone{apex: dns.CanonicalName(apex)}
+	if !hasNs {
+		zone.nameservers = []string{"ns." + zone.apex}
+		return zone, nil
+	}
+	for _, ns := range strings.Split(nameservers, ",") {
+		zone.nameservers = append(zone.nameservers, dns.Fqdn(ns))
+	}
+	return zone, nil
+}
+
+// authZone returns the most specific zone the proxy is authoritative for containing name.
+func (p *Proxy) authZone(name string) (authZone, bool) {
+	var found authZone
+	ok := false
+	for _, zone := range p.authZones {
+		if dns.IsSubDomain(zone.apex, name) && (!ok || dns.CountLabel(zone.apex) > dns.CountLabel(found.apex)) {
+			found = zone
+			ok = true
+		}
+	}
+	return found, ok
+}
+
+// ownsNames returns whether the proxy owns all names in questions: all local
+// names if no zones are configured, otherwise only those in authoritative zones.
+func (p *Proxy) ownsNames(questions []dns.Question) bool {
+	if len(p.authZones) == 0 {
+		return true
+	}
+	for _, q := range questions {
+		if _, ok := p.authZone(q.Name); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Proxy) zoneSOA(zone authZone) dns.RR {
+	soa := p.syntheticSOA(zone.apex).(*dns.SOA)
+	soa.Ns = zone.nameservers[0]
+	return soa
+}
+
+// addApexRecords adds the SOA and NS records for an authoritative zone's
+// apex to m, returning whether q was such a query.
+func (p *Proxy) addApexRecords(m *dns.Msg, q dns.Question) bool {
+	zone, ok := p.authZone(q.Name)
+	if !ok || dns.CanonicalName(q.Name) != zone.apex {
+		return false
+	}
+	switch q.Qtype {
+	case dns.TypeSOA:
+		soa := p.zoneSOA(zone)
+		soa.Header().Name = q.Name
+		m.Answer = append(m.Answer, soa)
+	case dns.TypeNS:
+		for _, ns := range zone.nameservers {
+			m.Answer = append(m.Answer, &dns.NS{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: uint32(p.localTTL)},
+				Ns:  ns,
+			})
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// addZoneNegativeAnswer answers a query within an authoritative zone that
+// had no local answer with NODATA if the name exists, or NXDOMAIN if it
+// doesn't, rather than forwarding it. It returns the rcode and whether it answered.
+func (p *Proxy) addZoneNegativeAnswer(m *dns.Msg) (int, bool) {
+	if len(m.Question) != 1 {
+		return 0, false
+	}
+	name := m.Question[0].Name
+	zone, ok := p.authZone(name)
+	if !ok {
+		return 0, false
+	}
+	m.Ns = append(m.Ns, p.zoneSOA(zone))
+	// Delegated names only get here for DS queries at the cut, and exist.
+	_, delegated := p.delegation(name)
+	if dns.CanonicalName(name) == zone.apex || delegated || p.isLocalName(name) || p.hasNamesBelow(name) {
+		return dns.RcodeSuccess, true
+	}
+	return dns.RcodeNameError, true
+}
@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testZone = `$ORIGIN corp.internal.
+$TTL 300
+@       IN SOA ns1 hostmaster 1 3600 600 86400 60
+@       IN MX  10 mail
+@       IN LOC 52 22 23.000 N 4 53 32.000 E -2.00m 1m 10000m 10m
+mail    IN A   10.0.0.25
+mail    IN HINFO "x86_64" "Linux"
+www     60 IN CNAME web.example.com.
+_sip._tcp IN SRV 0 5 5060 sip
+txt     IN TXT "hello"
+`
+
+func TestZoneFile(t *testing.T) {
+	records, rrs, err := parseZone(strings.NewReader(testZone), "test.zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := Proxy{
+		records:     records,
+		zoneRecords: rrs,
+		localTTL:    10,
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		ttl   uint32
+	}{
+		{"corp.internal.", dns.TypeMX, 300},
+		{"mail.corp.internal.", dns.TypeA, 300},
+		{"_sip._tcp.corp.internal.", dns.TypeSRV, 300},
+		{"txt.corp.internal.", dns.TypeTXT, 300},
+		{"mail.corp.internal.", dns.TypeHINFO, 300},
+		{"corp.internal.", dns.TypeLOC, 300},
+		{"25.0.0.10.in-addr.arpa.", dns.TypePTR, 10},
+	}
+	for _, test := range tests {
+		msg := new(dns.Msg)
+		msg.SetQuestion(test.name, test.qtype)
+		resp, err := proxy.respondToRequest(context.Background(), msg, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].Header().Rrtype != test.qtype || resp.Answer[0].Header().Ttl != test.ttl {
+			t.Errorf("Incorrect answer for %s %s: %v", test.name, dns.TypeToString[test.qtype], resp.Answer)
+		}
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("Corp.Internal.", dns.TypeANY)
+	resp, err := proxy.respondToRequest(context.Background(), msg, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []uint16
+	for _, rr := range resp.Answer {
+		types = append(types, rr.Header().Rrtype)
+		if rr.Header().Name != "Corp.Internal." {
+			t.Error("Expected the name as queried, got", rr.Header().Name)
+		}
+	}
+	if !slices.Equal(types, []uint16{dns.TypeSOA, dns.TypeMX, dns.TypeLOC}) {
+		t.Error("Expected all of the apex's records for ANY, got", resp.Answer)
+	}
+
+	if len(records["www.corp.internal."]) != 1 || records["www.corp.internal."][0].CName != "web.example.com." {
+		t.Error("Expected www to be loaded as a CNAME, got", records["www.corp.internal."])
+	}
+
+	if _, _, err := parseZone(strings.NewReader("bogus IN A not-an-ip\n"), "bad.zone"); err == nil {
+		t.Error("Expected an error for an invalid zone")
+	}
+}
+
+func TestAuthoritativeZone(t *testing.T) {
+	zone, err := parseAuthZone("corp.internal=ns1.corp.internal,ns2.corp.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwarded := false
+	proxy := Proxy{
+		records: map[string][]HostInfo{
+			"host.corp.internal.":  {{IP: net.ParseIP("10.0.0.1")}},
+			"a.b.c.corp.internal.": {{IP: net.ParseIP("10.0.0.2")}},
+		},
+		localTTL:  10,
+		authZones: []authZone{zone},
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			forwarded = true
+			m := new(dns.Msg)
+			m.SetReply(req)
+			return m, nil
+		}),
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answers int
+	}{
+		{"corp.internal.", dns.TypeSOA, dns.RcodeSuccess, 1},
+		{"corp.internal.", dns.TypeNS, dns.RcodeSuccess, 2},
+		{"corp.internal.", dns.TypeA, dns.RcodeSuccess, 0},
+		{"host.corp.internal.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"host.corp.internal.", dns.TypeNS, dns.RcodeSuccess, 0},
+		{"missing.corp.internal.", dns.TypeA, dns.RcodeNameError, 0},
+		// Empty non-terminals exist, having names below them.
+		{"b.c.corp.internal.", dns.TypeA, dns.RcodeSuccess, 0},
+		{"C.corp.internal.", dns.TypeA, dns.RcodeSuccess, 0},
+		{"x.b.c.corp.internal.", dns.TypeA, dns.RcodeNameError, 0},
+	}
+	for _, test := range tests {
+		msg := new(dns.Msg)
+		msg.SetQuestion(test.name, test.qtype)
+		resp, err := proxy.respondToRequest(context.Background(), msg, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Rcode != test.rcode || len(resp.Answer) != test.answers || !resp.Authoritative {
+			t.Errorf("Incorrect response for %s %s: %v", test.name, dns.TypeToString[test.qtype], resp)
+		}
+		if test.answers == 0 && (len(resp.Ns) != 1 || resp.Ns[0].(*dns.SOA).Ns != "ns1.corp.internal.") {
+			t.Errorf("Expected the zone's SOA in the authority section for %s, got %v", test.name, resp.Ns)
+		}
+	}
+	if forwarded {
+		t.Error("Expected queries within the zone not to be forwarded")
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	resp, err := proxy.respondToRequest(context.Background(), msg, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !forwarded || resp.Authoritative {
+		t.Error("Expected a non-authoritative forwarded response outside the zone, got", resp)
+	}
+}
+
+func TestDelegation(t *testing.T) {
+	zone, err := parseAuthZone("corp.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	delegation, err := parseDelegation("sub.corp.internal=10.0.0.53,ns.corp.internal,ns.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := Proxy{
+		records: map[string][]HostInfo{
+			"ns.corp.internal.":       {{IP: net.ParseIP("fd00::53")}},
+			"host.sub.corp.internal.": {{IP: net.ParseIP("10.0.0.1")}},
+		},
+		localTTL:    10,
+		authZones:   []authZone{zone},
+		delegations: []subzoneDelegation{delegation},
+		upstream: stubUpstream(func(req *dns.Msg, _ net.IP) (*dns.Msg, error) {
+			t.Error("Unexpected upstream query for", req.Question[0].Name)
+			return replyA(req), nil
+		}),
+	}
+	query := func(name string, qtype uint16) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		resp, err := proxy.respondToRequest(context.Background(), msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	for _, name := range []string{"sub.corp.internal.", "host.sub.corp.internal.", "deep.host.sub.corp.internal."} {
+		resp := query(name, dns.TypeA)
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || resp.Authoritative {
+			t.Error("Expected a non-authoritative referral without answers for", name, "got", resp)
+			continue
+		}
+		var nameservers []string
+		for _, rr := range resp.Ns {
+			if ns, ok := rr.(*dns.NS); ok && ns.Hdr.Name == "sub.corp.internal." {
+				nameservers = append(nameservers, ns.Ns)
+			}
+		}
+		if !slices.Equal(nameservers, []string{"ns1.sub.corp.internal.", "ns.corp.internal.", "ns.example.com."}) {
+			t.Error("Expected the delegation's nameservers in the authority section, got", resp.Ns)
+		}
+		// Glue for the nameserver given by address and the one with a local address, none for the other.
+		if len(resp.Extra) != 2 || resp.Extra[0].(*dns.A).A.String() != "10.0.0.53" || resp.Extra[1].(*dns.AAAA).AAAA.String() != "fd00::53" {
+			t.Error("Expected glue for ns1.sub.corp.internal. and ns.corp.internal., got", resp.Extra)
+		}
+	}
+
+	if resp := query("ns.corp.internal.", dns.TypeAAAA); len(resp.Answer) != 1 || !resp.Authoritative {
+		t.Error("Expected names outside the delegation to be answered as usual, got", resp)
+	}
+	if resp := query("sub.corp.internal.", dns.TypeDS); resp.Rcode != dns.RcodeSuccess || len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Error("Expected NODATA from the parent zone for the DS query at the cut, got", resp)
+	}
+
+	for _, spec := range []string{"sub.corp.internal", "sub.corp.internal=", "=10.0.0.53", "sub.corp.internal=bad..name"} {
+		if _, err := parseDelegation(spec); err == nil {
+			t.Error("Expected an error parsing", spec)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFdsStart is the first file descriptor passed with systemd socket
+// activation (SD_LISTEN_FDS_START).
+const listenFdsStart = 3
+
+// systemdServers returns DNS servers for the sockets passed with systemd
+// socket activation (LISTEN_PID and LISTEN_FDS), or nil if the process
+// wasn't socket activated.
+func systemdServers() ([]*dns.Server, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	// The sockets are ours, don't let child processes think they're theirs.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	servers := make([]*dns.Server, 0, count)
+	for fd := listenFdsStart; fd < listenFdsStart+count; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		server, err := serverFromFile(f)
+		// The listener has its own copy of the file descriptor.
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// serverFromFile creates a DNS server for an inherited stream or datagram socket.
+func serverFromFile(f *os.File) (*dns.Server, error) {
+	if l, err := net.FileListener(f); err == nil {
+		return &dns.Server{Listener: l}, nil
+	}
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherited socket %s is neither a stream nor a datagram socket: %w", f.Name(), err)
+	}
+	return &dns.Server{PacketConn: pc}, nil
+}